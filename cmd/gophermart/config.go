@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rs/zerolog"
+
+	"github.com/Hobrus/gophermarket/internal/config"
+	"github.com/Hobrus/gophermarket/pkg/lifecycle"
+)
+
+const configUsage = `usage: gophermart config print [flags]
+
+  print    validate the configuration and print it with secrets redacted
+
+Flags and environment variables are the same as for the server.
+`
+
+// runConfig implements the config subcommand and returns the exit code.
+func runConfig(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprint(stderr, configUsage)
+		return 2
+	}
+	cfg, err := config.Parse(args[1:])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := cfg.Print(stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// reloader returns a component that loads the configuration again on
+// SIGHUP and passes the running and the new one to apply, which should only
+// apply the reloadable fields that changed. Other changes are reported as
+// needing a restart.
+func reloader(cfg config.Config, l *zerolog.Logger, apply func(prev, next config.Config)) lifecycle.Component {
+	hup := make(chan os.Signal, 1)
+	return lifecycle.Component{
+		Name: "config reloader",
+		Start: func(context.Context) error {
+			signal.Notify(hup, syscall.SIGHUP)
+			return nil
+		},
+		Run: func(ctx context.Context) error {
+			defer signal.Stop(hup)
+			cur := cfg
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-hup:
+				}
+				next, err := config.Load()
+				if err != nil {
+					l.Error().Err(err).Msg("config reload failed, keeping the current config")
+					continue
+				}
+				// static fields are compared with the config the server
+				// started with, they are never applied
+				if cfg.RestartRequired(next) {
+					l.Warn().Msg("config has changes that need a restart, only reloadable fields are applied")
+				}
+				apply(cur, next)
+				cur = next
+				l.Info().Msg("config reloaded")
+			}
+		},
+	}
+}
@@ -6,17 +6,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"sync/atomic"
 	"syscall"
-	"time"
 
-	"github.com/exaring/otelpgx"
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/riandyrn/otelchi"
+	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
@@ -31,13 +32,25 @@ import (
 	"github.com/Hobrus/gophermarket/internal/accrualclient"
 	"github.com/Hobrus/gophermarket/internal/config"
 	dhttp "github.com/Hobrus/gophermarket/internal/delivery/http"
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/notify"
 	"github.com/Hobrus/gophermarket/internal/service"
 	"github.com/Hobrus/gophermarket/internal/storage/postgres"
+	"github.com/Hobrus/gophermarket/pkg/crypto"
+	"github.com/Hobrus/gophermarket/pkg/jwtkeys"
+	"github.com/Hobrus/gophermarket/pkg/lifecycle"
 	"github.com/Hobrus/gophermarket/pkg/logger"
 	"github.com/Hobrus/gophermarket/pkg/middleware"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
@@ -48,95 +61,304 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
-	traceExp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
-	if err != nil {
-		log.Fatal(err)
-	}
-	metricExp, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpoint(endpoint), otlpmetrichttp.WithInsecure())
-	if err != nil {
-		log.Fatal(err)
+	if err := run(ctx, cfg, l); err != nil {
+		l.Error().Err(err).Msg("exiting")
+		stop()
+		os.Exit(1)
 	}
+}
+
+// run wires the application and serves it until ctx is canceled.
+func run(ctx context.Context, cfg config.Config, l *zerolog.Logger) error {
+	// background workers log through the logger of their context
+	ctx = logger.WithLogger(ctx, l)
+	app := lifecycle.New(l, cfg.HTTP.ShutdownTimeout)
+
 	res, err := resource.New(ctx,
 		resource.WithSchemaURL(semconv.SchemaURL),
 		resource.WithAttributes(semconv.ServiceName("gophermart")),
 	)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(traceExp),
-		sdktrace.WithResource(res),
-	)
-	mp := sdkmetric.NewMeterProvider(
-		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExp)),
-		sdkmetric.WithResource(res),
-	)
+	traceOpts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	metricOpts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+	// without an endpoint telemetry is recorded but not exported
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		traceExp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+		if err != nil {
+			return err
+		}
+		metricExp, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpoint(endpoint), otlpmetrichttp.WithInsecure())
+		if err != nil {
+			return err
+		}
+		traceOpts = append(traceOpts, sdktrace.WithBatcher(traceExp))
+		metricOpts = append(metricOpts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExp)))
+	}
+	tp := sdktrace.NewTracerProvider(traceOpts...)
+	mp := sdkmetric.NewMeterProvider(metricOpts...)
 	otel.SetTracerProvider(tp)
 	otel.SetMeterProvider(mp)
-	tr := tp.Tracer("gophermart")
-	_ = tr
-
-	defer func() {
-		_ = tp.Shutdown(ctx)
-		_ = mp.Shutdown(ctx)
-	}()
+	// providers are stopped last, flushing what the other components recorded
+	app.Add(lifecycle.Component{
+		Name: "telemetry",
+		Stop: func(ctx context.Context) error {
+			return errors.Join(tp.Shutdown(ctx), mp.Shutdown(ctx))
+		},
+	})
 
-	poolCfg, err := pgxpool.ParseConfig(cfg.DatabaseURI)
+	store, err := openStorage(ctx, cfg.DatabaseURI, cfg.Storage.Timeout, tp, mp, l)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	poolCfg.ConnConfig.Tracer = otelpgx.NewTracer(
-		otelpgx.WithTracerProvider(tp),
-		otelpgx.WithMeterProvider(mp),
-	)
-	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	app.Add(lifecycle.Component{
+		Name: "storage",
+		Stop: func(context.Context) error {
+			store.close()
+			return nil
+		},
+	})
+	if store.listen != nil {
+		app.Add(lifecycle.Component{Name: "notification listener", Run: store.listen})
+	}
+	userRepo, orderRepo, withdrawalRepo := store.users, store.orders, store.withdrawals
+
+	keys, err := jwtkeys.Load(cfg.JWTKeys, []byte(cfg.JWTSecret))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	if err := otelpgx.RecordStats(pool, otelpgx.WithStatsMeterProvider(mp)); err != nil {
-		log.Fatal(err)
+	authSvc := service.NewAuthService(userRepo, store.sessions, keys)
+	argon := crypto.DefaultArgon2Params
+	argon.Memory = uint32(cfg.Auth.Argon2Memory)
+	argon.Time = uint32(cfg.Auth.Argon2Time)
+	argon.Threads = uint8(cfg.Auth.Argon2Threads)
+	authSvc.SetHasher(crypto.NewDefaultParams(argon, []byte(cfg.PasswordPepper)))
+	authSvc.SetTokenTTL(cfg.Auth.AccessTokenTTL, cfg.Auth.RefreshTokenTTL)
+	var breached service.PasswordList
+	if cfg.BreachedPasswords != "" {
+		if breached, err = service.LoadPasswordList(cfg.BreachedPasswords); err != nil {
+			return err
+		}
 	}
-	if err := postgres.ApplyMigrations(ctx, pool); err != nil {
-		log.Fatal(err)
+	logins, passwords, err := credentialPolicies(cfg.Auth, breached)
+	if err != nil {
+		return err
 	}
-
-	userRepo, orderRepo, withdrawalRepo := postgres.New(pool)
-
-	authSvc := service.NewAuthService(userRepo, []byte(cfg.JWTSecret))
+	authSvc.SetPolicies(logins, passwords)
+	// users have no address to send reset tokens to yet; the sinks hand
+	// them to the operator, so password reset only exists in dev mode
+	var resetSvc *service.PasswordResetService
+	if cfg.DevMode {
+		var notifier service.ResetNotifier = notify.NewLog(l)
+		if cfg.NotifyFile != "" {
+			notifier = notify.NewFile(cfg.NotifyFile)
+		}
+		resetSvc = service.NewPasswordResetService(userRepo, store.passwordResets, authSvc, notifier)
+	} else {
+		l.Warn().Msg("password reset is disabled outside dev mode, there is no notifier delivering tokens to users")
+	}
+	loginThrottler := service.NewLoginThrottler(store.loginAttempts)
+	loginThrottler.SetPolicies(service.ThrottlePolicy(cfg.Throttle.Login), service.ThrottlePolicy(cfg.Throttle.IP))
+	resetThrottler := service.NewResetThrottler(store.loginAttempts)
+	resetThrottler.SetPolicies(service.ThrottlePolicy(cfg.Throttle.Reset), service.ThrottlePolicy(cfg.Throttle.ResetIP))
+	attemptPruner := service.NewAttemptPruner(store.loginAttempts, loginThrottler, resetThrottler)
+	apiKeySvc := service.NewAPIKeyService(store.apiKeys)
 	orderSvc := service.NewOrderService(orderRepo)
-	balanceSvc := service.NewBalanceService(orderRepo, withdrawalRepo)
-	withdrawSvc := service.NewWithdrawService(orderRepo, withdrawalRepo, balanceSvc)
-	updater := service.NewOrderUpdater(orderRepo, accrualclient.New(cfg.AccrualAddress), balanceSvc)
+	orderSvc.SetNotifier(store.notifier)
+	balanceSvc := service.NewBalanceService(store.ledger)
+	balanceSvc.SetTTL(cfg.Balance.CacheTTL)
+	withdrawSvc := service.NewWithdrawService(withdrawalRepo, balanceSvc)
+	idempotency := dhttp.Idempotency(store.idempotency)
+	accrual := accrualclient.New(cfg.AccrualAddress,
+		accrualclient.WithRateLimit(cfg.Accrual.RateLimit),
+		accrualclient.WithRequestTimeout(cfg.Accrual.RequestTimeout),
+		accrualclient.WithDialTimeout(cfg.Accrual.DialTimeout),
+		accrualclient.WithTLSHandshakeTimeout(cfg.Accrual.TLSHandshakeTimeout),
+		accrualclient.WithBreaker(cfg.Accrual.BreakerThreshold, cfg.Accrual.BreakerCooldown),
+	)
+	updater := service.NewOrderUpdater(orderRepo, accrual, balanceSvc)
+	updater.SetNotifier(store.notifier)
+	updater.SetRetryPolicy(retryPolicy(cfg.Updater))
+	eventSvc := service.NewEventService(store.events, store.notifier, balanceSvc)
+	updater.SetObserver(eventSvc)
+	withdrawSvc.SetObserver(eventSvc)
+	webhookSvc := service.NewWebhookService(store.webhooks)
+	dispatcher := service.NewWebhookDispatcher(store.webhooks, service.NewWebhookClient(cfg.Webhooks.Timeout, cfg.Webhooks.AllowPrivate))
+	dispatcher.SetRetention(cfg.Webhooks.Retention)
+	// streams are ended when the server shuts down, they would hold it
+	// until the shutdown timeout otherwise
+	streams, stopStreams := context.WithCancel(context.Background())
+	defer stopStreams()
 
 	router := chi.NewRouter()
 	router.Use(middleware.RequestID)
 	router.Use(logger.Middleware(l))
-	router.Use(middleware.Gzip(5))
+	var gzipLevel atomic.Int64
+	gzipLevel.Store(int64(cfg.HTTP.GzipLevel))
+	router.Use(middleware.GzipFunc(func() int { return int(gzipLevel.Load()) }, dhttp.MiddlewareError))
 	router.Use(otelchi.Middleware("gophermart", otelchi.WithTracerProvider(tp)))
 
 	router.Get("/swagger/*", httpSwagger.Handler(httpSwagger.URL("/swagger/doc.json")))
 
-	router.Mount("/health", dhttp.NewHealthRouter(pool))
+	router.Mount("/health", dhttp.NewHealthRouter(store.db, func() string { return accrual.BreakerState().String() }))
+
+	router.Get("/.well-known/jwks.json", dhttp.JWKS(keys))
 
 	router.Post("/api/user/register", dhttp.Register(authSvc))
-	router.Post("/api/user/login", dhttp.Login(authSvc))
+	router.Post("/api/user/login", dhttp.Login(authSvc, loginThrottler))
+	router.Post("/api/user/token/refresh", dhttp.Refresh(authSvc))
+	if resetSvc != nil {
+		router.Post("/api/user/password/reset-request", dhttp.RequestPasswordReset(resetSvc, resetThrottler))
+		router.Post("/api/user/password/reset", dhttp.ResetPassword(resetSvc))
+	}
+
+	// pointsRoutes registers endpoints dealing with points. They are served
+	// again under /api/v2 with amounts encoded as exact decimal strings.
+	pointsRoutes := func(r chi.Router, prefix string) {
+		r.With(dhttp.RequireScope(domain.ScopeOrdersWrite), idempotency).Post(prefix+"/orders", dhttp.UploadOrder(orderSvc))
+		r.With(dhttp.RequireScope(domain.ScopeOrdersRead)).Get(prefix+"/orders", dhttp.ListOrders(orderRepo))
+		r.With(dhttp.RequireScope(domain.ScopeOrdersRead)).Get(prefix+"/orders/stream", dhttp.OrderStream(eventSvc, cfg.HTTP.StreamKeepalive, streams.Done()))
+		r.With(dhttp.RequireScope(domain.ScopeBalanceRead)).Get(prefix+"/balance", dhttp.Balance(balanceSvc))
+		r.With(dhttp.RequireScope(domain.ScopeWithdraw), idempotency).Post(prefix+"/balance/withdraw", dhttp.Withdraw(withdrawSvc))
+		r.With(dhttp.RequireScope(domain.ScopeBalanceRead)).Get(prefix+"/withdrawals", dhttp.Withdrawals(withdrawalRepo))
+	}
 
 	router.Group(func(r chi.Router) {
-		r.Use(dhttp.JWT([]byte(cfg.JWTSecret)))
-		r.Post("/api/user/orders", dhttp.UploadOrder(orderSvc))
-		r.Get("/api/user/orders", dhttp.ListOrders(orderRepo))
-		r.Get("/api/user/balance", dhttp.Balance(balanceSvc))
-		r.Post("/api/user/balance/withdraw", dhttp.Withdraw(withdrawSvc))
-		r.Get("/api/user/withdrawals", dhttp.Withdrawals(withdrawalRepo))
+		r.Use(dhttp.JWT(keys, dhttp.WithSessions(authSvc), dhttp.WithTokenVersions(authSvc), dhttp.WithAPIKeys(apiKeySvc)))
+		pointsRoutes(r, "/api/user")
+		r.Group(func(r chi.Router) {
+			r.Use(dhttp.ExactAmounts)
+			pointsRoutes(r, "/api/v2/user")
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(dhttp.RequireSession)
+			r.Post("/api/user/logout", dhttp.Logout(authSvc))
+			r.Post("/api/user/logout-all", dhttp.LogoutAll(authSvc))
+			r.Post("/api/user/password", dhttp.ChangePassword(authSvc))
+			r.Post("/api/user/api-keys", dhttp.CreateAPIKey(apiKeySvc))
+			r.Get("/api/user/api-keys", dhttp.ListAPIKeys(apiKeySvc))
+			r.Delete("/api/user/api-keys/{id}", dhttp.RevokeAPIKey(apiKeySvc))
+			dhttp.WebhookRoutes(r, "/api/user/webhooks", webhookSvc)
+		})
+	})
+	if cfg.AdminToken != "" {
+		router.Group(func(r chi.Router) {
+			r.Use(dhttp.RequireAdmin(cfg.AdminToken))
+			dhttp.WebhookRoutes(r, "/api/admin/webhooks", webhookSvc)
+		})
+	}
+
+	// the updater and the webhook dispatcher are stopped after the server
+	// and before the storage, so their workers finish while the database is
+	// still there
+	app.Add(lifecycle.Component{
+		Name: "order updater",
+		Run: func(ctx context.Context) error {
+			updater.Run(ctx, cfg.Updater.Workers, cfg.Updater.BatchSize, cfg.Updater.Interval)
+			return nil
+		},
 	})
+	app.Add(lifecycle.Component{
+		Name: "webhook dispatcher",
+		Run: func(ctx context.Context) error {
+			dispatcher.Run(ctx, cfg.Webhooks.Workers, cfg.Webhooks.BatchSize, cfg.Webhooks.Interval)
+			return nil
+		},
+	})
+	app.Add(lifecycle.Component{
+		Name: "idempotency key pruner",
+		Run: func(ctx context.Context) error {
+			service.PruneIdempotencyKeys(ctx, store.idempotency)
+			return nil
+		},
+	})
+	app.Add(lifecycle.Component{
+		Name: "login attempt pruner",
+		Run: func(ctx context.Context) error {
+			attemptPruner.Run(ctx, cfg.Throttle.PruneInterval)
+			return nil
+		},
+	})
+	srv := &http.Server{
+		Addr:              cfg.RunAddress,
+		Handler:           router,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+	}
+	srv.RegisterOnShutdown(stopStreams)
+	app.Add(lifecycle.HTTPServer("http server", srv))
+	app.Add(reloader(cfg, l, func(prev, next config.Config) {
+		// unchanged values are left alone, e.g. the rate limit announced by
+		// the accrual system must survive a reload of other settings
+		if next.HTTP.GzipLevel != prev.HTTP.GzipLevel {
+			gzipLevel.Store(int64(next.HTTP.GzipLevel))
+		}
+		if next.Accrual.RateLimit != prev.Accrual.RateLimit {
+			accrual.SetRateLimit(next.Accrual.RateLimit)
+		}
+		if next.Updater != prev.Updater {
+			updater.SetLimits(next.Updater.Workers, next.Updater.BatchSize, next.Updater.Interval)
+			updater.SetRetryPolicy(retryPolicy(next.Updater))
+		}
+		if next.Balance.CacheTTL != prev.Balance.CacheTTL {
+			balanceSvc.SetTTL(next.Balance.CacheTTL)
+		}
+		if next.Storage.Timeout != prev.Storage.Timeout {
+			postgres.SetTimeout(next.Storage.Timeout)
+		}
+		if next.Throttle.Login != prev.Throttle.Login || next.Throttle.IP != prev.Throttle.IP {
+			loginThrottler.SetPolicies(service.ThrottlePolicy(next.Throttle.Login), service.ThrottlePolicy(next.Throttle.IP))
+		}
+		if next.Throttle.Reset != prev.Throttle.Reset || next.Throttle.ResetIP != prev.Throttle.ResetIP {
+			resetThrottler.SetPolicies(service.ThrottlePolicy(next.Throttle.Reset), service.ThrottlePolicy(next.Throttle.ResetIP))
+		}
+		if credentialRules(next.Auth) != credentialRules(prev.Auth) {
+			// the pattern has been validated with the rest of next
+			if logins, passwords, err := credentialPolicies(next.Auth, breached); err == nil {
+				authSvc.SetPolicies(logins, passwords)
+			}
+		}
+	}))
+
+	return app.Run(ctx)
+}
 
-	go updater.Run(ctx, 2, 5, time.Second)
-	go http.ListenAndServe(cfg.RunAddress, router)
+// retryPolicy returns the policy the order updater applies to orders the
+// accrual service fails to report.
+func retryPolicy(u config.Updater) service.RetryPolicy {
+	return service.RetryPolicy{
+		BaseDelay:   u.RetryBaseDelay,
+		MaxDelay:    u.RetryMaxDelay,
+		MaxAttempts: u.MaxAttempts,
+		MaxAge:      u.MaxAge,
+	}
+}
+
+// credentialRules returns a with everything but the login and password
+// rules zeroed, so that changes of the rules can be compared.
+func credentialRules(a config.Auth) config.Auth {
+	return config.Auth{
+		LoginMinLength:    a.LoginMinLength,
+		LoginMaxLength:    a.LoginMaxLength,
+		LoginPattern:      a.LoginPattern,
+		PasswordMinLength: a.PasswordMinLength,
+		PasswordMaxLength: a.PasswordMaxLength,
+	}
+}
 
-	<-ctx.Done()
-	ctxShutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	pool.Close()
-	<-ctxShutdown.Done()
+// credentialPolicies returns the rules for new logins and passwords.
+func credentialPolicies(a config.Auth, breached service.PasswordList) (service.LoginPolicy, service.PasswordPolicy, error) {
+	logins := service.LoginPolicy{MinLength: a.LoginMinLength, MaxLength: a.LoginMaxLength}
+	if a.LoginPattern != "" {
+		re, err := regexp.Compile(a.LoginPattern)
+		if err != nil {
+			return service.LoginPolicy{}, service.PasswordPolicy{}, err
+		}
+		logins.Pattern = re
+	}
+	passwords := service.PasswordPolicy{MinLength: a.PasswordMinLength, MaxLength: a.PasswordMaxLength, Breached: breached}
+	return logins, passwords, nil
 }
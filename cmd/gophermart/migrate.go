@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/internal/storage/memory"
+	"github.com/Hobrus/gophermarket/internal/storage/postgres"
+	"github.com/Hobrus/gophermarket/migrations"
+)
+
+const migrateUsage = `usage: gophermart migrate [-d database-uri] up|down|status
+
+  up       apply pending migrations
+  down     revert the latest migration, -steps reverts more, -steps -1 all of them
+  status   list migrations and when they were applied
+`
+
+// runMigrate implements the migrate subcommand and returns the exit code.
+func runMigrate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, migrateUsage); fs.PrintDefaults() }
+	dsn := fs.String("d", os.Getenv("DATABASE_URI"), "database uri")
+	steps := fs.Int("steps", 1, "number of migrations to revert with down")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	// flags may also follow the command
+	cmd := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[min(1, fs.NArg()):]); err != nil {
+		return 2
+	}
+	if cmd == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if *dsn == "" {
+		fmt.Fprintln(stderr, "database URI is required")
+		return 2
+	}
+	if *dsn == memory.URI {
+		fmt.Fprintln(stderr, "in-memory storage has no migrations")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	pool, err := pgxpool.New(ctx, *dsn)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer pool.Close()
+	m, err := postgres.NewMigrator(pool, migrations.FS)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	switch cmd {
+	case "up":
+		var done []postgres.Migration
+		done, err = m.Up(ctx)
+		for _, mg := range done {
+			fmt.Fprintf(stdout, "applied %04d_%s\n", mg.Version, mg.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(stdout, "no pending migrations")
+		}
+	case "down":
+		var done []postgres.Migration
+		done, err = m.Down(ctx, *steps)
+		for _, mg := range done {
+			fmt.Fprintf(stdout, "reverted %04d_%s\n", mg.Version, mg.Name)
+		}
+	case "status":
+		var list []postgres.MigrationStatus
+		list, err = m.Status(ctx)
+		for _, st := range list {
+			fmt.Fprintf(stdout, "%04d_%-24s %s\n", st.Version, st.Name, describeStatus(st))
+		}
+	default:
+		err = errors.New("unknown migrate command " + cmd)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func describeStatus(st postgres.MigrationStatus) string {
+	if st.AppliedAt == nil {
+		return "pending"
+	}
+	s := "applied " + st.AppliedAt.Local().Format(time.DateTime)
+	switch {
+	case st.Unknown:
+		s += " (not in this binary)"
+	case st.Modified:
+		s += " (modified since applied)"
+	}
+	return s
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/exaring/otelpgx"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	dhttp "github.com/Hobrus/gophermarket/internal/delivery/http"
+	"github.com/Hobrus/gophermarket/internal/repository"
+	"github.com/Hobrus/gophermarket/internal/storage/memory"
+	"github.com/Hobrus/gophermarket/internal/storage/postgres"
+)
+
+// storage holds repositories of the selected backend.
+type storage struct {
+	users          repository.UserRepo
+	orders         repository.OrderRepo
+	withdrawals    repository.WithdrawalRepo
+	ledger         repository.LedgerRepo
+	idempotency    repository.IdempotencyRepo
+	sessions       repository.SessionRepo
+	apiKeys        repository.APIKeyRepo
+	loginAttempts  repository.LoginAttemptRepo
+	passwordResets repository.PasswordResetRepo
+	events         repository.EventRepo
+	webhooks       repository.WebhookRepo
+	notifier       repository.Notifier
+	// listen receives notifications of other replicas until ctx is done.
+	// It is nil when there are no other replicas.
+	listen func(ctx context.Context) error
+	// db is checked by the readiness probe.
+	db    dhttp.DBPinger
+	close func()
+}
+
+// openStorage connects to PostgreSQL and applies migrations, or creates an
+// in-memory store when uri is memory://. timeout limits PostgreSQL calls.
+func openStorage(ctx context.Context, uri string, timeout time.Duration, tp trace.TracerProvider, mp metric.MeterProvider, l *zerolog.Logger) (storage, error) {
+	if uri == memory.URI {
+		l.Warn().Msg("using in-memory storage, data will be lost on exit")
+		s := memory.NewStore()
+		users, orders, withdrawals := memory.New(s)
+		return storage{
+			users:          users,
+			orders:         orders,
+			withdrawals:    withdrawals,
+			ledger:         memory.NewLedgerRepo(s),
+			idempotency:    memory.NewIdempotencyRepo(s),
+			sessions:       memory.NewSessionRepo(s),
+			apiKeys:        memory.NewAPIKeyRepo(s),
+			loginAttempts:  memory.NewLoginAttemptRepo(s),
+			passwordResets: memory.NewPasswordResetRepo(s),
+			events:         memory.NewEventRepo(s),
+			webhooks:       memory.NewWebhookRepo(s),
+			notifier:       memory.NewNotifier(),
+			db:             s,
+			close:          func() {},
+		}, nil
+	}
+
+	poolCfg, err := pgxpool.ParseConfig(uri)
+	if err != nil {
+		return storage{}, err
+	}
+	poolCfg.ConnConfig.Tracer = otelpgx.NewTracer(
+		otelpgx.WithTracerProvider(tp),
+		otelpgx.WithMeterProvider(mp),
+	)
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	if err != nil {
+		return storage{}, err
+	}
+	if err := otelpgx.RecordStats(pool, otelpgx.WithStatsMeterProvider(mp)); err != nil {
+		pool.Close()
+		return storage{}, err
+	}
+	if err := postgres.ApplyMigrations(ctx, pool); err != nil {
+		pool.Close()
+		return storage{}, err
+	}
+	postgres.SetTimeout(timeout)
+	users, orders, withdrawals := postgres.New(pool)
+	notifier := postgres.NewNotifier(pool)
+	notifier.SetErrorHandler(func(err error) {
+		l.Warn().Err(err).Msg("notification listener failed, reconnecting")
+	})
+	return storage{
+		users:          users,
+		orders:         orders,
+		withdrawals:    withdrawals,
+		ledger:         postgres.NewLedgerRepo(pool),
+		idempotency:    postgres.NewIdempotencyRepo(pool),
+		sessions:       postgres.NewSessionRepo(pool),
+		apiKeys:        postgres.NewAPIKeyRepo(pool),
+		loginAttempts:  postgres.NewLoginAttemptRepo(pool),
+		passwordResets: postgres.NewPasswordResetRepo(pool),
+		events:         postgres.NewEventRepo(pool),
+		webhooks:       postgres.NewWebhookRepo(pool),
+		notifier:       notifier,
+		listen:         notifier.Run,
+		db:             pool,
+		close:          pool.Close,
+	}, nil
+}
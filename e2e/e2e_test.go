@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -23,6 +24,7 @@ import (
 	dhttp "github.com/Hobrus/gophermarket/internal/delivery/http"
 	"github.com/Hobrus/gophermarket/internal/service"
 	"github.com/Hobrus/gophermarket/internal/storage/postgres"
+	"github.com/Hobrus/gophermarket/pkg/jwtkeys"
 	"github.com/Hobrus/gophermarket/pkg/logger"
 	"github.com/Hobrus/gophermarket/pkg/middleware"
 	"github.com/go-chi/chi/v5"
@@ -63,10 +65,7 @@ var _ = BeforeSuite(func() {
 	defer cancelPing()
 	Expect(pool.Ping(ctxPing)).To(Succeed())
 
-	b, err := os.ReadFile(filepath.Join("migrations", "0001_init.up.sql"))
-	Expect(err).NotTo(HaveOccurred())
-	_, err = pool.Exec(ctx, string(b))
-	Expect(err).NotTo(HaveOccurred())
+	Expect(postgres.ApplyMigrations(ctx, pool)).To(Succeed())
 
 	script, err := os.ReadFile(filepath.Join("e2e", "accrual_server.js"))
 	Expect(err).NotTo(HaveOccurred())
@@ -94,20 +93,22 @@ var _ = BeforeSuite(func() {
 	baseURL = "http://" + ln.Addr().String()
 
 	userRepo, orderRepo, withdrawalRepo := postgres.New(pool)
-	authSvc := service.NewAuthService(userRepo, []byte("secret"))
+	keys, err := jwtkeys.NewKeyring(jwtkeys.NewHMAC([]byte("secret")))
+	Expect(err).NotTo(HaveOccurred())
+	authSvc := service.NewAuthService(userRepo, postgres.NewSessionRepo(pool), keys)
 	orderSvc := service.NewOrderService(orderRepo)
-	balanceSvc := service.NewBalanceService(orderRepo, withdrawalRepo)
-	withdrawSvc := service.NewWithdrawService(orderRepo, withdrawalRepo, balanceSvc)
+	balanceSvc := service.NewBalanceService(postgres.NewLedgerRepo(pool))
+	withdrawSvc := service.NewWithdrawService(withdrawalRepo, balanceSvc)
 	updater := service.NewOrderUpdater(orderRepo, accrualclient.New(accrualAddr), balanceSvc)
 
 	router := chi.NewRouter()
 	router.Use(middleware.RequestID)
 	l := logger.Init("info")
 	router.Use(logger.Middleware(l))
-	router.Use(middleware.Gzip(5))
+	router.Use(middleware.Gzip(5, dhttp.MiddlewareError))
 	router.Mount("/", dhttp.NewRouter(authSvc))
 	router.Group(func(r chi.Router) {
-		r.Use(dhttp.JWT([]byte("secret")))
+		r.Use(dhttp.JWT(keys, dhttp.WithSessions(authSvc)))
 		r.Mount("/", dhttp.NewOrderRouter(orderSvc))
 		r.Get("/api/user/balance", dhttp.Balance(balanceSvc))
 		r.Post("/api/user/balance/withdraw", dhttp.Withdraw(withdrawSvc))
@@ -139,7 +140,7 @@ var _ = AfterSuite(func() {
 
 var _ = Describe("E2E", func() {
 	It("processes full scenario", func() {
-		resp, err := client.Post(baseURL+"/api/user/register", "application/json", strings.NewReader(`{"login":"u","password":"p"}`))
+		resp, err := client.Post(baseURL+"/api/user/register", "application/json", strings.NewReader(`{"login":"user","password":"s3cret-pass"}`))
 		Expect(err).NotTo(HaveOccurred())
 		Expect(resp.StatusCode).To(Equal(http.StatusOK))
 		resp.Body.Close()
@@ -203,4 +204,88 @@ var _ = Describe("E2E", func() {
 		Expect(bal.Current).To(Equal(400.0))
 		Expect(bal.Withdrawn).To(Equal(600.0))
 	})
+
+	It("never overdraws balance on concurrent withdrawals", func() {
+		jar, _ := cookiejar.New(nil)
+		c := &http.Client{Jar: jar}
+
+		resp, err := c.Post(baseURL+"/api/user/register", "application/json", strings.NewReader(`{"login":"racer","password":"s3cret-pass"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		resp.Body.Close()
+
+		resp, err = c.Post(baseURL+"/api/user/orders", "text/plain", strings.NewReader(luhnNumber("4561261212345")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		resp.Body.Close()
+
+		getBalance := func() (float64, float64) {
+			r, err := c.Get(baseURL + "/api/user/balance")
+			if err != nil {
+				return 0, 0
+			}
+			defer r.Body.Close()
+			var b struct {
+				Current   float64 `json:"current"`
+				Withdrawn float64 `json:"withdrawn"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+				return 0, 0
+			}
+			return b.Current, b.Withdrawn
+		}
+		Eventually(func() float64 {
+			cur, _ := getBalance()
+			return cur
+		}, 5*time.Second, 500*time.Millisecond).Should(Equal(1000.0))
+
+		const parallel = 30
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			codes = map[int]int{}
+		)
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := fmt.Sprintf(`{"order":"%s","sum":100}`, luhnNumber(fmt.Sprintf("9%09d", i)))
+				r, err := c.Post(baseURL+"/api/user/balance/withdraw", "application/json", strings.NewReader(body))
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, r.Body)
+				r.Body.Close()
+				mu.Lock()
+				codes[r.StatusCode]++
+				mu.Unlock()
+			}(i)
+		}
+		wg.Wait()
+
+		Expect(codes[http.StatusOK]).To(Equal(10))
+		Expect(codes[http.StatusPaymentRequired]).To(Equal(parallel - 10))
+
+		cur, withdrawn := getBalance()
+		Expect(cur).To(Equal(0.0))
+		Expect(withdrawn).To(Equal(1000.0))
+	})
 })
+
+// luhnNumber appends a Luhn check digit to prefix.
+func luhnNumber(prefix string) string {
+	sum := 0
+	double := true
+	for i := len(prefix) - 1; i >= 0; i-- {
+		d := int(prefix[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return fmt.Sprintf("%s%d", prefix, (10-sum%10)%10)
+}
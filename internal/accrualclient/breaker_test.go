@@ -0,0 +1,44 @@
+package accrualclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(2, 50*time.Millisecond)
+
+	b.failure()
+	if err := b.allow(); err != nil || b.State() != BreakerClosed {
+		t.Fatalf("expected closed after single failure, got %v %s", err, b.State())
+	}
+	b.failure()
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected open circuit, got %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open, got %s", b.State())
+	}
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second probe must be rejected, got %v", err)
+	}
+	b.failure()
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("failed probe must reopen the circuit, got %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	b.success()
+	if err := b.allow(); err != nil || b.State() != BreakerClosed {
+		t.Fatalf("expected closed after successful probe, got %v %s", err, b.State())
+	}
+}
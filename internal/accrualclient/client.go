@@ -6,13 +6,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 
 	"github.com/shopspring/decimal"
 	"golang.org/x/time/rate"
@@ -22,63 +26,198 @@ import (
 type Client interface {
 	// Get retrieves accrual status for order number. If the service responds
 	// with 429 Too Many Requests the returned retryAfter specifies how long to
-	// wait before the next request.
-	Get(ctx context.Context, number string) (status string, accrual *decimal.Decimal, retryAfter time.Duration, err error)
+	// wait before the next request. Empty status means the order is not
+	// registered in the accrual system.
+	Get(ctx context.Context, number string) (status Status, accrual *decimal.Decimal, retryAfter time.Duration, err error)
 }
 
+// defaultRetryAfter is used when 429 response has no valid Retry-After header.
+const defaultRetryAfter = time.Minute
+
+// limitRe extracts the announced rate limit from 429 response body,
+// e.g. "No more than 10 requests per minute allowed".
+var limitRe = regexp.MustCompile(`(\d+) requests per minute`)
+
 // HTTPClient implements Client using net/http.
+// After a 429 response all requests of the client are suspended until
+// the Retry-After deadline, and the rate limiter adopts the limit
+// announced by the accrual system. Consecutive transport errors and 5xx
+// responses open the circuit breaker, see ErrCircuitOpen.
 type HTTPClient struct {
 	baseURL string
 	http    *http.Client
 	limiter *rate.Limiter
+	breaker *breaker
+
+	mu          sync.Mutex
+	pausedUntil time.Time
 }
 
 // New creates a new HTTPClient with provided base URL.
-func New(baseURL string) *HTTPClient {
-	lim := rate.NewLimiter(rate.Limit(5), 5)
-	lim.AllowN(time.Now(), 5)
-	return &HTTPClient{
+func New(baseURL string, opts ...Option) *HTTPClient {
+	o := defaultOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{Timeout: o.dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	tr.TLSHandshakeTimeout = o.tlsHandshakeTimeout
+
+	burst := rateBurst(o.rateLimit)
+	lim := rate.NewLimiter(rate.Limit(o.rateLimit), burst)
+	lim.AllowN(time.Now(), burst)
+	c := &HTTPClient{
 		baseURL: strings.TrimRight(baseURL, "/"),
 		http: &http.Client{
-			Transport: otelhttp.NewTransport(http.DefaultTransport, otelhttp.WithTracerProvider(otel.GetTracerProvider())),
+			Timeout:   o.requestTimeout,
+			Transport: otelhttp.NewTransport(tr, otelhttp.WithTracerProvider(otel.GetTracerProvider())),
 		},
 		limiter: lim,
+		breaker: newBreaker(o.breakerThreshold, o.breakerCooldown),
 	}
+	c.registerMetrics()
+	return c
+}
+
+// BreakerState returns the current state of the circuit breaker.
+func (c *HTTPClient) BreakerState() BreakerState {
+	return c.breaker.State()
+}
+
+// registerMetrics exposes circuit breaker state as an OTel gauge:
+// 0 - closed, 1 - half-open, 2 - open.
+func (c *HTTPClient) registerMetrics() {
+	meter := otel.GetMeterProvider().Meter("github.com/Hobrus/gophermarket/internal/accrualclient")
+	_, _ = meter.Int64ObservableGauge("accrual.breaker.state",
+		metric.WithDescription("Accrual client circuit breaker state: 0 closed, 1 half-open, 2 open"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(c.breaker.State()))
+			return nil
+		}),
+	)
 }
 
 type getResponse struct {
 	Order   string           `json:"order"`
-	Status  string           `json:"status"`
+	Status  Status           `json:"status"`
 	Accrual *decimal.Decimal `json:"accrual"`
 }
 
+// PausedUntil returns the time until which requests are suspended
+// because of a 429 response. Zero time means requests are allowed.
+func (c *HTTPClient) PausedUntil() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pausedUntil
+}
+
+// pause suspends requests until t unless they are already suspended longer.
+func (c *HTTPClient) pause(t time.Time) {
+	c.mu.Lock()
+	if t.After(c.pausedUntil) {
+		c.pausedUntil = t
+	}
+	c.mu.Unlock()
+}
+
+// waitPause blocks while requests are suspended or ctx is done.
+func (c *HTTPClient) waitPause(ctx context.Context) error {
+	for {
+		d := time.Until(c.PausedUntil())
+		if d <= 0 {
+			return nil
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// rateBurst allows bursts of one second of requests.
+func rateBurst(perSecond float64) int {
+	return max(1, int(perSecond))
+}
+
+// SetRateLimit changes the rate limit set with WithRateLimit, replacing
+// the one announced by the accrual system, if any. It is safe to call
+// while the client is in use.
+func (c *HTTPClient) SetRateLimit(perSecond float64) {
+	c.limiter.SetLimit(rate.Limit(perSecond))
+	c.limiter.SetBurst(rateBurst(perSecond))
+}
+
+// adaptLimit switches the limiter to the rate announced in 429 response body.
+func (c *HTTPClient) adaptLimit(body io.Reader) {
+	b, err := io.ReadAll(io.LimitReader(body, 1024))
+	if err != nil {
+		return
+	}
+	m := limitRe.FindSubmatch(b)
+	if m == nil {
+		return
+	}
+	n, err := strconv.Atoi(string(m[1]))
+	if err != nil || n <= 0 {
+		return
+	}
+	c.limiter.SetLimit(rate.Limit(float64(n) / 60))
+	c.limiter.SetBurst(1)
+}
+
 // Get implements Client using GET /api/orders/{number} request.
-func (c *HTTPClient) Get(ctx context.Context, number string) (string, *decimal.Decimal, time.Duration, error) {
+func (c *HTTPClient) Get(ctx context.Context, number string) (Status, *decimal.Decimal, time.Duration, error) {
+	if err := c.waitPause(ctx); err != nil {
+		return "", nil, 0, err
+	}
+	// an open breaker fails fast, without waiting for or spending a token
+	if err := c.breaker.allow(); err != nil {
+		return "", nil, 0, err
+	}
 	if err := c.limiter.Wait(ctx); err != nil {
+		c.breaker.ignore()
 		return "", nil, 0, err
 	}
 	url := fmt.Sprintf("%s/api/orders/%s", c.baseURL, number)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
+		c.breaker.ignore()
 		return "", nil, 0, err
 	}
 	req.Header.Set("Accept-Encoding", "gzip")
 
 	resp, err := c.http.Do(req)
 	if err != nil {
+		if ctx.Err() != nil {
+			c.breaker.ignore()
+		} else {
+			c.breaker.failure()
+		}
 		return "", nil, 0, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		c.breaker.failure()
+	} else {
+		c.breaker.success()
+	}
+
 	switch resp.StatusCode {
 	case http.StatusNoContent:
 		return "", nil, 0, nil
 	case http.StatusTooManyRequests:
-		raStr := resp.Header.Get("Retry-After")
-		if sec, err := strconv.Atoi(raStr); err == nil {
-			return "", nil, time.Duration(sec) * time.Second, nil
+		retry := defaultRetryAfter
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+			retry = time.Duration(sec) * time.Second
 		}
-		return "", nil, 0, nil
+		c.pause(time.Now().Add(retry))
+		c.adaptLimit(resp.Body)
+		return "", nil, retry, nil
 	}
 
 	if resp.StatusCode > 299 {
@@ -4,6 +4,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -15,7 +16,7 @@ import (
 
 func TestHTTPClient_Get(t *testing.T) {
 	type want struct {
-		status  string
+		status  Status
 		accrual *decimal.Decimal
 		retry   time.Duration
 		err     bool
@@ -134,3 +135,87 @@ func TestHTTPClient_RateLimit(t *testing.T) {
 		t.Fatalf("expected duration >= 2s, got %v", time.Since(start))
 	}
 }
+
+func TestHTTPClient_TooManyRequests(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		c := calls
+		mu.Unlock()
+		if c == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("No more than 120 requests per minute allowed"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	_, _, retry, err := c.Get(context.Background(), "42")
+	if err != nil || retry != time.Second {
+		t.Fatalf("unexpected result %v %v", retry, err)
+	}
+	if got := c.limiter.Limit(); got != 2 {
+		t.Fatalf("expected limit adapted to 2 rps, got %v", got)
+	}
+
+	start := time.Now()
+	if _, _, _, err := c.Get(context.Background(), "43"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 900*time.Millisecond {
+		t.Fatalf("request was not paused, took %v", time.Since(start))
+	}
+}
+
+func TestHTTPClient_Breaker(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithBreaker(2, time.Minute), WithRateLimit(1))
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := c.Get(context.Background(), "42"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	// the open breaker answers at once instead of waiting for the limiter
+	start := time.Now()
+	if _, _, _, err := c.Get(context.Background(), "42"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected open circuit, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("open circuit waited for the rate limiter for %s", d)
+	}
+	if c.BreakerState() != BreakerOpen {
+		t.Fatalf("expected open state, got %s", c.BreakerState())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("expected 2 requests to reach server, got %d", calls)
+	}
+}
+
+func TestHTTPClient_Timeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRequestTimeout(100*time.Millisecond))
+	if _, _, _, err := c.Get(context.Background(), "42"); err == nil {
+		t.Fatal("expected timeout error")
+	}
+}
@@ -0,0 +1,55 @@
+package accrualclient
+
+import "time"
+
+type options struct {
+	requestTimeout      time.Duration
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	breakerThreshold    int
+	breakerCooldown     time.Duration
+	rateLimit           float64
+}
+
+var defaultOptions = options{
+	requestTimeout:      5 * time.Second,
+	dialTimeout:         2 * time.Second,
+	tlsHandshakeTimeout: 2 * time.Second,
+	breakerThreshold:    5,
+	breakerCooldown:     10 * time.Second,
+	rateLimit:           5,
+}
+
+// Option configures HTTPClient.
+type Option func(*options)
+
+// WithRequestTimeout limits the whole request including reading the body.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) { o.requestTimeout = d }
+}
+
+// WithDialTimeout limits establishing a TCP connection.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) { o.dialTimeout = d }
+}
+
+// WithTLSHandshakeTimeout limits the TLS handshake.
+func WithTLSHandshakeTimeout(d time.Duration) Option {
+	return func(o *options) { o.tlsHandshakeTimeout = d }
+}
+
+// WithBreaker opens the circuit breaker after threshold consecutive failures
+// and probes the accrual system again after cooldown. Zero threshold
+// disables the breaker.
+func WithBreaker(threshold int, cooldown time.Duration) Option {
+	return func(o *options) {
+		o.breakerThreshold = threshold
+		o.breakerCooldown = cooldown
+	}
+}
+
+// WithRateLimit limits requests to perSecond until the accrual system
+// announces its own limit in a 429 response.
+func WithRateLimit(perSecond float64) Option {
+	return func(o *options) { o.rateLimit = perSecond }
+}
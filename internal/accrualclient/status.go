@@ -0,0 +1,36 @@
+package accrualclient
+
+import (
+	"fmt"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+// Status is an order status reported by the accrual system.
+type Status string
+
+const (
+	// StatusRegistered means the order is registered but the accrual is not calculated yet.
+	StatusRegistered Status = "REGISTERED"
+	// StatusInvalid means the order will not be rewarded.
+	StatusInvalid Status = "INVALID"
+	// StatusProcessing means the accrual is being calculated.
+	StatusProcessing Status = "PROCESSING"
+	// StatusProcessed means the accrual has been calculated.
+	StatusProcessed Status = "PROCESSED"
+)
+
+// OrderStatus maps the accrual system status to the gophermart order status.
+// It returns an error for statuses unknown to gophermart.
+func (s Status) OrderStatus() (domain.OrderStatus, error) {
+	switch s {
+	case StatusRegistered, StatusProcessing:
+		return domain.OrderProcessing, nil
+	case StatusInvalid:
+		return domain.OrderInvalid, nil
+	case StatusProcessed:
+		return domain.OrderProcessed, nil
+	default:
+		return "", fmt.Errorf("unknown accrual status %q", string(s))
+	}
+}
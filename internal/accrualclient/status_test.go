@@ -0,0 +1,30 @@
+package accrualclient
+
+import (
+	"testing"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+func TestStatus_OrderStatus(t *testing.T) {
+	tests := []struct {
+		in      Status
+		want    domain.OrderStatus
+		wantErr bool
+	}{
+		{in: StatusRegistered, want: domain.OrderProcessing},
+		{in: StatusProcessing, want: domain.OrderProcessing},
+		{in: StatusInvalid, want: domain.OrderInvalid},
+		{in: StatusProcessed, want: domain.OrderProcessed},
+		{in: "UNKNOWN", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.in.OrderStatus()
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: unexpected error %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -3,54 +3,645 @@ package config
 import (
 	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// DefaultJWTSecret is the well-known secret used in dev mode when no keys are configured.
+const DefaultJWTSecret = "secret"
+
 // Config holds application configuration parameters.
+//
+// Values are taken from the defaults, then the config file, then environment
+// variables and finally command line flags, each overriding the previous.
+// Fields marked as reloadable are applied on SIGHUP, the rest only on start.
 type Config struct {
-	RunAddress     string
-	DatabaseURI    string
-	AccrualAddress string
-	JWTSecret      string
+	RunAddress     string `yaml:"run_address"`
+	DatabaseURI    string `yaml:"database_uri"`
+	AccrualAddress string `yaml:"accrual_address"`
+	JWTSecret      string `yaml:"jwt_secret"`
+	// JWTKeys are PEM files with RSA or Ed25519 keys. The first one signs
+	// tokens, the rest only verify them.
+	JWTKeys []string `yaml:"jwt_keys"`
+	// DevMode allows running with the default JWT secret.
+	DevMode bool `yaml:"dev_mode"`
+	// PasswordPepper is mixed into argon2id password hashes. Hashes made
+	// with one pepper don't verify with another, so it must not change.
+	PasswordPepper string `yaml:"password_pepper"`
+	// NotifyFile is the file password reset tokens are written to in dev
+	// mode. They are logged when it is empty. Password reset is disabled
+	// outside dev mode.
+	NotifyFile string `yaml:"notify_file"`
+	// BreachedPasswords is a file with passwords rejected on registration
+	// and password change, one per line.
+	BreachedPasswords string `yaml:"breached_passwords"`
+	// AdminToken authenticates administrator requests to /api/admin.
+	// Administrator endpoints are disabled when it is empty.
+	AdminToken string `yaml:"admin_token"`
+
+	HTTP    HTTP    `yaml:"http"`
+	Storage Storage `yaml:"storage"`
+	Auth    Auth    `yaml:"auth"`
+	Accrual Accrual `yaml:"accrual"`
+	Updater Updater `yaml:"updater"`
+	Balance Balance `yaml:"balance"`
+	// Throttle configures the throttling of logins and password reset
+	// requests.
+	Throttle Throttle `yaml:"throttle"`
+	// Webhooks configures the webhook delivery worker.
+	Webhooks Webhooks `yaml:"webhooks"`
 }
 
-// Load reads configuration from environment variables and command line flags.
-// Flags have priority over environment variables.
-func Load() (Config, error) {
-	cfg := Config{RunAddress: ":8080"}
+// HTTP configures the HTTP server.
+type HTTP struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is given to every component to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// GzipLevel is the compress/gzip level of responses. Reloadable.
+	GzipLevel int `yaml:"gzip_level"`
+	// StreamKeepalive is the interval of keepalive comments on event
+	// streams.
+	StreamKeepalive time.Duration `yaml:"stream_keepalive"`
+}
 
-	if v := os.Getenv("RUN_ADDRESS"); v != "" {
-		cfg.RunAddress = v
-	}
-	if v := os.Getenv("DATABASE_URI"); v != "" {
-		cfg.DatabaseURI = v
-	}
-	if v := os.Getenv("ACCRUAL_SYSTEM_ADDRESS"); v != "" {
-		cfg.AccrualAddress = v
-	}
-	if v := os.Getenv("JWT_SECRET"); v != "" {
-		cfg.JWTSecret = v
+// Storage configures the repositories.
+type Storage struct {
+	// Timeout limits a single repository call. Reloadable.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Auth configures tokens and password hashing.
+type Auth struct {
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	// Argon2 parameters of new password hashes. Existing hashes are
+	// rehashed on the next login after a change.
+	Argon2Memory  int `yaml:"argon2_memory"` // KiB
+	Argon2Time    int `yaml:"argon2_time"`
+	Argon2Threads int `yaml:"argon2_threads"`
+	// Rules for new logins. LoginPattern must match the whole login after
+	// Unicode normalization; empty allows any characters. Reloadable.
+	LoginMinLength int    `yaml:"login_min_length"`
+	LoginMaxLength int    `yaml:"login_max_length"`
+	LoginPattern   string `yaml:"login_pattern"`
+	// Length bounds of new passwords in characters. Reloadable.
+	PasswordMinLength int `yaml:"password_min_length"`
+	PasswordMaxLength int `yaml:"password_max_length"`
+}
+
+// Accrual configures the accrual system client.
+type Accrual struct {
+	// RateLimit is the number of requests per second sent to the accrual
+	// system until it announces its own limit. Reloadable.
+	RateLimit      float64       `yaml:"rate_limit"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// DialTimeout and TLSHandshakeTimeout limit establishing a connection.
+	DialTimeout         time.Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	// BreakerThreshold is the number of consecutive failures opening the
+	// circuit breaker, zero disables it. BreakerCooldown is how long the
+	// circuit stays open before the accrual system is probed again.
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+}
+
+// Updater configures the background order updater. Reloadable.
+type Updater struct {
+	// Workers is the number of orders checked at once.
+	Workers int `yaml:"workers"`
+	// BatchSize is the number of orders claimed per tick.
+	BatchSize int `yaml:"batch_size"`
+	// Interval is the period of the sweep for orders due for a retry.
+	// Uploaded orders are claimed right away.
+	Interval time.Duration `yaml:"interval"`
+	// RetryBaseDelay is the delay after the first failed check of an order.
+	// It doubles with every subsequent failure up to RetryMaxDelay.
+	RetryBaseDelay time.Duration `yaml:"retry_base_delay"`
+	RetryMaxDelay  time.Duration `yaml:"retry_max_delay"`
+	// MaxAttempts and MaxAge are the failed checks and the order age after
+	// which an order is marked INVALID. Zero disables the limit.
+	MaxAttempts int           `yaml:"max_attempts"`
+	MaxAge      time.Duration `yaml:"max_age"`
+}
+
+// Balance configures the balance service.
+type Balance struct {
+	// CacheTTL is how long a balance is served from cache. Reloadable.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// Throttle configures the throttling of failed logins per login name and
+// per client address, and of password reset requests. The policies are
+// reloadable.
+type Throttle struct {
+	Login   ThrottlePolicy `yaml:"login"`
+	IP      ThrottlePolicy `yaml:"ip"`
+	Reset   ThrottlePolicy `yaml:"reset"`
+	ResetIP ThrottlePolicy `yaml:"reset_ip"`
+	// PruneInterval is the period of removing counters outside every window.
+	PruneInterval time.Duration `yaml:"prune_interval"`
+}
+
+// ThrottlePolicy defines how failures slow down further attempts. It has
+// the fields of service.ThrottlePolicy and converts to it.
+type ThrottlePolicy struct {
+	// FreeAttempts is the number of failures allowed without delay.
+	FreeAttempts int `yaml:"free_attempts"`
+	// BaseDelay is the delay after the first failure beyond FreeAttempts,
+	// doubling with every further failure up to MaxDelay.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+	// LockoutAfter failures lock the key for LockoutFor. Zero disables
+	// lockout.
+	LockoutAfter int           `yaml:"lockout_after"`
+	LockoutFor   time.Duration `yaml:"lockout_for"`
+	// Window is how long a failure is remembered.
+	Window time.Duration `yaml:"window"`
+}
+
+// Webhooks configures the delivery of webhooks.
+type Webhooks struct {
+	// Workers is the number of deliveries sent at once.
+	Workers int `yaml:"workers"`
+	// BatchSize is the number of deliveries claimed per tick.
+	BatchSize int `yaml:"batch_size"`
+	// Interval is the period of checks for due deliveries.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout limits a single delivery. Claimed deliveries are leased for
+	// BatchSize times Timeout plus a margin.
+	Timeout time.Duration `yaml:"timeout"`
+	// AllowPrivate allows endpoints on loopback and private addresses,
+	// e.g. for local development.
+	AllowPrivate bool `yaml:"allow_private"`
+	// Retention is how long delivered and dead deliveries are kept.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() Config {
+	return Config{
+		RunAddress: ":8080",
+		HTTP: HTTP{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			// writes may take long for large order lists
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 10 * time.Second,
+			GzipLevel:       5,
+			StreamKeepalive: 15 * time.Second,
+		},
+		Storage: Storage{Timeout: 5 * time.Second},
+		Auth: Auth{
+			AccessTokenTTL:    15 * time.Minute,
+			RefreshTokenTTL:   30 * 24 * time.Hour,
+			Argon2Memory:      64 * 1024,
+			Argon2Time:        3,
+			Argon2Threads:     4,
+			LoginMinLength:    3,
+			LoginMaxLength:    64,
+			LoginPattern:      `^[\p{L}\p{N}._-]+$`,
+			PasswordMinLength: 8,
+			PasswordMaxLength: 256,
+		},
+		Accrual: Accrual{
+			RateLimit:           5,
+			RequestTimeout:      5 * time.Second,
+			DialTimeout:         2 * time.Second,
+			TLSHandshakeTimeout: 2 * time.Second,
+			BreakerThreshold:    5,
+			BreakerCooldown:     10 * time.Second,
+		},
+		Updater: Updater{
+			Workers:        2,
+			BatchSize:      5,
+			Interval:       10 * time.Second,
+			RetryBaseDelay: time.Second,
+			RetryMaxDelay:  10 * time.Minute,
+			MaxAttempts:    30,
+			MaxAge:         72 * time.Hour,
+		},
+		Balance: Balance{CacheTTL: 30 * time.Second},
+		Throttle: Throttle{
+			Login: ThrottlePolicy{
+				FreeAttempts: 3,
+				BaseDelay:    time.Second,
+				MaxDelay:     time.Minute,
+				LockoutAfter: 10,
+				LockoutFor:   15 * time.Minute,
+				Window:       15 * time.Minute,
+			},
+			// many users may share an address
+			IP: ThrottlePolicy{
+				FreeAttempts: 20,
+				BaseDelay:    time.Second,
+				MaxDelay:     time.Minute,
+				LockoutAfter: 100,
+				LockoutFor:   15 * time.Minute,
+				Window:       15 * time.Minute,
+			},
+			// a lockout would let anyone block the resets of a user
+			Reset: ThrottlePolicy{
+				FreeAttempts: 3,
+				BaseDelay:    time.Minute,
+				MaxDelay:     15 * time.Minute,
+				Window:       time.Hour,
+			},
+			ResetIP: ThrottlePolicy{
+				FreeAttempts: 10,
+				BaseDelay:    time.Second,
+				MaxDelay:     15 * time.Minute,
+				LockoutAfter: 50,
+				LockoutFor:   time.Hour,
+				Window:       time.Hour,
+			},
+			PruneInterval: time.Hour,
+		},
+		Webhooks: Webhooks{Workers: 4, BatchSize: 20, Interval: 5 * time.Second, Timeout: 10 * time.Second, Retention: 7 * 24 * time.Hour},
 	}
+}
+
+// envFlags maps environment variables to the flags they set.
+var envFlags = []struct{ env, flag string }{
+	{"RUN_ADDRESS", "a"},
+	{"DATABASE_URI", "d"},
+	{"ACCRUAL_SYSTEM_ADDRESS", "r"},
+	{"JWT_SECRET", "s"},
+	{"JWT_KEYS", "k"},
+	{"DEV_MODE", "dev"},
+	{"PASSWORD_PEPPER", "pepper"},
+	{"NOTIFY_FILE", "notify-file"},
+	{"BREACHED_PASSWORDS_FILE", "breached-passwords"},
+	{"ADMIN_TOKEN", "admin-token"},
+	{"HTTP_READ_HEADER_TIMEOUT", "http.read-header-timeout"},
+	{"HTTP_READ_TIMEOUT", "http.read-timeout"},
+	{"HTTP_WRITE_TIMEOUT", "http.write-timeout"},
+	{"HTTP_IDLE_TIMEOUT", "http.idle-timeout"},
+	{"HTTP_SHUTDOWN_TIMEOUT", "http.shutdown-timeout"},
+	{"HTTP_GZIP_LEVEL", "http.gzip-level"},
+	{"HTTP_STREAM_KEEPALIVE", "http.stream-keepalive"},
+	{"STORAGE_TIMEOUT", "storage.timeout"},
+	{"AUTH_ACCESS_TOKEN_TTL", "auth.access-token-ttl"},
+	{"AUTH_REFRESH_TOKEN_TTL", "auth.refresh-token-ttl"},
+	{"AUTH_ARGON2_MEMORY", "auth.argon2-memory"},
+	{"AUTH_ARGON2_TIME", "auth.argon2-time"},
+	{"AUTH_ARGON2_THREADS", "auth.argon2-threads"},
+	{"AUTH_LOGIN_MIN_LENGTH", "auth.login-min-length"},
+	{"AUTH_LOGIN_MAX_LENGTH", "auth.login-max-length"},
+	{"AUTH_LOGIN_PATTERN", "auth.login-pattern"},
+	{"AUTH_PASSWORD_MIN_LENGTH", "auth.password-min-length"},
+	{"AUTH_PASSWORD_MAX_LENGTH", "auth.password-max-length"},
+	{"ACCRUAL_RATE_LIMIT", "accrual.rate-limit"},
+	{"ACCRUAL_REQUEST_TIMEOUT", "accrual.request-timeout"},
+	{"ACCRUAL_DIAL_TIMEOUT", "accrual.dial-timeout"},
+	{"ACCRUAL_TLS_HANDSHAKE_TIMEOUT", "accrual.tls-handshake-timeout"},
+	{"ACCRUAL_BREAKER_THRESHOLD", "accrual.breaker-threshold"},
+	{"ACCRUAL_BREAKER_COOLDOWN", "accrual.breaker-cooldown"},
+	{"UPDATER_WORKERS", "updater.workers"},
+	{"UPDATER_BATCH_SIZE", "updater.batch-size"},
+	{"UPDATER_INTERVAL", "updater.interval"},
+	{"UPDATER_RETRY_BASE_DELAY", "updater.retry-base-delay"},
+	{"UPDATER_RETRY_MAX_DELAY", "updater.retry-max-delay"},
+	{"UPDATER_MAX_ATTEMPTS", "updater.max-attempts"},
+	{"UPDATER_MAX_AGE", "updater.max-age"},
+	{"BALANCE_CACHE_TTL", "balance.cache-ttl"},
+	{"THROTTLE_LOGIN_FREE_ATTEMPTS", "throttle.login.free-attempts"},
+	{"THROTTLE_LOGIN_BASE_DELAY", "throttle.login.base-delay"},
+	{"THROTTLE_LOGIN_MAX_DELAY", "throttle.login.max-delay"},
+	{"THROTTLE_LOGIN_LOCKOUT_AFTER", "throttle.login.lockout-after"},
+	{"THROTTLE_LOGIN_LOCKOUT_FOR", "throttle.login.lockout-for"},
+	{"THROTTLE_LOGIN_WINDOW", "throttle.login.window"},
+	{"THROTTLE_IP_FREE_ATTEMPTS", "throttle.ip.free-attempts"},
+	{"THROTTLE_IP_BASE_DELAY", "throttle.ip.base-delay"},
+	{"THROTTLE_IP_MAX_DELAY", "throttle.ip.max-delay"},
+	{"THROTTLE_IP_LOCKOUT_AFTER", "throttle.ip.lockout-after"},
+	{"THROTTLE_IP_LOCKOUT_FOR", "throttle.ip.lockout-for"},
+	{"THROTTLE_IP_WINDOW", "throttle.ip.window"},
+	{"THROTTLE_RESET_FREE_ATTEMPTS", "throttle.reset.free-attempts"},
+	{"THROTTLE_RESET_BASE_DELAY", "throttle.reset.base-delay"},
+	{"THROTTLE_RESET_MAX_DELAY", "throttle.reset.max-delay"},
+	{"THROTTLE_RESET_LOCKOUT_AFTER", "throttle.reset.lockout-after"},
+	{"THROTTLE_RESET_LOCKOUT_FOR", "throttle.reset.lockout-for"},
+	{"THROTTLE_RESET_WINDOW", "throttle.reset.window"},
+	{"THROTTLE_RESET_IP_FREE_ATTEMPTS", "throttle.reset-ip.free-attempts"},
+	{"THROTTLE_RESET_IP_BASE_DELAY", "throttle.reset-ip.base-delay"},
+	{"THROTTLE_RESET_IP_MAX_DELAY", "throttle.reset-ip.max-delay"},
+	{"THROTTLE_RESET_IP_LOCKOUT_AFTER", "throttle.reset-ip.lockout-after"},
+	{"THROTTLE_RESET_IP_LOCKOUT_FOR", "throttle.reset-ip.lockout-for"},
+	{"THROTTLE_RESET_IP_WINDOW", "throttle.reset-ip.window"},
+	{"THROTTLE_PRUNE_INTERVAL", "throttle.prune-interval"},
+	{"WEBHOOKS_WORKERS", "webhooks.workers"},
+	{"WEBHOOKS_BATCH_SIZE", "webhooks.batch-size"},
+	{"WEBHOOKS_INTERVAL", "webhooks.interval"},
+	{"WEBHOOKS_TIMEOUT", "webhooks.timeout"},
+	{"WEBHOOKS_ALLOW_PRIVATE", "webhooks.allow-private"},
+	{"WEBHOOKS_RETENTION", "webhooks.retention"},
+}
 
+// newFlagSet defines flags setting fields of cfg and the config file path.
+func newFlagSet(cfg *Config, file *string) *flag.FlagSet {
 	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.StringVar(file, "config", *file, "YAML config file")
 	fs.StringVar(&cfg.RunAddress, "a", cfg.RunAddress, "run address")
 	fs.StringVar(&cfg.DatabaseURI, "d", cfg.DatabaseURI, "database uri")
 	fs.StringVar(&cfg.AccrualAddress, "r", cfg.AccrualAddress, "accrual system address")
 	fs.StringVar(&cfg.JWTSecret, "s", cfg.JWTSecret, "jwt secret")
+	fs.Var((*listValue)(&cfg.JWTKeys), "k", "comma separated jwt key files, the first one signs tokens")
+	fs.BoolVar(&cfg.DevMode, "dev", cfg.DevMode, "dev mode, allows the default jwt secret")
+	fs.StringVar(&cfg.PasswordPepper, "pepper", cfg.PasswordPepper, "password hashing pepper")
+	fs.StringVar(&cfg.NotifyFile, "notify-file", cfg.NotifyFile, "file receiving password reset tokens in dev mode, logged if empty")
+	fs.StringVar(&cfg.BreachedPasswords, "breached-passwords", cfg.BreachedPasswords, "file with rejected passwords, one per line")
+	fs.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "bearer token of the administrator, admin endpoints are disabled if empty")
+
+	fs.DurationVar(&cfg.HTTP.ReadHeaderTimeout, "http.read-header-timeout", cfg.HTTP.ReadHeaderTimeout, "time to read request headers")
+	fs.DurationVar(&cfg.HTTP.ReadTimeout, "http.read-timeout", cfg.HTTP.ReadTimeout, "time to read a request")
+	fs.DurationVar(&cfg.HTTP.WriteTimeout, "http.write-timeout", cfg.HTTP.WriteTimeout, "time to write a response")
+	fs.DurationVar(&cfg.HTTP.IdleTimeout, "http.idle-timeout", cfg.HTTP.IdleTimeout, "keep-alive connection idle time")
+	fs.DurationVar(&cfg.HTTP.ShutdownTimeout, "http.shutdown-timeout", cfg.HTTP.ShutdownTimeout, "time given to every component to stop")
+	fs.IntVar(&cfg.HTTP.GzipLevel, "http.gzip-level", cfg.HTTP.GzipLevel, "gzip level of responses, -2 to 9")
+	fs.DurationVar(&cfg.HTTP.StreamKeepalive, "http.stream-keepalive", cfg.HTTP.StreamKeepalive, "interval of keepalive comments on event streams")
+	fs.DurationVar(&cfg.Storage.Timeout, "storage.timeout", cfg.Storage.Timeout, "timeout of a repository call")
+	fs.DurationVar(&cfg.Auth.AccessTokenTTL, "auth.access-token-ttl", cfg.Auth.AccessTokenTTL, "access token lifetime")
+	fs.DurationVar(&cfg.Auth.RefreshTokenTTL, "auth.refresh-token-ttl", cfg.Auth.RefreshTokenTTL, "refresh token lifetime")
+	fs.IntVar(&cfg.Auth.Argon2Memory, "auth.argon2-memory", cfg.Auth.Argon2Memory, "argon2id memory in KiB")
+	fs.IntVar(&cfg.Auth.Argon2Time, "auth.argon2-time", cfg.Auth.Argon2Time, "argon2id iterations")
+	fs.IntVar(&cfg.Auth.Argon2Threads, "auth.argon2-threads", cfg.Auth.Argon2Threads, "argon2id parallelism")
+	fs.IntVar(&cfg.Auth.LoginMinLength, "auth.login-min-length", cfg.Auth.LoginMinLength, "minimum login length in characters")
+	fs.IntVar(&cfg.Auth.LoginMaxLength, "auth.login-max-length", cfg.Auth.LoginMaxLength, "maximum login length in characters")
+	fs.StringVar(&cfg.Auth.LoginPattern, "auth.login-pattern", cfg.Auth.LoginPattern, "regular expression matching allowed logins, empty allows any")
+	fs.IntVar(&cfg.Auth.PasswordMinLength, "auth.password-min-length", cfg.Auth.PasswordMinLength, "minimum password length in characters")
+	fs.IntVar(&cfg.Auth.PasswordMaxLength, "auth.password-max-length", cfg.Auth.PasswordMaxLength, "maximum password length in characters")
+	fs.Float64Var(&cfg.Accrual.RateLimit, "accrual.rate-limit", cfg.Accrual.RateLimit, "requests per second to the accrual system")
+	fs.DurationVar(&cfg.Accrual.RequestTimeout, "accrual.request-timeout", cfg.Accrual.RequestTimeout, "accrual system request timeout")
+	fs.DurationVar(&cfg.Accrual.DialTimeout, "accrual.dial-timeout", cfg.Accrual.DialTimeout, "accrual system connection timeout")
+	fs.DurationVar(&cfg.Accrual.TLSHandshakeTimeout, "accrual.tls-handshake-timeout", cfg.Accrual.TLSHandshakeTimeout, "accrual system TLS handshake timeout")
+	fs.IntVar(&cfg.Accrual.BreakerThreshold, "accrual.breaker-threshold", cfg.Accrual.BreakerThreshold, "consecutive accrual system failures opening the circuit, 0 disables the breaker")
+	fs.DurationVar(&cfg.Accrual.BreakerCooldown, "accrual.breaker-cooldown", cfg.Accrual.BreakerCooldown, "time before an open circuit probes the accrual system")
+	fs.IntVar(&cfg.Updater.Workers, "updater.workers", cfg.Updater.Workers, "orders checked at once")
+	fs.IntVar(&cfg.Updater.BatchSize, "updater.batch-size", cfg.Updater.BatchSize, "orders claimed per tick")
+	fs.DurationVar(&cfg.Updater.Interval, "updater.interval", cfg.Updater.Interval, "period of the order updater sweep")
+	fs.DurationVar(&cfg.Updater.RetryBaseDelay, "updater.retry-base-delay", cfg.Updater.RetryBaseDelay, "delay after the first failed order check, doubling with every failure")
+	fs.DurationVar(&cfg.Updater.RetryMaxDelay, "updater.retry-max-delay", cfg.Updater.RetryMaxDelay, "maximum delay between order checks")
+	fs.IntVar(&cfg.Updater.MaxAttempts, "updater.max-attempts", cfg.Updater.MaxAttempts, "failed checks after which an order is invalid, 0 for no limit")
+	fs.DurationVar(&cfg.Updater.MaxAge, "updater.max-age", cfg.Updater.MaxAge, "age after which a failing order is invalid, 0 for no limit")
+	fs.DurationVar(&cfg.Balance.CacheTTL, "balance.cache-ttl", cfg.Balance.CacheTTL, "balance cache lifetime")
+	throttleFlags(fs, "throttle.login", "failed logins per login name", &cfg.Throttle.Login)
+	throttleFlags(fs, "throttle.ip", "failed logins per client address", &cfg.Throttle.IP)
+	throttleFlags(fs, "throttle.reset", "password reset requests per login name", &cfg.Throttle.Reset)
+	throttleFlags(fs, "throttle.reset-ip", "password reset requests per client address", &cfg.Throttle.ResetIP)
+	fs.DurationVar(&cfg.Throttle.PruneInterval, "throttle.prune-interval", cfg.Throttle.PruneInterval, "period of removing expired throttling counters")
+	fs.IntVar(&cfg.Webhooks.Workers, "webhooks.workers", cfg.Webhooks.Workers, "webhook deliveries sent at once")
+	fs.IntVar(&cfg.Webhooks.BatchSize, "webhooks.batch-size", cfg.Webhooks.BatchSize, "webhook deliveries claimed per tick")
+	fs.DurationVar(&cfg.Webhooks.Interval, "webhooks.interval", cfg.Webhooks.Interval, "period of checks for due webhook deliveries")
+	fs.DurationVar(&cfg.Webhooks.Timeout, "webhooks.timeout", cfg.Webhooks.Timeout, "timeout of a webhook delivery")
+	fs.BoolVar(&cfg.Webhooks.AllowPrivate, "webhooks.allow-private", cfg.Webhooks.AllowPrivate, "allow webhook endpoints on private addresses")
+	fs.DurationVar(&cfg.Webhooks.Retention, "webhooks.retention", cfg.Webhooks.Retention, "how long delivered and dead webhook deliveries are kept")
+	return fs
+}
+
+// throttleFlags defines flags setting the fields of p under prefix. What
+// names the attempts the policy applies to.
+func throttleFlags(fs *flag.FlagSet, prefix, what string, p *ThrottlePolicy) {
+	fs.IntVar(&p.FreeAttempts, prefix+".free-attempts", p.FreeAttempts, what+" allowed without delay")
+	fs.DurationVar(&p.BaseDelay, prefix+".base-delay", p.BaseDelay, "delay after the first throttled "+what+", doubling with every failure")
+	fs.DurationVar(&p.MaxDelay, prefix+".max-delay", p.MaxDelay, "maximum delay between "+what)
+	fs.IntVar(&p.LockoutAfter, prefix+".lockout-after", p.LockoutAfter, what+" causing a lockout, 0 disables it")
+	fs.DurationVar(&p.LockoutFor, prefix+".lockout-for", p.LockoutFor, "lockout duration of "+what)
+	fs.DurationVar(&p.Window, prefix+".window", p.Window, "how long "+what+" are remembered")
+}
 
-	if err := fs.Parse(os.Args[1:]); err != nil {
+// listValue is a comma separated list flag.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// Load reads configuration from the process arguments and environment.
+func Load() (Config, error) {
+	return Parse(os.Args[1:])
+}
+
+// Parse reads configuration from the config file, environment variables and
+// command line flags in args, and validates it. The config file is given by
+// the -config flag or the CONFIG_FILE variable.
+func Parse(args []string) (Config, error) {
+	// the first pass only finds the config file
+	scratch, file := Default(), os.Getenv("CONFIG_FILE")
+	fs := newFlagSet(&scratch, &file)
+	if err := fs.Parse(args); err != nil {
 		return Config{}, err
 	}
 
-	if cfg.DatabaseURI == "" {
-		return Config{}, errors.New("database URI is required")
+	cfg := Default()
+	if file != "" {
+		if err := readFile(file, &cfg); err != nil {
+			return Config{}, err
+		}
 	}
-	if cfg.AccrualAddress == "" {
-		return Config{}, errors.New("accrual address is required")
+	fs = newFlagSet(&cfg, &file)
+	fs.SetOutput(io.Discard)
+	for _, e := range envFlags {
+		if v := os.Getenv(e.env); v != "" {
+			if err := fs.Set(e.flag, v); err != nil {
+				return Config{}, fmt.Errorf("invalid value %q for %s: %w", v, e.env, err)
+			}
+		}
 	}
-	if cfg.JWTSecret == "" {
-		cfg.JWTSecret = "secret"
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
 	}
 
+	if cfg.JWTSecret == "" && len(cfg.JWTKeys) == 0 && cfg.DevMode {
+		cfg.JWTSecret = DefaultJWTSecret
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
 	return cfg, nil
 }
+
+// readFile decodes the YAML file into cfg. Keys missing from the file keep
+// their values, unknown keys are an error.
+func readFile(name string, cfg *Config) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", name, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid value of c.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	positive := func(name string, d time.Duration) {
+		check(d > 0, "%s must be positive, got %s", name, d)
+	}
+
+	check(c.RunAddress != "", "run address is required")
+	check(c.DatabaseURI != "", "database URI is required")
+	check(c.AccrualAddress != "", "accrual address is required")
+	if c.JWTSecret == DefaultJWTSecret && !c.DevMode {
+		errs = append(errs, errors.New("refusing to use the default JWT secret outside dev mode"))
+	}
+	check(c.JWTSecret != "" || len(c.JWTKeys) > 0, "JWT secret or keys are required")
+	check(c.NotifyFile == "" || c.DevMode, "notify file is only allowed in dev mode, password reset is disabled outside it")
+
+	positive("http.read_header_timeout", c.HTTP.ReadHeaderTimeout)
+	positive("http.read_timeout", c.HTTP.ReadTimeout)
+	positive("http.write_timeout", c.HTTP.WriteTimeout)
+	positive("http.idle_timeout", c.HTTP.IdleTimeout)
+	positive("http.shutdown_timeout", c.HTTP.ShutdownTimeout)
+	positive("http.stream_keepalive", c.HTTP.StreamKeepalive)
+	check(c.HTTP.GzipLevel >= -2 && c.HTTP.GzipLevel <= 9, "http.gzip_level must be between -2 and 9, got %d", c.HTTP.GzipLevel)
+	positive("storage.timeout", c.Storage.Timeout)
+	positive("auth.access_token_ttl", c.Auth.AccessTokenTTL)
+	check(c.Auth.RefreshTokenTTL > c.Auth.AccessTokenTTL, "auth.refresh_token_ttl must exceed auth.access_token_ttl, got %s", c.Auth.RefreshTokenTTL)
+	check(c.Auth.Argon2Threads >= 1 && c.Auth.Argon2Threads <= 255, "auth.argon2_threads must be between 1 and 255, got %d", c.Auth.Argon2Threads)
+	check(c.Auth.Argon2Time >= 1, "auth.argon2_time must be positive, got %d", c.Auth.Argon2Time)
+	check(c.Auth.Argon2Memory >= 8*c.Auth.Argon2Threads && c.Auth.Argon2Memory <= 4<<20,
+		"auth.argon2_memory must be between 8 KiB per thread and 4 GiB, got %d", c.Auth.Argon2Memory)
+	check(c.Auth.LoginMinLength >= 1, "auth.login_min_length must be positive, got %d", c.Auth.LoginMinLength)
+	check(c.Auth.LoginMaxLength >= c.Auth.LoginMinLength, "auth.login_max_length must not be less than auth.login_min_length, got %d", c.Auth.LoginMaxLength)
+	if _, err := regexp.Compile(c.Auth.LoginPattern); err != nil {
+		errs = append(errs, fmt.Errorf("auth.login_pattern: %w", err))
+	}
+	check(c.Auth.PasswordMinLength >= 1, "auth.password_min_length must be positive, got %d", c.Auth.PasswordMinLength)
+	check(c.Auth.PasswordMaxLength >= c.Auth.PasswordMinLength, "auth.password_max_length must not be less than auth.password_min_length, got %d", c.Auth.PasswordMaxLength)
+	check(c.Accrual.RateLimit > 0, "accrual.rate_limit must be positive, got %g", c.Accrual.RateLimit)
+	positive("accrual.request_timeout", c.Accrual.RequestTimeout)
+	positive("accrual.dial_timeout", c.Accrual.DialTimeout)
+	positive("accrual.tls_handshake_timeout", c.Accrual.TLSHandshakeTimeout)
+	check(c.Accrual.BreakerThreshold >= 0, "accrual.breaker_threshold must not be negative, got %d", c.Accrual.BreakerThreshold)
+	check(c.Accrual.BreakerThreshold == 0 || c.Accrual.BreakerCooldown > 0, "accrual.breaker_cooldown must be positive, got %s", c.Accrual.BreakerCooldown)
+	check(c.Updater.Workers > 0, "updater.workers must be positive, got %d", c.Updater.Workers)
+	check(c.Updater.BatchSize > 0, "updater.batch_size must be positive, got %d", c.Updater.BatchSize)
+	positive("updater.interval", c.Updater.Interval)
+	positive("updater.retry_base_delay", c.Updater.RetryBaseDelay)
+	check(c.Updater.RetryMaxDelay >= c.Updater.RetryBaseDelay, "updater.retry_max_delay must not be less than updater.retry_base_delay, got %s", c.Updater.RetryMaxDelay)
+	check(c.Updater.MaxAttempts >= 0, "updater.max_attempts must not be negative, got %d", c.Updater.MaxAttempts)
+	check(c.Updater.MaxAge >= 0, "updater.max_age must not be negative, got %s", c.Updater.MaxAge)
+	positive("balance.cache_ttl", c.Balance.CacheTTL)
+	for name, p := range map[string]ThrottlePolicy{
+		"throttle.login":    c.Throttle.Login,
+		"throttle.ip":       c.Throttle.IP,
+		"throttle.reset":    c.Throttle.Reset,
+		"throttle.reset_ip": c.Throttle.ResetIP,
+	} {
+		check(p.FreeAttempts >= 0, "%s.free_attempts must not be negative, got %d", name, p.FreeAttempts)
+		positive(name+".base_delay", p.BaseDelay)
+		check(p.MaxDelay >= p.BaseDelay, "%s.max_delay must not be less than %[1]s.base_delay, got %s", name, p.MaxDelay)
+		check(p.LockoutAfter >= 0, "%s.lockout_after must not be negative, got %d", name, p.LockoutAfter)
+		check(p.LockoutAfter == 0 || p.LockoutFor > 0, "%s.lockout_for must be positive, got %s", name, p.LockoutFor)
+		positive(name+".window", p.Window)
+	}
+	positive("throttle.prune_interval", c.Throttle.PruneInterval)
+	check(c.Webhooks.Workers > 0, "webhooks.workers must be positive, got %d", c.Webhooks.Workers)
+	check(c.Webhooks.BatchSize > 0, "webhooks.batch_size must be positive, got %d", c.Webhooks.BatchSize)
+	positive("webhooks.interval", c.Webhooks.Interval)
+	positive("webhooks.retention", c.Webhooks.Retention)
+	positive("webhooks.timeout", c.Webhooks.Timeout)
+	return errors.Join(errs...)
+}
+
+// RestartRequired reports whether next differs from c in fields that are
+// not reloadable.
+func (c Config) RestartRequired(next Config) bool {
+	return !reflect.DeepEqual(c.static(), next.static())
+}
+
+// static returns c without the reloadable fields.
+func (c Config) static() Config {
+	c.HTTP.GzipLevel = 0
+	c.Accrual.RateLimit = 0
+	c.Updater = Updater{}
+	c.Balance = Balance{}
+	c.Storage.Timeout = 0
+	c.Auth.LoginMinLength, c.Auth.LoginMaxLength, c.Auth.LoginPattern = 0, 0, ""
+	c.Auth.PasswordMinLength, c.Auth.PasswordMaxLength = 0, 0
+	c.Throttle.Login, c.Throttle.IP = ThrottlePolicy{}, ThrottlePolicy{}
+	c.Throttle.Reset, c.Throttle.ResetIP = ThrottlePolicy{}, ThrottlePolicy{}
+	return c
+}
+
+const redacted = "REDACTED"
+
+// dsnPassword matches the password of a key/value connection string.
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('(\\.|[^'])*'|\S+)`)
+
+// Redacted returns c with secrets replaced, suitable for printing.
+func (c Config) Redacted() Config {
+	if c.JWTSecret != "" {
+		c.JWTSecret = redacted
+	}
+	if c.PasswordPepper != "" {
+		c.PasswordPepper = redacted
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	if u, err := url.Parse(c.DatabaseURI); err == nil && u.Scheme != "" {
+		changed := false
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			changed = true
+		}
+		if q := u.Query(); q.Has("password") {
+			q.Set("password", redacted)
+			u.RawQuery = q.Encode()
+			changed = true
+		}
+		if changed {
+			c.DatabaseURI = u.String()
+		}
+	} else {
+		c.DatabaseURI = dsnPassword.ReplaceAllString(c.DatabaseURI, "${1}"+redacted)
+	}
+	return c
+}
+
+// Print writes c as YAML with secrets redacted. The output is a valid
+// config file apart from the secrets.
+func (c Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoad_FlagsOverrideEnv(t *testing.T) {
@@ -50,6 +53,8 @@ func TestLoad_DefaultJWTSecret(t *testing.T) {
 	t.Setenv("DATABASE_URI", "db")
 	t.Setenv("ACCRUAL_SYSTEM_ADDRESS", "acc")
 	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_KEYS", "")
+	t.Setenv("DEV_MODE", "true")
 	os.Args = []string{"cmd"}
 
 	cfg, err := Load()
@@ -61,3 +66,186 @@ func TestLoad_DefaultJWTSecret(t *testing.T) {
 		t.Errorf("expected default secret, got %s", cfg.JWTSecret)
 	}
 }
+
+func TestLoad_DefaultJWTSecretRequiresDevMode(t *testing.T) {
+	t.Setenv("DATABASE_URI", "db")
+	t.Setenv("ACCRUAL_SYSTEM_ADDRESS", "acc")
+	t.Setenv("JWT_KEYS", "")
+	t.Setenv("DEV_MODE", "")
+
+	for _, secret := range []string{"", "secret"} {
+		t.Setenv("JWT_SECRET", secret)
+		os.Args = []string{"cmd"}
+		if _, err := Load(); err == nil {
+			t.Fatalf("secret %q: expected error outside dev mode", secret)
+		}
+	}
+}
+
+func TestLoad_JWTKeys(t *testing.T) {
+	t.Setenv("DATABASE_URI", "db")
+	t.Setenv("ACCRUAL_SYSTEM_ADDRESS", "acc")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_KEYS", "new.pem, old.pem")
+	t.Setenv("DEV_MODE", "")
+	os.Args = []string{"cmd"}
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.JWTKeys) != 2 || cfg.JWTKeys[0] != "new.pem" || cfg.JWTKeys[1] != "old.pem" {
+		t.Errorf("unexpected keys %v", cfg.JWTKeys)
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestParse_Precedence(t *testing.T) {
+	file := writeFile(t, `
+database_uri: filedb
+accrual_address: fileacc
+jwt_secret: filejwt
+updater:
+  workers: 4
+  batch_size: 10
+  interval: 3s
+balance:
+  cache_ttl: 1m
+`)
+	t.Setenv("DATABASE_URI", "")
+	t.Setenv("ACCRUAL_SYSTEM_ADDRESS", "")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_KEYS", "")
+	t.Setenv("DEV_MODE", "")
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("UPDATER_WORKERS", "6")
+	t.Setenv("UPDATER_BATCH_SIZE", "20")
+
+	cfg, err := Parse([]string{"-updater.batch-size", "30"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.DatabaseURI != "filedb" || cfg.Balance.CacheTTL != time.Minute || cfg.Updater.Interval != 3*time.Second {
+		t.Errorf("expected values from file, got %+v", cfg)
+	}
+	if cfg.Updater.Workers != 6 {
+		t.Errorf("expected workers from env, got %d", cfg.Updater.Workers)
+	}
+	if cfg.Updater.BatchSize != 30 {
+		t.Errorf("expected batch size from flag, got %d", cfg.Updater.BatchSize)
+	}
+	if cfg.HTTP.GzipLevel != Default().HTTP.GzipLevel {
+		t.Errorf("expected default gzip level, got %d", cfg.HTTP.GzipLevel)
+	}
+}
+
+func TestParse_FileErrors(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	for name, content := range map[string]string{
+		"unknown key": "updater:\n  threads: 2\n",
+		"bad type":    "updater:\n  interval: soon\n",
+	} {
+		file := writeFile(t, content)
+		if _, err := Parse([]string{"-config", file, "-d", "db", "-r", "acc", "-s", "jwt"}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse_Validation(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("UPDATER_WORKERS", "0")
+	t.Setenv("HTTP_GZIP_LEVEL", "12")
+	t.Setenv("WEBHOOKS_TIMEOUT", "0s")
+	t.Setenv("NOTIFY_FILE", "tokens.jsonl")
+	t.Setenv("DEV_MODE", "")
+	t.Setenv("UPDATER_RETRY_MAX_DELAY", "500ms")
+	t.Setenv("ACCRUAL_DIAL_TIMEOUT", "0s")
+	t.Setenv("AUTH_LOGIN_PATTERN", "[a-z")
+	t.Setenv("THROTTLE_RESET_IP_MAX_DELAY", "10ms")
+
+	_, err := Parse([]string{"-d", "db", "-r", "acc", "-s", "jwt"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{"updater.workers must be positive", "http.gzip_level must be between -2 and 9",
+		"webhooks.timeout must be positive", "notify file is only allowed in dev mode",
+		"updater.retry_max_delay must not be less than updater.retry_base_delay", "accrual.dial_timeout must be positive",
+		"auth.login_pattern", "throttle.reset_ip.max_delay must not be less than throttle.reset_ip.base_delay, got 10ms"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+}
+
+func TestParse_InvalidEnv(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("UPDATER_INTERVAL", "soon")
+
+	_, err := Parse([]string{"-d", "db", "-r", "acc", "-s", "jwt"})
+	if err == nil || !strings.Contains(err.Error(), "UPDATER_INTERVAL") {
+		t.Fatalf("expected error naming the variable, got %v", err)
+	}
+}
+
+func TestConfig_Redacted(t *testing.T) {
+	cfg := Default()
+	cfg.JWTSecret = "jwt-secret"
+	cfg.PasswordPepper = "pepper"
+	cfg.AdminToken = "admin-token"
+	for uri, want := range map[string]string{
+		"postgres://app:hunter2@db:5432/app?sslmode=disable": "postgres://app:REDACTED@db:5432/app?sslmode=disable",
+		"host=db user=app password=hunter2 dbname=app":       "host=db user=app password=REDACTED dbname=app",
+		"memory://": "memory://",
+	} {
+		cfg.DatabaseURI = uri
+		if got := cfg.Redacted().DatabaseURI; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	var b strings.Builder
+	if err := cfg.Print(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"jwt-secret", "password_pepper: pepper", "hunter2", "admin-token"} {
+		if strings.Contains(b.String(), secret) {
+			t.Errorf("secret %q printed:\n%s", secret, b.String())
+		}
+	}
+	if !strings.Contains(b.String(), "cache_ttl: 30s") {
+		t.Errorf("expected durations printed as strings:\n%s", b.String())
+	}
+}
+
+func TestConfig_RestartRequired(t *testing.T) {
+	cfg := Default()
+	next := cfg
+	next.Updater.Workers = 8
+	next.Updater.MaxAttempts = 3
+	next.Auth.PasswordMinLength = 12
+	next.Throttle.Login.LockoutAfter = 5
+	next.HTTP.GzipLevel = 1
+	next.Balance.CacheTTL = time.Minute
+	next.Storage.Timeout = time.Second
+	if cfg.RestartRequired(next) {
+		t.Error("reloadable changes should not need a restart")
+	}
+	next.HTTP.ReadTimeout = time.Minute
+	if !cfg.RestartRequired(next) {
+		t.Error("expected read timeout change to need a restart")
+	}
+	next = cfg
+	next.Accrual.BreakerThreshold = 1
+	if !cfg.RestartRequired(next) {
+		t.Error("expected breaker change to need a restart")
+	}
+}
@@ -0,0 +1,81 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+const exactAmountsKey ctxKey = "exact_amounts"
+
+// amount is a number of points in request and response bodies. It is
+// encoded as a JSON number unless the client asked for exact amounts, which
+// are encoded as decimal strings like "500.50". Both forms are accepted on
+// input and parsed without going through float64.
+type amount struct {
+	value decimal.Decimal
+	exact bool
+}
+
+func newAmount(r *http.Request, d decimal.Decimal) amount {
+	return amount{value: d, exact: exactAmounts(r)}
+}
+
+func (a amount) MarshalJSON() ([]byte, error) {
+	if a.exact {
+		return json.Marshal(a.value.StringFixed(2))
+	}
+	return json.Marshal(a.value.InexactFloat64())
+}
+
+func (a *amount) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return fmt.Errorf("invalid amount %q", s)
+	}
+	a.value = d
+	return nil
+}
+
+// ExactAmounts makes handlers encode amounts as decimal strings regardless
+// of the Accept header. It is used for the /api/v2 routes.
+func ExactAmounts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exactAmountsKey, true)))
+	})
+}
+
+// exactAmounts reports whether amounts are encoded as strings for the request,
+// either because of ExactAmounts or an Accept header like
+// "application/json; amounts=string".
+func exactAmounts(r *http.Request) bool {
+	if v, _ := r.Context().Value(exactAmountsKey).(bool); v {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(accept)
+		if err == nil && (mt == "application/json" || mt == "*/*") && params["amounts"] == "string" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonContentType returns Content-Type of JSON responses carrying amounts.
+func jsonContentType(r *http.Request) string {
+	if exactAmounts(r) {
+		return "application/json; amounts=string"
+	}
+	return "application/json"
+}
@@ -0,0 +1,96 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+func TestBalance_ExactAmounts(t *testing.T) {
+	svc := &stubBalanceSvc{getFunc: func(ctx context.Context, userID int64) (domain.Balance, error) {
+		return domain.Balance{
+			Current:   decimal.RequireFromString("9999999999.99"),
+			Withdrawn: decimal.RequireFromString("0.1"),
+		}, nil
+	}}
+
+	cases := []struct {
+		name   string
+		accept string
+		v2     bool
+		body   string
+		ct     string
+	}{
+		{"default", "", false, `{"current":9999999999.99,"withdrawn":0.1}`, "application/json"},
+		{"accept", "text/html, application/json; amounts=string", false, `{"current":"9999999999.99","withdrawn":"0.10"}`, "application/json; amounts=string"},
+		{"v2", "application/json", true, `{"current":"9999999999.99","withdrawn":"0.10"}`, "application/json; amounts=string"},
+	}
+	for _, c := range cases {
+		var h http.Handler = Balance(svc)
+		if c.v2 {
+			h = ExactAmounts(h)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if got := string(bytes.TrimSpace(w.Body.Bytes())); got != c.body {
+			t.Fatalf("%s: unexpected body %s", c.name, got)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != c.ct {
+			t.Fatalf("%s: unexpected content type %q", c.name, ct)
+		}
+	}
+}
+
+func TestWithdraw_ExactSum(t *testing.T) {
+	var got decimal.Decimal
+	svc := &stubWithdrawSvc{withdrawFunc: func(ctx context.Context, userID int64, number string, amount decimal.Decimal) error {
+		got = amount
+		if amount.IsNegative() {
+			return &domain.ValidationError{Fields: []domain.FieldError{{Field: "sum", Code: domain.CodeNotPositive}}}
+		}
+		return nil
+	}}
+
+	for body, want := range map[string]int{
+		`{"order":"2377225624","sum":"0.30"}`:      http.StatusOK,
+		`{"order":"2377225624","sum":0.30}`:        http.StatusOK,
+		`{"order":"2377225624","sum":"-1"}`:        http.StatusBadRequest,
+		`{"order":"2377225624","sum":"ten"}`:       http.StatusBadRequest,
+		`{"order":"2377225624","sum":{"v":"0.3"}}`: http.StatusBadRequest,
+	} {
+		got = decimal.Zero
+		req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+		w := httptest.NewRecorder()
+		Withdraw(svc).ServeHTTP(w, req)
+
+		if w.Code != want {
+			t.Fatalf("%s: expected %d, got %d", body, want, w.Code)
+		}
+		if want == http.StatusOK && got.String() != "0.3" {
+			t.Fatalf("%s: amount must be exact, got %s", body, got)
+		}
+	}
+}
+
+func TestAmount_UnmarshalRejectsGarbage(t *testing.T) {
+	var a amount
+	if err := a.UnmarshalJSON([]byte(`null`)); err == nil {
+		t.Fatal("expected error for null")
+	}
+	if err := a.UnmarshalJSON([]byte(`"1e400x"`)); err == nil {
+		t.Fatal("expected error for malformed string")
+	}
+}
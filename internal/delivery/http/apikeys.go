@@ -0,0 +1,161 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+// APIKeyService defines methods required to manage API keys.
+type APIKeyService interface {
+	Create(ctx context.Context, userID int64, name string, scopes []string) (domain.APIKey, string, error)
+	List(ctx context.Context, userID int64) ([]domain.APIKey, error)
+	Revoke(ctx context.Context, userID, id int64) error
+}
+
+// NewAPIKeyRouter creates chi router with API key management endpoints.
+func NewAPIKeyRouter(svc APIKeyService) http.Handler {
+	r := chi.NewRouter()
+	r.Post("/api/user/api-keys", CreateAPIKey(svc))
+	r.Get("/api/user/api-keys", ListAPIKeys(svc))
+	r.Delete("/api/user/api-keys/{id}", RevokeAPIKey(svc))
+	return r
+}
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type apiKeyDTO struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	// Key is only returned on creation.
+	Key string `json:"key,omitempty"`
+}
+
+func newAPIKeyDTO(k domain.APIKey) apiKeyDTO {
+	dto := apiKeyDTO{
+		ID:        k.ID,
+		Name:      k.Name,
+		Prefix:    k.Prefix,
+		Scopes:    make([]string, len(k.Scopes)),
+		CreatedAt: k.CreatedAt.Format(time.RFC3339),
+	}
+	for i, s := range k.Scopes {
+		dto.Scopes[i] = string(s)
+	}
+	if k.LastUsedAt != nil {
+		dto.LastUsedAt = k.LastUsedAt.Format(time.RFC3339)
+	}
+	return dto
+}
+
+// CreateAPIKey returns handler for POST /api/user/api-keys.
+// @Summary Create API key
+// @Description The key is returned only once. Scopes: orders:read, orders:write, balance:read, withdraw.
+// @Param request body apiKeyRequest true "Key name and scopes"
+// @Success 201 {object} apiKeyDTO
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/api-keys [post]
+func CreateAPIKey(svc APIKeyService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromCtx(r.Context())
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		var req apiKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		k, key, err := svc.Create(r.Context(), userID, strings.TrimSpace(req.Name), req.Scopes)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		resp := newAPIKeyDTO(k)
+		resp.Key = key
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// ListAPIKeys returns handler for GET /api/user/api-keys.
+// @Summary List API keys
+// @Success 200 {array} apiKeyDTO
+// @Success 204 {string} string "No Content"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/api-keys [get]
+func ListAPIKeys(svc APIKeyService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromCtx(r.Context())
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		list, err := svc.List(r.Context(), userID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if len(list) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resp := make([]apiKeyDTO, len(list))
+		for i, k := range list {
+			resp[i] = newAPIKeyDTO(k)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// RevokeAPIKey returns handler for DELETE /api/user/api-keys/{id}.
+// @Summary Revoke API key
+// @Param id path int true "Key id"
+// @Success 204 {string} string "No Content"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 404 {object} Problem "Not Found"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/api-keys/{id} [delete]
+func RevokeAPIKey(svc APIKeyService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromCtx(r.Context())
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		if err := svc.Revoke(r.Context(), userID, id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,92 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type stubAPIKeys struct {
+	createFunc func(ctx context.Context, userID int64, name string, scopes []string) (domain.APIKey, string, error)
+	listFunc   func(ctx context.Context, userID int64) ([]domain.APIKey, error)
+	revokeFunc func(ctx context.Context, userID, id int64) error
+}
+
+func (s *stubAPIKeys) Create(ctx context.Context, userID int64, name string, scopes []string) (domain.APIKey, string, error) {
+	return s.createFunc(ctx, userID, name, scopes)
+}
+
+func (s *stubAPIKeys) List(ctx context.Context, userID int64) ([]domain.APIKey, error) {
+	return s.listFunc(ctx, userID)
+}
+
+func (s *stubAPIKeys) Revoke(ctx context.Context, userID, id int64) error {
+	return s.revokeFunc(ctx, userID, id)
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	svc := &stubAPIKeys{createFunc: func(ctx context.Context, userID int64, name string, scopes []string) (domain.APIKey, string, error) {
+		if userID != 1 || name != "ci" || len(scopes) != 1 || scopes[0] != "orders:write" {
+			t.Fatalf("unexpected args %d %s %v", userID, name, scopes)
+		}
+		return domain.APIKey{ID: 5, UserID: 1, Name: name, Prefix: "gmk_abcdefgh", Scopes: []domain.Scope{domain.ScopeOrdersWrite}, CreatedAt: time.Now()}, "gmk_abcdefghsecret", nil
+	}}
+	router := NewAPIKeyRouter(svc)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/api-keys", bytes.NewBufferString(`{"name":"ci","scopes":["orders:write"]}`))
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	var resp apiKeyDTO
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 5 || resp.Key != "gmk_abcdefghsecret" || resp.Prefix != "gmk_abcdefgh" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestCreateAPIKey_InvalidScope(t *testing.T) {
+	svc := &stubAPIKeys{createFunc: func(ctx context.Context, userID int64, name string, scopes []string) (domain.APIKey, string, error) {
+		return domain.APIKey{}, "", domain.ErrInvalidScope
+	}}
+	router := NewAPIKeyRouter(svc)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/api-keys", bytes.NewBufferString(`{"name":"ci","scopes":["admin"]}`))
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestRevokeAPIKey_NotFound(t *testing.T) {
+	svc := &stubAPIKeys{revokeFunc: func(ctx context.Context, userID, id int64) error {
+		if userID != 1 || id != 9 {
+			t.Fatalf("unexpected args %d %d", userID, id)
+		}
+		return domain.ErrNotFound
+	}}
+	router := NewAPIKeyRouter(svc)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/user/api-keys/9", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
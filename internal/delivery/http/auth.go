@@ -4,17 +4,37 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 
 	"github.com/Hobrus/gophermarket/internal/domain"
 )
 
+// Cookies carrying the tokens. The refresh token is only sent to the refresh endpoint.
+const (
+	accessCookie  = "AuthToken"
+	refreshCookie = "RefreshToken"
+	refreshPath   = "/api/user/token"
+)
+
 // AuthService defines methods required for user authentication.
 type AuthService interface {
-	Register(ctx context.Context, login, password string) (string, error)
-	Login(ctx context.Context, login, password string) (string, error)
+	Register(ctx context.Context, login, password string) (domain.TokenPair, error)
+	Login(ctx context.Context, login, password string) (domain.TokenPair, error)
+	Refresh(ctx context.Context, refreshToken string) (domain.TokenPair, error)
+	Logout(ctx context.Context, sessionID string) error
+	LogoutAll(ctx context.Context, userID int64) error
+}
+
+// LoginThrottler defines methods required to limit failed logins.
+// Attempt counts the attempt as failed until Success is called.
+type LoginThrottler interface {
+	Attempt(ctx context.Context, login, ip string) error
+	Success(ctx context.Context, login, ip string) error
 }
 
 type credentials struct {
@@ -26,76 +46,204 @@ type credentials struct {
 func NewRouter(auth AuthService) http.Handler {
 	r := chi.NewRouter()
 	r.Post("/api/user/register", Register(auth))
-	r.Post("/api/user/login", Login(auth))
+	r.Post("/api/user/login", Login(auth, nil))
+	r.Post("/api/user/token/refresh", Refresh(auth))
 	return r
 }
 
 // register handles user registration
+// Invalid login or password are reported as a JSON list of failing fields.
 // @Summary Register new user
 // @Param credentials body credentials true "User credentials"
 // @Success 200 {string} string "OK"
-// @Success 400 {string} string "Bad Request"
-// @Success 409 {string} string "Conflict"
-// @Success 500 {string} string "Internal Server Error"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 409 {object} Problem "Conflict"
+// @Success 413 {object} Problem "Request Entity Too Large"
+// @Success 500 {object} Problem "Internal Server Error"
 // @Router /api/user/register [post]
 func Register(auth AuthService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var creds credentials
-		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		if !decodeAuthBody(w, r, &creds) {
 			return
 		}
-		token, err := auth.Register(r.Context(), creds.Login, creds.Password)
+		tokens, err := auth.Register(r.Context(), creds.Login, creds.Password)
 		if err != nil {
-			switch {
-			case errors.Is(err, domain.ErrConflictSelf):
-				w.WriteHeader(http.StatusConflict)
-			default:
-				w.WriteHeader(http.StatusInternalServerError)
+			if errors.Is(err, domain.ErrConflictSelf) {
+				writeProblem(w, r, http.StatusConflict, codeLoginTaken)
+				return
 			}
+			writeError(w, r, err)
 			return
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     "AuthToken",
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-		})
+		setTokenCookies(w, tokens)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
 // login handles user login
+// Failed attempts slow down further attempts for the login and the client
+// address and eventually lock them out for a while.
 // @Summary Login user
 // @Param credentials body credentials true "User credentials"
 // @Success 200 {string} string "OK"
-// @Success 400 {string} string "Bad Request"
-// @Success 401 {string} string "Unauthorized"
-// @Success 500 {string} string "Internal Server Error"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 413 {object} Problem "Request Entity Too Large"
+// @Success 429 {object} Problem "Too Many Requests"
+// @Success 500 {object} Problem "Internal Server Error"
 // @Router /api/user/login [post]
-func Login(auth AuthService) http.HandlerFunc {
+func Login(auth AuthService, throttle LoginThrottler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var creds credentials
-		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		if !decodeAuthBody(w, r, &creds) {
 			return
 		}
-		token, err := auth.Login(r.Context(), creds.Login, creds.Password)
+		ip := clientIP(r)
+		if throttle != nil {
+			if err := throttle.Attempt(r.Context(), creds.Login, ip); err != nil {
+				writeThrottled(w, r, err)
+				return
+			}
+		}
+		tokens, err := auth.Login(r.Context(), creds.Login, creds.Password)
 		if err != nil {
-			switch {
-			case errors.Is(err, domain.ErrNotFound), err.Error() == "invalid credentials":
-				w.WriteHeader(http.StatusUnauthorized)
-			default:
-				w.WriteHeader(http.StatusInternalServerError)
+			if errors.Is(err, domain.ErrNotFound) || errors.Is(err, domain.ErrInvalidCredentials) {
+				// unknown logins look the same as wrong passwords
+				writeProblem(w, r, http.StatusUnauthorized, codeInvalidCredentials)
+				return
 			}
+			writeError(w, r, err)
 			return
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     "AuthToken",
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-		})
+		if throttle != nil {
+			_ = throttle.Success(r.Context(), creds.Login, ip)
+		}
+		setTokenCookies(w, tokens)
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// writeThrottled writes err, telling throttled clients when to retry.
+func writeThrottled(w http.ResponseWriter, r *http.Request, err error) {
+	var te *domain.ThrottledError
+	if errors.As(err, &te) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(te.RetryAfter.Seconds()))))
+	}
+	writeError(w, r, err)
+}
+
+// clientIP returns address of the connected client. Forwarding headers are
+// ignored: they are set by the client and would let it dodge throttling.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh exchanges a refresh token for a new token pair
+// @Summary Refresh tokens
+// @Description The refresh token is read from the RefreshToken cookie or the request body.
+// @Description Reusing a refresh token revokes all tokens issued from the same login.
+// @Param request body refreshRequest false "Refresh token"
+// @Success 200 {string} string "OK"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/token/refresh [post]
+func Refresh(auth AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req refreshRequest
+		if c, err := r.Cookie(refreshCookie); err == nil {
+			req.RefreshToken = c.Value
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		tokens, err := auth.Refresh(r.Context(), req.RefreshToken)
+		if err != nil {
+			if errors.Is(err, domain.ErrSessionInvalid) || errors.Is(err, domain.ErrRefreshTokenReused) {
+				clearTokenCookies(w)
+			}
+			writeError(w, r, err)
+			return
+		}
+		setTokenCookies(w, tokens)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Logout revokes the current session. API keys have no session, so the
+// route must be behind RequireSession.
+// @Summary Logout
+// @Success 200 {string} string "OK"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/logout [post]
+func Logout(auth AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sid, ok := SessionIDFromCtx(r.Context())
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		if err := auth.Logout(r.Context(), sid); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		clearTokenCookies(w)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// LogoutAll revokes all sessions of the user. Like Logout, it is only
+// available to login sessions.
+// @Summary Logout from all devices
+// @Success 200 {string} string "OK"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/logout-all [post]
+func LogoutAll(auth AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromCtx(r.Context())
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		if err := auth.LogoutAll(r.Context(), userID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		clearTokenCookies(w)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func setTokenCookies(w http.ResponseWriter, tokens domain.TokenPair) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookie,
+		Value:    tokens.AccessToken,
+		Path:     "/",
+		HttpOnly: true,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    tokens.RefreshToken,
+		Path:     refreshPath,
+		Expires:  tokens.RefreshExpiresAt,
+		HttpOnly: true,
+	})
+}
+
+func clearTokenCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: accessCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Path: refreshPath, MaxAge: -1, HttpOnly: true})
+}
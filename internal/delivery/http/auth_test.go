@@ -3,33 +3,53 @@ package http
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 
 	"github.com/Hobrus/gophermarket/internal/domain"
 )
 
 type stubAuth struct {
-	registerFunc func(ctx context.Context, login, password string) (string, error)
-	loginFunc    func(ctx context.Context, login, password string) (string, error)
+	registerFunc  func(ctx context.Context, login, password string) (domain.TokenPair, error)
+	loginFunc     func(ctx context.Context, login, password string) (domain.TokenPair, error)
+	refreshFunc   func(ctx context.Context, token string) (domain.TokenPair, error)
+	logoutFunc    func(ctx context.Context, sessionID string) error
+	logoutAllFunc func(ctx context.Context, userID int64) error
 }
 
-func (s *stubAuth) Register(ctx context.Context, login, password string) (string, error) {
+func (s *stubAuth) Register(ctx context.Context, login, password string) (domain.TokenPair, error) {
 	return s.registerFunc(ctx, login, password)
 }
 
-func (s *stubAuth) Login(ctx context.Context, login, password string) (string, error) {
+func (s *stubAuth) Login(ctx context.Context, login, password string) (domain.TokenPair, error) {
 	return s.loginFunc(ctx, login, password)
 }
 
+func (s *stubAuth) Refresh(ctx context.Context, token string) (domain.TokenPair, error) {
+	return s.refreshFunc(ctx, token)
+}
+
+func (s *stubAuth) Logout(ctx context.Context, sessionID string) error {
+	return s.logoutFunc(ctx, sessionID)
+}
+
+func (s *stubAuth) LogoutAll(ctx context.Context, userID int64) error {
+	return s.logoutAllFunc(ctx, userID)
+}
+
 func TestRegister_Success(t *testing.T) {
-	auth := &stubAuth{registerFunc: func(ctx context.Context, login, password string) (string, error) {
+	auth := &stubAuth{registerFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
 		if login != "user" || password != "pass" {
 			t.Fatalf("unexpected args %s %s", login, password)
 		}
-		return "token", nil
+		return domain.TokenPair{AccessToken: "token", RefreshToken: "refresh"}, nil
 	}}
 	router := NewRouter(auth)
 
@@ -58,8 +78,8 @@ func TestRegister_Success(t *testing.T) {
 }
 
 func TestRegister_Conflict(t *testing.T) {
-	auth := &stubAuth{registerFunc: func(ctx context.Context, login, password string) (string, error) {
-		return "", domain.ErrConflictSelf
+	auth := &stubAuth{registerFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
+		return domain.TokenPair{}, domain.ErrConflictSelf
 	}}
 	router := NewRouter(auth)
 
@@ -75,8 +95,8 @@ func TestRegister_Conflict(t *testing.T) {
 }
 
 func TestRegister_BadRequest(t *testing.T) {
-	auth := &stubAuth{registerFunc: func(ctx context.Context, login, password string) (string, error) {
-		return "", errors.New("should not be called")
+	auth := &stubAuth{registerFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
+		return domain.TokenPair{}, errors.New("should not be called")
 	}}
 	router := NewRouter(auth)
 
@@ -91,9 +111,55 @@ func TestRegister_BadRequest(t *testing.T) {
 	}
 }
 
+func TestRegister_ValidationError(t *testing.T) {
+	auth := &stubAuth{registerFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
+		verr := &domain.ValidationError{}
+		verr.Add("login", domain.CodeTooShort, "login must be at least 3 characters")
+		verr.Add("password", domain.CodeBreached, "password appears in a list of breached passwords")
+		return domain.TokenPair{}, verr
+	}}
+	router := NewRouter(auth)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login":"a","password":"password"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	var body Problem
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "validation_failed" || len(body.Errors) != 2 || body.Errors[0].Field != "login" || body.Errors[1].Code != domain.CodeBreached {
+		t.Fatalf("unexpected errors %+v", body.Errors)
+	}
+}
+
+func TestRegister_TooLarge(t *testing.T) {
+	auth := &stubAuth{registerFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
+		return domain.TokenPair{}, errors.New("should not be called")
+	}}
+	router := NewRouter(auth)
+
+	body := `{"login":"user","password":"` + strings.Repeat("x", 10<<20) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/user/register", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", w.Code)
+	}
+}
+
 func TestLogin_Unauthorized(t *testing.T) {
-	auth := &stubAuth{loginFunc: func(ctx context.Context, login, password string) (string, error) {
-		return "", errors.New("invalid credentials")
+	auth := &stubAuth{loginFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
+		return domain.TokenPair{}, domain.ErrInvalidCredentials
 	}}
 	router := NewRouter(auth)
 
@@ -109,11 +175,11 @@ func TestLogin_Unauthorized(t *testing.T) {
 }
 
 func TestLogin_Success(t *testing.T) {
-	auth := &stubAuth{loginFunc: func(ctx context.Context, login, password string) (string, error) {
+	auth := &stubAuth{loginFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
 		if login != "user" || password != "pass" {
 			t.Fatalf("unexpected args %s %s", login, password)
 		}
-		return "tok", nil
+		return domain.TokenPair{AccessToken: "tok", RefreshToken: "refresh"}, nil
 	}}
 	router := NewRouter(auth)
 
@@ -140,3 +206,194 @@ func TestLogin_Success(t *testing.T) {
 		t.Fatal("cookie properties incorrect")
 	}
 }
+
+func TestRefresh_FromCookie(t *testing.T) {
+	auth := &stubAuth{refreshFunc: func(ctx context.Context, token string) (domain.TokenPair, error) {
+		if token != "old" {
+			t.Fatalf("unexpected token %s", token)
+		}
+		return domain.TokenPair{AccessToken: "access", RefreshToken: "new"}, nil
+	}}
+	router := NewRouter(auth)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/token/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: "RefreshToken", Value: "old"})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	got := map[string]*http.Cookie{}
+	for _, ck := range res.Cookies() {
+		got[ck.Name] = ck
+	}
+	if c := got["AuthToken"]; c == nil || c.Value != "access" {
+		t.Fatal("access cookie incorrect")
+	}
+	if c := got["RefreshToken"]; c == nil || c.Value != "new" || c.Path != "/api/user/token" || !c.HttpOnly {
+		t.Fatal("refresh cookie incorrect")
+	}
+}
+
+func TestRefresh_Reused(t *testing.T) {
+	auth := &stubAuth{refreshFunc: func(ctx context.Context, token string) (domain.TokenPair, error) {
+		if token != "old" {
+			t.Fatalf("unexpected token %s", token)
+		}
+		return domain.TokenPair{}, domain.ErrRefreshTokenReused
+	}}
+	router := NewRouter(auth)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/token/refresh", bytes.NewBufferString(`{"refresh_token":"old"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", res.StatusCode)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	var revoked string
+	auth := &stubAuth{logoutFunc: func(ctx context.Context, sessionID string) error {
+		revoked = sessionID
+		return nil
+	}}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/logout", nil)
+	req = req.WithContext(context.WithValue(req.Context(), sessionIDKey, "s1"))
+	w := httptest.NewRecorder()
+	Logout(auth).ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if revoked != "s1" {
+		t.Fatalf("expected session s1 revoked, got %q", revoked)
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	var revoked int64
+	auth := &stubAuth{logoutAllFunc: func(ctx context.Context, userID int64) error {
+		revoked = userID
+		return nil
+	}}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/logout-all", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(3)))
+	w := httptest.NewRecorder()
+	LogoutAll(auth).ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if revoked != 3 {
+		t.Fatalf("expected user 3 sessions revoked, got %d", revoked)
+	}
+}
+
+func TestLogout_APIKey(t *testing.T) {
+	auth := &stubAuth{
+		logoutFunc: func(ctx context.Context, sessionID string) error {
+			t.Fatal("logout must not be called for an API key")
+			return nil
+		},
+		logoutAllFunc: func(ctx context.Context, userID int64) error {
+			t.Fatal("logout must not be called for an API key")
+			return nil
+		},
+	}
+	// same wiring as in cmd/gophermart
+	r := chi.NewRouter()
+	r.Use(JWT(testKeys, WithAPIKeys(stubKeyAuth{})))
+	r.Group(func(r chi.Router) {
+		r.Use(RequireSession)
+		r.Post("/api/user/logout", Logout(auth))
+		r.Post("/api/user/logout-all", LogoutAll(auth))
+	})
+
+	for _, path := range []string{"/api/user/logout", "/api/user/logout-all"} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer gmk_valid")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected 403, got %d", path, w.Code)
+		}
+	}
+}
+
+type stubThrottle struct {
+	attemptErr error
+	attempts   []string
+	successes  []string
+}
+
+func (s *stubThrottle) Attempt(ctx context.Context, login, ip string) error {
+	s.attempts = append(s.attempts, login+"@"+ip)
+	return s.attemptErr
+}
+
+func (s *stubThrottle) Success(ctx context.Context, login, ip string) error {
+	s.successes = append(s.successes, login+"@"+ip)
+	return nil
+}
+
+func TestLogin_Throttled(t *testing.T) {
+	auth := &stubAuth{loginFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
+		t.Fatal("password must not be checked while throttled")
+		return domain.TokenPair{}, nil
+	}}
+	throttle := &stubThrottle{attemptErr: &domain.ThrottledError{RetryAfter: 1500 * time.Millisecond}}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewBufferString(`{"login":"u","password":"p"}`))
+	w := httptest.NewRecorder()
+	Login(auth, throttle).ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", got)
+	}
+}
+
+func TestLogin_RecordsFailure(t *testing.T) {
+	auth := &stubAuth{loginFunc: func(ctx context.Context, login, password string) (domain.TokenPair, error) {
+		if password == "good" {
+			return domain.TokenPair{AccessToken: "tok"}, nil
+		}
+		return domain.TokenPair{}, domain.ErrInvalidCredentials
+	}}
+	throttle := &stubThrottle{}
+	h := Login(auth, throttle)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewBufferString(`{"login":"u","password":"bad"}`))
+	req.RemoteAddr = "10.0.0.1:5555"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+	if len(throttle.attempts) != 1 || throttle.attempts[0] != "u@10.0.0.1" || len(throttle.successes) != 0 {
+		t.Fatalf("unexpected attempts %v %v", throttle.attempts, throttle.successes)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewBufferString(`{"login":"u","password":"good"}`))
+	req.RemoteAddr = "10.0.0.1:5555"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || len(throttle.successes) != 1 || throttle.successes[0] != "u@10.0.0.1" {
+		t.Fatalf("expected success to reset counters: %d %v", w.Code, throttle.successes)
+	}
+}
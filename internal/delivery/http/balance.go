@@ -9,8 +9,8 @@ import (
 )
 
 type respDTO struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   amount `json:"current" swaggertype:"number"`
+	Withdrawn amount `json:"withdrawn" swaggertype:"number"`
 }
 
 // BalanceService defines method required to get user balance.
@@ -21,27 +21,27 @@ type BalanceService interface {
 // Balance returns handler for GET /api/user/balance.
 // @Summary Get user balance
 // @Success 200 {object} respDTO
-// @Success 401 {string} string "Unauthorized"
-// @Success 500 {string} string "Internal Server Error"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 500 {object} Problem "Internal Server Error"
 // @Router /api/user/balance [get]
 func Balance(svc BalanceService) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		uid, ok := UserIDFromCtx(r.Context())
 		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
 			return
 		}
 		bal, err := svc.GetBalance(r.Context(), uid)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		resp := respDTO{
-			Current:   bal.Current.InexactFloat64(),
-			Withdrawn: bal.Withdrawn.InexactFloat64(),
+			Current:   newAmount(r, bal.Current),
+			Withdrawn: newAmount(r, bal.Withdrawn),
 		}
-		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Type", jsonContentType(r))
 		json.NewEncoder(w).Encode(resp)
 	}
 }
@@ -0,0 +1,27 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// maxAuthBody limits bodies of authentication requests. They are tiny, and
+// a huge password would only make the server spend time hashing it.
+const maxAuthBody = 4 << 10
+
+// decodeAuthBody decodes a JSON body of at most maxAuthBody bytes into v.
+// On failure it writes a 413 or 400 problem and returns false.
+func decodeAuthBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAuthBody)).Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, codeRequestTooLarge)
+	} else {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+	}
+	return false
+}
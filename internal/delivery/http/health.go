@@ -2,6 +2,7 @@ package http
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"time"
 
@@ -13,11 +14,20 @@ type DBPinger interface {
 	Ping(ctx context.Context) error
 }
 
+// BreakerStateFunc returns state of the circuit breaker guarding the accrual system.
+type BreakerStateFunc func() string
+
+type readyDTO struct {
+	Database       string `json:"database"`
+	AccrualCircuit string `json:"accrual_circuit,omitempty"`
+}
+
 // NewHealthRouter creates chi router with health check endpoints.
-func NewHealthRouter(db DBPinger) http.Handler {
+// The accrual breaker state is optional and may be nil.
+func NewHealthRouter(db DBPinger, accrual BreakerStateFunc) http.Handler {
 	r := chi.NewRouter()
 	r.Get("/live", live())
-	r.Get("/ready", ready(db))
+	r.Get("/ready", ready(db, accrual))
 	return r
 }
 
@@ -31,19 +41,29 @@ func live() http.HandlerFunc {
 	}
 }
 
-// ready checks database connectivity.
+// ready checks database connectivity and reports accrual circuit breaker state.
+// An open breaker does not fail the check: the API keeps serving requests
+// while the accrual system is unavailable.
 // @Summary Readiness check
-// @Success 200 {string} string "OK"
-// @Failure 500 {string} string "Internal Server Error"
+// @Success 200 {object} readyDTO
+// @Failure 500 {object} readyDTO
 // @Router /health/ready [get]
-func ready(db DBPinger) http.HandlerFunc {
+func ready(db DBPinger, accrual BreakerStateFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
 		defer cancel()
+
+		resp := readyDTO{Database: "ok"}
+		status := http.StatusOK
 		if err := db.Ping(ctx); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			resp.Database = "unavailable"
+			status = http.StatusInternalServerError
 		}
-		w.WriteHeader(http.StatusOK)
+		if accrual != nil {
+			resp.AccrualCircuit = accrual()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
 	}
 }
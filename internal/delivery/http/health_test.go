@@ -0,0 +1,48 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type stubPinger struct{ err error }
+
+func (s stubPinger) Ping(ctx context.Context) error { return s.err }
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		pingErr error
+		status  int
+		body    readyDTO
+	}{
+		{name: "ok", status: http.StatusOK, body: readyDTO{Database: "ok", AccrualCircuit: "open"}},
+		{name: "db down", pingErr: errors.New("down"), status: http.StatusInternalServerError, body: readyDTO{Database: "unavailable", AccrualCircuit: "open"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewHealthRouter(stubPinger{err: tt.pingErr}, func() string { return "open" })
+
+			req := httptest.NewRequest(http.MethodGet, "/ready", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.status {
+				t.Fatalf("expected %d, got %d", tt.status, res.StatusCode)
+			}
+			var body readyDTO
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body != tt.body {
+				t.Fatalf("unexpected body %+v", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Hobrus/gophermarket/pkg/jwtkeys"
+)
+
+// JWKSProvider returns public keys verifying issued tokens.
+type JWKSProvider interface {
+	JWKS() jwtkeys.JWKSet
+}
+
+// JWKS returns handler for GET /.well-known/jwks.json.
+// Shared HS256 secrets are never published, so with HS256 keys only the set is empty.
+// @Summary Public keys verifying access tokens
+// @Success 200 {object} jwtkeys.JWKSet
+// @Router /.well-known/jwks.json [get]
+func JWKS(keys JWKSProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// keep it short: verifiers must pick up a rotated key soon
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(keys.JWKS())
+	}
+}
@@ -0,0 +1,36 @@
+package http
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Hobrus/gophermarket/pkg/jwtkeys"
+)
+
+func TestJWKS(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key := jwtkeys.NewEd25519(priv, nil)
+	keys, err := jwtkeys.NewKeyring(key, jwtkeys.NewHMAC([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	JWKS(keys).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var set jwtkeys.JWKSet
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].Kid != key.ID || set.Keys[0].Alg != "EdDSA" {
+		t.Fatalf("expected only the public key, got %+v", set)
+	}
+}
@@ -0,0 +1,145 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+// IdempotencyHeader is the request header carrying the client generated key.
+const IdempotencyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLen = 255
+
+// maxIdempotentBody limits bodies of requests with an idempotency key, since
+// they are read into memory to be hashed.
+const maxIdempotentBody = 1 << 20
+
+// idempotencyLease is how long a request holds its key. A key left in
+// progress by a crashed replica is free again after it, so it has to be
+// longer than any request is allowed to take.
+const idempotencyLease = time.Minute
+
+// IdempotencyStore defines methods required to store replayable responses.
+type IdempotencyStore interface {
+	Reserve(ctx context.Context, userID int64, key, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error)
+	Complete(ctx context.Context, userID int64, key string, statusCode int, contentType string, body []byte) error
+	Delete(ctx context.Context, userID int64, key string) error
+}
+
+// Idempotency replays the recorded response for requests repeated with the
+// same Idempotency-Key header. Reusing a key with a different request
+// results in 422, a request still in progress with the same key in 409.
+// Server errors and panics are not recorded so the client may retry them.
+// Bodies larger than 1 MiB are rejected with 413.
+// It must be used after JWT middleware.
+func Idempotency(store IdempotencyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			userID, ok := UserIDFromCtx(r.Context())
+			if !ok {
+				writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLen {
+				writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					writeProblem(w, r, http.StatusRequestEntityTooLarge, codeRequestTooLarge)
+				} else {
+					writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+				}
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			h := sha256.New()
+			h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+			h.Write(body)
+			hash := hex.EncodeToString(h.Sum(nil))
+
+			rec, reserved, err := store.Reserve(r.Context(), userID, key, hash, idempotencyLease)
+			if err != nil {
+				if errors.Is(err, domain.ErrNotFound) {
+					// the key is being released by a concurrent request
+					writeProblem(w, r, http.StatusConflict, codeRequestInProgress)
+					return
+				}
+				writeError(w, r, err)
+				return
+			}
+			if !reserved {
+				switch {
+				case rec.RequestHash != hash:
+					writeProblem(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyReused)
+				case rec.StatusCode == 0:
+					writeProblem(w, r, http.StatusConflict, codeRequestInProgress)
+				default:
+					if rec.ContentType != "" {
+						w.Header().Set("Content-Type", rec.ContentType)
+					}
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(rec.StatusCode)
+					w.Write(rec.Body)
+				}
+				return
+			}
+
+			ctx := context.WithoutCancel(r.Context())
+			defer func() {
+				// release the key, so the retry isn't refused until the lease ends
+				if p := recover(); p != nil {
+					_ = store.Delete(ctx, userID, key)
+					panic(p)
+				}
+			}()
+			rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r)
+
+			if rw.status >= http.StatusInternalServerError {
+				_ = store.Delete(ctx, userID, key)
+				return
+			}
+			_ = store.Complete(ctx, userID, key, rw.status, w.Header().Get("Content-Type"), rw.body.Bytes())
+		})
+	}
+}
+
+// recordingWriter passes the response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
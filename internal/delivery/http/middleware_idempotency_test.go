@@ -0,0 +1,159 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type stubIdempotencyStore struct {
+	mu   sync.Mutex
+	recs map[string]domain.IdempotencyRecord
+}
+
+func (s *stubIdempotencyStore) Reserve(ctx context.Context, userID int64, key, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.recs[key]; ok {
+		return rec, false, nil
+	}
+	rec := domain.IdempotencyRecord{UserID: userID, Key: key, RequestHash: requestHash}
+	s.recs[key] = rec
+	return rec, true, nil
+}
+
+func (s *stubIdempotencyStore) Complete(ctx context.Context, userID int64, key string, statusCode int, contentType string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.recs[key]
+	rec.StatusCode, rec.ContentType, rec.Body = statusCode, contentType, body
+	s.recs[key] = rec
+	return nil
+}
+
+func (s *stubIdempotencyStore) Delete(ctx context.Context, userID int64, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.recs, key)
+	return nil
+}
+
+func TestIdempotency(t *testing.T) {
+	store := &stubIdempotencyStore{recs: map[string]domain.IdempotencyRecord{}}
+	calls := 0
+	status := http.StatusOK
+	h := Idempotency(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		w.Write([]byte("done"))
+	}))
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(body))
+		req.Header.Set(IdempotencyHeader, key)
+		req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("k1", "a"); w.Code != http.StatusOK || w.Body.String() != "done" {
+		t.Fatalf("unexpected first response %d %q", w.Code, w.Body.String())
+	}
+	w := send("k1", "a")
+	if w.Code != http.StatusOK || w.Body.String() != "done" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected replay %d %q", w.Code, w.Body.String())
+	}
+	if calls != 1 {
+		t.Fatalf("handler called %d times", calls)
+	}
+
+	if w := send("k1", "b"); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for reused key, got %d", w.Code)
+	}
+
+	// server errors are not recorded
+	status = http.StatusInternalServerError
+	send("k2", "a")
+	status = http.StatusOK
+	if w := send("k2", "a"); w.Code != http.StatusOK || calls != 3 {
+		t.Fatalf("expected retry after server error, got %d calls %d", w.Code, calls)
+	}
+}
+
+func TestIdempotency_InProgress(t *testing.T) {
+	store := &stubIdempotencyStore{recs: map[string]domain.IdempotencyRecord{}}
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("a"))
+		req.Header.Set(IdempotencyHeader, "k")
+		return req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+	}
+
+	var h http.Handler
+	var inner *httptest.ResponseRecorder
+	h = Idempotency(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inner == nil {
+			inner = httptest.NewRecorder()
+			h.ServeHTTP(inner, newReq())
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newReq())
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if inner.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for concurrent request, got %d", inner.Code)
+	}
+}
+
+func TestIdempotency_Panic(t *testing.T) {
+	store := &stubIdempotencyStore{recs: map[string]domain.IdempotencyRecord{}}
+	h := Idempotency(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("a"))
+	req.Header.Set(IdempotencyHeader, "k")
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the panic to be passed on")
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	if _, ok := store.recs["k"]; ok {
+		t.Fatal("key must be released after a panic")
+	}
+}
+
+func TestIdempotency_TooLarge(t *testing.T) {
+	store := &stubIdempotencyStore{recs: map[string]domain.IdempotencyRecord{}}
+	h := Idempotency(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler must not be called")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(make([]byte, maxIdempotentBody+1)))
+	req.Header.Set(IdempotencyHeader, "k")
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", w.Code)
+	}
+	if len(store.recs) != 0 {
+		t.Fatal("key must not be reserved")
+	}
+}
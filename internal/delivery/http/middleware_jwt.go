@@ -4,52 +4,268 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
 )
 
 // ctxKey is context key type for storing values.
 type ctxKey string
 
-const userIDKey ctxKey = "user_id"
+const (
+	userIDKey    ctxKey = "user_id"
+	sessionIDKey ctxKey = "session_id"
+	scopesKey    ctxKey = "scopes"
+	principalKey ctxKey = "principal"
+)
+
+// errSessionInvalid reports a revoked session or an outdated token version.
+var errSessionInvalid = errors.New("session invalid")
+
+// principal lets long-running handlers check the request authentication
+// again after it was made.
+type principal struct {
+	// expires is zero for API keys
+	expires time.Time
+	verify  func(ctx context.Context) error
+}
+
+// SessionChecker reports whether a session has not been revoked.
+type SessionChecker interface {
+	IsSessionActive(ctx context.Context, sessionID string) (bool, error)
+}
 
-// JWT parses AuthToken cookie and validates JWT.
-// On success user id is stored in request context.
-func JWT(secret []byte) func(http.Handler) http.Handler {
+// TokenVersionChecker returns the current token version of a user.
+type TokenVersionChecker interface {
+	TokenVersion(ctx context.Context, userID int64) (int, error)
+}
+
+// APIKeyAuthenticator resolves an API key to its owner and granted scopes.
+type APIKeyAuthenticator interface {
+	Authenticate(ctx context.Context, key string) (int64, []domain.Scope, error)
+}
+
+// KeyResolver resolves the key verifying a token, e.g. by its kid header.
+type KeyResolver interface {
+	Keyfunc(t *jwt.Token) (interface{}, error)
+}
+
+// JWTOption configures JWT middleware.
+type JWTOption func(*jwtConfig)
+
+type jwtConfig struct {
+	sessions SessionChecker
+	versions TokenVersionChecker
+	apiKeys  APIKeyAuthenticator
+}
+
+// WithSessions makes JWT middleware reject tokens without a session or whose
+// session has been revoked.
+func WithSessions(s SessionChecker) JWTOption {
+	return func(c *jwtConfig) { c.sessions = s }
+}
+
+// WithTokenVersions makes JWT middleware reject tokens whose tv claim differs
+// from the current token version of the user, e.g. after a password change.
+// Tokens without the claim are treated as version 0.
+func WithTokenVersions(v TokenVersionChecker) JWTOption {
+	return func(c *jwtConfig) { c.versions = v }
+}
+
+// WithAPIKeys makes JWT middleware accept API keys as bearer tokens.
+func WithAPIKeys(a APIKeyAuthenticator) JWTOption {
+	return func(c *jwtConfig) { c.apiKeys = a }
+}
+
+// JWT authenticates the request with a token from the Authorization: Bearer
+// header or the AuthToken cookie. The token is either a JWT or, if enabled,
+// an API key. On success user id, session id and granted scopes are stored
+// in request context. JWT tokens are granted all scopes.
+func JWT(keys KeyResolver, opts ...JWTOption) func(http.Handler) http.Handler {
+	var cfg jwtConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			c, err := r.Cookie("AuthToken")
-			if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
+			raw, ok := bearerToken(r)
+			if !ok {
+				writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
 				return
 			}
 
-			token, err := jwt.Parse(c.Value, func(t *jwt.Token) (interface{}, error) {
-				if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-					return nil, errors.New("unexpected signing method")
+			if strings.HasPrefix(raw, domain.APIKeyPrefix) {
+				if cfg.apiKeys == nil {
+					writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken)
+					return
+				}
+				userID, scopes, err := cfg.apiKeys.Authenticate(r.Context(), raw)
+				if err != nil {
+					if errors.Is(err, domain.ErrNotFound) {
+						writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken)
+					} else {
+						writeError(w, r, err)
+					}
+					return
 				}
-				return secret, nil
-			})
+				ctx := context.WithValue(r.Context(), userIDKey, userID)
+				ctx = context.WithValue(ctx, scopesKey, scopes)
+				ctx = context.WithValue(ctx, principalKey, principal{verify: func(ctx context.Context) error {
+					// a revoked key is no longer found
+					_, _, err := cfg.apiKeys.Authenticate(ctx, raw)
+					return err
+				}})
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			token, err := jwt.Parse(raw, keys.Keyfunc)
 			if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
+				writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken)
 				return
 			}
 			claims, ok := token.Claims.(jwt.MapClaims)
 			if !ok || !token.Valid {
-				w.WriteHeader(http.StatusUnauthorized)
+				writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken)
 				return
 			}
 			sub, ok := claims["sub"].(float64)
 			if !ok {
-				w.WriteHeader(http.StatusUnauthorized)
+				writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken)
+				return
+			}
+			sid, _ := claims["sid"].(string)
+			if cfg.sessions != nil && sid == "" {
+				writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken)
 				return
 			}
+			tv, _ := claims["tv"].(float64)
+			verify := func(ctx context.Context) error {
+				return cfg.verifySession(ctx, int64(sub), sid, int(tv))
+			}
+			if err := verify(r.Context()); err != nil {
+				switch {
+				case errors.Is(err, errSessionInvalid):
+					writeProblem(w, r, http.StatusUnauthorized, codeSessionInvalid)
+				case errors.Is(err, domain.ErrNotFound):
+					writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken)
+				default:
+					writeError(w, r, err)
+				}
+				return
+			}
+			p := principal{verify: verify}
+			if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+				p.expires = exp.Time
+			}
 			ctx := context.WithValue(r.Context(), userIDKey, int64(sub))
+			if sid != "" {
+				ctx = context.WithValue(ctx, sessionIDKey, sid)
+			}
+			ctx = context.WithValue(ctx, scopesKey, domain.AllScopes)
+			ctx = context.WithValue(ctx, principalKey, p)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// verifySession checks that the session of a token has not been revoked
+// and its token version is current.
+func (c *jwtConfig) verifySession(ctx context.Context, userID int64, sid string, tv int) error {
+	if c.sessions != nil {
+		active, err := c.sessions.IsSessionActive(ctx, sid)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return errSessionInvalid
+		}
+	}
+	if c.versions != nil {
+		current, err := c.versions.TokenVersion(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if tv != current {
+			return errSessionInvalid
+		}
+	}
+	return nil
+}
+
+// Reauthenticate checks again the credentials the request was authenticated
+// with by JWT middleware, so long-lived handlers notice revoked sessions and
+// keys and expired access tokens. Requests not authenticated by the
+// middleware always pass.
+func Reauthenticate(ctx context.Context) error {
+	p, ok := ctx.Value(principalKey).(principal)
+	if !ok {
+		return nil
+	}
+	if !p.expires.IsZero() && !time.Now().Before(p.expires) {
+		return errSessionInvalid
+	}
+	return p.verify(ctx)
+}
+
+// accessExpiry returns the time the access token of the request expires at,
+// zero for API keys.
+func accessExpiry(ctx context.Context) time.Time {
+	p, _ := ctx.Value(principalKey).(principal)
+	return p.expires
+}
+
+// bearerToken returns the token from Authorization header, falling back to the AuthToken cookie.
+func bearerToken(r *http.Request) (string, bool) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		scheme, token, ok := strings.Cut(h, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", false
+		}
+		return strings.TrimSpace(token), true
+	}
+	c, err := r.Cookie(accessCookie)
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+	return c.Value, true
+}
+
+// RequireScope responds with 403 unless the request was granted scope.
+// It must be used after JWT middleware.
+func RequireScope(scope domain.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scopes, ok := ScopesFromCtx(r.Context())
+			if !ok {
+				writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+				return
+			}
+			if !domain.HasScope(scopes, scope) {
+				writeProblem(w, r, http.StatusForbidden, codeForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession responds with 403 to requests authenticated with an API key,
+// e.g. to keep keys from managing other keys.
+// It must be used after JWT middleware.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := SessionIDFromCtx(r.Context()); !ok {
+			writeProblem(w, r, http.StatusForbidden, codeForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // UserIDFromCtx extracts user id from context.
 func UserIDFromCtx(ctx context.Context) (int64, bool) {
 	if ctx == nil {
@@ -58,3 +274,21 @@ func UserIDFromCtx(ctx context.Context) (int64, bool) {
 	id, ok := ctx.Value(userIDKey).(int64)
 	return id, ok
 }
+
+// SessionIDFromCtx extracts session id from context.
+func SessionIDFromCtx(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	id, ok := ctx.Value(sessionIDKey).(string)
+	return id, ok
+}
+
+// ScopesFromCtx extracts granted scopes from context.
+func ScopesFromCtx(ctx context.Context) ([]domain.Scope, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	scopes, ok := ctx.Value(scopesKey).([]domain.Scope)
+	return scopes, ok
+}
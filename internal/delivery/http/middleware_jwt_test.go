@@ -1,17 +1,23 @@
 package http
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/pkg/jwtkeys"
 )
 
+var testKeys, _ = jwtkeys.NewKeyring(jwtkeys.NewHMAC([]byte("secret")))
+
 func TestJWT_NoToken(t *testing.T) {
 	handlerCalled := false
-	mw := JWT([]byte("secret"))
+	mw := JWT(testKeys)
 	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handlerCalled = true
 	}))
@@ -32,7 +38,7 @@ func TestJWT_NoToken(t *testing.T) {
 
 func TestJWT_WithToken(t *testing.T) {
 	var gotID int64
-	mw := JWT([]byte("secret"))
+	mw := JWT(testKeys)
 	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id, ok := UserIDFromCtx(r.Context())
 		if !ok {
@@ -42,11 +48,10 @@ func TestJWT_WithToken(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	}))
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	tokenStr, err := testKeys.Sign(jwt.MapClaims{
 		"sub": int64(42),
 		"exp": time.Now().Add(time.Hour).Unix(),
 	})
-	tokenStr, err := token.SignedString([]byte("secret"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -65,3 +70,179 @@ func TestJWT_WithToken(t *testing.T) {
 		t.Fatalf("expected id 42, got %d", gotID)
 	}
 }
+
+type stubSessionChecker map[string]bool
+
+func (s stubSessionChecker) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	return s[sessionID], nil
+}
+
+func TestJWT_RevokedSession(t *testing.T) {
+	mw := JWT(testKeys, WithSessions(stubSessionChecker{"active": true, "revoked": false}))
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sid, _ := SessionIDFromCtx(r.Context()); sid != "active" {
+			t.Fatalf("unexpected session %q", sid)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for sid, want := range map[string]int{"active": http.StatusOK, "revoked": http.StatusUnauthorized, "": http.StatusUnauthorized} {
+		claims := jwt.MapClaims{"sub": int64(42), "exp": time.Now().Add(time.Hour).Unix()}
+		if sid != "" {
+			claims["sid"] = sid
+		}
+		tokenStr, err := testKeys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "AuthToken", Value: tokenStr})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("session %q: expected %d, got %d", sid, want, w.Code)
+		}
+	}
+}
+
+type stubVersions map[int64]int
+
+func (s stubVersions) TokenVersion(ctx context.Context, userID int64) (int, error) {
+	v, ok := s[userID]
+	if !ok {
+		return 0, domain.ErrNotFound
+	}
+	return v, nil
+}
+
+func TestJWT_TokenVersion(t *testing.T) {
+	mw := JWT(testKeys, WithTokenVersions(stubVersions{42: 2, 43: 0}))
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		name string
+		sub  int64
+		tv   any
+		want int
+	}{
+		{"current", 42, 2, http.StatusOK},
+		{"stale", 42, 1, http.StatusUnauthorized},
+		{"no claim", 43, nil, http.StatusOK},
+		{"unknown user", 44, 0, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		claims := jwt.MapClaims{"sub": c.sub, "exp": time.Now().Add(time.Hour).Unix()}
+		if c.tv != nil {
+			claims["tv"] = c.tv
+		}
+		tokenStr, err := testKeys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Fatalf("%s: expected %d, got %d", c.name, c.want, w.Code)
+		}
+	}
+}
+
+type stubKeyAuth struct{}
+
+func (stubKeyAuth) Authenticate(ctx context.Context, key string) (int64, []domain.Scope, error) {
+	if key != "gmk_valid" {
+		return 0, nil, domain.ErrNotFound
+	}
+	return 7, []domain.Scope{domain.ScopeBalanceRead}, nil
+}
+
+func TestJWT_BearerToken(t *testing.T) {
+	var gotScopes []domain.Scope
+	mw := JWT(testKeys)
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotScopes, _ = ScopesFromCtx(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tokenStr, err := testKeys.Sign(jwt.MapClaims{
+		"sub": int64(42),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if len(gotScopes) != len(domain.AllScopes) {
+		t.Fatalf("expected all scopes, got %v", gotScopes)
+	}
+}
+
+func TestJWT_APIKey(t *testing.T) {
+	mw := JWT(testKeys, WithAPIKeys(stubKeyAuth{}))
+	h := mw(RequireScope(domain.ScopeBalanceRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := UserIDFromCtx(r.Context()); id != 7 {
+			t.Fatalf("unexpected user %d", id)
+		}
+		w.WriteHeader(http.StatusOK)
+	})))
+	withdraw := mw(RequireScope(domain.ScopeWithdraw)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not be called")
+	})))
+
+	cases := []struct {
+		name string
+		h    http.Handler
+		key  string
+		want int
+	}{
+		{"granted", h, "gmk_valid", http.StatusOK},
+		{"unknown key", h, "gmk_other", http.StatusUnauthorized},
+		{"missing scope", withdraw, "gmk_valid", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tc.key)
+		w := httptest.NewRecorder()
+		tc.h.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, w.Code)
+		}
+	}
+}
+
+func TestJWT_UnknownKey(t *testing.T) {
+	mw := JWT(testKeys)
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not be called")
+	}))
+
+	other, _ := jwtkeys.NewKeyring(jwtkeys.NewHMAC([]byte("other")))
+	claims := jwt.MapClaims{"sub": int64(42), "exp": time.Now().Add(time.Hour).Unix()}
+	foreign, _ := other.Sign(claims)
+	// tokens without kid, as issued before key rotation support, are rejected
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+
+	for _, tokenStr := range []string{foreign, legacy} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "AuthToken", Value: tokenStr})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", w.Code)
+		}
+	}
+}
@@ -28,33 +28,33 @@ func NewOrderRouter(svc UploadService) http.Handler {
 // @Param number body string true "Order number"
 // @Success 202 {string} string "Accepted"
 // @Success 200 {string} string "Already uploaded"
-// @Success 400 {string} string "Bad Request"
-// @Success 401 {string} string "Unauthorized"
-// @Success 409 {string} string "Conflict"
-// @Success 422 {string} string "Unprocessable Entity"
-// @Success 500 {string} string "Internal Server Error"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 409 {object} Problem "Conflict"
+// @Success 422 {object} Problem "Unprocessable Entity"
+// @Success 500 {object} Problem "Internal Server Error"
 // @Router /api/user/orders [post]
 func UploadOrder(svc UploadService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := UserIDFromCtx(r.Context())
 		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
 			return
 		}
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
 			return
 		}
 		number := strings.TrimSpace(string(body))
 		if !luhn.IsValid(number) {
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeProblem(w, r, http.StatusUnprocessableEntity, codeInvalidOrderNumber)
 			return
 		}
 		errSelf, errOther, err := svc.Add(r.Context(), userID, number)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		if errSelf != nil {
@@ -62,7 +62,7 @@ func UploadOrder(svc UploadService) http.HandlerFunc {
 			return
 		}
 		if errOther != nil {
-			w.WriteHeader(http.StatusConflict)
+			writeError(w, r, errOther)
 			return
 		}
 		w.WriteHeader(http.StatusAccepted)
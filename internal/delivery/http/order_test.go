@@ -119,7 +119,7 @@ func TestUploadOrder(t *testing.T) {
 
 	for _, tt := range tests {
 		svc := &stubOrderService{addFunc: tt.addFn}
-		router := middleware.Gzip(5)(NewOrderRouter(svc))
+		router := middleware.Gzip(5, MiddlewareError)(NewOrderRouter(svc))
 
 		var buf bytes.Buffer
 		if tt.gzip && !tt.noCompress {
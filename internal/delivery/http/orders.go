@@ -14,10 +14,10 @@ import (
 )
 
 type orderDTO struct {
-	Number     string   `json:"number"`
-	Status     string   `json:"status"`
-	Accrual    *float64 `json:"accrual,omitempty"`
-	UploadedAt string   `json:"uploaded_at"`
+	Number     string  `json:"number"`
+	Status     string  `json:"status"`
+	Accrual    *amount `json:"accrual,omitempty" swaggertype:"number"`
+	UploadedAt string  `json:"uploaded_at"`
 }
 
 // ListService defines method required for listing user orders.
@@ -36,15 +36,15 @@ func NewOrdersRouter(svc ListService) http.Handler {
 // @Summary List user orders
 // @Success 200 {array} orderDTO
 // @Success 204 {string} string "No Content"
-// @Success 401 {string} string "Unauthorized"
-// @Success 500 {string} string "Internal Server Error"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 500 {object} Problem "Internal Server Error"
 // @Router /api/user/orders [get]
 func ListOrders(svc ListService) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		uid, ok := UserIDFromCtx(r.Context())
 		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
 			return
 		}
 		q := r.URL.Query()
@@ -66,7 +66,7 @@ func ListOrders(svc ListService) http.HandlerFunc {
 
 		orders, err := svc.ListByUser(r.Context(), uid, limit, offset)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		if len(orders) == 0 {
@@ -77,20 +77,20 @@ func ListOrders(svc ListService) http.HandlerFunc {
 
 		resp := make([]orderDTO, 0, len(orders))
 		for _, o := range orders {
-			var accrual *float64
+			var accrual *amount
 			if o.Accrual != nil {
-				v := o.Accrual.InexactFloat64()
+				v := newAmount(r, *o.Accrual)
 				accrual = &v
 			}
 			resp = append(resp, orderDTO{
 				Number:     o.Number,
-				Status:     o.Status,
+				Status:     string(o.Status),
 				Accrual:    accrual,
 				UploadedAt: o.UploadedAt.Format(time.RFC3339),
 			})
 		}
 
-		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Type", jsonContentType(r))
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
@@ -0,0 +1,124 @@
+package http
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+// PasswordChanger defines method required to change the password.
+type PasswordChanger interface {
+	ChangePassword(ctx context.Context, userID int64, current, next string) (domain.TokenPair, error)
+}
+
+// PasswordResetter defines methods required for the password reset flow.
+type PasswordResetter interface {
+	Request(ctx context.Context, login string) error
+	Reset(ctx context.Context, token, password string) error
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type resetRequest struct {
+	Login string `json:"login"`
+}
+
+type resetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ChangePassword returns handler for POST /api/user/password.
+// All previously issued tokens are revoked, the response carries new ones.
+// @Summary Change password
+// @Param request body changePasswordRequest true "Current and new password"
+// @Success 200 {string} string "OK"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 413 {object} Problem "Request Entity Too Large"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/password [post]
+func ChangePassword(svc PasswordChanger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromCtx(r.Context())
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		var req changePasswordRequest
+		if !decodeAuthBody(w, r, &req) {
+			return
+		}
+		tokens, err := svc.ChangePassword(r.Context(), userID, req.CurrentPassword, req.NewPassword)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		setTokenCookies(w, tokens)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// RequestPasswordReset returns handler for POST /api/user/password/reset-request.
+// The response is the same whether the login exists or not. Every request
+// counts against throttle, if set, per login and per client address.
+// @Summary Request password reset token
+// @Param request body resetRequest true "Login"
+// @Success 202 {string} string "Accepted"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 413 {object} Problem "Request Entity Too Large"
+// @Success 429 {object} Problem "Too Many Requests"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/password/reset-request [post]
+func RequestPasswordReset(svc PasswordResetter, throttle LoginThrottler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req resetRequest
+		if !decodeAuthBody(w, r, &req) {
+			return
+		}
+		if req.Login == "" {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		if throttle != nil {
+			ip := clientIP(r)
+			if err := throttle.Attempt(r.Context(), req.Login, ip); err != nil {
+				writeThrottled(w, r, err)
+				return
+			}
+		}
+		if err := svc.Request(r.Context(), req.Login); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ResetPassword returns handler for POST /api/user/password/reset.
+// @Summary Set new password with reset token
+// @Param request body resetPasswordRequest true "Reset token and new password"
+// @Success 200 {string} string "OK"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 413 {object} Problem "Request Entity Too Large"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/password/reset [post]
+func ResetPassword(svc PasswordResetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req resetPasswordRequest
+		if !decodeAuthBody(w, r, &req) {
+			return
+		}
+		if err := svc.Reset(r.Context(), req.Token, req.NewPassword); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
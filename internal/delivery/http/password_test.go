@@ -0,0 +1,134 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type stubPasswordChanger func(ctx context.Context, userID int64, current, next string) (domain.TokenPair, error)
+
+func (f stubPasswordChanger) ChangePassword(ctx context.Context, userID int64, current, next string) (domain.TokenPair, error) {
+	return f(ctx, userID, current, next)
+}
+
+type stubResetter struct {
+	requested string
+	resetFunc func(ctx context.Context, token, password string) error
+}
+
+func (s *stubResetter) Request(ctx context.Context, login string) error {
+	s.requested = login
+	return nil
+}
+
+func (s *stubResetter) Reset(ctx context.Context, token, password string) error {
+	return s.resetFunc(ctx, token, password)
+}
+
+func TestChangePassword(t *testing.T) {
+	svc := stubPasswordChanger(func(ctx context.Context, userID int64, current, next string) (domain.TokenPair, error) {
+		if userID != 1 {
+			t.Fatalf("unexpected user %d", userID)
+		}
+		if next == "" {
+			verr := &domain.ValidationError{}
+			verr.Add("new_password", domain.CodeRequired, "password is required")
+			return domain.TokenPair{}, verr
+		}
+		if current != "old" {
+			return domain.TokenPair{}, domain.ErrInvalidCredentials
+		}
+		return domain.TokenPair{AccessToken: "access", RefreshToken: "refresh", RefreshExpiresAt: time.Now().Add(time.Hour)}, nil
+	})
+
+	for body, want := range map[string]int{
+		`{"current_password":"old","new_password":"new"}`:   http.StatusOK,
+		`{"current_password":"wrong","new_password":"new"}`: http.StatusUnauthorized,
+		`{"current_password":"old"}`:                        http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/password", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+		w := httptest.NewRecorder()
+		ChangePassword(svc).ServeHTTP(w, req)
+		res := w.Result()
+		res.Body.Close()
+
+		if res.StatusCode != want {
+			t.Fatalf("%s: expected %d, got %d", body, want, res.StatusCode)
+		}
+		if want == http.StatusOK && len(res.Cookies()) != 2 {
+			t.Fatalf("expected new token cookies, got %v", res.Cookies())
+		}
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	svc := &stubResetter{resetFunc: func(ctx context.Context, token, password string) error {
+		if password == "" {
+			verr := &domain.ValidationError{}
+			verr.Add("new_password", domain.CodeRequired, "password is required")
+			return verr
+		}
+		if token != "good" {
+			return domain.ErrResetTokenInvalid
+		}
+		return nil
+	}}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/password/reset-request", bytes.NewBufferString(`{"login":"user"}`))
+	w := httptest.NewRecorder()
+	RequestPasswordReset(svc, nil).ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", w.Code)
+	}
+	if svc.requested != "user" {
+		t.Fatalf("unexpected login %q", svc.requested)
+	}
+
+	for body, want := range map[string]int{
+		`{"token":"good","new_password":"new"}`: http.StatusOK,
+		`{"token":"bad","new_password":"new"}`:  http.StatusUnauthorized,
+		`{"token":"good"}`:                      http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/password/reset", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		ResetPassword(svc).ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("%s: expected %d, got %d", body, want, w.Code)
+		}
+	}
+}
+
+func TestRequestPasswordReset_Throttled(t *testing.T) {
+	svc := &stubResetter{}
+	throttle := &stubThrottle{}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/password/reset-request", bytes.NewBufferString(`{"login":"user"}`))
+	w := httptest.NewRecorder()
+	RequestPasswordReset(svc, throttle).ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", w.Code)
+	}
+	// every request counts, not only those for existing logins
+	if len(throttle.attempts) != 1 || throttle.attempts[0] != "user@192.0.2.1" {
+		t.Fatalf("expected the request to be recorded, got %v", throttle.attempts)
+	}
+
+	svc.requested = ""
+	throttle.attemptErr = &domain.ThrottledError{RetryAfter: time.Minute}
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/api/user/password/reset-request", bytes.NewBufferString(`{"login":"user"}`))
+	RequestPasswordReset(svc, throttle).ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if svc.requested != "" {
+		t.Fatal("throttled request must not send a token")
+	}
+}
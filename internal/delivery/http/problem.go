@@ -0,0 +1,152 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/pkg/logger"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 error body. Code is stable and meant for clients,
+// Detail is a human readable message.
+type Problem struct {
+	Type      string              `json:"type"`
+	Title     string              `json:"title"`
+	Status    int                 `json:"status"`
+	Code      string              `json:"code"`
+	Detail    string              `json:"detail"`
+	Instance  string              `json:"instance,omitempty"`
+	RequestID string              `json:"request_id,omitempty"`
+	Errors    []domain.FieldError `json:"errors,omitempty"`
+}
+
+// Problem codes returned to clients. They are part of the API and must not change.
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeRequestTooLarge      = "request_too_large"
+	codeValidationFailed     = "validation_failed"
+	codeUnauthorized         = "unauthorized"
+	codeInvalidToken         = "invalid_token"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeInvalidCredentials   = "invalid_credentials"
+	codeSessionInvalid       = "session_invalid"
+	codeRefreshTokenReused   = "refresh_token_reused"
+	codeResetTokenInvalid    = "reset_token_invalid"
+	codeTooManyAttempts      = "too_many_attempts"
+	codeLoginTaken           = "login_taken"
+	codeInvalidScope         = "invalid_scope"
+	codeInvalidOrderNumber   = "invalid_order_number"
+	codeAlreadyExists        = "already_exists"
+	codeOrderOwnedByOther    = "order_owned_by_other_user"
+	codeInsufficientFunds    = "insufficient_funds"
+	codeDuplicateWithdrawal  = "duplicate_withdrawal"
+	codeInvalidTransition    = "invalid_transition"
+	codeAlreadyReversed      = "already_reversed"
+	codeIdempotencyKeyReused = "idempotency_key_reused"
+	codeRequestInProgress    = "request_in_progress"
+	codeInternal             = "internal_error"
+)
+
+var problemMessages = map[string]string{
+	codeInvalidRequest:       "request is malformed",
+	codeRequestTooLarge:      "request body is too large",
+	codeValidationFailed:     "request failed validation",
+	codeUnauthorized:         "authentication is required",
+	codeInvalidToken:         "token is invalid or expired",
+	codeForbidden:            "access to the resource is not allowed",
+	codeNotFound:             "resource not found",
+	codeInvalidCredentials:   "login or password is wrong",
+	codeSessionInvalid:       "session has expired or been revoked",
+	codeRefreshTokenReused:   "refresh token has already been used, all sessions of this login are revoked",
+	codeResetTokenInvalid:    "password reset token is invalid, expired or used",
+	codeTooManyAttempts:      "too many failed login attempts, retry later",
+	codeLoginTaken:           "login is already taken",
+	codeInvalidScope:         "unknown API key scope",
+	codeInvalidOrderNumber:   "order number is invalid",
+	codeAlreadyExists:        "resource already exists",
+	codeOrderOwnedByOther:    "order number has been uploaded by another user",
+	codeInsufficientFunds:    "balance is insufficient",
+	codeDuplicateWithdrawal:  "withdrawal for this order already exists",
+	codeInvalidTransition:    "order status can't be changed",
+	codeAlreadyReversed:      "transaction has already been reversed",
+	codeIdempotencyKeyReused: "idempotency key has been used with a different request",
+	codeRequestInProgress:    "request with this idempotency key is in progress",
+	codeInternal:             "internal server error",
+}
+
+// errorProblems maps domain errors to status and code. The first match wins.
+var errorProblems = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{domain.ErrNotFound, http.StatusNotFound, codeNotFound},
+	{domain.ErrConflictSelf, http.StatusConflict, codeAlreadyExists},
+	{domain.ErrConflictOther, http.StatusConflict, codeOrderOwnedByOther},
+	{domain.ErrInsufficientFunds, http.StatusPaymentRequired, codeInsufficientFunds},
+	{domain.ErrDuplicateWithdrawal, http.StatusConflict, codeDuplicateWithdrawal},
+	{domain.ErrInvalidTransition, http.StatusConflict, codeInvalidTransition},
+	{domain.ErrAlreadyReversed, http.StatusConflict, codeAlreadyReversed},
+	{domain.ErrInvalidCredentials, http.StatusUnauthorized, codeInvalidCredentials},
+	{domain.ErrSessionInvalid, http.StatusUnauthorized, codeSessionInvalid},
+	{domain.ErrRefreshTokenReused, http.StatusUnauthorized, codeRefreshTokenReused},
+	{domain.ErrResetTokenInvalid, http.StatusUnauthorized, codeResetTokenInvalid},
+	{domain.ErrTooManyAttempts, http.StatusTooManyRequests, codeTooManyAttempts},
+	{domain.ErrInvalidScope, http.StatusBadRequest, codeInvalidScope},
+	{domain.ErrInvalidInput, http.StatusBadRequest, codeValidationFailed},
+}
+
+// writeProblem writes a problem+json response with the message of code.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string) {
+	renderProblem(w, r, Problem{Status: status, Code: code, Detail: problemMessages[code]})
+}
+
+// writeError writes a problem+json response for err. Domain errors get their
+// status and code, field errors of *ValidationError are listed, anything
+// else is logged and answered with 500 without details.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	p := Problem{Status: http.StatusInternalServerError, Code: codeInternal}
+	for _, m := range errorProblems {
+		if errors.Is(err, m.err) {
+			p.Status, p.Code = m.status, m.code
+			break
+		}
+	}
+	var verr *domain.ValidationError
+	if errors.As(err, &verr) {
+		p.Errors = verr.Fields
+	}
+	if p.Code == codeInternal {
+		if l := logger.FromContext(r.Context()); l != nil {
+			l.Error().Err(err).Str("path", r.URL.Path).Msg("request failed")
+		}
+	}
+	p.Detail = problemMessages[p.Code]
+	renderProblem(w, r, p)
+}
+
+// MiddlewareError writes the problem of a request rejected by a middleware
+// of pkg/middleware, so clients parse its errors like those of the handlers.
+// It is a middleware.ErrorWriter.
+func MiddlewareError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	code := codeInvalidRequest
+	if status >= http.StatusInternalServerError {
+		code = codeInternal
+	}
+	renderProblem(w, r, Problem{Status: status, Code: code, Detail: detail})
+}
+
+func renderProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = logger.RequestIDFromContext(r.Context())
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/pkg/logger"
+)
+
+func TestWriteError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{domain.ErrConflictSelf, http.StatusConflict, "already_exists"},
+		{domain.ErrConflictOther, http.StatusConflict, "order_owned_by_other_user"},
+		{fmt.Errorf("withdraw: %w", domain.ErrInsufficientFunds), http.StatusPaymentRequired, "insufficient_funds"},
+		{domain.ErrNotFound, http.StatusNotFound, "not_found"},
+		{&domain.ThrottledError{}, http.StatusTooManyRequests, "too_many_attempts"},
+		{errors.New("connection refused"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/orders", nil)
+		req = req.WithContext(logger.WithRequestID(req.Context(), "req-1"))
+		w := httptest.NewRecorder()
+		writeError(w, req, c.err)
+
+		if w.Code != c.status {
+			t.Fatalf("%v: expected %d, got %d", c.err, c.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		var p Problem
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Code != c.code || p.Status != c.status || p.Detail == "" || p.Title != http.StatusText(c.status) {
+			t.Fatalf("%v: unexpected problem %+v", c.err, p)
+		}
+		if p.RequestID != "req-1" || p.Instance != "/api/user/orders" {
+			t.Fatalf("unexpected request id or instance %+v", p)
+		}
+		if p.Detail == c.err.Error() {
+			t.Fatalf("error text must not leak: %+v", p)
+		}
+	}
+}
+
+func TestMiddlewareError(t *testing.T) {
+	for status, code := range map[int]string{
+		http.StatusBadRequest:          "invalid_request",
+		http.StatusInternalServerError: "internal_error",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/orders", nil)
+		w := httptest.NewRecorder()
+		MiddlewareError(w, req, status, "request body is not valid gzip")
+
+		var p Problem
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != status || w.Header().Get("Content-Type") != "application/problem+json" ||
+			p.Status != status || p.Code != code || p.Detail != "request body is not valid gzip" {
+			t.Fatalf("unexpected problem %d %+v", w.Code, p)
+		}
+	}
+}
+
+func TestProblemMessages(t *testing.T) {
+	for _, m := range errorProblems {
+		if problemMessages[m.code] == "" {
+			t.Errorf("no message for %s", m.code)
+		}
+	}
+}
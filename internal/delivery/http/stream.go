@@ -0,0 +1,161 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+// EventStream defines methods required to stream user events.
+type EventStream interface {
+	LastID(ctx context.Context, userID int64) (int64, error)
+	Since(ctx context.Context, userID, afterID int64) ([]domain.Event, error)
+	Subscribe(ctx context.Context, userID int64) <-chan struct{}
+}
+
+type orderEventDTO struct {
+	Number  string  `json:"number"`
+	Status  string  `json:"status"`
+	Accrual *amount `json:"accrual,omitempty" swaggertype:"number"`
+}
+
+// OrderStream returns handler for GET /api/user/orders/stream. It streams
+// order status changes and balance updates of the user as server-sent
+// events. A client reconnecting with Last-Event-ID first receives the kept
+// events it missed. A comment is sent every keepalive so proxies don't
+// drop the idle connection. The credentials are checked again on every
+// keepalive and the stream ends when they are revoked or the access token
+// expires, so the client has to reconnect with a fresh one. Streams also
+// end when done is closed, which lets the server shut down.
+// @Summary Stream order status changes and balance updates
+// @Produce text/event-stream
+// @Param Last-Event-ID header string false "id of the last received event"
+// @Success 200 {string} string "event stream with order and balance events"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/orders/stream [get]
+func OrderStream(svc EventStream, keepalive time.Duration, done <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := UserIDFromCtx(r.Context())
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		ctx := r.Context()
+
+		// subscribe before reading the log, so no event falls in between
+		signal := svc.Subscribe(ctx, uid)
+		var last int64
+		if v := r.Header.Get("Last-Event-ID"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || id < 0 {
+				writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+				return
+			}
+			last = id
+		} else {
+			id, err := svc.LastID(ctx, uid)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			last = id
+		}
+
+		rc := http.NewResponseController(w)
+		// the stream outlives the server write timeout
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		// send writes the events after last and reports whether the client
+		// is still there
+		send := func() bool {
+			events, err := svc.Since(ctx, uid, last)
+			if err != nil {
+				// the next signal or keepalive tries again
+				return ctx.Err() == nil
+			}
+			for _, e := range events {
+				if err := writeEvent(w, r, e); err != nil {
+					return false
+				}
+				last = e.ID
+			}
+			return len(events) == 0 || rc.Flush() == nil
+		}
+
+		if !send() {
+			return
+		}
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		// the client reconnects with a refreshed token
+		var expired <-chan time.Time
+		if exp := accessExpiry(ctx); !exp.IsZero() {
+			t := time.NewTimer(time.Until(exp))
+			defer t.Stop()
+			expired = t.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-expired:
+				return
+			case <-signal:
+				if !send() {
+					return
+				}
+			case <-ticker.C:
+				if Reauthenticate(ctx) != nil {
+					return
+				}
+				// notifications may be lost, so poll as well
+				if !send() {
+					return
+				}
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeEvent writes e in the server-sent events format.
+func writeEvent(w http.ResponseWriter, r *http.Request, e domain.Event) error {
+	var data any
+	switch {
+	case e.Type == domain.EventOrder && e.Order != nil:
+		dto := orderEventDTO{Number: e.Order.Number, Status: string(e.Order.Status)}
+		if e.Order.Accrual != nil {
+			a := newAmount(r, *e.Order.Accrual)
+			dto.Accrual = &a
+		}
+		data = dto
+	case e.Type == domain.EventBalance && e.Balance != nil:
+		data = respDTO{Current: newAmount(r, e.Balance.Current), Withdrawn: newAmount(r, e.Balance.Withdrawn)}
+	default:
+		return nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+	return err
+}
@@ -0,0 +1,236 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type stubEventStream struct {
+	mu     sync.Mutex
+	events []domain.Event
+	signal chan struct{}
+}
+
+func (s *stubEventStream) LastID(ctx context.Context, userID int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) == 0 {
+		return 0, nil
+	}
+	return s.events[len(s.events)-1].ID, nil
+}
+
+func (s *stubEventStream) Since(ctx context.Context, userID, afterID int64) ([]domain.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []domain.Event
+	for _, e := range s.events {
+		if e.ID > afterID {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+func (s *stubEventStream) Subscribe(ctx context.Context, userID int64) <-chan struct{} {
+	return s.signal
+}
+
+func (s *stubEventStream) add(e domain.Event) {
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	s.mu.Unlock()
+	s.signal <- struct{}{}
+}
+
+func withUser(id int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDKey, id)))
+	})
+}
+
+// readEvent reads lines of the stream up to the next blank line.
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var b strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		if line == "\n" {
+			return b.String()
+		}
+		b.WriteString(line)
+	}
+}
+
+func openStream(t *testing.T, url, lastID string) *bufio.Reader {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	return bufio.NewReader(res.Body)
+}
+
+func TestOrderStream_Unauthorized(t *testing.T) {
+	h := OrderStream(&stubEventStream{}, time.Minute, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/orders/stream", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestOrderStream_BadLastEventID(t *testing.T) {
+	h := OrderStream(&stubEventStream{}, time.Minute, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/orders/stream", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	w := httptest.NewRecorder()
+	withUser(1, h).ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestOrderStream_Resume(t *testing.T) {
+	accrual := decimal.NewFromInt(500)
+	svc := &stubEventStream{signal: make(chan struct{}, 1), events: []domain.Event{
+		{ID: 1, Type: domain.EventOrder, Order: &domain.Order{Number: "79927398713", Status: domain.OrderProcessing}},
+		{ID: 2, Type: domain.EventOrder, Order: &domain.Order{Number: "79927398713", Status: domain.OrderProcessed, Accrual: &accrual}},
+	}}
+	done := make(chan struct{})
+	srv := httptest.NewServer(withUser(1, OrderStream(svc, time.Minute, done)))
+	defer srv.Close()
+	defer close(done)
+
+	r := openStream(t, srv.URL, "1")
+	got := readEvent(t, r)
+	want := "id: 2\nevent: order\ndata: {\"number\":\"79927398713\",\"status\":\"PROCESSED\",\"accrual\":500}\n"
+	if got != want {
+		t.Fatalf("unexpected event %q", got)
+	}
+
+	svc.add(domain.Event{ID: 3, Type: domain.EventBalance, Balance: &domain.Balance{Current: accrual, Withdrawn: decimal.Zero}})
+	got = readEvent(t, r)
+	want = "id: 3\nevent: balance\ndata: {\"current\":500,\"withdrawn\":0}\n"
+	if got != want {
+		t.Fatalf("unexpected event %q", got)
+	}
+}
+
+func TestOrderStream_Keepalive(t *testing.T) {
+	svc := &stubEventStream{signal: make(chan struct{}, 1), events: []domain.Event{
+		{ID: 1, Type: domain.EventOrder, Order: &domain.Order{Number: "79927398713", Status: domain.OrderNew}},
+	}}
+	done := make(chan struct{})
+	srv := httptest.NewServer(withUser(1, OrderStream(svc, 10*time.Millisecond, done)))
+	defer srv.Close()
+
+	// without Last-Event-ID only new events are sent
+	r := openStream(t, srv.URL, "")
+	if got := readEvent(t, r); got != ": keepalive\n" {
+		t.Fatalf("unexpected event %q", got)
+	}
+
+	// the stream ends once done is closed
+	close(done)
+	var err error
+	for err == nil {
+		_, err = r.ReadString('\n')
+	}
+}
+
+type revocableSession struct{ revoked atomic.Bool }
+
+func (s *revocableSession) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	return !s.revoked.Load(), nil
+}
+
+// withToken authenticates every request with a token signed for claims.
+func withToken(t *testing.T, claims jwt.MapClaims, sessions SessionChecker, h http.Handler) http.Handler {
+	t.Helper()
+	token, err := testKeys.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = JWT(testKeys, WithSessions(sessions))(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// waitClosed reads the stream until it ends.
+func waitClosed(t *testing.T, r *bufio.Reader) {
+	t.Helper()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream not closed")
+	}
+}
+
+func TestOrderStream_RevokedSession(t *testing.T) {
+	svc := &stubEventStream{signal: make(chan struct{}, 1)}
+	sessions := &revocableSession{}
+	claims := jwt.MapClaims{"sub": int64(1), "sid": "s1", "exp": time.Now().Add(time.Hour).Unix()}
+	srv := httptest.NewServer(withToken(t, claims, sessions, OrderStream(svc, 10*time.Millisecond, nil)))
+	defer srv.Close()
+
+	r := openStream(t, srv.URL, "")
+	if got := readEvent(t, r); got != ": keepalive\n" {
+		t.Fatalf("unexpected event %q", got)
+	}
+	sessions.revoked.Store(true)
+	waitClosed(t, r)
+}
+
+func TestOrderStream_TokenExpiry(t *testing.T) {
+	svc := &stubEventStream{signal: make(chan struct{}, 1)}
+	// exp has a precision of seconds
+	claims := jwt.MapClaims{"sub": int64(1), "sid": "s1", "exp": time.Now().Add(time.Second).Unix()}
+	srv := httptest.NewServer(withToken(t, claims, &revocableSession{}, OrderStream(svc, time.Minute, nil)))
+	defer srv.Close()
+
+	r := openStream(t, srv.URL, "")
+	waitClosed(t, r)
+}
@@ -0,0 +1,290 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+// WebhookService defines methods required to manage webhook endpoints.
+// Zero user id stands for the administrator.
+type WebhookService interface {
+	Create(ctx context.Context, userID int64, url string, events []string) (domain.Webhook, error)
+	List(ctx context.Context, userID int64) ([]domain.Webhook, error)
+	Delete(ctx context.Context, userID, id int64) error
+	Deliveries(ctx context.Context, userID, webhookID int64) ([]domain.WebhookDelivery, error)
+	Redeliver(ctx context.Context, userID, webhookID, id int64) error
+}
+
+// WebhookRoutes registers webhook management endpoints under prefix, e.g.
+// /api/user/webhooks.
+func WebhookRoutes(r chi.Router, prefix string, svc WebhookService) {
+	r.Post(prefix, CreateWebhook(svc))
+	r.Get(prefix, ListWebhooks(svc))
+	r.Delete(prefix+"/{id}", DeleteWebhook(svc))
+	r.Get(prefix+"/{id}/deliveries", ListWebhookDeliveries(svc))
+	r.Post(prefix+"/{id}/deliveries/{delivery}/redeliver", RedeliverWebhook(svc))
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type webhookDTO struct {
+	ID        int64    `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	CreatedAt string   `json:"created_at"`
+	// Secret is only returned on creation.
+	Secret string `json:"secret,omitempty"`
+}
+
+func newWebhookDTO(wh domain.Webhook) webhookDTO {
+	dto := webhookDTO{
+		ID:        wh.ID,
+		URL:       wh.URL,
+		Events:    make([]string, len(wh.Events)),
+		CreatedAt: wh.CreatedAt.Format(time.RFC3339),
+	}
+	for i, e := range wh.Events {
+		dto.Events[i] = string(e)
+	}
+	return dto
+}
+
+type deliveryDTO struct {
+	ID            int64   `json:"id"`
+	Event         string  `json:"event"`
+	Order         string  `json:"order"`
+	Amount        *amount `json:"amount,omitempty" swaggertype:"number"`
+	Status        string  `json:"status"`
+	Attempts      int     `json:"attempts"`
+	LastError     string  `json:"last_error,omitempty"`
+	NextAttemptAt string  `json:"next_attempt_at,omitempty"`
+	DeliveredAt   string  `json:"delivered_at,omitempty"`
+	CreatedAt     string  `json:"created_at"`
+}
+
+func newDeliveryDTO(r *http.Request, d domain.WebhookDelivery) deliveryDTO {
+	dto := deliveryDTO{
+		ID:        d.ID,
+		Event:     string(d.Event),
+		Order:     d.OrderNumber,
+		Status:    string(d.Status),
+		Attempts:  d.Attempts,
+		LastError: d.LastError,
+		CreatedAt: d.OccurredAt.Format(time.RFC3339),
+	}
+	if d.Amount != nil {
+		a := newAmount(r, *d.Amount)
+		dto.Amount = &a
+	}
+	if d.Status == domain.DeliveryPending {
+		dto.NextAttemptAt = d.NextAttemptAt.Format(time.RFC3339)
+	}
+	if d.DeliveredAt != nil {
+		dto.DeliveredAt = d.DeliveredAt.Format(time.RFC3339)
+	}
+	return dto
+}
+
+// webhookOwner returns the user managing webhooks, zero for the administrator.
+func webhookOwner(r *http.Request) (int64, bool) {
+	if IsAdmin(r.Context()) {
+		return 0, true
+	}
+	return UserIDFromCtx(r.Context())
+}
+
+// pathID parses the int64 URL parameter name.
+func pathID(r *http.Request, name string) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, name), 10, 64)
+	return id, err == nil
+}
+
+// CreateWebhook returns handler for POST /api/user/webhooks. The same
+// handlers serve /api/admin/webhooks, managing endpoints that receive
+// events of every user.
+// @Summary Register webhook endpoint
+// @Description The secret signing deliveries is returned only once. Events: order.processed, order.invalid, withdrawal.created.
+// @Param request body webhookRequest true "Endpoint URL and events"
+// @Success 201 {object} webhookDTO
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/webhooks [post]
+func CreateWebhook(svc WebhookService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := webhookOwner(r)
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		wh, err := svc.Create(r.Context(), owner, req.URL, req.Events)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		resp := newWebhookDTO(wh)
+		resp.Secret = wh.Secret
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// ListWebhooks returns handler for GET /api/user/webhooks.
+// @Summary List webhook endpoints
+// @Success 200 {array} webhookDTO
+// @Success 204 {string} string "No Content"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/webhooks [get]
+func ListWebhooks(svc WebhookService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := webhookOwner(r)
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		list, err := svc.List(r.Context(), owner)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if len(list) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resp := make([]webhookDTO, len(list))
+		for i, wh := range list {
+			resp[i] = newWebhookDTO(wh)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// DeleteWebhook returns handler for DELETE /api/user/webhooks/{id}.
+// @Summary Delete webhook endpoint
+// @Description Pending deliveries to the endpoint are dropped.
+// @Param id path int true "Webhook id"
+// @Success 204 {string} string "No Content"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 404 {object} Problem "Not Found"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/webhooks/{id} [delete]
+func DeleteWebhook(svc WebhookService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := webhookOwner(r)
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		id, ok := pathID(r, "id")
+		if !ok {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		if err := svc.Delete(r.Context(), owner, id); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListWebhookDeliveries returns handler for GET /api/user/webhooks/{id}/deliveries.
+// @Summary List latest deliveries to webhook endpoint
+// @Description Statuses: pending, delivered and dead. Dead deliveries are only sent again on redelivery.
+// @Param id path int true "Webhook id"
+// @Success 200 {array} deliveryDTO
+// @Success 204 {string} string "No Content"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 404 {object} Problem "Not Found"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/webhooks/{id}/deliveries [get]
+func ListWebhookDeliveries(svc WebhookService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := webhookOwner(r)
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		id, ok := pathID(r, "id")
+		if !ok {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		list, err := svc.Deliveries(r.Context(), owner, id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if len(list) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resp := make([]deliveryDTO, len(list))
+		for i, d := range list {
+			resp[i] = newDeliveryDTO(r, d)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// RedeliverWebhook returns handler for POST /api/user/webhooks/{id}/deliveries/{delivery}/redeliver.
+// @Summary Send delivery again
+// @Description The delivery is queued with attempts reset, whatever its status.
+// @Param id path int true "Webhook id"
+// @Param delivery path int true "Delivery id"
+// @Success 202 {string} string "Accepted"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 403 {object} Problem "Forbidden"
+// @Success 404 {object} Problem "Not Found"
+// @Success 500 {object} Problem "Internal Server Error"
+// @Router /api/user/webhooks/{id}/deliveries/{delivery}/redeliver [post]
+func RedeliverWebhook(svc WebhookService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := webhookOwner(r)
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		id, ok := pathID(r, "id")
+		if !ok {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		deliveryID, ok := pathID(r, "delivery")
+		if !ok {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
+			return
+		}
+		if err := svc.Redeliver(r.Context(), owner, id, deliveryID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
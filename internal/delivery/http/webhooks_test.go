@@ -0,0 +1,171 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type stubWebhooks struct {
+	createFunc     func(ctx context.Context, userID int64, url string, events []string) (domain.Webhook, error)
+	deliveriesFunc func(ctx context.Context, userID, webhookID int64) ([]domain.WebhookDelivery, error)
+	redeliverFunc  func(ctx context.Context, userID, webhookID, id int64) error
+}
+
+func (s *stubWebhooks) Create(ctx context.Context, userID int64, url string, events []string) (domain.Webhook, error) {
+	return s.createFunc(ctx, userID, url, events)
+}
+
+func (s *stubWebhooks) List(ctx context.Context, userID int64) ([]domain.Webhook, error) {
+	return nil, nil
+}
+
+func (s *stubWebhooks) Delete(ctx context.Context, userID, id int64) error {
+	return domain.ErrNotFound
+}
+
+func (s *stubWebhooks) Deliveries(ctx context.Context, userID, webhookID int64) ([]domain.WebhookDelivery, error) {
+	return s.deliveriesFunc(ctx, userID, webhookID)
+}
+
+func (s *stubWebhooks) Redeliver(ctx context.Context, userID, webhookID, id int64) error {
+	return s.redeliverFunc(ctx, userID, webhookID, id)
+}
+
+func webhookRouter(svc WebhookService, adminToken string) http.Handler {
+	r := chi.NewRouter()
+	WebhookRoutes(r, "/api/user/webhooks", svc)
+	r.Group(func(r chi.Router) {
+		r.Use(RequireAdmin(adminToken))
+		WebhookRoutes(r, "/api/admin/webhooks", svc)
+	})
+	return r
+}
+
+func TestCreateWebhook(t *testing.T) {
+	var owners []int64
+	svc := &stubWebhooks{createFunc: func(ctx context.Context, userID int64, url string, events []string) (domain.Webhook, error) {
+		owners = append(owners, userID)
+		if url != "https://example.com/hook" || len(events) != 1 || events[0] != "order.processed" {
+			t.Fatalf("unexpected args %s %v", url, events)
+		}
+		return domain.Webhook{ID: 3, UserID: userID, URL: url, Secret: "whsec_x", Events: []domain.WebhookEvent{domain.WebhookOrderProcessed}, CreatedAt: time.Now()}, nil
+	}}
+	router := webhookRouter(svc, "admin-token")
+	body := `{"url":"https://example.com/hook","events":["order.processed"]}`
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/webhooks", bytes.NewBufferString(body))
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	var resp webhookDTO
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 3 || resp.Secret != "whsec_x" || len(resp.Events) != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer admin-token")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for admin, got %d", w.Code)
+	}
+	if len(owners) != 2 || owners[0] != 1 || owners[1] != 0 {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+}
+
+func TestCreateWebhook_Unauthorized(t *testing.T) {
+	router := webhookRouter(&stubWebhooks{}, "admin-token")
+
+	for _, auth := range []string{"", "Bearer wrong", "Bearer admin-token2"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", bytes.NewBufferString(`{}`))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("%q: expected 401, got %d", auth, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/webhooks", bytes.NewBufferString(`{}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without user, got %d", w.Code)
+	}
+}
+
+func TestListWebhookDeliveries(t *testing.T) {
+	sum := decimal.RequireFromString("12.5")
+	svc := &stubWebhooks{deliveriesFunc: func(ctx context.Context, userID, webhookID int64) ([]domain.WebhookDelivery, error) {
+		if userID != 1 || webhookID != 3 {
+			t.Fatalf("unexpected args %d %d", userID, webhookID)
+		}
+		return []domain.WebhookDelivery{{
+			ID: 7, WebhookID: 3, Event: domain.WebhookWithdrawalCreated, OrderNumber: "1", Amount: &sum,
+			Status: domain.DeliveryDead, Attempts: 10, LastError: "unexpected status 500 Internal Server Error", OccurredAt: time.Now(),
+		}}, nil
+	}}
+	router := webhookRouter(svc, "admin-token")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/webhooks/3/deliveries", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || resp[0]["status"] != "dead" || resp[0]["amount"] != 12.5 || resp[0]["next_attempt_at"] != nil {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestRedeliverWebhook(t *testing.T) {
+	svc := &stubWebhooks{redeliverFunc: func(ctx context.Context, userID, webhookID, id int64) error {
+		if id != 7 {
+			return domain.ErrNotFound
+		}
+		return nil
+	}}
+	router := webhookRouter(svc, "admin-token")
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/api/user/webhooks/3/deliveries/7/redeliver", http.StatusAccepted},
+		{"/api/user/webhooks/3/deliveries/8/redeliver", http.StatusNotFound},
+		{"/api/user/webhooks/3/deliveries/x/redeliver", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Fatalf("%s: expected %d, got %d", tt.path, tt.want, w.Code)
+		}
+	}
+}
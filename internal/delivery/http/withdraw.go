@@ -3,10 +3,8 @@ package http
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"net/http"
 
-	"github.com/Hobrus/gophermarket/internal/domain"
 	"github.com/Hobrus/gophermarket/pkg/luhn"
 	"github.com/shopspring/decimal"
 )
@@ -17,45 +15,40 @@ type WithdrawalService interface {
 }
 
 type reqDTO struct {
-	Order string  `json:"order"`
-	Sum   float64 `json:"sum"`
+	Order string `json:"order"`
+	Sum   amount `json:"sum" swaggertype:"number"`
 }
 
 // Withdraw returns handler for POST /api/user/balance/withdraw.
 // @Summary Withdraw user balance
 // @Param request body reqDTO true "Withdraw info"
 // @Success 200 {string} string "OK"
-// @Success 400 {string} string "Bad Request"
-// @Success 401 {string} string "Unauthorized"
-// @Success 402 {string} string "Payment Required"
-// @Success 422 {string} string "Unprocessable Entity"
-// @Success 500 {string} string "Internal Server Error"
+// @Success 400 {object} Problem "Bad Request"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 402 {object} Problem "Payment Required"
+// @Success 409 {object} Problem "Conflict"
+// @Success 422 {object} Problem "Unprocessable Entity"
+// @Success 500 {object} Problem "Internal Server Error"
 // @Router /api/user/balance/withdraw [post]
 func Withdraw(svc WithdrawalService) http.HandlerFunc {
-
 	return func(w http.ResponseWriter, r *http.Request) {
 		uid, ok := UserIDFromCtx(r.Context())
 		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
 			return
 		}
 		var req reqDTO
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest)
 			return
 		}
 		if !luhn.IsValid(req.Order) {
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeProblem(w, r, http.StatusUnprocessableEntity, codeInvalidOrderNumber)
 			return
 		}
-		err := svc.Withdraw(r.Context(), uid, req.Order, decimal.NewFromFloat(req.Sum))
+		err := svc.Withdraw(r.Context(), uid, req.Order, req.Sum.value)
 		if err != nil {
-			switch {
-			case errors.Is(err, domain.ErrInsufficientFunds):
-				w.WriteHeader(http.StatusPaymentRequired)
-			default:
-				w.WriteHeader(http.StatusInternalServerError)
-			}
+			writeError(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -76,3 +76,21 @@ func TestWithdraw_InvalidOrder(t *testing.T) {
 		t.Fatalf("expected 422, got %d", res.StatusCode)
 	}
 }
+
+func TestWithdraw_Duplicate(t *testing.T) {
+	svc := &stubWithdrawSvc{withdrawFunc: func(ctx context.Context, userID int64, number string, amount decimal.Decimal) error {
+		return domain.ErrDuplicateWithdrawal
+	}}
+	h := Withdraw(svc)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(`{"order":"2377225624","sum":5}`))
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, int64(1)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", res.StatusCode)
+	}
+}
@@ -16,23 +16,23 @@ type WithdrawalRepo interface {
 }
 
 type respItem struct {
-	Order       string  `json:"order"`
-	Sum         float64 `json:"sum"`
-	ProcessedAt string  `json:"processed_at"`
+	Order       string `json:"order"`
+	Sum         amount `json:"sum" swaggertype:"number"`
+	ProcessedAt string `json:"processed_at"`
 }
 
 // Withdrawals returns handler for GET /api/user/withdrawals.
 // @Summary List user withdrawals
 // @Success 200 {array} respItem
 // @Success 204 {string} string "No Content"
-// @Success 401 {string} string "Unauthorized"
-// @Success 500 {string} string "Internal Server Error"
+// @Success 401 {object} Problem "Unauthorized"
+// @Success 500 {object} Problem "Internal Server Error"
 // @Router /api/user/withdrawals [get]
 func Withdrawals(repo WithdrawalRepo) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := UserIDFromCtx(r.Context())
 		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized)
 			return
 		}
 		q := r.URL.Query()
@@ -54,7 +54,7 @@ func Withdrawals(repo WithdrawalRepo) http.HandlerFunc {
 
 		list, err := repo.ListByUser(r.Context(), userID, limit, offset)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		if len(list) == 0 {
@@ -65,11 +65,11 @@ func Withdrawals(repo WithdrawalRepo) http.HandlerFunc {
 		for i, it := range list {
 			resp[i] = respItem{
 				Order:       it.Number,
-				Sum:         it.Amount.InexactFloat64(),
+				Sum:         newAmount(r, it.Amount),
 				ProcessedAt: it.ProcessedAt.Format(time.RFC3339),
 			}
 		}
-		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Type", jsonContentType(r))
 		json.NewEncoder(w).Encode(resp)
 	}
 }
@@ -0,0 +1,58 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+// APIKeyPrefix starts every API key, telling them apart from JWT tokens.
+const APIKeyPrefix = "gmk_"
+
+// Scope is a permission granted to an API key.
+type Scope string
+
+const (
+	// ScopeOrdersRead allows listing orders.
+	ScopeOrdersRead Scope = "orders:read"
+	// ScopeOrdersWrite allows uploading orders.
+	ScopeOrdersWrite Scope = "orders:write"
+	// ScopeBalanceRead allows reading balance and withdrawals.
+	ScopeBalanceRead Scope = "balance:read"
+	// ScopeWithdraw allows withdrawing points.
+	ScopeWithdraw Scope = "withdraw"
+)
+
+// AllScopes lists every scope. Users logged in with a password are granted all of them.
+var AllScopes = []Scope{ScopeOrdersRead, ScopeOrdersWrite, ScopeBalanceRead, ScopeWithdraw}
+
+// ParseScope validates scope name.
+func ParseScope(s string) (Scope, error) {
+	for _, sc := range AllScopes {
+		if string(sc) == s {
+			return sc, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidScope, s)
+}
+
+// HasScope reports whether scopes contain s.
+func HasScope(scopes []Scope, s Scope) bool {
+	for _, sc := range scopes {
+		if sc == s {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey is a long-lived credential of a user limited to a set of scopes.
+// Only the hash of the key is stored, Prefix helps the user recognise it.
+type APIKey struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	Prefix     string
+	Scopes     []Scope
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
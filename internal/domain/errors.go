@@ -1,6 +1,9 @@
 package domain
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	// ErrConflictSelf indicates the order already belongs to the same user.
@@ -11,4 +14,38 @@ var (
 	ErrNotFound = errors.New("not found")
 	// ErrInsufficientFunds indicates not enough balance for withdrawal.
 	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrDuplicateWithdrawal indicates a withdrawal for the order already exists.
+	ErrDuplicateWithdrawal = errors.New("withdrawal for order already exists")
+	// ErrInvalidTransition indicates a forbidden order status change.
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	// ErrInvalidCredentials indicates wrong login or password.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrSessionInvalid indicates an unknown, expired or revoked session.
+	ErrSessionInvalid = errors.New("session is invalid")
+	// ErrRefreshTokenReused indicates an already rotated refresh token was
+	// presented again. The whole session family is revoked in this case.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// ErrInvalidScope indicates an unknown API key scope.
+	ErrInvalidScope = errors.New("invalid scope")
+	// ErrTooManyAttempts indicates login is throttled after failed attempts.
+	ErrTooManyAttempts = errors.New("too many login attempts")
+	// ErrResetTokenInvalid indicates an unknown, expired or used password reset token.
+	ErrResetTokenInvalid = errors.New("password reset token is invalid")
+	// ErrInvalidInput indicates a request failed validation. Errors wrapping
+	// it are usually *ValidationError listing the failing fields.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrAlreadyReversed indicates the ledger transaction has already been reversed.
+	ErrAlreadyReversed = errors.New("ledger transaction already reversed")
 )
+
+// ThrottledError is returned while login attempts are throttled.
+// It wraps ErrTooManyAttempts.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return ErrTooManyAttempts.Error() + ", retry after " + e.RetryAfter.String()
+}
+
+func (e *ThrottledError) Unwrap() error { return ErrTooManyAttempts }
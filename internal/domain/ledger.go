@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// LedgerEntryKind describes the operation that produced a ledger entry.
+type LedgerEntryKind string
+
+const (
+	// LedgerAccrual credits points accrued for a processed order.
+	LedgerAccrual LedgerEntryKind = "accrual"
+	// LedgerWithdrawal debits points spent on an order.
+	LedgerWithdrawal LedgerEntryKind = "withdrawal"
+	// LedgerAdjustment is a manual correction of the balance.
+	LedgerAdjustment LedgerEntryKind = "adjustment"
+	// LedgerReversal compensates a previously posted entry.
+	LedgerReversal LedgerEntryKind = "reversal"
+)
+
+// System ledger accounts used as counterparts of user accounts.
+const (
+	AccountAccrual     = "system:accrual"
+	AccountWithdrawals = "system:withdrawals"
+	AccountAdjustments = "system:adjustments"
+)
+
+// UserAccount returns the ledger account name of the user.
+func UserAccount(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+// LedgerEntry is a single posting of a double-entry transaction.
+// Amounts of all entries sharing TxID sum up to zero.
+type LedgerEntry struct {
+	ID          int64
+	TxID        int64
+	Account     string
+	UserID      int64
+	Kind        LedgerEntryKind
+	Amount      decimal.Decimal
+	OrderNumber string
+	ReversalOf  *int64
+	CreatedAt   time.Time
+}
@@ -11,15 +11,20 @@ type User struct {
 	ID           int64
 	Login        string
 	PasswordHash string
+	// TokenVersion changes with the password. Tokens issued for another
+	// version are rejected.
+	TokenVersion int
 }
 
 // Order represents user order uploaded for accrual processing.
 type Order struct {
 	Number     string
 	UserID     int64
-	Status     string
+	Status     OrderStatus
 	Accrual    *decimal.Decimal
 	UploadedAt time.Time
+	// Attempts is the number of consecutive failed accrual checks.
+	Attempts int
 }
 
 // Withdrawal represents loyalty points withdrawal by a user.
@@ -35,3 +40,66 @@ type Balance struct {
 	Current   decimal.Decimal
 	Withdrawn decimal.Decimal
 }
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	// EventOrder reports a new status of an order.
+	EventOrder EventType = "order"
+	// EventBalance reports the balance after it changed.
+	EventBalance EventType = "balance"
+)
+
+// Event is a change streamed to the user it concerns. IDs increase per
+// user, so a client can resume after the last event it received.
+type Event struct {
+	ID     int64
+	UserID int64
+	Type   EventType
+	// Order is set for EventOrder.
+	Order *Order
+	// Balance is set for EventBalance.
+	Balance   *Balance
+	CreatedAt time.Time
+}
+
+// IdempotencyRecord is a response stored for a request with Idempotency-Key.
+type IdempotencyRecord struct {
+	UserID      int64
+	Key         string
+	RequestHash string
+	// StatusCode is zero while the original request is in progress.
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// Session is a refresh token issued to a user. Every refresh rotates the
+// token: the used session is marked rotated and a new one of the same
+// family is created.
+type Session struct {
+	ID        string
+	FamilyID  string
+	UserID    int64
+	ExpiresAt time.Time
+	RotatedAt *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// TokenPair holds credentials issued to a user on login or refresh.
+type TokenPair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// LoginAttempts holds recent failed logins for a login name or a client address.
+type LoginAttempts struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
@@ -0,0 +1,34 @@
+package domain
+
+// OrderStatus is the processing status of an uploaded order.
+type OrderStatus string
+
+const (
+	// OrderNew means the order is uploaded but not yet processed.
+	OrderNew OrderStatus = "NEW"
+	// OrderProcessing means the accrual is being calculated.
+	OrderProcessing OrderStatus = "PROCESSING"
+	// OrderInvalid means the accrual system refused to calculate the accrual.
+	OrderInvalid OrderStatus = "INVALID"
+	// OrderProcessed means the accrual has been calculated.
+	OrderProcessed OrderStatus = "PROCESSED"
+)
+
+// IsTerminal reports whether the status is final.
+func (s OrderStatus) IsTerminal() bool {
+	return s == OrderInvalid || s == OrderProcessed
+}
+
+// CanTransition reports whether an order may move from s to next.
+// Orders only move forward: NEW -> PROCESSING -> PROCESSED or INVALID.
+// Repeating a non-terminal status is allowed, terminal statuses are final.
+func (s OrderStatus) CanTransition(next OrderStatus) bool {
+	switch s {
+	case OrderNew:
+		return next == OrderNew || next == OrderProcessing || next.IsTerminal()
+	case OrderProcessing:
+		return next == OrderProcessing || next.IsTerminal()
+	default:
+		return false
+	}
+}
@@ -0,0 +1,29 @@
+package domain
+
+import "testing"
+
+func TestOrderStatus_CanTransition(t *testing.T) {
+	tests := []struct {
+		from, to OrderStatus
+		want     bool
+	}{
+		{OrderNew, OrderNew, true},
+		{OrderNew, OrderProcessing, true},
+		{OrderNew, OrderProcessed, true},
+		{OrderNew, OrderInvalid, true},
+		{OrderProcessing, OrderProcessing, true},
+		{OrderProcessing, OrderProcessed, true},
+		{OrderProcessing, OrderInvalid, true},
+		{OrderProcessing, OrderNew, false},
+		{OrderProcessed, OrderProcessing, false},
+		{OrderProcessed, OrderProcessed, false},
+		{OrderProcessed, OrderInvalid, false},
+		{OrderInvalid, OrderProcessed, false},
+		{OrderNew, OrderStatus("REGISTERED"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransition(tt.to); got != tt.want {
+			t.Errorf("%s -> %s: got %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package domain
+
+import "strings"
+
+// Validation error codes.
+const (
+	CodeRequired     = "required"
+	CodeTooShort     = "too_short"
+	CodeTooLong      = "too_long"
+	CodeInvalidChars = "invalid_chars"
+	CodeBreached     = "breached"
+	CodeNotPositive  = "not_positive"
+	CodeTooPrecise   = "too_many_decimals"
+	CodeInvalidURL   = "invalid_url"
+	CodeUnknown      = "unknown"
+)
+
+// FieldError describes a single invalid field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field failing validation. It wraps ErrInvalidInput.
+type ValidationError struct {
+	Fields []FieldError `json:"errors"`
+}
+
+// Add records a failing field.
+func (e *ValidationError) Add(field, code, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Err returns e if any field failed and nil otherwise.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return ErrInvalidInput.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Unwrap() error { return ErrInvalidInput }
@@ -0,0 +1,71 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// WebhookEvent is a kind of event sent to webhook endpoints.
+type WebhookEvent string
+
+const (
+	// WebhookOrderProcessed is sent when the accrual of an order is credited.
+	WebhookOrderProcessed WebhookEvent = "order.processed"
+	// WebhookOrderInvalid is sent when the accrual system rejects an order.
+	WebhookOrderInvalid WebhookEvent = "order.invalid"
+	// WebhookWithdrawalCreated is sent when points are withdrawn.
+	WebhookWithdrawalCreated WebhookEvent = "withdrawal.created"
+)
+
+// AllWebhookEvents lists every known webhook event.
+var AllWebhookEvents = []WebhookEvent{WebhookOrderProcessed, WebhookOrderInvalid, WebhookWithdrawalCreated}
+
+// Webhook is an endpoint receiving events. Endpoints with zero UserID are
+// registered by an administrator and receive events of every user.
+type Webhook struct {
+	ID     int64
+	UserID int64
+	URL    string
+	// Secret signs the deliveries.
+	Secret    string
+	Events    []WebhookEvent
+	CreatedAt time.Time
+}
+
+// DeliveryStatus is the state of a webhook delivery.
+type DeliveryStatus string
+
+const (
+	// DeliveryPending means the delivery is waiting for its next attempt.
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliveryDelivered means the endpoint accepted the delivery.
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryDead means the delivery failed too many times and is only
+	// sent again on request.
+	DeliveryDead DeliveryStatus = "dead"
+)
+
+// WebhookDelivery is an event queued for a single endpoint. It is written
+// in the same transaction as the change it reports.
+type WebhookDelivery struct {
+	ID        int64
+	WebhookID int64
+	Event     WebhookEvent
+	UserID    int64
+	// OrderNumber is the processed order or the order paid with a withdrawal.
+	OrderNumber string
+	// Amount is the accrual or the withdrawn sum, nil for invalid orders.
+	Amount     *decimal.Decimal
+	OccurredAt time.Time
+
+	Status        DeliveryStatus
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	DeliveredAt   *time.Time
+
+	// URL and Secret of the endpoint are set on claimed deliveries.
+	URL    string
+	Secret string
+}
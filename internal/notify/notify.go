@@ -0,0 +1,73 @@
+// Package notify delivers messages to users. Gophermart users have no
+// e-mail address yet, so the sinks here are meant for development: they
+// hand reset tokens to the operator instead of the user.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Log writes notifications to a logger. Anyone reading the log can use the
+// tokens, so it is only meant for dev mode.
+type Log struct {
+	l *zerolog.Logger
+}
+
+// NewLog creates notifier writing to l.
+func NewLog(l *zerolog.Logger) *Log {
+	return &Log{l: l}
+}
+
+// SendPasswordReset logs the reset token.
+func (n *Log) SendPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error {
+	n.l.Info().Str("login", login).Str("reset_token", token).Time("expires_at", expiresAt).Msg("password reset requested")
+	return nil
+}
+
+// File appends notifications to a file as JSON lines.
+type File struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFile creates notifier appending to the file at path.
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+type passwordResetMessage struct {
+	Type      string    `json:"type"`
+	Login     string    `json:"login"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SendPasswordReset appends the reset token to the file.
+func (n *File) SendPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error {
+	return n.write(passwordResetMessage{Type: "password_reset", Login: login, Token: token, ExpiresAt: expiresAt})
+}
+
+func (n *File) write(msg any) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,39 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFile_SendPasswordReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	n := NewFile(path)
+	exp := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	for _, login := range []string{"alice", "bob"} {
+		if err := n.SendPasswordReset(context.Background(), login, "tok-"+login, exp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	var msg passwordResetMessage
+	if err := json.Unmarshal([]byte(lines[1]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "password_reset" || msg.Login != "bob" || msg.Token != "tok-bob" || !msg.ExpiresAt.Equal(exp) {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"github.com/shopspring/decimal"
 
@@ -10,11 +11,23 @@ import (
 
 // UserRepo accesses user storage.
 type UserRepo interface {
-	// Create stores new user and returns its id.
+	// Create stores new user and returns its id. Logins are unique regardless of case.
 	// Returns ErrConflictSelf on unique violation.
 	Create(ctx context.Context, login, hash string) (int64, error)
-	// GetByLogin returns user by login. Returns ErrNotFound if absent.
+	// GetByLogin returns user by login compared case-insensitively.
+	// Returns ErrNotFound if absent.
 	GetByLogin(ctx context.Context, login string) (domain.User, error)
+	// GetByID returns user by id. Returns ErrNotFound if absent.
+	GetByID(ctx context.Context, id int64) (domain.User, error)
+	// UpdatePasswordHash replaces password hash of the user, e.g. to upgrade
+	// the hashing algorithm. Returns ErrNotFound if absent.
+	UpdatePasswordHash(ctx context.Context, userID int64, hash string) error
+	// ChangePassword replaces password hash of the user, increments token
+	// version and revokes all its sessions at once. Returns the new version
+	// or ErrNotFound if absent.
+	ChangePassword(ctx context.Context, userID int64, hash string) (int, error)
+	// TokenVersion returns token version of the user. Returns ErrNotFound if absent.
+	TokenVersion(ctx context.Context, userID int64) (int, error)
 }
 
 // OrderRepo accesses order storage.
@@ -22,25 +35,206 @@ type OrderRepo interface {
 	// Add stores a new order for user.
 	// Returns ErrConflictSelf if the order already belongs to this user,
 	// ErrConflictOther if it belongs to another user.
-	Add(ctx context.Context, num string, userID int64, status string) (errConflictSelf, errConflictOther, err error)
+	Add(ctx context.Context, num string, userID int64, status domain.OrderStatus) (errConflictSelf, errConflictOther, err error)
 	// ListByUser returns orders uploaded by the user sorted by upload time desc.
 	// Limit and offset define pagination parameters.
 	ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Order, error)
-	// GetUnprocessed returns a list of orders with status NEW or PROCESSING up to limit.
+	// GetUnprocessed returns a list of orders with status NEW or PROCESSING
+	// that are due for a check, up to limit.
 	GetUnprocessed(ctx context.Context, limit int) ([]domain.Order, error)
+	// Claim leases up to limit due orders with status NEW or PROCESSING to owner for ttl.
+	// Orders leased by other owners are skipped until their lease expires.
+	Claim(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.Order, error)
+	// Release drops the lease held by owner on the order.
+	Release(ctx context.Context, num, owner string) error
 	// UpdateStatus updates order status and optional accrual.
-	UpdateStatus(ctx context.Context, num, status string, accrual *decimal.Decimal) error
-	// SumProcessedAccrualByUser returns total accrual for processed orders of the user.
-	SumProcessedAccrualByUser(ctx context.Context, userID int64) (decimal.Decimal, error)
+	// Returns ErrInvalidTransition if the current status can't be changed to status.
+	// Accrual is credited to the ledger when the order becomes PROCESSED.
+	// Orders becoming PROCESSED or INVALID are queued for the webhooks
+	// subscribed to the event in the same transaction.
+	// When the status changes, failed attempts counter is reset and the order
+	// becomes due immediately. Repeating the current status changes nothing,
+	// so the backoff of the order is kept.
+	// Returns ErrNotFound if the order is absent.
+	UpdateStatus(ctx context.Context, num string, status domain.OrderStatus, accrual *decimal.Decimal) error
+	// RecordFailure increments failed attempts of the order, stores lastErr
+	// and postpones its next check until next.
+	// Returns ErrNotFound if the order is absent.
+	RecordFailure(ctx context.Context, num, lastErr string, next time.Time) error
+	// Postpone moves the next check of the order to next without counting
+	// a failed attempt.
+	// Returns ErrNotFound if the order is absent.
+	Postpone(ctx context.Context, num string, next time.Time) error
 }
 
 // WithdrawalRepo accesses withdrawals storage.
 type WithdrawalRepo interface {
-	// Create registers a withdrawal request for user.
-	Create(ctx context.Context, num string, userID int64, amount decimal.Decimal) error
+	// Withdraw atomically checks user's balance, registers a withdrawal and
+	// debits the ledger. The withdrawal is queued for subscribed webhooks in
+	// the same transaction. Concurrent calls for the same user are serialized.
+	// Returns ErrInsufficientFunds if current balance is less than amount and
+	// ErrDuplicateWithdrawal if the order has already been used.
+	Withdraw(ctx context.Context, num string, userID int64, amount decimal.Decimal) error
 	// ListByUser returns withdrawal history for user sorted by processed time desc.
 	// Limit and offset define pagination parameters.
 	ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Withdrawal, error)
-	// SumByUser returns total amount withdrawn by user.
-	SumByUser(ctx context.Context, userID int64) (decimal.Decimal, error)
+}
+
+// LedgerRepo accesses the double-entry points ledger.
+type LedgerRepo interface {
+	// Adjust posts a manual adjustment of user's balance by amount,
+	// which may be negative, and returns the ledger transaction id.
+	Adjust(ctx context.Context, userID int64, amount decimal.Decimal) (int64, error)
+	// Reverse posts a transaction compensating every entry of txID and returns its id.
+	// Returns ErrNotFound if the transaction is absent and ErrAlreadyReversed
+	// if it has been reversed before.
+	Reverse(ctx context.Context, txID int64) (int64, error)
+	// Balance computes user's current and withdrawn amounts from the ledger.
+	Balance(ctx context.Context, userID int64) (domain.Balance, error)
+	// ListByUser returns entries of the user's account sorted by creation time desc.
+	// Limit and offset define pagination parameters.
+	ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.LedgerEntry, error)
+}
+
+// IdempotencyRepo stores responses of requests sent with Idempotency-Key header.
+type IdempotencyRepo interface {
+	// Reserve stores a new in-progress record for the user's key and returns true.
+	// If an unexpired record already exists it is returned with false. A record
+	// still in progress expires after lease, so a key left by a crashed request
+	// can be used again.
+	Reserve(ctx context.Context, userID int64, key, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error)
+	// Complete stores the response of the request made with the key.
+	Complete(ctx context.Context, userID int64, key string, statusCode int, contentType string, body []byte) error
+	// Delete removes the key so that the request may be retried.
+	Delete(ctx context.Context, userID int64, key string) error
+	// Prune removes records whose responses may no longer be replayed.
+	// Returns the number of removed records.
+	Prune(ctx context.Context) (int64, error)
+}
+
+// SessionRepo accesses refresh token sessions.
+type SessionRepo interface {
+	// Create stores a new session identified by the hash of its refresh token.
+	Create(ctx context.Context, s domain.Session, refreshHash string) error
+	// Rotate marks the session with refreshHash as rotated and stores next
+	// in the same family for the same user. It returns the stored next session.
+	// Returns ErrSessionInvalid if the session is unknown, expired or revoked,
+	// and ErrRefreshTokenReused after revoking the family if it was rotated before.
+	Rotate(ctx context.Context, refreshHash string, next domain.Session, nextHash string) (domain.Session, error)
+	// IsActive reports whether the session exists and has not been revoked.
+	IsActive(ctx context.Context, id string) (bool, error)
+	// RevokeFamily revokes every session of the family the session belongs to.
+	RevokeFamily(ctx context.Context, id string) error
+	// RevokeAll revokes every session of the user.
+	RevokeAll(ctx context.Context, userID int64) error
+}
+
+// APIKeyRepo accesses API keys.
+type APIKeyRepo interface {
+	// Create stores the key identified by hash and returns it with id set.
+	Create(ctx context.Context, k domain.APIKey, hash string) (domain.APIKey, error)
+	// GetByHash returns an active key and records its use. The use is only
+	// stored when the recorded one is more than a minute old, so busy keys
+	// don't cause a write per request.
+	// Returns ErrNotFound for unknown or revoked keys.
+	GetByHash(ctx context.Context, hash string) (domain.APIKey, error)
+	// ListByUser returns active keys of the user.
+	ListByUser(ctx context.Context, userID int64) ([]domain.APIKey, error)
+	// Revoke revokes the key of the user. Returns ErrNotFound if there is no such active key.
+	Revoke(ctx context.Context, userID, id int64) error
+}
+
+// LoginAttemptRepo accesses failed login counters shared by all replicas.
+type LoginAttemptRepo interface {
+	// Get returns counters for key, zero value if there were no failures.
+	Get(ctx context.Context, key string) (domain.LoginAttempts, error)
+	// Record counts an attempt as failed before it is made and returns the
+	// counters as they were before it. Concurrent attempts are counted one
+	// after another, so each sees the attempts recorded before it. Counting
+	// restarts when the previous failure is older than window. Once failures
+	// reach lockAfter the key is locked for lockFor.
+	Record(ctx context.Context, key string, window time.Duration, lockAfter int, lockFor time.Duration) (domain.LoginAttempts, error)
+	// Release uncounts an attempt recorded for key that succeeded. A lockout
+	// it caused is kept.
+	Release(ctx context.Context, key string) error
+	// Reset clears counters for key.
+	Reset(ctx context.Context, key string) error
+	// Prune removes counters whose last failure was before before and which
+	// are not locked anymore. Returns the number of removed counters.
+	Prune(ctx context.Context, before time.Time) (int64, error)
+}
+
+// PasswordResetRepo accesses password reset tokens.
+type PasswordResetRepo interface {
+	// Create stores a reset token identified by its hash.
+	Create(ctx context.Context, userID int64, tokenHash string, expiresAt time.Time) error
+	// Consume marks the token and all other tokens of its user as used and
+	// changes the password like UserRepo.ChangePassword at once, returning
+	// the user id.
+	// Returns ErrResetTokenInvalid if the token is unknown, expired or
+	// already used.
+	Consume(ctx context.Context, tokenHash, passwordHash string) (int64, error)
+}
+
+// Notifier delivers notifications between replicas sharing the storage.
+// Notifications are hints: they may be lost, for example while the
+// connection to the database is restored, so subscribers must also poll.
+type Notifier interface {
+	// Notify sends payload to the subscribers of channel in every replica.
+	Notify(ctx context.Context, channel, payload string) error
+	// Subscribe returns payloads sent to channel until ctx is done.
+	// An empty payload is also delivered after notifications may have
+	// been lost.
+	Subscribe(ctx context.Context, channel string) <-chan string
+}
+
+// EventRepo keeps a bounded log of the latest events of every user.
+type EventRepo interface {
+	// Append stores the event and returns its id. Ids are numbered per
+	// user and become visible in order: once an id is listed, no lower id
+	// of the user appears later. Events of the user beyond the keep latest
+	// ones are dropped.
+	Append(ctx context.Context, e domain.Event, keep int) (int64, error)
+	// ListAfter returns events of the user with ids greater than afterID
+	// in ascending order, up to limit.
+	ListAfter(ctx context.Context, userID, afterID int64, limit int) ([]domain.Event, error)
+	// LastID returns the id of the latest event of the user, zero if there
+	// are none.
+	LastID(ctx context.Context, userID int64) (int64, error)
+}
+
+// WebhookRepo accesses webhook endpoints and the outbox of their deliveries.
+// Endpoints are owned by a user; zero user id stands for endpoints of the
+// administrator, which receive events of every user.
+type WebhookRepo interface {
+	// Create stores the endpoint and returns it with id set.
+	Create(ctx context.Context, w domain.Webhook) (domain.Webhook, error)
+	// ListByUser returns endpoints of the user sorted by id.
+	ListByUser(ctx context.Context, userID int64) ([]domain.Webhook, error)
+	// Delete removes the endpoint of the user with all its deliveries.
+	// Returns ErrNotFound if there is no such endpoint.
+	Delete(ctx context.Context, userID, id int64) error
+	// ClaimDeliveries leases up to limit due pending deliveries to owner
+	// for ttl. Deliveries leased by other owners are skipped until their
+	// lease expires.
+	ClaimDeliveries(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.WebhookDelivery, error)
+	// MarkDelivered records a successful attempt and drops the lease held
+	// by owner. Nothing is changed if owner no longer holds the lease.
+	MarkDelivered(ctx context.Context, id int64, owner string) error
+	// RecordFailure increments attempts of the delivery, stores lastErr and
+	// drops the lease held by owner. The delivery is retried at next, or
+	// becomes dead if dead is set. Nothing is changed if owner no longer
+	// holds the lease.
+	RecordFailure(ctx context.Context, id int64, owner, lastErr string, next time.Time, dead bool) error
+	// ListDeliveries returns up to limit latest deliveries of the user's
+	// endpoint, newest first. Returns ErrNotFound if there is no such endpoint.
+	ListDeliveries(ctx context.Context, userID, webhookID int64, limit int) ([]domain.WebhookDelivery, error)
+	// Redeliver makes the delivery of the user's endpoint pending and due
+	// immediately with attempts reset and the lease dropped, whatever its
+	// status. Returns ErrNotFound if there is no such delivery.
+	Redeliver(ctx context.Context, userID, webhookID, id int64) error
+	// PruneDeliveries removes delivered deliveries sent before before and
+	// dead ones whose last attempt was before it. Returns the number of
+	// removed deliveries.
+	PruneDeliveries(ctx context.Context, before time.Time) (int64, error)
 }
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// apiKeyPrefixLen is the number of leading key characters kept in clear text.
+const apiKeyPrefixLen = len(domain.APIKeyPrefix) + 8
+
+// APIKeyService manages API keys and authenticates requests made with them.
+type APIKeyService struct {
+	repo repository.APIKeyRepo
+}
+
+// NewAPIKeyService creates a new APIKeyService instance.
+func NewAPIKeyService(repo repository.APIKeyRepo) *APIKeyService {
+	return &APIKeyService{repo: repo}
+}
+
+// Create issues a new key with given scopes. The key itself is returned only
+// once, the repository keeps its hash.
+// Returns ErrInvalidScope if scopes are empty or unknown.
+func (s *APIKeyService) Create(ctx context.Context, userID int64, name string, scopes []string) (domain.APIKey, string, error) {
+	if len(scopes) == 0 {
+		return domain.APIKey{}, "", domain.ErrInvalidScope
+	}
+	k := domain.APIKey{UserID: userID, Name: name}
+	for _, sc := range scopes {
+		parsed, err := domain.ParseScope(sc)
+		if err != nil {
+			return domain.APIKey{}, "", err
+		}
+		if !domain.HasScope(k.Scopes, parsed) {
+			k.Scopes = append(k.Scopes, parsed)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return domain.APIKey{}, "", err
+	}
+	key := domain.APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	k.Prefix = key[:apiKeyPrefixLen]
+
+	k, err := s.repo.Create(ctx, k, hashAPIKey(key))
+	if err != nil {
+		return domain.APIKey{}, "", err
+	}
+	return k, key, nil
+}
+
+// List returns active keys of the user.
+func (s *APIKeyService) List(ctx context.Context, userID int64) ([]domain.APIKey, error) {
+	return s.repo.ListByUser(ctx, userID)
+}
+
+// Revoke revokes the key of the user.
+func (s *APIKeyService) Revoke(ctx context.Context, userID, id int64) error {
+	return s.repo.Revoke(ctx, userID, id)
+}
+
+// Authenticate returns the owner and the scopes of an active key.
+// Returns ErrNotFound for unknown or revoked keys.
+func (s *APIKeyService) Authenticate(ctx context.Context, key string) (int64, []domain.Scope, error) {
+	if !strings.HasPrefix(key, domain.APIKeyPrefix) {
+		return 0, nil, domain.ErrNotFound
+	}
+	k, err := s.repo.GetByHash(ctx, hashAPIKey(key))
+	if err != nil {
+		return 0, nil, err
+	}
+	return k.UserID, k.Scopes, nil
+}
+
+// hashAPIKey hashes a key. Keys are random, so a fast hash is enough.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type stubAPIKeyRepo struct {
+	keys map[string]domain.APIKey
+}
+
+func (s *stubAPIKeyRepo) Create(ctx context.Context, k domain.APIKey, hash string) (domain.APIKey, error) {
+	k.ID = int64(len(s.keys) + 1)
+	s.keys[hash] = k
+	return k, nil
+}
+
+func (s *stubAPIKeyRepo) GetByHash(ctx context.Context, hash string) (domain.APIKey, error) {
+	k, ok := s.keys[hash]
+	if !ok {
+		return domain.APIKey{}, domain.ErrNotFound
+	}
+	return k, nil
+}
+
+func (s *stubAPIKeyRepo) ListByUser(ctx context.Context, userID int64) ([]domain.APIKey, error) {
+	return nil, nil
+}
+
+func (s *stubAPIKeyRepo) Revoke(ctx context.Context, userID, id int64) error {
+	return nil
+}
+
+func TestAPIKeyService_CreateAndAuthenticate(t *testing.T) {
+	repo := &stubAPIKeyRepo{keys: map[string]domain.APIKey{}}
+	svc := NewAPIKeyService(repo)
+	ctx := context.Background()
+
+	k, key, err := svc.Create(ctx, 3, "ci", []string{"orders:write", "balance:read", "orders:write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, domain.APIKeyPrefix) || !strings.HasPrefix(key, k.Prefix) {
+		t.Fatalf("unexpected key %s with prefix %s", key, k.Prefix)
+	}
+	if len(k.Scopes) != 2 {
+		t.Fatalf("expected duplicate scopes removed, got %v", k.Scopes)
+	}
+	for hash := range repo.keys {
+		if strings.Contains(hash, key) {
+			t.Fatal("key stored in clear text")
+		}
+	}
+
+	userID, scopes, err := svc.Authenticate(ctx, key)
+	if err != nil || userID != 3 || !domain.HasScope(scopes, domain.ScopeBalanceRead) {
+		t.Fatalf("authenticate: %d %v %v", userID, scopes, err)
+	}
+	if _, _, err := svc.Authenticate(ctx, key+"x"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestAPIKeyService_InvalidScope(t *testing.T) {
+	svc := NewAPIKeyService(&stubAPIKeyRepo{keys: map[string]domain.APIKey{}})
+
+	for _, scopes := range [][]string{nil, {"admin"}} {
+		if _, _, err := svc.Create(context.Background(), 1, "ci", scopes); !errors.Is(err, domain.ErrInvalidScope) {
+			t.Fatalf("scopes %v: expected invalid scope, got %v", scopes, err)
+		}
+	}
+}
@@ -18,9 +18,9 @@ type BalanceInvalidator interface {
 }
 
 // BalanceService provides current balance calculation logic.
+// Balances are derived from the points ledger.
 type BalanceService struct {
-	orders      repository.OrderRepo
-	withdrawals repository.WithdrawalRepo
+	ledger repository.LedgerRepo
 
 	mu    sync.Mutex
 	cache *lru.Cache
@@ -28,15 +28,25 @@ type BalanceService struct {
 }
 
 // NewBalanceService creates a new BalanceService instance.
-func NewBalanceService(o repository.OrderRepo, w repository.WithdrawalRepo) *BalanceService {
+func NewBalanceService(l repository.LedgerRepo) *BalanceService {
 	return &BalanceService{
-		orders:      o,
-		withdrawals: w,
-		cache:       lru.New(0),
-		ttl:         30 * time.Second,
+		ledger: l,
+		cache:  lru.New(0),
+		ttl:    defaultBalanceTTL,
 	}
 }
 
+// defaultBalanceTTL is how long a balance is cached unless changed with SetTTL.
+const defaultBalanceTTL = 30 * time.Second
+
+// SetTTL changes how long balances are cached. It is safe to call while the
+// service is in use; cached balances keep their expiry.
+func (s *BalanceService) SetTTL(d time.Duration) {
+	s.mu.Lock()
+	s.ttl = d
+	s.mu.Unlock()
+}
+
 // GetBalance returns current and withdrawn amounts for user.
 func (s *BalanceService) GetBalance(ctx context.Context, userID int64) (domain.Balance, error) {
 	key := fmt.Sprintf("balance:%d", userID)
@@ -53,16 +63,10 @@ func (s *BalanceService) GetBalance(ctx context.Context, userID int64) (domain.B
 	}
 	s.mu.Unlock()
 
-	totalAccrual, err := s.orders.SumProcessedAccrualByUser(ctx, userID)
-	if err != nil {
-		return domain.Balance{}, err
-	}
-	totalWithdrawn, err := s.withdrawals.SumByUser(ctx, userID)
+	bal, err := s.ledger.Balance(ctx, userID)
 	if err != nil {
 		return domain.Balance{}, err
 	}
-	current := totalAccrual.Sub(totalWithdrawn)
-	bal := domain.Balance{Current: current, Withdrawn: totalWithdrawn}
 
 	s.mu.Lock()
 	s.cache.Add(key, cacheItem{bal: bal, exp: time.Now().Add(s.ttl)})
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"path/filepath"
 	"testing"
 	"time"
 
@@ -65,12 +64,7 @@ func setupPostgresBal(t *testing.T) (*pgxpool.Pool, func()) {
 		t.Fatal(err)
 	}
 
-	path := filepath.Join("migrations", "0001_init.up.sql")
-	b, err := os.ReadFile(path)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if _, err := pool.Exec(ctx, string(b)); err != nil {
+	if err := postgres.ApplyMigrations(ctx, pool); err != nil {
 		t.Fatal(err)
 	}
 
@@ -112,11 +106,11 @@ func TestBalanceService_GetBalance(t *testing.T) {
 		t.Fatalf("add order: %v", err)
 	}
 
-	if err := withdrawalRepo.Create(ctx, "w1", uid, decimal.NewFromInt(8)); err != nil {
-		t.Fatalf("withdraw create: %v", err)
+	if err := withdrawalRepo.Withdraw(ctx, "w1", uid, decimal.NewFromInt(8)); err != nil {
+		t.Fatalf("withdraw: %v", err)
 	}
 
-	svc := NewBalanceService(orderRepo, withdrawalRepo)
+	svc := NewBalanceService(postgres.NewLedgerRepo(pool))
 	bal, err := svc.GetBalance(ctx, uid)
 	if err != nil {
 		t.Fatalf("get balance: %v", err)
@@ -130,42 +124,25 @@ func TestBalanceService_GetBalance(t *testing.T) {
 	}
 }
 
-type stubOrderRepoBal struct{ calls int }
+type stubLedgerRepoBal struct{ calls int }
 
-func (s *stubOrderRepoBal) Add(ctx context.Context, num string, userID int64, status string) (error, error, error) {
-	return nil, nil, nil
-}
-func (s *stubOrderRepoBal) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Order, error) {
-	return nil, nil
-}
-func (s *stubOrderRepoBal) GetUnprocessed(ctx context.Context, limit int) ([]domain.Order, error) {
-	return nil, nil
+func (s *stubLedgerRepoBal) Adjust(ctx context.Context, userID int64, amount decimal.Decimal) (int64, error) {
+	return 0, nil
 }
-func (s *stubOrderRepoBal) UpdateStatus(ctx context.Context, num, status string, accrual *decimal.Decimal) error {
-	return nil
+func (s *stubLedgerRepoBal) Reverse(ctx context.Context, txID int64) (int64, error) {
+	return 0, nil
 }
-func (s *stubOrderRepoBal) SumProcessedAccrualByUser(ctx context.Context, userID int64) (decimal.Decimal, error) {
+func (s *stubLedgerRepoBal) Balance(ctx context.Context, userID int64) (domain.Balance, error) {
 	s.calls++
-	return decimal.NewFromInt(10), nil
-}
-
-type stubWithdrawalRepoBal struct{ calls int }
-
-func (s *stubWithdrawalRepoBal) Create(ctx context.Context, num string, userID int64, amount decimal.Decimal) error {
-	return nil
+	return domain.Balance{Current: decimal.NewFromInt(5), Withdrawn: decimal.NewFromInt(5)}, nil
 }
-func (s *stubWithdrawalRepoBal) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Withdrawal, error) {
+func (s *stubLedgerRepoBal) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.LedgerEntry, error) {
 	return nil, nil
 }
-func (s *stubWithdrawalRepoBal) SumByUser(ctx context.Context, userID int64) (decimal.Decimal, error) {
-	s.calls++
-	return decimal.NewFromInt(5), nil
-}
 
 func TestBalanceService_Cache(t *testing.T) {
-	oRepo := &stubOrderRepoBal{}
-	wRepo := &stubWithdrawalRepoBal{}
-	svc := NewBalanceService(oRepo, wRepo)
+	repo := &stubLedgerRepoBal{}
+	svc := NewBalanceService(repo)
 	ctx := context.Background()
 
 	for i := 0; i < 3; i++ {
@@ -177,7 +154,7 @@ func TestBalanceService_Cache(t *testing.T) {
 			t.Fatalf("unexpected balance %+v", bal)
 		}
 	}
-	if oRepo.calls != 1 || wRepo.calls != 1 {
-		t.Fatalf("expected single repo call, got %d %d", oRepo.calls, wRepo.calls)
+	if repo.calls != 1 {
+		t.Fatalf("expected single repo call, got %d", repo.calls)
 	}
 }
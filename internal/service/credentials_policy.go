@@ -0,0 +1,114 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+// LoginPolicy defines which logins may be registered. Logins are compared
+// case-insensitively after NormalizeLogin.
+type LoginPolicy struct {
+	// MinLength and MaxLength bound the login length in characters.
+	MinLength int
+	MaxLength int
+	// Pattern must match the whole normalized login. Nil allows any characters.
+	Pattern *regexp.Regexp
+}
+
+// PasswordPolicy defines which passwords may be set.
+type PasswordPolicy struct {
+	// MinLength and MaxLength bound the password length in characters.
+	MinLength int
+	MaxLength int
+	// Breached lists passwords known from leaks, which are rejected.
+	Breached PasswordList
+}
+
+var (
+	// DefaultLoginPolicy allows letters, digits, dots, dashes and underscores.
+	DefaultLoginPolicy = LoginPolicy{
+		MinLength: 3,
+		MaxLength: 64,
+		Pattern:   regexp.MustCompile(`^[\p{L}\p{N}._-]+$`),
+	}
+	// DefaultPasswordPolicy requires at least 8 characters.
+	DefaultPasswordPolicy = PasswordPolicy{
+		MinLength: 8,
+		MaxLength: 256,
+	}
+)
+
+// NormalizeLogin brings login to Unicode NFKC form, so that visually equal
+// logins typed differently are the same login.
+func NormalizeLogin(login string) string {
+	return norm.NFKC.String(login)
+}
+
+// validate checks the normalized login and records violations in verr.
+func (p LoginPolicy) validate(login string, verr *domain.ValidationError) {
+	n := utf8.RuneCountInString(login)
+	switch {
+	case n == 0:
+		verr.Add("login", domain.CodeRequired, "login is required")
+	case n < p.MinLength:
+		verr.Add("login", domain.CodeTooShort, fmt.Sprintf("login must be at least %d characters", p.MinLength))
+	case p.MaxLength > 0 && n > p.MaxLength:
+		verr.Add("login", domain.CodeTooLong, fmt.Sprintf("login must be at most %d characters", p.MaxLength))
+	case p.Pattern != nil && !p.Pattern.MatchString(login):
+		verr.Add("login", domain.CodeInvalidChars, "login contains characters that are not allowed")
+	}
+}
+
+// validate checks the password given in field and records violations in verr.
+func (p PasswordPolicy) validate(field, password string, verr *domain.ValidationError) {
+	n := utf8.RuneCountInString(password)
+	switch {
+	case n == 0:
+		verr.Add(field, domain.CodeRequired, "password is required")
+	case n < p.MinLength:
+		verr.Add(field, domain.CodeTooShort, fmt.Sprintf("password must be at least %d characters", p.MinLength))
+	case p.MaxLength > 0 && n > p.MaxLength:
+		verr.Add(field, domain.CodeTooLong, fmt.Sprintf("password must be at most %d characters", p.MaxLength))
+	case p.Breached.Contains(password):
+		verr.Add(field, domain.CodeBreached, "password appears in a list of breached passwords")
+	}
+}
+
+// PasswordList is a set of passwords.
+type PasswordList map[string]struct{}
+
+// Contains reports whether password is in the list.
+func (l PasswordList) Contains(password string) bool {
+	_, ok := l[password]
+	return ok
+}
+
+// LoadPasswordList reads passwords from a file, one per line.
+// Empty lines are skipped.
+func LoadPasswordList(path string) (PasswordList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := PasswordList{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if p := strings.TrimRight(sc.Text(), "\r"); p != "" {
+			l[p] = struct{}{}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+	"github.com/Hobrus/gophermarket/pkg/logger"
+)
+
+// EventsChannel is the notification channel announcing new user events to
+// the streams of every replica. Payloads are user ids.
+const EventsChannel = "gophermart_user_events"
+
+// eventLogSize is the number of latest events kept for every user. Clients
+// that reconnect later than that miss the older events.
+const eventLogSize = 100
+
+// BalanceGetter returns the current balance of a user.
+type BalanceGetter interface {
+	GetBalance(ctx context.Context, userID int64) (domain.Balance, error)
+}
+
+// EventService records changes of orders and balances in the user event log
+// and announces them to the event streams.
+type EventService struct {
+	repo     repository.EventRepo
+	notifier repository.Notifier
+	balances BalanceGetter
+}
+
+// NewEventService creates a new EventService instance.
+func NewEventService(repo repository.EventRepo, n repository.Notifier, b BalanceGetter) *EventService {
+	return &EventService{repo: repo, notifier: n, balances: b}
+}
+
+// OrderUpdated records the new status of the order and, once the order is
+// processed, the new balance of its owner. Events are best effort: the
+// order is already stored, so errors are only logged.
+func (s *EventService) OrderUpdated(ctx context.Context, o domain.Order) {
+	s.publish(ctx, domain.Event{UserID: o.UserID, Type: domain.EventOrder, Order: &o})
+	if o.Status == domain.OrderProcessed {
+		s.BalanceChanged(ctx, o.UserID)
+	}
+}
+
+// BalanceChanged records the current balance of the user, e.g. after a
+// withdrawal. Like OrderUpdated, it only logs errors.
+func (s *EventService) BalanceChanged(ctx context.Context, userID int64) {
+	bal, err := s.balances.GetBalance(ctx, userID)
+	if err != nil {
+		if l := logger.FromContext(ctx); l != nil {
+			l.Warn().Err(err).Int64("user", userID).Msg("balance event dropped, the balance can't be read")
+		}
+		return
+	}
+	s.publish(ctx, domain.Event{UserID: userID, Type: domain.EventBalance, Balance: &bal})
+}
+
+// publish stores the event and announces it to the streams.
+func (s *EventService) publish(ctx context.Context, e domain.Event) {
+	if _, err := s.repo.Append(ctx, e, eventLogSize); err != nil {
+		if l := logger.FromContext(ctx); l != nil {
+			l.Warn().Err(err).Int64("user", e.UserID).Str("event", string(e.Type)).Msg("user event dropped, it can't be stored")
+		}
+		return
+	}
+	if err := s.notifier.Notify(ctx, EventsChannel, strconv.FormatInt(e.UserID, 10)); err != nil {
+		// the event is stored, streams poll for it
+		if l := logger.FromContext(ctx); l != nil {
+			l.Warn().Err(err).Int64("user", e.UserID).Str("event", string(e.Type)).Msg("user event notification failed, streams see the event on their next poll")
+		}
+	}
+}
+
+// LastID returns the id of the latest event of the user, zero if none.
+func (s *EventService) LastID(ctx context.Context, userID int64) (int64, error) {
+	return s.repo.LastID(ctx, userID)
+}
+
+// Since returns the kept events of the user after afterID in order.
+func (s *EventService) Since(ctx context.Context, userID, afterID int64) ([]domain.Event, error) {
+	return s.repo.ListAfter(ctx, userID, afterID, eventLogSize)
+}
+
+// Subscribe signals when the user may have new events, until ctx is done.
+// Signals are coalesced and may be lost, so readers should also poll.
+func (s *EventService) Subscribe(ctx context.Context, userID int64) <-chan struct{} {
+	notes := s.notifier.Subscribe(ctx, EventsChannel)
+	signal := make(chan struct{}, 1)
+	uid := strconv.FormatInt(userID, 10)
+	go func() {
+		defer close(signal)
+		for p := range notes {
+			// an empty payload means notifications were lost
+			if p != uid && p != "" {
+				continue
+			}
+			select {
+			case signal <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return signal
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/storage/memory"
+	"github.com/Hobrus/gophermarket/pkg/logger"
+)
+
+type stubBalances struct{ bal domain.Balance }
+
+func (s stubBalances) GetBalance(ctx context.Context, userID int64) (domain.Balance, error) {
+	return s.bal, nil
+}
+
+func TestEventService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bal := domain.Balance{Current: decimal.NewFromInt(10)}
+	svc := NewEventService(memory.NewEventRepo(memory.NewStore()), memory.NewNotifier(), stubBalances{bal})
+
+	alice := svc.Subscribe(ctx, 1)
+	bob := svc.Subscribe(ctx, 2)
+
+	svc.OrderUpdated(ctx, domain.Order{Number: "1", UserID: 1, Status: domain.OrderProcessing})
+	accrual := decimal.NewFromInt(10)
+	svc.OrderUpdated(ctx, domain.Order{Number: "1", UserID: 1, Status: domain.OrderProcessed, Accrual: &accrual})
+
+	select {
+	case <-alice:
+	case <-time.After(time.Second):
+		t.Fatal("expected a signal for the owner")
+	}
+	select {
+	case <-bob:
+		t.Fatal("unexpected signal for another user")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	events, err := svc.Since(ctx, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 2 order events and a balance event, got %+v", events)
+	}
+	if events[0].Order.Status != domain.OrderProcessing || events[1].Order.Status != domain.OrderProcessed {
+		t.Fatalf("unexpected order events %+v", events[:2])
+	}
+	if events[2].Type != domain.EventBalance || !events[2].Balance.Current.Equal(bal.Current) {
+		t.Fatalf("unexpected balance event %+v", events[2])
+	}
+	if last, err := svc.LastID(ctx, 1); err != nil || last != events[2].ID {
+		t.Fatalf("expected last id %d, got %d %v", events[2].ID, last, err)
+	}
+	if rest, err := svc.Since(ctx, 1, events[1].ID); err != nil || len(rest) != 1 {
+		t.Fatalf("expected one event after %d, got %+v %v", events[1].ID, rest, err)
+	}
+}
+
+type failingEventRepo struct{ err error }
+
+func (r failingEventRepo) Append(ctx context.Context, e domain.Event, keep int) (int64, error) {
+	return 0, r.err
+}
+
+func (r failingEventRepo) ListAfter(ctx context.Context, userID, afterID int64, limit int) ([]domain.Event, error) {
+	return nil, r.err
+}
+
+func (r failingEventRepo) LastID(ctx context.Context, userID int64) (int64, error) {
+	return 0, r.err
+}
+
+func TestEventService_LogsErrors(t *testing.T) {
+	var buf bytes.Buffer
+	l := zerolog.New(&buf)
+	ctx := logger.WithLogger(context.Background(), &l)
+	svc := NewEventService(failingEventRepo{errors.New("disk full")}, memory.NewNotifier(), stubBalances{})
+
+	svc.OrderUpdated(ctx, domain.Order{Number: "1", UserID: 1, Status: domain.OrderProcessed})
+	if out := buf.String(); strings.Count(out, `"level":"warn"`) != 2 || !strings.Contains(out, "disk full") {
+		t.Fatalf("expected warnings for the order and the balance event, got %q", out)
+	}
+}
+
+func TestWithdrawService_PublishesBalance(t *testing.T) {
+	ctx := context.Background()
+	bal := domain.Balance{Current: decimal.NewFromInt(5)}
+	events := NewEventService(memory.NewEventRepo(memory.NewStore()), memory.NewNotifier(), stubBalances{bal})
+	svc := NewWithdrawService(&stubWithdrawals{}, nil)
+	svc.SetObserver(events)
+
+	if err := svc.Withdraw(ctx, 1, "79927398713", decimal.NewFromInt(5)); err != nil {
+		t.Fatal(err)
+	}
+	list, err := events.Since(ctx, 1, 0)
+	if err != nil || len(list) != 1 || list[0].Type != domain.EventBalance || !list[0].Balance.Current.Equal(bal.Current) {
+		t.Fatalf("expected a balance event, got %+v %v", list, err)
+	}
+}
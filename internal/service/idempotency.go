@@ -0,0 +1,33 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/repository"
+	"github.com/Hobrus/gophermarket/pkg/logger"
+)
+
+// PruneIdempotencyKeys removes expired idempotency keys once every
+// pruneInterval until ctx is done. Keys are only taken over when reused,
+// so without it a row is kept for every key ever sent.
+func PruneIdempotencyKeys(ctx context.Context, repo repository.IdempotencyRepo) {
+	pruneIdempotencyKeys(ctx, repo, pruneInterval)
+}
+
+func pruneIdempotencyKeys(ctx context.Context, repo repository.IdempotencyRepo, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := repo.Prune(ctx); err != nil && ctx.Err() == nil {
+			if l := logger.FromContext(ctx); l != nil {
+				l.Warn().Err(err).Msg("pruning idempotency keys failed")
+			}
+		}
+	}
+}
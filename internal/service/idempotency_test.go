@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/repository"
+	"github.com/Hobrus/gophermarket/internal/storage/memory"
+)
+
+type countingIdempotencyRepo struct {
+	repository.IdempotencyRepo
+	pruned atomic.Int32
+}
+
+func (r *countingIdempotencyRepo) Prune(ctx context.Context) (int64, error) {
+	r.pruned.Add(1)
+	return r.IdempotencyRepo.Prune(ctx)
+}
+
+func TestPruneIdempotencyKeys(t *testing.T) {
+	repo := &countingIdempotencyRepo{IdempotencyRepo: memory.NewIdempotencyRepo(memory.NewStore())}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pruneIdempotencyKeys(ctx, repo, 5*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	<-done
+	if repo.pruned.Load() == 0 {
+		t.Fatal("expected keys to be pruned on every tick")
+	}
+}
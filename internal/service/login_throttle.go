@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+	"github.com/Hobrus/gophermarket/pkg/logger"
+)
+
+// ThrottlePolicy defines how failed logins slow down further attempts.
+type ThrottlePolicy struct {
+	// FreeAttempts is the number of failures allowed without delay.
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure beyond FreeAttempts.
+	// It doubles with every subsequent failure.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts.
+	MaxDelay time.Duration
+	// LockoutAfter is the number of failures locking the key for LockoutFor.
+	// Zero disables lockout.
+	LockoutAfter int
+	LockoutFor   time.Duration
+	// Window is how long a failure is remembered.
+	Window time.Duration
+}
+
+// wait returns how long the next attempt must wait after a failures.
+func (p ThrottlePolicy) wait(a domain.LoginAttempts, now time.Time) time.Duration {
+	var until time.Time
+	if a.LockedUntil != nil {
+		until = *a.LockedUntil
+	}
+	if a.Failures > p.FreeAttempts && now.Sub(a.LastFailureAt) < p.Window {
+		d := p.BaseDelay
+		for i := p.FreeAttempts + 1; i < a.Failures && d < p.MaxDelay; i++ {
+			d *= 2
+		}
+		if p.MaxDelay > 0 && d > p.MaxDelay {
+			d = p.MaxDelay
+		}
+		if next := a.LastFailureAt.Add(d); next.After(until) {
+			until = next
+		}
+	}
+	if until.After(now) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+var (
+	// DefaultLoginThrottle applies to a single login name.
+	DefaultLoginThrottle = ThrottlePolicy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		LockoutAfter: 10,
+		LockoutFor:   15 * time.Minute,
+		Window:       15 * time.Minute,
+	}
+	// DefaultIPThrottle applies to a client address. It is looser than the
+	// login policy since many users may share an address.
+	DefaultIPThrottle = ThrottlePolicy{
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		LockoutAfter: 100,
+		LockoutFor:   15 * time.Minute,
+		Window:       15 * time.Minute,
+	}
+	// DefaultResetThrottle applies to password reset requests for a single
+	// login. There is no lockout, which would let anyone block the resets
+	// of a user.
+	DefaultResetThrottle = ThrottlePolicy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     15 * time.Minute,
+		Window:       time.Hour,
+	}
+	// DefaultResetIPThrottle applies to password reset requests from a
+	// client address.
+	DefaultResetIPThrottle = ThrottlePolicy{
+		FreeAttempts: 10,
+		BaseDelay:    time.Second,
+		MaxDelay:     15 * time.Minute,
+		LockoutAfter: 50,
+		LockoutFor:   time.Hour,
+		Window:       time.Hour,
+	}
+)
+
+// LoginThrottler limits failed logins per login name and per client address.
+// Throttled attempts are rejected before the password is checked, so they
+// cost no hashing. Every attempt is counted as failed before it is made, so
+// concurrent attempts can't all slip through before the first failure is
+// recorded.
+type LoginThrottler struct {
+	repo repository.LoginAttemptRepo
+	// scope prefixes the keys, so throttlers of different actions don't
+	// share counters
+	scope string
+
+	mu    sync.Mutex
+	login ThrottlePolicy
+	ip    ThrottlePolicy
+}
+
+// NewLoginThrottler creates a throttler with default policies.
+func NewLoginThrottler(repo repository.LoginAttemptRepo) *LoginThrottler {
+	return &LoginThrottler{repo: repo, login: DefaultLoginThrottle, ip: DefaultIPThrottle}
+}
+
+// NewResetThrottler creates a throttler of password reset requests with
+// default policies. Every request counts and Success is never called, so it
+// limits how many tokens are sent for a login and from an address.
+func NewResetThrottler(repo repository.LoginAttemptRepo) *LoginThrottler {
+	return &LoginThrottler{repo: repo, scope: "reset:", login: DefaultResetThrottle, ip: DefaultResetIPThrottle}
+}
+
+// SetPolicies replaces policies for login names and client addresses.
+// It may be called while the throttler is in use.
+func (t *LoginThrottler) SetPolicies(login, ip ThrottlePolicy) {
+	t.mu.Lock()
+	t.login = login
+	t.ip = ip
+	t.mu.Unlock()
+}
+
+func (t *LoginThrottler) policies() (login, ip ThrottlePolicy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.login, t.ip
+}
+
+// loginKey normalizes login like AuthService.Login does, so spellings of
+// the same login share the counter.
+func (t *LoginThrottler) loginKey(login string) string {
+	return t.scope + "login:" + strings.ToLower(NormalizeLogin(login))
+}
+
+func (t *LoginThrottler) ipKey(ip string) string { return t.scope + "ip:" + ip }
+
+type throttleCounter struct {
+	key    string
+	policy ThrottlePolicy
+}
+
+func (t *LoginThrottler) counters(login, ip string) []throttleCounter {
+	loginPolicy, ipPolicy := t.policies()
+	return []throttleCounter{{t.loginKey(login), loginPolicy}, {t.ipKey(ip), ipPolicy}}
+}
+
+// Attempt reserves an attempt for login from ip, counting it as failed.
+// It returns ThrottledError if the attempt must wait. A client that is
+// already throttled is refused without counting, so retrying too early
+// doesn't extend the wait.
+func (t *LoginThrottler) Attempt(ctx context.Context, login, ip string) error {
+	now := time.Now()
+	counters := t.counters(login, ip)
+	var wait time.Duration
+	for _, c := range counters {
+		a, err := t.repo.Get(ctx, c.key)
+		if err != nil {
+			return err
+		}
+		wait = max(wait, c.policy.wait(a, now))
+	}
+	if wait == 0 {
+		// the check is repeated on the counters seen by the reservation,
+		// which include the attempts reserved concurrently
+		for _, c := range counters {
+			prev, err := t.repo.Record(ctx, c.key, c.policy.Window, c.policy.LockoutAfter, c.policy.LockoutFor)
+			if err != nil {
+				return err
+			}
+			wait = max(wait, c.policy.wait(prev, now))
+		}
+	}
+	if wait > 0 {
+		return &domain.ThrottledError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// window returns how long the throttler looks back at failures.
+func (t *LoginThrottler) window() time.Duration {
+	login, ip := t.policies()
+	return max(login.Window, ip.Window)
+}
+
+// Success clears failures of login and uncounts the attempt from ip.
+// Address failures are kept, otherwise logging into an own account would
+// reset a stuffing attack.
+func (t *LoginThrottler) Success(ctx context.Context, login, ip string) error {
+	if err := t.repo.Reset(ctx, t.loginKey(login)); err != nil {
+		return err
+	}
+	return t.repo.Release(ctx, t.ipKey(ip))
+}
+
+// AttemptPruner removes failure counters no throttler looks at anymore.
+// Without it a row is kept for every login and address that ever failed.
+type AttemptPruner struct {
+	repo       repository.LoginAttemptRepo
+	throttlers []*LoginThrottler
+}
+
+// NewAttemptPruner creates a pruner of counters used by throttlers.
+func NewAttemptPruner(repo repository.LoginAttemptRepo, throttlers ...*LoginThrottler) *AttemptPruner {
+	return &AttemptPruner{repo: repo, throttlers: throttlers}
+}
+
+// Prune removes counters whose last failure is outside the window of every
+// throttler and whose lockout has passed.
+func (p *AttemptPruner) Prune(ctx context.Context) (int64, error) {
+	var window time.Duration
+	for _, t := range p.throttlers {
+		window = max(window, t.window())
+	}
+	return p.repo.Prune(ctx, time.Now().Add(-window))
+}
+
+// Run prunes counters every interval until ctx is done.
+func (p *AttemptPruner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := p.Prune(ctx); err != nil && ctx.Err() == nil {
+			if l := logger.FromContext(ctx); l != nil {
+				l.Warn().Err(err).Msg("pruning login attempts failed")
+			}
+		}
+	}
+}
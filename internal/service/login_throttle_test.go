@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/storage/memory"
+)
+
+func TestThrottlePolicy_Wait(t *testing.T) {
+	p := ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: 4 * time.Second, Window: time.Hour}
+	now := time.Now()
+	cases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{10, 4 * time.Second},
+	}
+	for _, tc := range cases {
+		got := p.wait(domain.LoginAttempts{Failures: tc.failures, LastFailureAt: now}, now)
+		if got != tc.want {
+			t.Errorf("failures %d: expected %v, got %v", tc.failures, tc.want, got)
+		}
+	}
+
+	if got := p.wait(domain.LoginAttempts{Failures: 10, LastFailureAt: now.Add(-2 * time.Hour)}, now); got != 0 {
+		t.Errorf("failures outside window must be ignored, got %v", got)
+	}
+	locked := now.Add(time.Minute)
+	if got := p.wait(domain.LoginAttempts{Failures: 1, LastFailureAt: now, LockedUntil: &locked}, now); got != time.Minute {
+		t.Errorf("expected lockout wait, got %v", got)
+	}
+}
+
+type stubAttempts struct {
+	m      map[string]domain.LoginAttempts
+	before time.Time
+}
+
+func (s *stubAttempts) Get(ctx context.Context, key string) (domain.LoginAttempts, error) {
+	return s.m[key], nil
+}
+
+func (s *stubAttempts) Record(ctx context.Context, key string, window time.Duration, lockAfter int, lockFor time.Duration) (domain.LoginAttempts, error) {
+	prev := s.m[key]
+	a := prev
+	a.Failures++
+	a.LastFailureAt = time.Now()
+	if lockAfter > 0 && a.Failures >= lockAfter {
+		until := a.LastFailureAt.Add(lockFor)
+		a.LockedUntil = &until
+	}
+	s.m[key] = a
+	return prev, nil
+}
+
+func (s *stubAttempts) Release(ctx context.Context, key string) error {
+	a := s.m[key]
+	a.Failures--
+	s.m[key] = a
+	return nil
+}
+
+func (s *stubAttempts) Reset(ctx context.Context, key string) error {
+	delete(s.m, key)
+	return nil
+}
+
+func (s *stubAttempts) Prune(ctx context.Context, before time.Time) (int64, error) {
+	s.before = before
+	return 0, nil
+}
+
+func TestLoginThrottler(t *testing.T) {
+	repo := &stubAttempts{m: map[string]domain.LoginAttempts{}}
+	th := NewLoginThrottler(repo)
+	th.SetPolicies(
+		ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, LockoutAfter: 5, LockoutFor: time.Hour, Window: time.Hour},
+		ThrottlePolicy{FreeAttempts: 100, Window: time.Hour},
+	)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := th.Attempt(ctx, "Alice", "1.1.1.1"); err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if err := th.Attempt(ctx, "alice", "2.2.2.2"); err != nil {
+		t.Fatalf("free attempts not used up yet: %v", err)
+	}
+
+	var te *domain.ThrottledError
+	if err := th.Attempt(ctx, "ＡＬＩＣＥ", "3.3.3.3"); !errors.As(err, &te) || te.RetryAfter <= 0 {
+		t.Fatalf("expected login to be throttled regardless of address, case and width, got %v", err)
+	}
+	if repo.m["login:alice"].Failures != 3 || repo.m["ip:3.3.3.3"].Failures != 0 {
+		t.Fatal("throttled attempts must not be counted")
+	}
+	if err := th.Attempt(ctx, "bob", "1.1.1.1"); err != nil {
+		t.Fatalf("other logins from the address are not throttled yet: %v", err)
+	}
+
+	if err := th.Success(ctx, "bob", "1.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Success(ctx, "alice", "1.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Attempt(ctx, "alice", "1.1.1.1"); err != nil {
+		t.Fatalf("expected reset after success, got %v", err)
+	}
+	if repo.m["ip:1.1.1.1"].Failures != 2 {
+		t.Fatalf("address failures must survive a successful login, got %d", repo.m["ip:1.1.1.1"].Failures)
+	}
+}
+
+func TestLoginThrottler_Concurrent(t *testing.T) {
+	th := NewLoginThrottler(memory.NewLoginAttemptRepo(memory.NewStore()))
+	th.SetPolicies(
+		ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour},
+		ThrottlePolicy{FreeAttempts: 100, Window: time.Hour},
+	)
+	ctx := context.Background()
+
+	var (
+		wg      sync.WaitGroup
+		allowed atomic.Int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if th.Attempt(ctx, "alice", "1.1.1.1") == nil {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	// the attempt after the free ones is allowed too, like sequential ones
+	if n := allowed.Load(); n != 3 {
+		t.Fatalf("expected 3 attempts to pass, got %d", n)
+	}
+}
+
+func TestResetThrottler(t *testing.T) {
+	repo := &stubAttempts{m: map[string]domain.LoginAttempts{}}
+	resets := NewResetThrottler(repo)
+	ctx := context.Background()
+
+	for i := 0; i <= DefaultResetThrottle.FreeAttempts; i++ {
+		if err := resets.Attempt(ctx, "alice", "1.1.1.1"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	var te *domain.ThrottledError
+	if err := resets.Attempt(ctx, "alice", "2.2.2.2"); !errors.As(err, &te) {
+		t.Fatalf("expected reset requests to be throttled, got %v", err)
+	}
+	// logins keep their own counters
+	if err := NewLoginThrottler(repo).Attempt(ctx, "alice", "1.1.1.1"); err != nil {
+		t.Fatalf("login must not be throttled by reset requests: %v", err)
+	}
+}
+
+func TestAttemptPruner(t *testing.T) {
+	repo := &stubAttempts{m: map[string]domain.LoginAttempts{}}
+	p := NewAttemptPruner(repo, NewLoginThrottler(repo), NewResetThrottler(repo))
+	if _, err := p.Prune(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// counters are kept for the longest window, that of reset requests
+	if d := time.Since(repo.before); d < DefaultResetThrottle.Window || d > DefaultResetThrottle.Window+time.Minute {
+		t.Fatalf("expected counters older than %v to be pruned, got %v", DefaultResetThrottle.Window, d)
+	}
+}
@@ -3,12 +3,19 @@ package service
 import (
 	"context"
 
+	"github.com/Hobrus/gophermarket/internal/domain"
 	"github.com/Hobrus/gophermarket/internal/repository"
+	"github.com/Hobrus/gophermarket/pkg/logger"
 )
 
+// NewOrdersChannel is the notification channel announcing uploaded orders
+// to the updaters of every replica.
+const NewOrdersChannel = "gophermart_new_orders"
+
 // OrderService provides order-related operations.
 type OrderService struct {
-	repo repository.OrderRepo
+	repo     repository.OrderRepo
+	notifier repository.Notifier
 }
 
 // NewOrderService creates a new OrderService instance.
@@ -16,7 +23,23 @@ func NewOrderService(repo repository.OrderRepo) *OrderService {
 	return &OrderService{repo: repo}
 }
 
+// SetNotifier makes the service announce new orders on NewOrdersChannel.
+// It must be called before use.
+func (s *OrderService) SetNotifier(n repository.Notifier) {
+	s.notifier = n
+}
+
 // Add registers a new order with status NEW.
 func (s *OrderService) Add(ctx context.Context, userID int64, number string) (errConflictSelf, errConflictOther, err error) {
-	return s.repo.Add(ctx, number, userID, "NEW")
+	errConflictSelf, errConflictOther, err = s.repo.Add(ctx, number, userID, domain.OrderNew)
+	if errConflictSelf == nil && errConflictOther == nil && err == nil && s.notifier != nil {
+		// the order is stored; without the notification it is only
+		// picked up by the next sweep of the updaters
+		if err := s.notifier.Notify(context.WithoutCancel(ctx), NewOrdersChannel, number); err != nil {
+			if l := logger.FromContext(ctx); l != nil {
+				l.Warn().Err(err).Str("order", number).Msg("new order notification failed, the order waits for the next sweep")
+			}
+		}
+	}
+	return errConflictSelf, errConflictOther, err
 }
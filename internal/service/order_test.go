@@ -1,20 +1,29 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/shopspring/decimal"
 
 	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/pkg/logger"
+	"github.com/Hobrus/gophermarket/pkg/pubsub"
 )
 
 type stubOrderRepo struct {
-	addFunc func(ctx context.Context, num string, userID int64, status string) (error, error, error)
+	addFunc func(ctx context.Context, num string, userID int64, status domain.OrderStatus) (error, error, error)
 }
 
-func (s *stubOrderRepo) Add(ctx context.Context, num string, userID int64, status string) (error, error, error) {
+func (s *stubOrderRepo) Add(ctx context.Context, num string, userID int64, status domain.OrderStatus) (error, error, error) {
 	if s.addFunc != nil {
 		return s.addFunc(ctx, num, userID, status)
 	}
@@ -27,16 +36,24 @@ func (s *stubOrderRepo) ListByUser(ctx context.Context, userID int64, limit, off
 func (s *stubOrderRepo) GetUnprocessed(ctx context.Context, limit int) ([]domain.Order, error) {
 	return nil, nil
 }
-func (s *stubOrderRepo) UpdateStatus(ctx context.Context, num, status string, accrual *decimal.Decimal) error {
+func (s *stubOrderRepo) Claim(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.Order, error) {
+	return nil, nil
+}
+func (s *stubOrderRepo) Release(ctx context.Context, num, owner string) error {
 	return nil
 }
-func (s *stubOrderRepo) SumProcessedAccrualByUser(ctx context.Context, userID int64) (decimal.Decimal, error) {
-	return decimal.Zero, nil
+func (s *stubOrderRepo) UpdateStatus(ctx context.Context, num string, status domain.OrderStatus, accrual *decimal.Decimal) error {
+	return nil
+}
+func (s *stubOrderRepo) RecordFailure(ctx context.Context, num, lastErr string, next time.Time) error {
+	return nil
+}
+func (s *stubOrderRepo) Postpone(ctx context.Context, num string, next time.Time) error {
+	return nil
 }
-
 func TestOrderService_Add(t *testing.T) {
-	repo := &stubOrderRepo{addFunc: func(ctx context.Context, num string, userID int64, status string) (error, error, error) {
-		if num != "123" || userID != 1 || status != "NEW" {
+	repo := &stubOrderRepo{addFunc: func(ctx context.Context, num string, userID int64, status domain.OrderStatus) (error, error, error) {
+		if num != "123" || userID != 1 || status != domain.OrderNew {
 			t.Fatalf("unexpected args %s %d %s", num, userID, status)
 		}
 		return nil, nil, nil
@@ -49,7 +66,7 @@ func TestOrderService_Add(t *testing.T) {
 }
 
 func TestOrderService_AddConflict(t *testing.T) {
-	repo := &stubOrderRepo{addFunc: func(ctx context.Context, num string, userID int64, status string) (error, error, error) {
+	repo := &stubOrderRepo{addFunc: func(ctx context.Context, num string, userID int64, status domain.OrderStatus) (error, error, error) {
 		return domain.ErrConflictSelf, nil, nil
 	}}
 	svc := NewOrderService(repo)
@@ -59,3 +76,64 @@ func TestOrderService_AddConflict(t *testing.T) {
 		t.Fatalf("unexpected errors %v %v %v", errSelf, errOther, err)
 	}
 }
+
+type stubOrderNotifier struct {
+	hub  pubsub.Hub
+	mu   sync.Mutex
+	sent []string
+	err  error
+}
+
+func (s *stubOrderNotifier) Notify(ctx context.Context, channel, payload string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.mu.Lock()
+	s.sent = append(s.sent, channel+":"+payload)
+	s.mu.Unlock()
+	s.hub.Publish(channel, payload)
+	return nil
+}
+
+func (s *stubOrderNotifier) Subscribe(ctx context.Context, channel string) <-chan string {
+	return s.hub.Subscribe(ctx, channel)
+}
+
+func TestOrderService_AddNotifies(t *testing.T) {
+	conflict := false
+	repo := &stubOrderRepo{addFunc: func(ctx context.Context, num string, userID int64, status domain.OrderStatus) (error, error, error) {
+		if conflict {
+			return domain.ErrConflictSelf, nil, nil
+		}
+		return nil, nil, nil
+	}}
+	n := &stubOrderNotifier{}
+	svc := NewOrderService(repo)
+	svc.SetNotifier(n)
+
+	svc.Add(context.Background(), 1, "123")
+	conflict = true
+	svc.Add(context.Background(), 1, "123")
+
+	if len(n.sent) != 1 || n.sent[0] != NewOrdersChannel+":123" {
+		t.Fatalf("expected one notification for the new order, got %v", n.sent)
+	}
+}
+
+func TestOrderService_AddLogsNotifyError(t *testing.T) {
+	var buf bytes.Buffer
+	base := zerolog.New(&buf)
+	var ctx context.Context
+	logger.Middleware(&base)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+
+	svc := NewOrderService(&stubOrderRepo{})
+	svc.SetNotifier(&stubOrderNotifier{err: errors.New("connection lost")})
+	if _, _, err := svc.Add(ctx, 1, "123"); err != nil {
+		t.Fatalf("the stored order must not fail: %v", err)
+	}
+	if out := buf.String(); !strings.Contains(out, `"level":"warn"`) || !strings.Contains(out, "connection lost") {
+		t.Fatalf("expected a warning, got %q", out)
+	}
+}
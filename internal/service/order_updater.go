@@ -2,30 +2,195 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/Hobrus/gophermarket/internal/accrualclient"
+	"github.com/Hobrus/gophermarket/internal/domain"
 	"github.com/Hobrus/gophermarket/internal/repository"
 )
 
+// defaultLease is how long a claimed order stays reserved for the updater.
+// It must exceed the time needed to query the accrual service, including
+// waiting for Retry-After.
+const defaultLease = time.Minute
+
+// RetryPolicy defines how often an order is re-checked after the accrual
+// service fails to return its status or returns the status it already has.
+// Only failures count towards MaxAttempts and MaxAge.
+type RetryPolicy struct {
+	// BaseDelay is the delay after the first failure. It doubles with every
+	// subsequent failure.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two checks. Zero means no cap.
+	MaxDelay time.Duration
+	// MaxAttempts is the number of failed checks after which the order is
+	// marked INVALID. Zero disables the limit.
+	MaxAttempts int
+	// MaxAge is the order age after which a failed order is marked INVALID.
+	// Zero disables the limit.
+	MaxAge time.Duration
+}
+
+// DefaultRetryPolicy is used by updaters unless overridden with SetRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay:   time.Second,
+	MaxDelay:    10 * time.Minute,
+	MaxAttempts: 30,
+	MaxAge:      72 * time.Hour,
+}
+
+// Delay returns the delay before the next check after attempts failures.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := p.BaseDelay
+	for i := 1; i < attempts; i++ {
+		if d > math.MaxInt64/2 {
+			// without a cap the delay saturates instead of overflowing
+			d = math.MaxInt64
+			break
+		}
+		d *= 2
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return d
+}
+
+// PollDelay returns the delay before the next check of an order uploaded at
+// uploadedAt whose status hasn't changed. It equals the order age bounded by
+// BaseDelay and MaxDelay, so the delay doubles with every check.
+func (p RetryPolicy) PollDelay(uploadedAt time.Time) time.Duration {
+	d := time.Since(uploadedAt)
+	if d < p.BaseDelay {
+		d = p.BaseDelay
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// exhausted reports whether an order failed too many times or is too old
+// to be checked again.
+func (p RetryPolicy) exhausted(attempts int, uploadedAt time.Time) bool {
+	if p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+		return true
+	}
+	return p.MaxAge > 0 && !uploadedAt.IsZero() && time.Since(uploadedAt) > p.MaxAge
+}
+
 // OrderUpdater periodically updates order statuses using external accrual service.
+// Orders are leased before processing, so several replicas may run
+// updaters against the same database without checking an order twice.
 type OrderUpdater struct {
 	repo   repository.OrderRepo
 	client accrualclient.Client
 	inval  BalanceInvalidator
+	owner  string
+	lease  time.Duration
+	// notifier wakes the updater when orders are uploaded
+	notifier repository.Notifier
+	observer OrderObserver
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+	limits      updaterLimits
+	retry       RetryPolicy
+}
+
+// updaterLimits control how much work a running updater does.
+type updaterLimits struct {
+	parallel int
+	batch    int
+	interval time.Duration
 }
 
 // NewOrderUpdater creates a new updater instance.
 func NewOrderUpdater(r repository.OrderRepo, c accrualclient.Client, b BalanceInvalidator) *OrderUpdater {
-	return &OrderUpdater{repo: r, client: c, inval: b}
+	return &OrderUpdater{
+		repo:   r,
+		client: c,
+		inval:  b,
+		owner:  uuid.NewString(),
+		lease:  defaultLease,
+		retry:  DefaultRetryPolicy,
+	}
+}
+
+// SetRetryPolicy replaces the policy applied to orders the accrual service
+// fails to report. It may be called while the updater is running.
+func (u *OrderUpdater) SetRetryPolicy(p RetryPolicy) {
+	u.mu.Lock()
+	u.retry = p
+	u.mu.Unlock()
+}
+
+func (u *OrderUpdater) retryPolicy() RetryPolicy {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.retry
+}
+
+// OrderObserver is told about orders whose status the updater changed.
+type OrderObserver interface {
+	OrderUpdated(ctx context.Context, o domain.Order)
+}
+
+// SetObserver sets the observer of status changes. It must be called
+// before Run.
+func (u *OrderUpdater) SetObserver(o OrderObserver) {
+	u.observer = o
+}
+
+// SetNotifier makes the updater claim orders as soon as they are announced
+// on NewOrdersChannel instead of waiting for the next tick. The ticker then
+// only sweeps up orders due for a retry and announcements that were lost.
+// It must be called before Run.
+func (u *OrderUpdater) SetNotifier(n repository.Notifier) {
+	u.notifier = n
+}
+
+// SetLimits changes the limits passed to Run while the updater is running.
+// They take effect on the next tick; orders being checked keep their
+// worker slots.
+func (u *OrderUpdater) SetLimits(parallel, batch int, interval time.Duration) {
+	u.mu.Lock()
+	u.limits = updaterLimits{parallel: parallel, batch: batch, interval: interval}
+	u.mu.Unlock()
+}
+
+func (u *OrderUpdater) currentLimits() updaterLimits {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.limits
 }
 
 // Run starts background workers that update orders until ctx is done.
+// Every tick up to batch orders are claimed and checked by at most
+// parallel workers.
 func (u *OrderUpdater) Run(ctx context.Context, parallel, batch int, interval time.Duration) {
-	sem := make(chan struct{}, parallel)
-	ticker := time.NewTicker(interval)
+	u.SetLimits(parallel, batch, interval)
+	cur := u.currentLimits()
+	sem := make(chan struct{}, cur.parallel)
+	ticker := time.NewTicker(cur.interval)
 	defer ticker.Stop()
+	// without a notifier wake stays nil and only the ticker claims orders
+	var wake <-chan string
+	if u.notifier != nil {
+		wake = u.notifier.Subscribe(ctx, NewOrdersChannel)
+	}
 
 	var wg sync.WaitGroup
 	for {
@@ -34,47 +199,122 @@ func (u *OrderUpdater) Run(ctx context.Context, parallel, batch int, interval ti
 			wg.Wait()
 			return
 		case <-ticker.C:
-			orders, err := u.repo.GetUnprocessed(ctx, batch)
-			if err != nil {
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
 				continue
 			}
-		ordersLoop:
-			for _, o := range orders {
-				uid := o.UserID
-				select {
-				case <-ctx.Done():
-					break ordersLoop
-				case sem <- struct{}{}:
-				}
-				wg.Add(1)
-				go func(num string, uid int64) {
-					defer func() {
-						<-sem
-						wg.Done()
-					}()
-
-					status, accrual, retry, err := u.client.Get(ctx, num)
-					if err != nil {
-						return
-					}
-					if retry > 0 {
-						t := time.NewTimer(retry)
-						select {
-						case <-ctx.Done():
-							t.Stop()
-							return
-						case <-t.C:
-						}
-					}
-					if status == "" {
-						return
-					}
-					_ = u.repo.UpdateStatus(ctx, num, status, accrual)
-					if status == "PROCESSED" && u.inval != nil {
-						u.inval.Invalidate(uid)
-					}
-				}(o.Number, uid)
+		}
+		if l := u.currentLimits(); l != cur {
+			if l.interval != cur.interval {
+				ticker.Reset(l.interval)
+			}
+			if l.parallel != cur.parallel {
+				sem = make(chan struct{}, l.parallel)
 			}
+			cur = l
+		}
+		if u.paused() {
+			continue
+		}
+		orders, err := u.repo.Claim(ctx, u.owner, cur.batch, u.lease)
+		if err != nil {
+			continue
+		}
+	ordersLoop:
+		for _, o := range orders {
+			select {
+			case <-ctx.Done():
+				break ordersLoop
+			case sem <- struct{}{}:
+			}
+			wg.Add(1)
+			go func(o domain.Order, sem chan struct{}) {
+				defer func() {
+					_ = u.repo.Release(context.WithoutCancel(ctx), o.Number, u.owner)
+					<-sem
+					wg.Done()
+				}()
+				u.process(ctx, o)
+			}(o, sem)
+		}
+	}
+}
+
+// pause stops claiming new orders until t.
+// The accrual service asks to slow down all clients, not a single request.
+func (u *OrderUpdater) pause(t time.Time) {
+	u.mu.Lock()
+	if t.After(u.pausedUntil) {
+		u.pausedUntil = t
+	}
+	u.mu.Unlock()
+}
+
+func (u *OrderUpdater) paused() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Now().Before(u.pausedUntil)
+}
+
+// process checks a single order and stores the result.
+func (u *OrderUpdater) process(ctx context.Context, o domain.Order) {
+	status, accrual, retry, err := u.client.Get(ctx, o.Number)
+	if err != nil {
+		// An open circuit says nothing about the order itself.
+		if ctx.Err() == nil && !errors.Is(err, accrualclient.ErrCircuitOpen) {
+			u.fail(ctx, o, err.Error())
+		}
+		return
+	}
+	if retry > 0 {
+		u.pause(time.Now().Add(retry))
+		return
+	}
+	if status == "" {
+		u.fail(ctx, o, "order is not registered in accrual system")
+		return
+	}
+	next, err := status.OrderStatus()
+	if err != nil {
+		u.fail(ctx, o, err.Error())
+		return
+	}
+	// ErrInvalidTransition means a stale response, the stored status wins.
+	if err := u.repo.UpdateStatus(ctx, o.Number, next, accrual); err != nil {
+		return
+	}
+	if next == domain.OrderProcessed && u.inval != nil {
+		u.inval.Invalidate(o.UserID)
+	}
+	if next == o.Status {
+		// an order stuck in the same status is checked less and less often
+		_ = u.repo.Postpone(ctx, o.Number, time.Now().Add(u.retryPolicy().PollDelay(o.UploadedAt)))
+		return
+	}
+	o.Status, o.Accrual = next, accrual
+	u.updated(ctx, o)
+}
+
+// updated tells the observer about the new status of o.
+func (u *OrderUpdater) updated(ctx context.Context, o domain.Order) {
+	if u.observer != nil {
+		u.observer.OrderUpdated(ctx, o)
+	}
+}
+
+// fail postpones the next check of the order with exponential backoff or
+// marks it INVALID once the retry policy is exhausted.
+func (u *OrderUpdater) fail(ctx context.Context, o domain.Order, reason string) {
+	attempts := o.Attempts + 1
+	retry := u.retryPolicy()
+	if retry.exhausted(attempts, o.UploadedAt) {
+		if err := u.repo.UpdateStatus(ctx, o.Number, domain.OrderInvalid, nil); err == nil {
+			o.Status, o.Accrual = domain.OrderInvalid, nil
+			u.updated(ctx, o)
 		}
+		_ = u.repo.RecordFailure(ctx, o.Number, fmt.Sprintf("gave up after %d attempts: %s", attempts, reason), time.Now())
+		return
 	}
+	_ = u.repo.RecordFailure(ctx, o.Number, reason, time.Now().Add(retry.Delay(attempts)))
 }
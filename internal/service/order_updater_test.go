@@ -4,11 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
-	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -19,6 +19,7 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 
 	"github.com/Hobrus/gophermarket/internal/accrualclient"
+	"github.com/Hobrus/gophermarket/internal/domain"
 	"github.com/Hobrus/gophermarket/internal/storage/postgres"
 )
 
@@ -70,12 +71,7 @@ func setupPostgres(t *testing.T) (*pgxpool.Pool, func()) {
 		t.Fatal(err)
 	}
 
-	path := filepath.Join("migrations", "0001_init.up.sql")
-	b, err := os.ReadFile(path)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if _, err := pool.Exec(ctx, string(b)); err != nil {
+	if err := postgres.ApplyMigrations(ctx, pool); err != nil {
 		t.Fatal(err)
 	}
 
@@ -158,3 +154,257 @@ func TestOrderUpdater_Run(t *testing.T) {
 		}
 	}
 }
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 4, want: 8 * time.Second},
+		{attempts: 5, want: 10 * time.Second},
+		{attempts: 100, want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.Delay(tt.attempts); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+
+	// without a cap the delay grows without overflowing
+	p.MaxDelay = 0
+	if got := p.Delay(5); got != 16*time.Second {
+		t.Errorf("uncapped delay(5) = %v, want 16s", got)
+	}
+	if got := p.Delay(100); got != math.MaxInt64 {
+		t.Errorf("uncapped delay(100) = %v, want the maximum duration", got)
+	}
+}
+
+type stubAccrual struct {
+	getFunc func(ctx context.Context, number string) (accrualclient.Status, *decimal.Decimal, time.Duration, error)
+}
+
+func (s *stubAccrual) Get(ctx context.Context, number string) (accrualclient.Status, *decimal.Decimal, time.Duration, error) {
+	return s.getFunc(ctx, number)
+}
+
+type stubUpdaterRepo struct {
+	stubOrderRepo
+	mu       sync.Mutex
+	order    domain.Order
+	claimed  bool
+	status   domain.OrderStatus
+	lastErr  string
+	next     time.Time
+	failures int
+}
+
+func (s *stubUpdaterRepo) Claim(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.claimed {
+		return nil, nil
+	}
+	s.claimed = true
+	return []domain.Order{s.order}, nil
+}
+
+func (s *stubUpdaterRepo) UpdateStatus(ctx context.Context, num string, status domain.OrderStatus, accrual *decimal.Decimal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	return nil
+}
+
+func (s *stubUpdaterRepo) RecordFailure(ctx context.Context, num, lastErr string, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	s.lastErr = lastErr
+	s.next = next
+	return nil
+}
+
+func (s *stubUpdaterRepo) Postpone(ctx context.Context, num string, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = next
+	return nil
+}
+
+func runUpdaterOnce(t *testing.T, repo *stubUpdaterRepo, policy RetryPolicy) {
+	t.Helper()
+	runUpdaterWith(t, repo, policy, "")
+}
+
+// runUpdaterWith runs the updater over repo with accrual answering status.
+func runUpdaterWith(t *testing.T, repo *stubUpdaterRepo, policy RetryPolicy, status accrualclient.Status) {
+	t.Helper()
+	client := &stubAccrual{getFunc: func(ctx context.Context, number string) (accrualclient.Status, *decimal.Decimal, time.Duration, error) {
+		return status, nil, 0, nil
+	}}
+	upd := NewOrderUpdater(repo, client, nil)
+	upd.SetRetryPolicy(policy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		upd.Run(ctx, 1, 1, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestOrderUpdater_Backoff(t *testing.T) {
+	repo := &stubUpdaterRepo{order: domain.Order{Number: "1", Status: "NEW", Attempts: 2, UploadedAt: time.Now()}}
+	runUpdaterOnce(t, repo, RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Hour, MaxAttempts: 5})
+
+	if repo.failures != 1 || repo.status != "" {
+		t.Fatalf("unexpected result: failures %d status %q", repo.failures, repo.status)
+	}
+	if d := time.Until(repo.next); d < 3*time.Minute || d > 4*time.Minute {
+		t.Fatalf("expected next check in ~4m, got %v", d)
+	}
+}
+
+func TestOrderUpdater_UnchangedStatus(t *testing.T) {
+	repo := &stubUpdaterRepo{order: domain.Order{Number: "1", Status: "PROCESSING", Attempts: 4, UploadedAt: time.Now().Add(-10 * time.Minute)}}
+	runUpdaterWith(t, repo, RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Hour, MaxAttempts: 5, MaxAge: time.Minute}, accrualclient.StatusProcessing)
+
+	// the accrual system is still working on the order, so it is neither
+	// a failure nor a reason to give up
+	if repo.failures != 0 || repo.status == domain.OrderInvalid {
+		t.Fatalf("unchanged status must not count: failures %d, status %q", repo.failures, repo.status)
+	}
+	if d := time.Until(repo.next); d < 9*time.Minute || d > 10*time.Minute {
+		t.Fatalf("expected next check in ~10m, got %v", d)
+	}
+}
+
+func TestOrderUpdater_DeadLetter(t *testing.T) {
+	repo := &stubUpdaterRepo{order: domain.Order{Number: "1", Status: "NEW", Attempts: 4, UploadedAt: time.Now()}}
+	runUpdaterOnce(t, repo, RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Hour, MaxAttempts: 5})
+
+	if repo.status != "INVALID" {
+		t.Fatalf("expected INVALID, got %q", repo.status)
+	}
+	if repo.lastErr == "" {
+		t.Fatal("expected last error to be recorded")
+	}
+}
+
+type claimRecorder struct {
+	stubOrderRepo
+	mu     sync.Mutex
+	limits []int
+}
+
+func (s *claimRecorder) Claim(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = append(s.limits, limit)
+	return nil, nil
+}
+
+func (s *claimRecorder) last() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.limits) == 0 {
+		return 0
+	}
+	return s.limits[len(s.limits)-1]
+}
+
+func TestOrderUpdater_SetLimits(t *testing.T) {
+	repo := &claimRecorder{}
+	upd := NewOrderUpdater(repo, &stubAccrual{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		upd.Run(ctx, 1, 1, 5*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	if got := repo.last(); got != 1 {
+		t.Fatalf("expected batch 1, got %d", got)
+	}
+	upd.SetLimits(2, 7, 5*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	<-done
+	if got := repo.last(); got != 7 {
+		t.Fatalf("expected batch 7 after SetLimits, got %d", got)
+	}
+}
+
+func TestOrderUpdater_Wakeup(t *testing.T) {
+	repo := &claimRecorder{}
+	n := &stubOrderNotifier{}
+	upd := NewOrderUpdater(repo, &stubAccrual{}, nil)
+	upd.SetNotifier(n)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		upd.Run(ctx, 1, 3, time.Hour)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the subscription is made when Run starts
+	deadline := time.Now().Add(time.Second)
+	for repo.last() == 0 && time.Now().Before(deadline) {
+		n.Notify(ctx, NewOrdersChannel, "123")
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := repo.last(); got != 3 {
+		t.Fatalf("expected a claim of 3 orders after the notification, got %d", got)
+	}
+}
+
+type observerFunc func(ctx context.Context, o domain.Order)
+
+func (f observerFunc) OrderUpdated(ctx context.Context, o domain.Order) { f(ctx, o) }
+
+func TestOrderUpdater_Observer(t *testing.T) {
+	repo := &stubUpdaterRepo{order: domain.Order{Number: "1", UserID: 7, Status: domain.OrderNew, UploadedAt: time.Now()}}
+	client := &stubAccrual{getFunc: func(ctx context.Context, number string) (accrualclient.Status, *decimal.Decimal, time.Duration, error) {
+		a := decimal.NewFromInt(10)
+		return accrualclient.StatusProcessed, &a, 0, nil
+	}}
+	upd := NewOrderUpdater(repo, client, nil)
+	var (
+		mu   sync.Mutex
+		seen []domain.Order
+	)
+	upd.SetObserver(observerFunc(func(ctx context.Context, o domain.Order) {
+		mu.Lock()
+		seen = append(seen, o)
+		mu.Unlock()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		upd.Run(ctx, 1, 1, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen[0].UserID != 7 || seen[0].Status != domain.OrderProcessed || !seen[0].Accrual.Equal(decimal.NewFromInt(10)) {
+		t.Fatalf("unexpected observed orders %+v", seen)
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// resetTTL is how long a password reset token stays valid.
+const resetTTL = 30 * time.Minute
+
+// ResetNotifier delivers password reset tokens to users.
+type ResetNotifier interface {
+	SendPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error
+}
+
+// PasswordHasher checks new passwords against the policy and hashes them.
+type PasswordHasher interface {
+	ValidatePassword(password string) error
+	HashPassword(password string) (string, error)
+}
+
+// PasswordResetService lets users who forgot their password set a new one
+// with a single-use token delivered by a notifier.
+type PasswordResetService struct {
+	users    repository.UserRepo
+	resets   repository.PasswordResetRepo
+	hasher   PasswordHasher
+	notifier ResetNotifier
+}
+
+// NewPasswordResetService creates a new PasswordResetService instance.
+func NewPasswordResetService(users repository.UserRepo, resets repository.PasswordResetRepo, hasher PasswordHasher, n ResetNotifier) *PasswordResetService {
+	return &PasswordResetService{users: users, resets: resets, hasher: hasher, notifier: n}
+}
+
+// Request issues a reset token for login and sends it to the user.
+// Unknown logins are silently ignored, so the result tells nothing about
+// which logins exist.
+func (s *PasswordResetService) Request(ctx context.Context, login string) error {
+	u, err := s.users.GetByLogin(ctx, NormalizeLogin(login))
+	if errors.Is(err, domain.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// reset tokens are as random as refresh tokens, so the same scheme fits
+	token, hash, err := newRefreshToken()
+	if err != nil {
+		return err
+	}
+	exp := time.Now().Add(resetTTL)
+	if err := s.resets.Create(ctx, u.ID, hash, exp); err != nil {
+		return err
+	}
+	return s.notifier.SendPasswordReset(ctx, u.Login, token, exp)
+}
+
+// Reset sets a new password using a reset token and invalidates all
+// previously issued tokens. The reset token and all other outstanding
+// tokens of the user can't be used again.
+// Returns ErrResetTokenInvalid for unknown, expired or used tokens and
+// *ValidationError if the password violates the policy.
+func (s *PasswordResetService) Reset(ctx context.Context, token, password string) error {
+	if token == "" {
+		return domain.ErrResetTokenInvalid
+	}
+	// checked first so that a rejected password doesn't burn the token
+	if err := s.hasher.ValidatePassword(password); err != nil {
+		return err
+	}
+	hash, err := s.hasher.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	// the token is spent together with the password change, so a failure
+	// leaves both untouched
+	_, err = s.resets.Consume(ctx, hashRefreshToken(token), hash)
+	return err
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type stubResets struct {
+	tokens map[string]int64
+	// passwords holds hashes set by Consume
+	passwords map[int64]string
+}
+
+func (s *stubResets) Create(ctx context.Context, userID int64, hash string, exp time.Time) error {
+	s.tokens[hash] = userID
+	return nil
+}
+
+func (s *stubResets) Consume(ctx context.Context, hash, passwordHash string) (int64, error) {
+	id, ok := s.tokens[hash]
+	if !ok {
+		return 0, domain.ErrResetTokenInvalid
+	}
+	for h, uid := range s.tokens {
+		if uid == id {
+			delete(s.tokens, h)
+		}
+	}
+	s.passwords[id] = passwordHash
+	return id, nil
+}
+
+type stubNotifier struct {
+	login, token string
+}
+
+func (n *stubNotifier) SendPasswordReset(ctx context.Context, login, token string, exp time.Time) error {
+	n.login, n.token = login, token
+	return nil
+}
+
+type stubHasher struct{}
+
+func (stubHasher) ValidatePassword(password string) error {
+	if len(password) < 8 {
+		return &domain.ValidationError{Fields: []domain.FieldError{{Field: "new_password", Code: domain.CodeTooShort}}}
+	}
+	return nil
+}
+
+func (stubHasher) HashPassword(password string) (string, error) {
+	return "hashed:" + password, nil
+}
+
+func TestPasswordResetService(t *testing.T) {
+	users := &stubRepo{getByLoginFunc: func(ctx context.Context, login string) (domain.User, error) {
+		if login != "user" {
+			return domain.User{}, domain.ErrNotFound
+		}
+		return domain.User{ID: 5, Login: login}, nil
+	}}
+	resets := &stubResets{tokens: map[string]int64{}, passwords: map[int64]string{}}
+	n := &stubNotifier{}
+	svc := NewPasswordResetService(users, resets, stubHasher{}, n)
+	ctx := context.Background()
+
+	if err := svc.Request(ctx, "ghost"); err != nil {
+		t.Fatalf("unknown login must not fail: %v", err)
+	}
+	if n.token != "" {
+		t.Fatal("nothing must be sent for unknown login")
+	}
+
+	if err := svc.Request(ctx, "user"); err != nil {
+		t.Fatal(err)
+	}
+	first := n.token
+	if err := svc.Request(ctx, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if n.login != "user" || n.token == "" || n.token == first {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+	if _, ok := resets.tokens[n.token]; ok {
+		t.Fatal("token must be stored hashed")
+	}
+
+	if err := svc.Reset(ctx, "bogus", "new-password"); !errors.Is(err, domain.ErrResetTokenInvalid) {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+	if err := svc.Reset(ctx, n.token, "short"); !errors.Is(err, domain.ErrInvalidInput) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	// the rejected password must not consume the token
+	if err := svc.Reset(ctx, n.token, "new-password"); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if resets.passwords[5] != "hashed:new-password" || len(resets.passwords) != 1 {
+		t.Fatalf("unexpected passwords set %+v", resets.passwords)
+	}
+	if err := svc.Reset(ctx, first, "another-password"); !errors.Is(err, domain.ErrResetTokenInvalid) {
+		t.Fatalf("other tokens must be consumed too, got %v", err)
+	}
+}
@@ -2,57 +2,271 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 
+	"github.com/Hobrus/gophermarket/internal/domain"
 	"github.com/Hobrus/gophermarket/internal/repository"
 	"github.com/Hobrus/gophermarket/pkg/crypto"
 )
 
+// Token lifetimes used unless changed with SetTokenTTL.
+const (
+	// defaultAccessTTL is the lifetime of an access token.
+	defaultAccessTTL = 15 * time.Minute
+	// defaultRefreshTTL is the lifetime of a refresh token.
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// TokenSigner signs access token claims.
+type TokenSigner interface {
+	Sign(claims jwt.Claims) (string, error)
+}
+
 // AuthService provides user registration and authentication logic.
 type AuthService struct {
-	repo      repository.UserRepo
-	jwtSecret []byte
+	repo       repository.UserRepo
+	sessions   repository.SessionRepo
+	signer     TokenSigner
+	hasher     crypto.Hasher
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+
+	// policies for new logins and passwords
+	mu             sync.Mutex
+	loginPolicy    LoginPolicy
+	passwordPolicy PasswordPolicy
 }
 
 // NewAuthService creates a new AuthService instance.
-func NewAuthService(repo repository.UserRepo, secret []byte) *AuthService {
-	return &AuthService{repo: repo, jwtSecret: secret}
+func NewAuthService(repo repository.UserRepo, sessions repository.SessionRepo, signer TokenSigner) *AuthService {
+	return &AuthService{
+		repo:           repo,
+		sessions:       sessions,
+		signer:         signer,
+		hasher:         crypto.Default,
+		loginPolicy:    DefaultLoginPolicy,
+		passwordPolicy: DefaultPasswordPolicy,
+		accessTTL:      defaultAccessTTL,
+		refreshTTL:     defaultRefreshTTL,
+	}
+}
+
+// SetHasher replaces the password hasher. It must be called before use.
+func (s *AuthService) SetHasher(h crypto.Hasher) {
+	s.hasher = h
+}
+
+// SetTokenTTL changes the lifetimes of access and refresh tokens.
+// It must be called before use.
+func (s *AuthService) SetTokenTTL(access, refresh time.Duration) {
+	s.accessTTL = access
+	s.refreshTTL = refresh
+}
+
+// SetPolicies replaces rules for new logins and passwords. It may be
+// called while the service is in use.
+func (s *AuthService) SetPolicies(login LoginPolicy, password PasswordPolicy) {
+	s.mu.Lock()
+	s.loginPolicy = login
+	s.passwordPolicy = password
+	s.mu.Unlock()
+}
+
+func (s *AuthService) policies() (LoginPolicy, PasswordPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loginPolicy, s.passwordPolicy
+}
+
+// ValidatePassword checks password against the password policy.
+// Returns *ValidationError for the new_password field.
+func (s *AuthService) ValidatePassword(password string) error {
+	var verr domain.ValidationError
+	_, passwords := s.policies()
+	passwords.validate("new_password", password, &verr)
+	return verr.Err()
 }
 
-// Register registers a new user and returns JWT token.
-func (s *AuthService) Register(ctx context.Context, login, password string) (string, error) {
-	hash, err := crypto.HashPassword(password)
+// Register registers a new user and starts a session for them.
+// Returns *ValidationError if login or password violate the policies.
+func (s *AuthService) Register(ctx context.Context, login, password string) (domain.TokenPair, error) {
+	login = NormalizeLogin(login)
+	var verr domain.ValidationError
+	logins, passwords := s.policies()
+	logins.validate(login, &verr)
+	passwords.validate("password", password, &verr)
+	if err := verr.Err(); err != nil {
+		return domain.TokenPair{}, err
+	}
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
-		return "", err
+		return domain.TokenPair{}, err
 	}
 	id, err := s.repo.Create(ctx, login, hash)
 	if err != nil {
-		return "", err
+		return domain.TokenPair{}, err
 	}
-	return s.issueToken(id, login)
+	return s.startSession(ctx, id, 0)
 }
 
-// Login authenticates user and returns JWT token.
-func (s *AuthService) Login(ctx context.Context, login, password string) (string, error) {
-	u, err := s.repo.GetByLogin(ctx, login)
+// Login authenticates user and starts a new session. Passwords hashed with
+// an outdated algorithm or parameters are rehashed.
+func (s *AuthService) Login(ctx context.Context, login, password string) (domain.TokenPair, error) {
+	u, err := s.repo.GetByLogin(ctx, NormalizeLogin(login))
 	if err != nil {
-		return "", err
+		return domain.TokenPair{}, err
+	}
+	if err := s.hasher.Verify(u.PasswordHash, password); err != nil {
+		if errors.Is(err, crypto.ErrMismatch) {
+			return domain.TokenPair{}, domain.ErrInvalidCredentials
+		}
+		return domain.TokenPair{}, err
 	}
-	if err := crypto.ComparePassword(u.PasswordHash, password); err != nil {
-		return "", errors.New("invalid credentials")
+	if s.hasher.NeedsRehash(u.PasswordHash) {
+		// The password is known only now. A failed upgrade is retried on the next login.
+		if hash, err := s.hasher.Hash(password); err == nil {
+			_ = s.repo.UpdatePasswordHash(ctx, u.ID, hash)
+		}
 	}
-	return s.issueToken(u.ID, u.Login)
+	return s.startSession(ctx, u.ID, u.TokenVersion)
 }
 
-func (s *AuthService) issueToken(userID int64, login string) (string, error) {
+// Refresh exchanges a refresh token for a new token pair. The presented
+// token can't be used again: presenting it twice revokes the whole session
+// family and returns ErrRefreshTokenReused.
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string) (domain.TokenPair, error) {
+	if refreshToken == "" {
+		return domain.TokenPair{}, domain.ErrSessionInvalid
+	}
+	token, hash, err := newRefreshToken()
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	next := domain.Session{ID: uuid.NewString(), ExpiresAt: time.Now().Add(s.refreshTTL)}
+	next, err = s.sessions.Rotate(ctx, hashRefreshToken(refreshToken), next, hash)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	version, err := s.repo.TokenVersion(ctx, next.UserID)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	return s.issueTokens(next, version, token)
+}
+
+// ChangePassword replaces the password if current matches and starts a new
+// session. All previously issued tokens are invalidated.
+// Returns *ValidationError if next violates the password policy.
+func (s *AuthService) ChangePassword(ctx context.Context, userID int64, current, next string) (domain.TokenPair, error) {
+	if err := s.ValidatePassword(next); err != nil {
+		return domain.TokenPair{}, err
+	}
+	u, err := s.repo.GetByID(ctx, userID)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	if err := s.hasher.Verify(u.PasswordHash, current); err != nil {
+		if errors.Is(err, crypto.ErrMismatch) {
+			return domain.TokenPair{}, domain.ErrInvalidCredentials
+		}
+		return domain.TokenPair{}, err
+	}
+	version, err := s.setPassword(ctx, userID, next)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	return s.startSession(ctx, userID, version)
+}
+
+// HashPassword hashes password with the configured hasher, e.g. to store
+// it along with other changes.
+func (s *AuthService) HashPassword(password string) (string, error) {
+	return s.hasher.Hash(password)
+}
+
+func (s *AuthService) setPassword(ctx context.Context, userID int64, password string) (int, error) {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+	// access tokens are rejected by the new version, refresh tokens by
+	// revocation; the repository does both at once
+	return s.repo.ChangePassword(ctx, userID, hash)
+}
+
+// TokenVersion returns the current token version of the user.
+func (s *AuthService) TokenVersion(ctx context.Context, userID int64) (int, error) {
+	return s.repo.TokenVersion(ctx, userID)
+}
+
+// Logout revokes the session family the session belongs to.
+func (s *AuthService) Logout(ctx context.Context, sessionID string) error {
+	return s.sessions.RevokeFamily(ctx, sessionID)
+}
+
+// LogoutAll revokes every session of the user.
+func (s *AuthService) LogoutAll(ctx context.Context, userID int64) error {
+	return s.sessions.RevokeAll(ctx, userID)
+}
+
+// IsSessionActive reports whether the session has not been revoked.
+func (s *AuthService) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	return s.sessions.IsActive(ctx, sessionID)
+}
+
+func (s *AuthService) startSession(ctx context.Context, userID int64, version int) (domain.TokenPair, error) {
+	token, hash, err := newRefreshToken()
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	id := uuid.NewString()
+	sess := domain.Session{ID: id, FamilyID: id, UserID: userID, ExpiresAt: time.Now().Add(s.refreshTTL)}
+	if err := s.sessions.Create(ctx, sess, hash); err != nil {
+		return domain.TokenPair{}, err
+	}
+	return s.issueTokens(sess, version, token)
+}
+
+func (s *AuthService) issueTokens(sess domain.Session, version int, refreshToken string) (domain.TokenPair, error) {
+	exp := time.Now().Add(s.accessTTL)
 	claims := jwt.MapClaims{
-		"sub":   userID,
-		"login": login,
-		"exp":   time.Now().Add(72 * time.Hour).Unix(),
+		"sub": sess.UserID,
+		"sid": sess.ID,
+		"tv":  version,
+		"exp": exp.Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.jwtSecret)
+	access, err := s.signer.Sign(claims)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	return domain.TokenPair{
+		AccessToken:      access,
+		AccessExpiresAt:  exp,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: sess.ExpiresAt,
+	}, nil
+}
+
+// newRefreshToken returns a random refresh token and the hash stored for it.
+func newRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
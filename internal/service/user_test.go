@@ -3,17 +3,25 @@ package service
 import (
 	"context"
 	"errors"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/Hobrus/gophermarket/internal/domain"
 	"github.com/Hobrus/gophermarket/pkg/crypto"
+	"github.com/Hobrus/gophermarket/pkg/jwtkeys"
 )
 
 type stubRepo struct {
 	createFunc     func(ctx context.Context, login, hash string) (int64, error)
 	getByLoginFunc func(ctx context.Context, login string) (domain.User, error)
+	updateHashFunc func(ctx context.Context, userID int64, hash string) error
+	getByIDFunc    func(ctx context.Context, id int64) (domain.User, error)
+	changeFunc     func(ctx context.Context, userID int64, hash string) (int, error)
+	version        int
 }
 
 func (s *stubRepo) Create(ctx context.Context, login, hash string) (int64, error) {
@@ -22,12 +30,93 @@ func (s *stubRepo) Create(ctx context.Context, login, hash string) (int64, error
 func (s *stubRepo) GetByLogin(ctx context.Context, login string) (domain.User, error) {
 	return s.getByLoginFunc(ctx, login)
 }
+func (s *stubRepo) UpdatePasswordHash(ctx context.Context, userID int64, hash string) error {
+	return s.updateHashFunc(ctx, userID, hash)
+}
+func (s *stubRepo) GetByID(ctx context.Context, id int64) (domain.User, error) {
+	return s.getByIDFunc(ctx, id)
+}
+func (s *stubRepo) ChangePassword(ctx context.Context, userID int64, hash string) (int, error) {
+	return s.changeFunc(ctx, userID, hash)
+}
+func (s *stubRepo) TokenVersion(ctx context.Context, userID int64) (int, error) {
+	return s.version, nil
+}
 
-func parseToken(t *testing.T, tokenStr string, secret []byte) jwt.MapClaims {
+// stubSessions keeps sessions in memory, keyed by refresh token hash.
+type stubSessions struct {
+	mu      sync.Mutex
+	byHash  map[string]*domain.Session
+	revoked map[string]bool
+}
+
+func newStubSessions() *stubSessions {
+	return &stubSessions{byHash: map[string]*domain.Session{}, revoked: map[string]bool{}}
+}
+
+func (s *stubSessions) Create(ctx context.Context, sess domain.Session, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHash[hash] = &sess
+	return nil
+}
+
+func (s *stubSessions) Rotate(ctx context.Context, hash string, next domain.Session, nextHash string) (domain.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.byHash[hash]
+	if !ok || s.revoked[cur.FamilyID] {
+		return domain.Session{}, domain.ErrSessionInvalid
+	}
+	if cur.RotatedAt != nil {
+		s.revoked[cur.FamilyID] = true
+		return domain.Session{}, domain.ErrRefreshTokenReused
+	}
+	now := time.Now()
+	cur.RotatedAt = &now
+	next.FamilyID, next.UserID = cur.FamilyID, cur.UserID
+	s.byHash[nextHash] = &next
+	return next, nil
+}
+
+func (s *stubSessions) IsActive(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.byHash {
+		if sess.ID == id {
+			return !s.revoked[sess.FamilyID], nil
+		}
+	}
+	return false, nil
+}
+
+func (s *stubSessions) RevokeFamily(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.byHash {
+		if sess.ID == id {
+			s.revoked[sess.FamilyID] = true
+		}
+	}
+	return nil
+}
+
+func (s *stubSessions) RevokeAll(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.byHash {
+		if sess.UserID == userID {
+			s.revoked[sess.FamilyID] = true
+		}
+	}
+	return nil
+}
+
+var testKeys, _ = jwtkeys.NewKeyring(jwtkeys.NewHMAC([]byte("secret")))
+
+func parseToken(t *testing.T, tokenStr string) jwt.MapClaims {
 	t.Helper()
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
+	token, err := jwt.Parse(tokenStr, testKeys.Keyfunc)
 	if err != nil {
 		t.Fatalf("parse token: %v", err)
 	}
@@ -45,19 +134,22 @@ func TestAuthService_RegisterSuccess(t *testing.T) {
 		}
 		return 1, nil
 	}}
-	svc := NewAuthService(repo, []byte("secret"))
+	svc := NewAuthService(repo, newStubSessions(), testKeys)
 
-	tokenStr, err := svc.Register(context.Background(), "user", "pass")
+	tokens, err := svc.Register(context.Background(), "user", "s3cret-pass")
 	if err != nil {
 		t.Fatalf("register: %v", err)
 	}
 
-	claims := parseToken(t, tokenStr, []byte("secret"))
+	claims := parseToken(t, tokens.AccessToken)
 	if sub, ok := claims["sub"].(float64); !ok || int64(sub) != 1 {
 		t.Errorf("unexpected sub %v", claims["sub"])
 	}
-	if claims["login"] != "user" {
-		t.Errorf("unexpected login claim %v", claims["login"])
+	if sid, ok := claims["sid"].(string); !ok || sid == "" {
+		t.Errorf("unexpected sid claim %v", claims["sid"])
+	}
+	if tokens.RefreshToken == "" {
+		t.Error("refresh token missing")
 	}
 }
 
@@ -65,9 +157,9 @@ func TestAuthService_RegisterConflict(t *testing.T) {
 	repo := &stubRepo{createFunc: func(ctx context.Context, login, hash string) (int64, error) {
 		return 0, domain.ErrConflictSelf
 	}}
-	svc := NewAuthService(repo, []byte("secret"))
+	svc := NewAuthService(repo, newStubSessions(), testKeys)
 
-	if _, err := svc.Register(context.Background(), "user", "pass"); !errors.Is(err, domain.ErrConflictSelf) {
+	if _, err := svc.Register(context.Background(), "user", "s3cret-pass"); !errors.Is(err, domain.ErrConflictSelf) {
 		t.Fatalf("expected conflict error, got %v", err)
 	}
 }
@@ -77,9 +169,202 @@ func TestAuthService_LoginWrongPassword(t *testing.T) {
 	repo := &stubRepo{getByLoginFunc: func(ctx context.Context, login string) (domain.User, error) {
 		return domain.User{ID: 1, Login: login, PasswordHash: hash}, nil
 	}}
-	svc := NewAuthService(repo, []byte("secret"))
+	svc := NewAuthService(repo, newStubSessions(), testKeys)
 
 	if _, err := svc.Login(context.Background(), "user", "wrong"); err == nil {
 		t.Fatal("expected error for wrong password")
 	}
 }
+
+func TestAuthService_RefreshRotates(t *testing.T) {
+	repo := &stubRepo{createFunc: func(ctx context.Context, login, hash string) (int64, error) {
+		return 7, nil
+	}}
+	svc := NewAuthService(repo, newStubSessions(), testKeys)
+	ctx := context.Background()
+
+	first, err := svc.Register(ctx, "user", "s3cret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("refresh token not rotated")
+	}
+	claims := parseToken(t, second.AccessToken)
+	if sub, ok := claims["sub"].(float64); !ok || int64(sub) != 7 {
+		t.Errorf("unexpected sub %v", claims["sub"])
+	}
+	sid := claims["sid"].(string)
+	if active, _ := svc.IsSessionActive(ctx, sid); !active {
+		t.Fatal("new session should be active")
+	}
+
+	if _, err := svc.Refresh(ctx, first.RefreshToken); !errors.Is(err, domain.ErrRefreshTokenReused) {
+		t.Fatalf("expected reuse error, got %v", err)
+	}
+	if active, _ := svc.IsSessionActive(ctx, sid); active {
+		t.Fatal("reuse should revoke the whole family")
+	}
+	if _, err := svc.Refresh(ctx, second.RefreshToken); !errors.Is(err, domain.ErrSessionInvalid) {
+		t.Fatalf("expected invalid session, got %v", err)
+	}
+}
+
+func TestAuthService_Logout(t *testing.T) {
+	repo := &stubRepo{createFunc: func(ctx context.Context, login, hash string) (int64, error) {
+		return 1, nil
+	}}
+	svc := NewAuthService(repo, newStubSessions(), testKeys)
+	ctx := context.Background()
+
+	tokens, err := svc.Register(ctx, "user", "s3cret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := parseToken(t, tokens.AccessToken)["sid"].(string)
+	if err := svc.Logout(ctx, sid); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := svc.IsSessionActive(ctx, sid); active {
+		t.Fatal("session should be revoked")
+	}
+	if _, err := svc.Refresh(ctx, tokens.RefreshToken); !errors.Is(err, domain.ErrSessionInvalid) {
+		t.Fatalf("expected invalid session, got %v", err)
+	}
+}
+
+func TestAuthService_LoginRehashesLegacyHash(t *testing.T) {
+	legacy := crypto.NewBcrypt(4)
+	old, _ := legacy.Hash("s3cret-pass")
+	var updated string
+	repo := &stubRepo{
+		getByLoginFunc: func(ctx context.Context, login string) (domain.User, error) {
+			return domain.User{ID: 1, Login: login, PasswordHash: old}, nil
+		},
+		updateHashFunc: func(ctx context.Context, userID int64, hash string) error {
+			updated = hash
+			return nil
+		},
+	}
+	hasher := crypto.NewMulti(crypto.NewArgon2id(crypto.Argon2Params{Memory: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}, nil), legacy)
+	svc := NewAuthService(repo, newStubSessions(), testKeys)
+	svc.SetHasher(hasher)
+
+	if _, err := svc.Login(context.Background(), "user", "s3cret-pass"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !strings.HasPrefix(updated, "$argon2id$") {
+		t.Fatalf("expected argon2id rehash, got %q", updated)
+	}
+	if err := hasher.Verify(updated, "s3cret-pass"); err != nil {
+		t.Fatalf("new hash must verify: %v", err)
+	}
+
+	// current hashes are left alone
+	old, updated = updated, ""
+	if _, err := svc.Login(context.Background(), "user", "s3cret-pass"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if updated != "" {
+		t.Fatal("current hash must not be rehashed")
+	}
+}
+
+func TestAuthService_ChangePassword(t *testing.T) {
+	hash, _ := crypto.HashPassword("old-password")
+	repo := &stubRepo{
+		createFunc: func(ctx context.Context, login, hash string) (int64, error) { return 3, nil },
+		getByIDFunc: func(ctx context.Context, id int64) (domain.User, error) {
+			return domain.User{ID: id, Login: "user", PasswordHash: hash}, nil
+		},
+	}
+	sessions := newStubSessions()
+	repo.changeFunc = func(ctx context.Context, userID int64, h string) (int, error) {
+		hash = h
+		repo.version++
+		return repo.version, sessions.RevokeAll(ctx, userID)
+	}
+	svc := NewAuthService(repo, sessions, testKeys)
+	ctx := context.Background()
+
+	before, err := svc.Register(ctx, "user", "old-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ChangePassword(ctx, 3, "wrong", "new-password"); !errors.Is(err, domain.ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	after, err := svc.ChangePassword(ctx, 3, "old-password", "new-password")
+	if err != nil {
+		t.Fatalf("change password: %v", err)
+	}
+	if err := crypto.ComparePassword(hash, "new-password"); err != nil {
+		t.Fatalf("new password must verify: %v", err)
+	}
+	if tv := parseToken(t, after.AccessToken)["tv"].(float64); int(tv) != 1 {
+		t.Fatalf("unexpected tv %v", tv)
+	}
+	oldSID := parseToken(t, before.AccessToken)["sid"].(string)
+	if active, _ := svc.IsSessionActive(ctx, oldSID); active {
+		t.Fatal("old sessions must be revoked")
+	}
+	if _, err := svc.Refresh(ctx, before.RefreshToken); !errors.Is(err, domain.ErrSessionInvalid) {
+		t.Fatalf("expected invalid session, got %v", err)
+	}
+	if _, err := svc.Refresh(ctx, after.RefreshToken); err != nil {
+		t.Fatalf("new refresh token must work: %v", err)
+	}
+}
+
+func TestAuthService_RegisterValidation(t *testing.T) {
+	var created string
+	repo := &stubRepo{createFunc: func(ctx context.Context, login, hash string) (int64, error) {
+		created = login
+		return 1, nil
+	}}
+	svc := NewAuthService(repo, newStubSessions(), testKeys)
+	svc.SetPolicies(DefaultLoginPolicy, PasswordPolicy{MinLength: 8, MaxLength: 64, Breached: PasswordList{"password": {}}})
+	ctx := context.Background()
+
+	cases := []struct {
+		login, password string
+		want            []domain.FieldError
+	}{
+		{"", "", []domain.FieldError{{Field: "login", Code: domain.CodeRequired}, {Field: "password", Code: domain.CodeRequired}}},
+		{"ab", "s3cret-pass", []domain.FieldError{{Field: "login", Code: domain.CodeTooShort}}},
+		{"user name", "s3cret-pass", []domain.FieldError{{Field: "login", Code: domain.CodeInvalidChars}}},
+		{"user", "short", []domain.FieldError{{Field: "password", Code: domain.CodeTooShort}}},
+		{"user", strings.Repeat("x", 65), []domain.FieldError{{Field: "password", Code: domain.CodeTooLong}}},
+		{"user", "password", []domain.FieldError{{Field: "password", Code: domain.CodeBreached}}},
+	}
+	for _, c := range cases {
+		_, err := svc.Register(ctx, c.login, c.password)
+		var verr *domain.ValidationError
+		if !errors.As(err, &verr) || !errors.Is(err, domain.ErrInvalidInput) {
+			t.Fatalf("%q/%q: expected validation error, got %v", c.login, c.password, err)
+		}
+		if len(verr.Fields) != len(c.want) {
+			t.Fatalf("%q/%q: unexpected fields %+v", c.login, c.password, verr.Fields)
+		}
+		for i, f := range verr.Fields {
+			if f.Field != c.want[i].Field || f.Code != c.want[i].Code || f.Message == "" {
+				t.Fatalf("%q/%q: unexpected field %+v", c.login, c.password, f)
+			}
+		}
+	}
+	if created != "" {
+		t.Fatal("invalid users must not be created")
+	}
+
+	// fullwidth letters are normalized to their ASCII forms
+	if _, err := svc.Register(ctx, "ｕｓｅｒ", "s3cret-pass"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if created != "user" {
+		t.Fatalf("expected normalized login, got %q", created)
+	}
+}
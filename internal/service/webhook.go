@@ -0,0 +1,411 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// Headers of webhook requests.
+const (
+	// WebhookEventHeader names the event, e.g. order.processed.
+	WebhookEventHeader = "X-Gophermart-Event"
+	// WebhookDeliveryHeader is the delivery id. It stays the same when the
+	// delivery is retried, so receivers can drop duplicates.
+	WebhookDeliveryHeader = "X-Gophermart-Delivery"
+	// WebhookTimestampHeader is the Unix time the request was signed at.
+	WebhookTimestampHeader = "X-Gophermart-Timestamp"
+	// WebhookSignatureHeader is "sha256=" followed by SignWebhook of the
+	// timestamp and the body.
+	WebhookSignatureHeader = "X-Gophermart-Signature"
+)
+
+// webhookSecretPrefix starts every webhook secret.
+const webhookSecretPrefix = "whsec_"
+
+// deliveriesListLimit is the number of latest deliveries listed per endpoint.
+const deliveriesListLimit = 100
+
+// DefaultWebhookRetryPolicy is used by dispatchers unless overridden with
+// SetRetryPolicy. Deliveries failing MaxAttempts times become dead.
+var DefaultWebhookRetryPolicy = RetryPolicy{
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    time.Hour,
+	MaxAttempts: 10,
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of the timestamp, a dot
+// and the body, keyed with the endpoint secret.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookService manages webhook endpoints of users and the administrator.
+// Zero user id stands for the administrator.
+type WebhookService struct {
+	repo repository.WebhookRepo
+}
+
+// NewWebhookService creates a new WebhookService instance.
+func NewWebhookService(repo repository.WebhookRepo) *WebhookService {
+	return &WebhookService{repo: repo}
+}
+
+// Create registers an endpoint receiving events. The returned webhook holds
+// the secret deliveries are signed with.
+// Returns *ValidationError if the URL isn't an absolute http or https URL
+// without credentials or events are empty or unknown.
+func (s *WebhookService) Create(ctx context.Context, userID int64, rawURL string, events []string) (domain.Webhook, error) {
+	var verr domain.ValidationError
+	w := domain.Webhook{UserID: userID, URL: rawURL}
+	if rawURL == "" {
+		verr.Add("url", domain.CodeRequired, "url is required")
+	} else if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		verr.Add("url", domain.CodeInvalidURL, "url must be an absolute http or https URL")
+	} else if u.User != nil {
+		// the URL is listed back to the owner and stored in plain text
+		verr.Add("url", domain.CodeInvalidURL, "url must not contain credentials")
+	}
+	if len(events) == 0 {
+		verr.Add("events", domain.CodeRequired, "at least one event is required")
+	}
+	for _, e := range events {
+		ev := domain.WebhookEvent(e)
+		switch {
+		case !containsEvent(domain.AllWebhookEvents, ev):
+			verr.Add("events", domain.CodeUnknown, fmt.Sprintf("unknown event %q", e))
+		case !containsEvent(w.Events, ev):
+			w.Events = append(w.Events, ev)
+		}
+	}
+	if err := verr.Err(); err != nil {
+		return domain.Webhook{}, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return domain.Webhook{}, err
+	}
+	w.Secret = webhookSecretPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return s.repo.Create(ctx, w)
+}
+
+func containsEvent(list []domain.WebhookEvent, e domain.WebhookEvent) bool {
+	for _, v := range list {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns endpoints of the user.
+func (s *WebhookService) List(ctx context.Context, userID int64) ([]domain.Webhook, error) {
+	return s.repo.ListByUser(ctx, userID)
+}
+
+// Delete removes the endpoint of the user and its pending deliveries.
+func (s *WebhookService) Delete(ctx context.Context, userID, id int64) error {
+	return s.repo.Delete(ctx, userID, id)
+}
+
+// Deliveries returns the latest deliveries to the endpoint of the user.
+func (s *WebhookService) Deliveries(ctx context.Context, userID, webhookID int64) ([]domain.WebhookDelivery, error) {
+	return s.repo.ListDeliveries(ctx, userID, webhookID, deliveriesListLimit)
+}
+
+// Redeliver queues the delivery again, including dead and delivered ones.
+func (s *WebhookService) Redeliver(ctx context.Context, userID, webhookID, id int64) error {
+	return s.repo.Redeliver(ctx, userID, webhookID, id)
+}
+
+var errPrivateAddress = errors.New("address is not public")
+
+// nonPublicPrefixes are the special-purpose ranges of the IANA IPv4 and
+// IPv6 registries that aren't globally reachable, plus multicast.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("3fff::/20"),
+	netip.MustParsePrefix("5f00::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// isPublicAddr reports whether ip is outside every non-public range.
+// IPv4-mapped IPv6 addresses are checked as IPv4.
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewWebhookClient returns a client for webhook deliveries. Unless
+// allowPrivate is set it refuses to connect to addresses that aren't
+// globally reachable, such as loopback, private, link-local, shared and
+// NAT64 ones, so endpoints can't point the service at internal systems.
+// Redirects are not followed for the same reason.
+func NewWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		// the check runs on the resolved address of every connection
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := ap.Addr(); !isPublicAddr(ip) {
+				return fmt.Errorf("%w: %s", errPrivateAddress, ip.Unmap())
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// a proxy would connect on our behalf, bypassing the check
+	transport.Proxy = nil
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// DefaultWebhookRetention is how long delivered and dead deliveries are
+// kept unless overridden with SetRetention.
+const DefaultWebhookRetention = 7 * 24 * time.Hour
+
+// pruneInterval is the period of removing deliveries past the retention.
+const pruneInterval = time.Hour
+
+// leaseMargin is added to the time a batch of deliveries may take to send,
+// leaving time to store the results before the lease expires.
+const leaseMargin = 10 * time.Second
+
+// WebhookDispatcher posts queued deliveries to their endpoints. Deliveries
+// are leased before sending, so several replicas may run dispatchers
+// against the same database. A delivery is sent at least once: it is
+// retried if the result can't be stored, and a result arriving after the
+// lease was taken over is dropped.
+type WebhookDispatcher struct {
+	repo      repository.WebhookRepo
+	client    *http.Client
+	owner     string
+	retry     RetryPolicy
+	retention time.Duration
+}
+
+// NewWebhookDispatcher creates a new dispatcher sending with client.
+// The lease of claimed deliveries is derived from the client timeout, so
+// the client should have one.
+func NewWebhookDispatcher(r repository.WebhookRepo, client *http.Client) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		repo:      r,
+		client:    client,
+		owner:     uuid.NewString(),
+		retry:     DefaultWebhookRetryPolicy,
+		retention: DefaultWebhookRetention,
+	}
+}
+
+// SetRetryPolicy replaces the policy applied to failed deliveries. MaxAge
+// is ignored. It must be called before Run.
+func (d *WebhookDispatcher) SetRetryPolicy(p RetryPolicy) {
+	d.retry = p
+}
+
+// leaseFor returns the lease of a claimed batch of deliveries. A delivery
+// may wait for the workers sending the rest of the batch, so the lease
+// covers every delivery of the batch timing out in turn. Without a client
+// timeout the default lease of a minute is used.
+func (d *WebhookDispatcher) leaseFor(batch int) time.Duration {
+	if d.client.Timeout <= 0 {
+		return defaultLease
+	}
+	return time.Duration(batch)*d.client.Timeout + leaseMargin
+}
+
+// SetRetention sets how long delivered and dead deliveries are kept.
+// It must be called before Run.
+func (d *WebhookDispatcher) SetRetention(retention time.Duration) {
+	d.retention = retention
+}
+
+// Run sends due deliveries until ctx is done. Every tick up to batch
+// deliveries are claimed and sent by at most parallel workers. Once an
+// hour deliveries past the retention are removed.
+func (d *WebhookDispatcher) Run(ctx context.Context, parallel, batch int, interval time.Duration) {
+	sem := make(chan struct{}, parallel)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lease := d.leaseFor(batch)
+
+	var (
+		wg     sync.WaitGroup
+		pruned time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+		if time.Since(pruned) >= pruneInterval {
+			if _, err := d.repo.PruneDeliveries(ctx, time.Now().Add(-d.retention)); err == nil {
+				pruned = time.Now()
+			}
+		}
+		list, err := d.repo.ClaimDeliveries(ctx, d.owner, batch, lease)
+		if err != nil {
+			continue
+		}
+	deliveriesLoop:
+		for _, dl := range list {
+			select {
+			case <-ctx.Done():
+				break deliveriesLoop
+			case sem <- struct{}{}:
+			}
+			wg.Add(1)
+			go func(dl domain.WebhookDelivery) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				d.deliver(ctx, dl)
+			}(dl)
+		}
+	}
+}
+
+type webhookPayload struct {
+	ID        int64       `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      webhookData `json:"data"`
+}
+
+type webhookData struct {
+	UserID  int64        `json:"user_id"`
+	Order   string       `json:"order"`
+	Accrual *json.Number `json:"accrual,omitempty"`
+	Sum     *json.Number `json:"sum,omitempty"`
+}
+
+func newWebhookPayload(dl domain.WebhookDelivery) webhookPayload {
+	p := webhookPayload{
+		ID:        dl.ID,
+		Type:      string(dl.Event),
+		CreatedAt: dl.OccurredAt.UTC(),
+		Data:      webhookData{UserID: dl.UserID, Order: dl.OrderNumber},
+	}
+	if dl.Amount != nil {
+		// amounts are exact decimals, like in the API
+		n := json.Number(dl.Amount.String())
+		if dl.Event == domain.WebhookWithdrawalCreated {
+			p.Data.Sum = &n
+		} else {
+			p.Data.Accrual = &n
+		}
+	}
+	return p
+}
+
+// deliver sends a single delivery and stores the result. A delivery
+// interrupted by shutdown is sent again once its lease expires.
+func (d *WebhookDispatcher) deliver(ctx context.Context, dl domain.WebhookDelivery) {
+	body, err := json.Marshal(newWebhookPayload(dl))
+	if err != nil {
+		d.fail(ctx, dl, err.Error())
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.URL, bytes.NewReader(body))
+	if err != nil {
+		d.fail(ctx, dl, err.Error())
+		return
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(dl.Event))
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(dl.ID, 10))
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(dl.Secret, ts, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			d.fail(ctx, dl, err.Error())
+		}
+		return
+	}
+	// draining a bit of the body lets the connection be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.fail(ctx, dl, "unexpected status "+resp.Status)
+		return
+	}
+	_ = d.repo.MarkDelivered(context.WithoutCancel(ctx), dl.ID, d.owner)
+}
+
+// fail postpones the next attempt with exponential backoff or makes the
+// delivery dead once the retry policy is exhausted.
+func (d *WebhookDispatcher) fail(ctx context.Context, dl domain.WebhookDelivery, reason string) {
+	attempts := dl.Attempts + 1
+	dead := d.retry.MaxAttempts > 0 && attempts >= d.retry.MaxAttempts
+	_ = d.repo.RecordFailure(context.WithoutCancel(ctx), dl.ID, d.owner, reason, time.Now().Add(d.retry.Delay(attempts)), dead)
+}
@@ -8,38 +8,62 @@ import (
 	"github.com/shopspring/decimal"
 )
 
+// amountPlaces is the number of fractional digits amounts are stored with.
+const amountPlaces = 2
+
 // WithdrawService provides withdrawal operations.
 type WithdrawService struct {
-	orders      repository.OrderRepo
 	withdrawals repository.WithdrawalRepo
 	inval       BalanceInvalidator
+	observer    BalanceObserver
 }
 
 // NewWithdrawService creates a new WithdrawService instance.
-func NewWithdrawService(o repository.OrderRepo, w repository.WithdrawalRepo, b BalanceInvalidator) *WithdrawService {
-	return &WithdrawService{orders: o, withdrawals: w, inval: b}
+func NewWithdrawService(w repository.WithdrawalRepo, b BalanceInvalidator) *WithdrawService {
+	return &WithdrawService{withdrawals: w, inval: b}
+}
+
+// BalanceObserver is told about users whose balance has changed.
+type BalanceObserver interface {
+	BalanceChanged(ctx context.Context, userID int64)
+}
+
+// SetObserver sets the observer of balance changes. It must be called
+// before use.
+func (s *WithdrawService) SetObserver(o BalanceObserver) {
+	s.observer = o
 }
 
 // Withdraw deducts amount from user's balance if sufficient.
-// Returns ErrInsufficientFunds if current balance is less than amount.
+// The balance check and the withdrawal are performed atomically by the repository.
+// Returns ErrInsufficientFunds if current balance is less than amount and
+// *ValidationError if amount is not positive or has more than two decimals.
 func (s *WithdrawService) Withdraw(ctx context.Context, userID int64, number string, amount decimal.Decimal) error {
-	totalAccrual, err := s.orders.SumProcessedAccrualByUser(ctx, userID)
-	if err != nil {
-		return err
-	}
-	totalWithdrawn, err := s.withdrawals.SumByUser(ctx, userID)
-	if err != nil {
+	var verr domain.ValidationError
+	validateAmount("sum", amount, &verr)
+	if err := verr.Err(); err != nil {
 		return err
 	}
-	current := totalAccrual.Sub(totalWithdrawn)
-	if current.Cmp(amount) < 0 {
-		return domain.ErrInsufficientFunds
-	}
-	if err := s.withdrawals.Create(ctx, number, userID, amount); err != nil {
+	if err := s.withdrawals.Withdraw(ctx, number, userID, amount); err != nil {
 		return err
 	}
 	if s.inval != nil {
 		s.inval.Invalidate(userID)
 	}
+	if s.observer != nil {
+		// the withdrawal is stored even if the client has gone
+		s.observer.BalanceChanged(context.WithoutCancel(ctx), userID)
+	}
 	return nil
 }
+
+// validateAmount records in verr why amount given in field can't be stored
+// exactly or isn't a positive number of points.
+func validateAmount(field string, amount decimal.Decimal, verr *domain.ValidationError) {
+	switch {
+	case !amount.IsPositive():
+		verr.Add(field, domain.CodeNotPositive, "amount must be greater than zero")
+	case !amount.Equal(amount.Round(amountPlaces)):
+		verr.Add(field, domain.CodeTooPrecise, "amount must have at most two decimal places")
+	}
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type stubWithdrawals struct {
+	amounts []decimal.Decimal
+}
+
+func (s *stubWithdrawals) Withdraw(ctx context.Context, num string, userID int64, amount decimal.Decimal) error {
+	s.amounts = append(s.amounts, amount)
+	return nil
+}
+
+func (s *stubWithdrawals) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Withdrawal, error) {
+	return nil, nil
+}
+
+func TestWithdrawService_ValidatesAmount(t *testing.T) {
+	repo := &stubWithdrawals{}
+	svc := NewWithdrawService(repo, nil)
+	ctx := context.Background()
+
+	for amount, code := range map[string]string{
+		"0":      domain.CodeNotPositive,
+		"-5":     domain.CodeNotPositive,
+		"10.001": domain.CodeTooPrecise,
+	} {
+		err := svc.Withdraw(ctx, 1, "79927398713", decimal.RequireFromString(amount))
+		var verr *domain.ValidationError
+		if !errors.As(err, &verr) || verr.Fields[0].Field != "sum" || verr.Fields[0].Code != code {
+			t.Fatalf("%s: expected %s, got %v", amount, code, err)
+		}
+	}
+	if len(repo.amounts) != 0 {
+		t.Fatal("invalid amounts must not be withdrawn")
+	}
+
+	for _, amount := range []string{"0.01", "10.5", "10.500", "751.99"} {
+		if err := svc.Withdraw(ctx, 1, "79927398713", decimal.RequireFromString(amount)); err != nil {
+			t.Fatalf("%s: %v", amount, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// apiKeyUseResolution is how precisely the last use of a key is recorded.
+const apiKeyUseResolution = time.Minute
+
+// NewAPIKeyRepo creates API key repository backed by the store.
+func NewAPIKeyRepo(s *Store) repository.APIKeyRepo {
+	return &apiKeyRepo{s}
+}
+
+type apiKeyRepo struct{ s *Store }
+
+type apiKey struct {
+	domain.APIKey
+	hash    string
+	revoked bool
+}
+
+// value returns a copy of the key that doesn't share scopes or timestamps.
+func (k *apiKey) value() domain.APIKey {
+	res := k.APIKey
+	res.Scopes = slices.Clone(k.Scopes)
+	if k.LastUsedAt != nil {
+		t := *k.LastUsedAt
+		res.LastUsedAt = &t
+	}
+	return res
+}
+
+var errDuplicateAPIKey = errors.New("memory: duplicate api key")
+
+func (r *apiKeyRepo) Create(ctx context.Context, k domain.APIKey, hash string) (domain.APIKey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, existing := range r.s.apiKeys {
+		if existing.hash == hash {
+			return domain.APIKey{}, errDuplicateAPIKey
+		}
+	}
+	r.s.lastKeyID++
+	k.ID = r.s.lastKeyID
+	k.CreatedAt = time.Now()
+	k.LastUsedAt = nil
+	stored := &apiKey{APIKey: k, hash: hash}
+	stored.Scopes = slices.Clone(k.Scopes)
+	r.s.apiKeys[k.ID] = stored
+	return stored.value(), nil
+}
+
+func (r *apiKeyRepo) GetByHash(ctx context.Context, hash string) (domain.APIKey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, k := range r.s.apiKeys {
+		if k.hash == hash && !k.revoked {
+			if now := time.Now(); k.LastUsedAt == nil || k.LastUsedAt.Before(now.Add(-apiKeyUseResolution)) {
+				k.LastUsedAt = &now
+			}
+			return k.value(), nil
+		}
+	}
+	return domain.APIKey{}, domain.ErrNotFound
+}
+
+func (r *apiKeyRepo) ListByUser(ctx context.Context, userID int64) ([]domain.APIKey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var list []domain.APIKey
+	for _, k := range r.s.apiKeys {
+		if k.UserID == userID && !k.revoked {
+			list = append(list, k.value())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (r *apiKeyRepo) Revoke(ctx context.Context, userID, id int64) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	k, ok := r.s.apiKeys[id]
+	if !ok || k.UserID != userID || k.revoked {
+		return domain.ErrNotFound
+	}
+	k.revoked = true
+	return nil
+}
@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewEventRepo creates user event log repository backed by the store.
+func NewEventRepo(s *Store) repository.EventRepo {
+	return &eventRepo{s}
+}
+
+type eventRepo struct{ s *Store }
+
+func (r *eventRepo) Append(ctx context.Context, e domain.Event, keep int) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	// copies keep callers from changing the stored event
+	if e.Order != nil {
+		o := *e.Order
+		e.Order = &o
+	}
+	if e.Balance != nil {
+		b := *e.Balance
+		e.Balance = &b
+	}
+	r.s.eventSeq[e.UserID]++
+	e.ID = r.s.eventSeq[e.UserID]
+	e.CreatedAt = time.Now()
+	log := append(r.s.events[e.UserID], e)
+	if len(log) > keep {
+		log = append([]domain.Event(nil), log[len(log)-keep:]...)
+	}
+	r.s.events[e.UserID] = log
+	return e.ID, nil
+}
+
+func (r *eventRepo) ListAfter(ctx context.Context, userID, afterID int64, limit int) ([]domain.Event, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var list []domain.Event
+	for _, e := range r.s.events[userID] {
+		if e.ID > afterID && len(list) < limit {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+func (r *eventRepo) LastID(ctx context.Context, userID int64) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	log := r.s.events[userID]
+	if len(log) == 0 {
+		return 0, nil
+	}
+	return log[len(log)-1].ID, nil
+}
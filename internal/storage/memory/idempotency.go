@@ -0,0 +1,81 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// idempotencyTTL is how long a stored response may be replayed.
+const idempotencyTTL = 24 * time.Hour
+
+// NewIdempotencyRepo creates idempotency key repository backed by the store.
+func NewIdempotencyRepo(s *Store) repository.IdempotencyRepo {
+	return &idempotencyRepo{s}
+}
+
+type idempotencyRepo struct{ s *Store }
+
+type idemKey struct {
+	userID int64
+	key    string
+}
+
+func (r *idempotencyRepo) Reserve(ctx context.Context, userID int64, key, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	k := idemKey{userID, key}
+	now := time.Now()
+	if rec, ok := r.s.idem[k]; ok {
+		ttl := idempotencyTTL
+		if rec.StatusCode == 0 {
+			ttl = lease
+		}
+		if !rec.CreatedAt.Before(now.Add(-ttl)) {
+			res := *rec
+			res.Body = append([]byte(nil), rec.Body...)
+			return res, false, nil
+		}
+	}
+	rec := domain.IdempotencyRecord{UserID: userID, Key: key, RequestHash: requestHash, CreatedAt: now}
+	r.s.idem[k] = &rec
+	return rec, true, nil
+}
+
+func (r *idempotencyRepo) Complete(ctx context.Context, userID int64, key string, statusCode int, contentType string, body []byte) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if rec, ok := r.s.idem[idemKey{userID, key}]; ok {
+		rec.StatusCode = statusCode
+		rec.ContentType = contentType
+		rec.Body = append([]byte(nil), body...)
+	}
+	return nil
+}
+
+func (r *idempotencyRepo) Delete(ctx context.Context, userID int64, key string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	delete(r.s.idem, idemKey{userID, key})
+	return nil
+}
+
+func (r *idempotencyRepo) Prune(ctx context.Context) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	before := time.Now().Add(-idempotencyTTL)
+	var n int64
+	for k, rec := range r.s.idem {
+		if rec.CreatedAt.Before(before) {
+			delete(r.s.idem, k)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,96 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewLedgerRepo creates ledger repository backed by the store.
+func NewLedgerRepo(s *Store) repository.LedgerRepo {
+	return &ledgerRepo{s}
+}
+
+type ledgerRepo struct{ s *Store }
+
+func (r *ledgerRepo) Adjust(ctx context.Context, userID int64, amount decimal.Decimal) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.postEntries(userID, domain.AccountAdjustments, domain.LedgerAdjustment, amount, ""), nil
+}
+
+func (r *ledgerRepo) Reverse(ctx context.Context, txID int64) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var legs []*domain.LedgerEntry
+	for _, e := range r.s.entries {
+		if e.TxID == txID {
+			legs = append(legs, e)
+		}
+	}
+	if len(legs) == 0 {
+		return 0, domain.ErrNotFound
+	}
+	for _, l := range legs {
+		if r.s.reversed[l.ID] {
+			return 0, domain.ErrAlreadyReversed
+		}
+	}
+
+	r.s.lastTxID++
+	now := time.Now()
+	for _, l := range legs {
+		id := l.ID
+		r.s.reversed[id] = true
+		r.s.addEntry(domain.LedgerEntry{
+			TxID:        r.s.lastTxID,
+			Account:     l.Account,
+			UserID:      l.UserID,
+			Kind:        domain.LedgerReversal,
+			Amount:      l.Amount.Neg(),
+			OrderNumber: l.OrderNumber,
+			ReversalOf:  &id,
+			CreatedAt:   now,
+		})
+	}
+	return r.s.lastTxID, nil
+}
+
+func (r *ledgerRepo) Balance(ctx context.Context, userID int64) (domain.Balance, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.balance(userID), nil
+}
+
+func (r *ledgerRepo) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.LedgerEntry, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	// entries are appended in creation order, so walking them backwards
+	// gives creation time desc, id desc
+	account := domain.UserAccount(userID)
+	var list []*domain.LedgerEntry
+	for i := len(r.s.entries) - 1; i >= 0; i-- {
+		if e := r.s.entries[i]; e.Account == account {
+			list = append(list, e)
+		}
+	}
+	var res []domain.LedgerEntry
+	for _, e := range page(list, limit, offset) {
+		c := *e
+		c.UserID = userID
+		if e.ReversalOf != nil {
+			id := *e.ReversalOf
+			c.ReversalOf = &id
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
@@ -0,0 +1,93 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewLoginAttemptRepo creates failed login counters repository backed by the store.
+func NewLoginAttemptRepo(s *Store) repository.LoginAttemptRepo {
+	return &loginAttemptRepo{s}
+}
+
+type loginAttemptRepo struct{ s *Store }
+
+func (r *loginAttemptRepo) Get(ctx context.Context, key string) (domain.LoginAttempts, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	a, ok := r.s.attempts[key]
+	if !ok {
+		return domain.LoginAttempts{}, nil
+	}
+	return copyAttempts(a), nil
+}
+
+func (r *loginAttemptRepo) Record(ctx context.Context, key string, window time.Duration, lockAfter int, lockFor time.Duration) (domain.LoginAttempts, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := time.Now()
+	a, ok := r.s.attempts[key]
+	if !ok {
+		a = &domain.LoginAttempts{}
+		r.s.attempts[key] = a
+	}
+	prev := copyAttempts(a)
+	if !ok || a.LastFailureAt.Before(now.Add(-window)) {
+		a.Failures = 1
+	} else {
+		a.Failures++
+	}
+	a.LastFailureAt = now
+	if lockAfter > 0 && a.Failures >= lockAfter {
+		until := now.Add(lockFor)
+		a.LockedUntil = &until
+	}
+	return prev, nil
+}
+
+func (r *loginAttemptRepo) Release(ctx context.Context, key string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if a, ok := r.s.attempts[key]; ok && a.Failures > 0 {
+		a.Failures--
+	}
+	return nil
+}
+
+func (r *loginAttemptRepo) Reset(ctx context.Context, key string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	delete(r.s.attempts, key)
+	return nil
+}
+
+func (r *loginAttemptRepo) Prune(ctx context.Context, before time.Time) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := time.Now()
+	var n int64
+	for key, a := range r.s.attempts {
+		if a.LastFailureAt.Before(before) && (a.LockedUntil == nil || a.LockedUntil.Before(now)) {
+			delete(r.s.attempts, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func copyAttempts(a *domain.LoginAttempts) domain.LoginAttempts {
+	res := *a
+	if a.LockedUntil != nil {
+		t := *a.LockedUntil
+		res.LockedUntil = &t
+	}
+	return res
+}
@@ -0,0 +1,129 @@
+// Package memory implements repositories kept in process memory. It is meant
+// for local development and tests: data is lost on restart and can't be
+// shared between replicas.
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// URI is the DATABASE_URI value selecting the in-memory backend.
+const URI = "memory://"
+
+// Store holds the data of all in-memory repositories. A single lock guards
+// everything, so operations spanning several tables, like a withdrawal
+// posting ledger entries, are atomic.
+type Store struct {
+	mu sync.Mutex
+
+	users          map[int64]*domain.User
+	orders         map[string]*order
+	withdrawals    map[string]*withdrawal
+	entries        []*domain.LedgerEntry
+	reversed       map[int64]bool
+	idem           map[idemKey]*domain.IdempotencyRecord
+	sessions       map[string]*session
+	apiKeys        map[int64]*apiKey
+	attempts       map[string]*domain.LoginAttempts
+	resets         map[string]*reset
+	events         map[int64][]domain.Event
+	eventSeq       map[int64]int64
+	webhooks       map[int64]*domain.Webhook
+	deliveries     map[int64]*delivery
+	lastUserID     int64
+	lastKeyID      int64
+	lastEntry      int64
+	lastTxID       int64
+	lastWebhookID  int64
+	lastDeliveryID int64
+	seq            int64
+}
+
+// NewStore creates an empty store.
+func NewStore() *Store {
+	return &Store{
+		users:       make(map[int64]*domain.User),
+		orders:      make(map[string]*order),
+		withdrawals: make(map[string]*withdrawal),
+		reversed:    make(map[int64]bool),
+		idem:        make(map[idemKey]*domain.IdempotencyRecord),
+		sessions:    make(map[string]*session),
+		apiKeys:     make(map[int64]*apiKey),
+		attempts:    make(map[string]*domain.LoginAttempts),
+		resets:      make(map[string]*reset),
+		events:      make(map[int64][]domain.Event),
+		eventSeq:    make(map[int64]int64),
+		webhooks:    make(map[int64]*domain.Webhook),
+		deliveries:  make(map[int64]*delivery),
+	}
+}
+
+// Ping always succeeds. It lets the store serve as readiness check target.
+func (s *Store) Ping(ctx context.Context) error {
+	return nil
+}
+
+// New creates repositories backed by the store.
+func New(s *Store) (repository.UserRepo, repository.OrderRepo, repository.WithdrawalRepo) {
+	return &userRepo{s}, &orderRepo{s}, &withdrawalRepo{s}
+}
+
+// next returns a number increasing with every call. It orders rows created
+// within the same clock tick.
+func (s *Store) next() int64 {
+	s.seq++
+	return s.seq
+}
+
+// postEntries records a balanced transaction: the user's account changes by
+// amount and the counter account by -amount. s.mu must be held.
+func (s *Store) postEntries(userID int64, counter string, kind domain.LedgerEntryKind, amount decimal.Decimal, orderNumber string) int64 {
+	s.lastTxID++
+	now := time.Now()
+	s.addEntry(domain.LedgerEntry{TxID: s.lastTxID, Account: domain.UserAccount(userID), UserID: userID, Kind: kind, Amount: amount, OrderNumber: orderNumber, CreatedAt: now})
+	s.addEntry(domain.LedgerEntry{TxID: s.lastTxID, Account: counter, Kind: kind, Amount: amount.Neg(), OrderNumber: orderNumber, CreatedAt: now})
+	return s.lastTxID
+}
+
+func (s *Store) addEntry(e domain.LedgerEntry) {
+	s.lastEntry++
+	e.ID = s.lastEntry
+	s.entries = append(s.entries, &e)
+}
+
+// balance computes user's balance from ledger entries. s.mu must be held.
+func (s *Store) balance(userID int64) domain.Balance {
+	account := domain.UserAccount(userID)
+	kinds := make(map[int64]domain.LedgerEntryKind)
+	bal := domain.Balance{Current: decimal.Zero, Withdrawn: decimal.Zero}
+	for _, e := range s.entries {
+		kinds[e.ID] = e.Kind
+		if e.Account != account {
+			continue
+		}
+		bal.Current = bal.Current.Add(e.Amount)
+		if e.Kind == domain.LedgerWithdrawal || (e.Kind == domain.LedgerReversal && e.ReversalOf != nil && kinds[*e.ReversalOf] == domain.LedgerWithdrawal) {
+			bal.Withdrawn = bal.Withdrawn.Sub(e.Amount)
+		}
+	}
+	return bal
+}
+
+// page returns the part of a sorted list selected by limit and offset.
+func page[T any](list []T, limit, offset int) []T {
+	if offset >= len(list) {
+		return nil
+	}
+	list = list[offset:]
+	if limit >= 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	return list
+}
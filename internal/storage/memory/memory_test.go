@@ -0,0 +1,27 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/Hobrus/gophermarket/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Repos {
+		s := NewStore()
+		users, orders, withdrawals := New(s)
+		return storagetest.Repos{
+			Users:          users,
+			Orders:         orders,
+			Withdrawals:    withdrawals,
+			Ledger:         NewLedgerRepo(s),
+			Idempotency:    NewIdempotencyRepo(s),
+			Sessions:       NewSessionRepo(s),
+			APIKeys:        NewAPIKeyRepo(s),
+			LoginAttempts:  NewLoginAttemptRepo(s),
+			PasswordResets: NewPasswordResetRepo(s),
+			Events:         NewEventRepo(s),
+			Webhooks:       NewWebhookRepo(s),
+		}
+	})
+}
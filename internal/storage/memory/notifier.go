@@ -0,0 +1,26 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/Hobrus/gophermarket/pkg/pubsub"
+)
+
+// Notifier delivers notifications within the process.
+type Notifier struct {
+	hub pubsub.Hub
+}
+
+// NewNotifier creates an in-process notifier.
+func NewNotifier() *Notifier {
+	return &Notifier{}
+}
+
+func (n *Notifier) Notify(ctx context.Context, channel, payload string) error {
+	n.hub.Publish(channel, payload)
+	return nil
+}
+
+func (n *Notifier) Subscribe(ctx context.Context, channel string) <-chan string {
+	return n.hub.Subscribe(ctx, channel)
+}
@@ -0,0 +1,55 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewPasswordResetRepo creates password reset token repository backed by the store.
+func NewPasswordResetRepo(s *Store) repository.PasswordResetRepo {
+	return &passwordResetRepo{s}
+}
+
+type passwordResetRepo struct{ s *Store }
+
+type reset struct {
+	userID    int64
+	expiresAt time.Time
+	used      bool
+}
+
+var errDuplicateReset = errors.New("memory: duplicate reset token")
+
+func (r *passwordResetRepo) Create(ctx context.Context, userID int64, tokenHash string, expiresAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.resets[tokenHash]; ok {
+		return errDuplicateReset
+	}
+	r.s.resets[tokenHash] = &reset{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (r *passwordResetRepo) Consume(ctx context.Context, tokenHash, passwordHash string) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	t, ok := r.s.resets[tokenHash]
+	if !ok || t.used || !t.expiresAt.After(time.Now()) {
+		return 0, domain.ErrResetTokenInvalid
+	}
+	for _, other := range r.s.resets {
+		if other.userID == t.userID {
+			other.used = true
+		}
+	}
+	if _, err := r.s.changePassword(t.userID, passwordHash); err != nil {
+		return 0, err
+	}
+	return t.userID, nil
+}
@@ -0,0 +1,348 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+type userRepo struct{ s *Store }
+
+type orderRepo struct{ s *Store }
+
+type withdrawalRepo struct{ s *Store }
+
+type order struct {
+	domain.Order
+	seq         int64
+	nextCheckAt time.Time
+	lockedBy    string
+	lockedUntil time.Time
+	lastError   string
+}
+
+// value returns a copy of the order that doesn't share the accrual.
+func (o *order) value() domain.Order {
+	res := o.Order
+	if o.Accrual != nil {
+		a := *o.Accrual
+		res.Accrual = &a
+	}
+	return res
+}
+
+type withdrawal struct {
+	domain.Withdrawal
+	seq int64
+}
+
+// -- UserRepo implementation --
+
+func (r *userRepo) Create(ctx context.Context, login, hash string) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.userByLogin(login); ok {
+		return 0, domain.ErrConflictSelf
+	}
+	r.s.lastUserID++
+	r.s.users[r.s.lastUserID] = &domain.User{ID: r.s.lastUserID, Login: login, PasswordHash: hash}
+	return r.s.lastUserID, nil
+}
+
+// userByLogin finds user by login compared case-insensitively. s.mu must be held.
+func (s *Store) userByLogin(login string) (*domain.User, bool) {
+	login = strings.ToLower(login)
+	for _, u := range s.users {
+		if strings.ToLower(u.Login) == login {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func (r *userRepo) GetByLogin(ctx context.Context, login string) (domain.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.userByLogin(login)
+	if !ok {
+		return domain.User{}, domain.ErrNotFound
+	}
+	return *u, nil
+}
+
+func (r *userRepo) GetByID(ctx context.Context, id int64) (domain.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[id]
+	if !ok {
+		return domain.User{}, domain.ErrNotFound
+	}
+	return *u, nil
+}
+
+func (r *userRepo) UpdatePasswordHash(ctx context.Context, userID int64, hash string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	u.PasswordHash = hash
+	return nil
+}
+
+func (r *userRepo) ChangePassword(ctx context.Context, userID int64, hash string) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.changePassword(userID, hash)
+}
+
+// changePassword replaces the password hash of the user, increments its
+// token version and revokes its sessions. s.mu must be held.
+func (s *Store) changePassword(userID int64, hash string) (int, error) {
+	u, ok := s.users[userID]
+	if !ok {
+		return 0, domain.ErrNotFound
+	}
+	u.PasswordHash = hash
+	u.TokenVersion++
+	s.revoke(func(sess *session) bool { return sess.UserID == userID }, time.Now())
+	return u.TokenVersion, nil
+}
+
+func (r *userRepo) TokenVersion(ctx context.Context, userID int64) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok {
+		return 0, domain.ErrNotFound
+	}
+	return u.TokenVersion, nil
+}
+
+// -- OrderRepo implementation --
+
+func (r *orderRepo) Add(ctx context.Context, num string, userID int64, status domain.OrderStatus) (error, error, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if o, ok := r.s.orders[num]; ok {
+		if o.UserID == userID {
+			return domain.ErrConflictSelf, nil, nil
+		}
+		return nil, domain.ErrConflictOther, nil
+	}
+	now := time.Now()
+	r.s.orders[num] = &order{
+		Order:       domain.Order{Number: num, UserID: userID, Status: status, UploadedAt: now},
+		seq:         r.s.next(),
+		nextCheckAt: now,
+	}
+	return nil, nil, nil
+}
+
+// sortedOrders returns orders matching keep sorted by upload time,
+// newest first if desc is set. s.mu must be held.
+func (s *Store) sortedOrders(keep func(o *order) bool, desc bool) []*order {
+	var list []*order
+	for _, o := range s.orders {
+		if keep(o) {
+			list = append(list, o)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if desc {
+			a, b = b, a
+		}
+		if !a.UploadedAt.Equal(b.UploadedAt) {
+			return a.UploadedAt.Before(b.UploadedAt)
+		}
+		return a.seq < b.seq
+	})
+	return list
+}
+
+// due reports whether the order is waiting for an accrual check.
+func (o *order) due(now time.Time) bool {
+	return (o.Status == domain.OrderNew || o.Status == domain.OrderProcessing) && !o.nextCheckAt.After(now)
+}
+
+func (r *orderRepo) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Order, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	list := r.s.sortedOrders(func(o *order) bool { return o.UserID == userID }, true)
+	var orders []domain.Order
+	for _, o := range page(list, limit, offset) {
+		orders = append(orders, o.value())
+	}
+	return orders, nil
+}
+
+func (r *orderRepo) GetUnprocessed(ctx context.Context, limit int) ([]domain.Order, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := time.Now()
+	list := r.s.sortedOrders(func(o *order) bool { return o.due(now) }, false)
+	var orders []domain.Order
+	for _, o := range page(list, limit, 0) {
+		orders = append(orders, o.value())
+	}
+	return orders, nil
+}
+
+func (r *orderRepo) Claim(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.Order, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := time.Now()
+	list := r.s.sortedOrders(func(o *order) bool {
+		return o.due(now) && (o.lockedUntil.IsZero() || o.lockedUntil.Before(now))
+	}, false)
+	var orders []domain.Order
+	for _, o := range page(list, limit, 0) {
+		o.lockedBy = owner
+		o.lockedUntil = now.Add(ttl)
+		orders = append(orders, o.value())
+	}
+	return orders, nil
+}
+
+func (r *orderRepo) Release(ctx context.Context, num, owner string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if o, ok := r.s.orders[num]; ok && o.lockedBy == owner {
+		o.lockedBy = ""
+		o.lockedUntil = time.Time{}
+	}
+	return nil
+}
+
+func (r *orderRepo) UpdateStatus(ctx context.Context, num string, status domain.OrderStatus, accrual *decimal.Decimal) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	o, ok := r.s.orders[num]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	if !o.Status.CanTransition(status) {
+		return domain.ErrInvalidTransition
+	}
+	if status == o.Status {
+		return nil
+	}
+	o.Status = status
+	o.Accrual = nil
+	if accrual != nil {
+		a := *accrual
+		o.Accrual = &a
+	}
+	o.Attempts = 0
+	o.nextCheckAt = time.Now()
+	if status == domain.OrderProcessed && accrual != nil && accrual.IsPositive() {
+		r.s.postEntries(o.UserID, domain.AccountAccrual, domain.LedgerAccrual, *accrual, num)
+	}
+	switch status {
+	case domain.OrderProcessed:
+		r.s.enqueueWebhooks(domain.WebhookOrderProcessed, o.UserID, num, accrual)
+	case domain.OrderInvalid:
+		r.s.enqueueWebhooks(domain.WebhookOrderInvalid, o.UserID, num, nil)
+	}
+	return nil
+}
+
+func (r *orderRepo) RecordFailure(ctx context.Context, num, lastErr string, next time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	o, ok := r.s.orders[num]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	o.Attempts++
+	o.lastError = lastErr
+	o.nextCheckAt = next
+	return nil
+}
+
+func (r *orderRepo) Postpone(ctx context.Context, num string, next time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	o, ok := r.s.orders[num]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	o.nextCheckAt = next
+	return nil
+}
+
+// -- WithdrawalRepo implementation --
+
+// Withdraw holds the store lock for the whole operation, so concurrent
+// withdrawals are executed one by one.
+func (r *withdrawalRepo) Withdraw(ctx context.Context, num string, userID int64, amount decimal.Decimal) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[userID]; !ok {
+		return domain.ErrNotFound
+	}
+	if r.s.balance(userID).Current.Cmp(amount) < 0 {
+		return domain.ErrInsufficientFunds
+	}
+	return r.s.withdraw(num, userID, amount)
+}
+
+// withdraw registers a withdrawal, debits the ledger and queues webhooks.
+// s.mu must be held.
+func (s *Store) withdraw(num string, userID int64, amount decimal.Decimal) error {
+	if _, ok := s.withdrawals[num]; ok {
+		return domain.ErrDuplicateWithdrawal
+	}
+	s.withdrawals[num] = &withdrawal{
+		Withdrawal: domain.Withdrawal{Number: num, UserID: userID, Amount: amount, ProcessedAt: time.Now()},
+		seq:        s.next(),
+	}
+	s.postEntries(userID, domain.AccountWithdrawals, domain.LedgerWithdrawal, amount.Neg(), num)
+	s.enqueueWebhooks(domain.WebhookWithdrawalCreated, userID, num, &amount)
+	return nil
+}
+
+func (r *withdrawalRepo) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Withdrawal, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var list []*withdrawal
+	for _, w := range r.s.withdrawals {
+		if w.UserID == userID {
+			list = append(list, w)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].ProcessedAt.Equal(list[j].ProcessedAt) {
+			return list[i].ProcessedAt.After(list[j].ProcessedAt)
+		}
+		return list[i].seq > list[j].seq
+	})
+	var res []domain.Withdrawal
+	for _, w := range page(list, limit, offset) {
+		res = append(res, w.Withdrawal)
+	}
+	return res, nil
+}
@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewSessionRepo creates session repository backed by the store.
+func NewSessionRepo(s *Store) repository.SessionRepo {
+	return &sessionRepo{s}
+}
+
+type sessionRepo struct{ s *Store }
+
+type session struct {
+	domain.Session
+	refreshHash string
+}
+
+var errDuplicateSession = errors.New("memory: duplicate session")
+
+func (r *sessionRepo) Create(ctx context.Context, s domain.Session, refreshHash string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.addSession(s, refreshHash)
+}
+
+// addSession stores a new session. s.mu must be held.
+func (s *Store) addSession(sess domain.Session, refreshHash string) error {
+	if _, ok := s.sessions[sess.ID]; ok {
+		return errDuplicateSession
+	}
+	if _, ok := s.sessionByHash(refreshHash); ok {
+		return errDuplicateSession
+	}
+	sess.RotatedAt, sess.RevokedAt = nil, nil
+	sess.CreatedAt = time.Now()
+	s.sessions[sess.ID] = &session{Session: sess, refreshHash: refreshHash}
+	return nil
+}
+
+// sessionByHash finds session by its refresh token hash. s.mu must be held.
+func (s *Store) sessionByHash(hash string) (*session, bool) {
+	for _, sess := range s.sessions {
+		if sess.refreshHash == hash {
+			return sess, true
+		}
+	}
+	return nil, false
+}
+
+func (r *sessionRepo) Rotate(ctx context.Context, refreshHash string, next domain.Session, nextHash string) (domain.Session, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	cur, ok := r.s.sessionByHash(refreshHash)
+	now := time.Now()
+	if !ok || cur.RevokedAt != nil || !cur.ExpiresAt.After(now) {
+		return domain.Session{}, domain.ErrSessionInvalid
+	}
+	if cur.RotatedAt != nil {
+		// the token leaked: whoever holds the newer one can't be trusted either
+		r.s.revoke(func(sess *session) bool { return sess.FamilyID == cur.FamilyID }, now)
+		return domain.Session{}, domain.ErrRefreshTokenReused
+	}
+
+	next.FamilyID = cur.FamilyID
+	next.UserID = cur.UserID
+	if err := r.s.addSession(next, nextHash); err != nil {
+		return domain.Session{}, err
+	}
+	cur.RotatedAt = &now
+	return r.s.sessions[next.ID].Session, nil
+}
+
+// revoke revokes every active session matching match. s.mu must be held.
+func (s *Store) revoke(match func(sess *session) bool, now time.Time) {
+	for _, sess := range s.sessions {
+		if sess.RevokedAt == nil && match(sess) {
+			t := now
+			sess.RevokedAt = &t
+		}
+	}
+}
+
+func (r *sessionRepo) IsActive(ctx context.Context, id string) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	sess, ok := r.s.sessions[id]
+	return ok && sess.RevokedAt == nil, nil
+}
+
+func (r *sessionRepo) RevokeFamily(ctx context.Context, id string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if cur, ok := r.s.sessions[id]; ok {
+		r.s.revoke(func(sess *session) bool { return sess.FamilyID == cur.FamilyID }, time.Now())
+	}
+	return nil
+}
+
+func (r *sessionRepo) RevokeAll(ctx context.Context, userID int64) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	r.s.revoke(func(sess *session) bool { return sess.UserID == userID }, time.Now())
+	return nil
+}
@@ -0,0 +1,228 @@
+package memory
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewWebhookRepo creates webhook repository backed by the store.
+func NewWebhookRepo(s *Store) repository.WebhookRepo {
+	return &webhookRepo{s}
+}
+
+type webhookRepo struct{ s *Store }
+
+type delivery struct {
+	domain.WebhookDelivery
+	lockedBy    string
+	lockedUntil time.Time
+}
+
+// value returns a copy of the delivery that doesn't share pointers.
+func (d *delivery) value() domain.WebhookDelivery {
+	res := d.WebhookDelivery
+	if d.Amount != nil {
+		a := *d.Amount
+		res.Amount = &a
+	}
+	if d.DeliveredAt != nil {
+		t := *d.DeliveredAt
+		res.DeliveredAt = &t
+	}
+	return res
+}
+
+// enqueueWebhooks queues the event for every endpoint subscribed to it.
+// s.mu must be held, so deliveries appear together with the change.
+func (s *Store) enqueueWebhooks(event domain.WebhookEvent, userID int64, num string, amount *decimal.Decimal) {
+	now := time.Now()
+	for _, w := range s.webhooks {
+		if (w.UserID != userID && w.UserID != 0) || !slices.Contains(w.Events, event) {
+			continue
+		}
+		s.lastDeliveryID++
+		d := domain.WebhookDelivery{
+			ID:            s.lastDeliveryID,
+			WebhookID:     w.ID,
+			Event:         event,
+			UserID:        userID,
+			OrderNumber:   num,
+			OccurredAt:    now,
+			Status:        domain.DeliveryPending,
+			NextAttemptAt: now,
+		}
+		if amount != nil {
+			a := *amount
+			d.Amount = &a
+		}
+		s.deliveries[d.ID] = &delivery{WebhookDelivery: d}
+	}
+}
+
+func (r *webhookRepo) Create(ctx context.Context, w domain.Webhook) (domain.Webhook, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	r.s.lastWebhookID++
+	w.ID = r.s.lastWebhookID
+	w.CreatedAt = time.Now()
+	w.Events = slices.Clone(w.Events)
+	r.s.webhooks[w.ID] = &w
+	res := w
+	res.Events = slices.Clone(w.Events)
+	return res, nil
+}
+
+func (r *webhookRepo) ListByUser(ctx context.Context, userID int64) ([]domain.Webhook, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var list []domain.Webhook
+	for _, w := range r.s.webhooks {
+		if w.UserID == userID {
+			res := *w
+			res.Events = slices.Clone(w.Events)
+			list = append(list, res)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (r *webhookRepo) Delete(ctx context.Context, userID, id int64) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	w, ok := r.s.webhooks[id]
+	if !ok || w.UserID != userID {
+		return domain.ErrNotFound
+	}
+	delete(r.s.webhooks, id)
+	for did, d := range r.s.deliveries {
+		if d.WebhookID == id {
+			delete(r.s.deliveries, did)
+		}
+	}
+	return nil
+}
+
+func (r *webhookRepo) ClaimDeliveries(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.WebhookDelivery, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := time.Now()
+	var due []*delivery
+	for _, d := range r.s.deliveries {
+		if d.Status == domain.DeliveryPending && !d.NextAttemptAt.After(now) && (d.lockedUntil.IsZero() || d.lockedUntil.Before(now)) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	var list []domain.WebhookDelivery
+	for _, d := range page(due, limit, 0) {
+		d.lockedBy = owner
+		d.lockedUntil = now.Add(ttl)
+		v := d.value()
+		w := r.s.webhooks[d.WebhookID]
+		v.URL, v.Secret = w.URL, w.Secret
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (r *webhookRepo) MarkDelivered(ctx context.Context, id int64, owner string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	d, ok := r.s.deliveries[id]
+	if !ok || d.lockedBy != owner {
+		return nil
+	}
+	now := time.Now()
+	d.Status = domain.DeliveryDelivered
+	d.Attempts++
+	d.LastError = ""
+	d.DeliveredAt = &now
+	d.lockedBy, d.lockedUntil = "", time.Time{}
+	return nil
+}
+
+func (r *webhookRepo) RecordFailure(ctx context.Context, id int64, owner, lastErr string, next time.Time, dead bool) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	d, ok := r.s.deliveries[id]
+	if !ok || d.lockedBy != owner {
+		return nil
+	}
+	d.Status = domain.DeliveryPending
+	if dead {
+		d.Status = domain.DeliveryDead
+	}
+	d.Attempts++
+	d.LastError = lastErr
+	d.NextAttemptAt = next
+	d.lockedBy, d.lockedUntil = "", time.Time{}
+	return nil
+}
+
+func (r *webhookRepo) ListDeliveries(ctx context.Context, userID, webhookID int64, limit int) ([]domain.WebhookDelivery, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if w, ok := r.s.webhooks[webhookID]; !ok || w.UserID != userID {
+		return nil, domain.ErrNotFound
+	}
+	var list []domain.WebhookDelivery
+	for _, d := range r.s.deliveries {
+		if d.WebhookID == webhookID {
+			list = append(list, d.value())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return page(list, limit, 0), nil
+}
+
+func (r *webhookRepo) Redeliver(ctx context.Context, userID, webhookID, id int64) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	d, ok := r.s.deliveries[id]
+	if !ok || d.WebhookID != webhookID || r.s.webhooks[webhookID].UserID != userID {
+		return domain.ErrNotFound
+	}
+	d.Status = domain.DeliveryPending
+	d.Attempts = 0
+	d.LastError = ""
+	d.NextAttemptAt = time.Now()
+	d.lockedBy, d.lockedUntil = "", time.Time{}
+	return nil
+}
+
+func (r *webhookRepo) PruneDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var n int64
+	for id, d := range r.s.deliveries {
+		delivered := d.Status == domain.DeliveryDelivered && d.DeliveredAt.Before(before)
+		dead := d.Status == domain.DeliveryDead && d.NextAttemptAt.Before(before)
+		if delivered || dead {
+			delete(r.s.deliveries, id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,117 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// apiKeyUseResolution is how precisely the last use of a key is recorded.
+const apiKeyUseResolution = time.Minute
+
+// NewAPIKeyRepo creates API key repository backed by pgx pool.
+func NewAPIKeyRepo(pool *pgxpool.Pool) repository.APIKeyRepo {
+	return &apiKeyRepo{pool}
+}
+
+type apiKeyRepo struct{ pool *pgxpool.Pool }
+
+func (r *apiKeyRepo) Create(ctx context.Context, k domain.APIKey, hash string) (domain.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	err := r.pool.QueryRow(ctx, `INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes) VALUES ($1,$2,$3,$4,$5) RETURNING id, created_at`,
+		k.UserID, k.Name, k.Prefix, hash, scopeStrings(k.Scopes)).Scan(&k.ID, &k.CreatedAt)
+	if err != nil {
+		return domain.APIKey{}, err
+	}
+	return k, nil
+}
+
+// GetByHash runs on every request made with a key, so the row is only
+// written when the recorded use is older than apiKeyUseResolution.
+func (r *apiKeyRepo) GetByHash(ctx context.Context, hash string) (domain.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	row := r.pool.QueryRow(ctx, `WITH k AS (
+			SELECT id, user_id, name, prefix, scopes, created_at, last_used_at FROM api_keys
+			WHERE key_hash=$1 AND revoked_at IS NULL
+		), used AS (
+			UPDATE api_keys SET last_used_at=now()
+			WHERE id=(SELECT id FROM k) AND (last_used_at IS NULL OR last_used_at < now() - $2 * interval '1 second')
+			RETURNING last_used_at
+		)
+		SELECT id, user_id, name, prefix, scopes, created_at, COALESCE((SELECT last_used_at FROM used), last_used_at) FROM k`,
+		hash, apiKeyUseResolution.Seconds())
+	k, err := scanAPIKey(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.APIKey{}, domain.ErrNotFound
+	}
+	return k, err
+}
+
+func (r *apiKeyRepo) ListByUser(ctx context.Context, userID int64) ([]domain.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx, `SELECT id, user_id, name, prefix, scopes, created_at, last_used_at FROM api_keys
+		WHERE user_id=$1 AND revoked_at IS NULL ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []domain.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, k)
+	}
+	return list, rows.Err()
+}
+
+func (r *apiKeyRepo) Revoke(ctx context.Context, userID, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `UPDATE api_keys SET revoked_at=now() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL`, id, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func scanAPIKey(row pgx.Row) (domain.APIKey, error) {
+	var (
+		k      domain.APIKey
+		scopes []string
+	)
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &scopes, &k.CreatedAt, &k.LastUsedAt); err != nil {
+		return domain.APIKey{}, err
+	}
+	k.Scopes = make([]domain.Scope, len(scopes))
+	for i, s := range scopes {
+		k.Scopes[i] = domain.Scope(s)
+	}
+	return k, nil
+}
+
+func scopeStrings(scopes []domain.Scope) []string {
+	res := make([]string, len(scopes))
+	for i, s := range scopes {
+		res[i] = string(s)
+	}
+	return res
+}
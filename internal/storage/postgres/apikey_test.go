@@ -0,0 +1,46 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+func TestAPIKeyRepo(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	userRepo, _, _ := New(pool)
+	repo := NewAPIKeyRepo(pool)
+	ctx := context.Background()
+
+	uid, err := userRepo.Create(ctx, "keys", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := repo.Create(ctx, domain.APIKey{UserID: uid, Name: "ci", Prefix: "gmk_1234", Scopes: []domain.Scope{domain.ScopeOrdersWrite}}, "h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.GetByHash(ctx, "h1")
+	if err != nil || got.ID != k.ID || got.UserID != uid || len(got.Scopes) != 1 || got.Scopes[0] != domain.ScopeOrdersWrite || got.LastUsedAt == nil {
+		t.Fatalf("unexpected key %+v %v", got, err)
+	}
+	list, err := repo.ListByUser(ctx, uid)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("list: %v %v", list, err)
+	}
+
+	if err := repo.Revoke(ctx, uid+1, k.ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found for other user, got %v", err)
+	}
+	if err := repo.Revoke(ctx, uid, k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetByHash(ctx, "h1"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected revoked key not found, got %v", err)
+	}
+}
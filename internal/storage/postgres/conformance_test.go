@@ -0,0 +1,36 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Hobrus/gophermarket/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Repos {
+		_, err := pool.Exec(context.Background(), `TRUNCATE users, orders, withdrawals, ledger_entries, idempotency_keys,
+			sessions, api_keys, login_attempts, password_resets, user_events,
+			webhooks, webhook_deliveries RESTART IDENTITY CASCADE`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, orders, withdrawals := New(pool)
+		return storagetest.Repos{
+			Users:          users,
+			Orders:         orders,
+			Withdrawals:    withdrawals,
+			Ledger:         NewLedgerRepo(pool),
+			Idempotency:    NewIdempotencyRepo(pool),
+			Sessions:       NewSessionRepo(pool),
+			APIKeys:        NewAPIKeyRepo(pool),
+			LoginAttempts:  NewLoginAttemptRepo(pool),
+			PasswordResets: NewPasswordResetRepo(pool),
+			Events:         NewEventRepo(pool),
+			Webhooks:       NewWebhookRepo(pool),
+		}
+	})
+}
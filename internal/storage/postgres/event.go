@@ -0,0 +1,92 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewEventRepo creates user event log repository backed by pgx pool.
+func NewEventRepo(pool *pgxpool.Pool) repository.EventRepo {
+	return &eventRepo{pool}
+}
+
+type eventRepo struct{ pool *pgxpool.Pool }
+
+// eventPayload is the stored body of an event.
+type eventPayload struct {
+	Order   *domain.Order   `json:"order,omitempty"`
+	Balance *domain.Balance `json:"balance,omitempty"`
+}
+
+func (r *eventRepo) Append(ctx context.Context, e domain.Event, keep int) (int64, error) {
+	payload, err := json.Marshal(eventPayload{Order: e.Order, Balance: e.Balance})
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		// the user row stays locked until commit, so a reader never sees an
+		// id before the lower ones of the same user
+		err := tx.QueryRow(ctx, `UPDATE users SET event_seq = event_seq + 1 WHERE id=$1 RETURNING event_seq`, e.UserID).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO user_events (user_id, seq, type, payload) VALUES ($1, $2, $3, $4)`,
+			e.UserID, id, e.Type, payload); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM user_events WHERE user_id=$1 AND seq <= $2`, e.UserID, id-int64(keep))
+		return err
+	})
+	return id, err
+}
+
+func (r *eventRepo) ListAfter(ctx context.Context, userID, afterID int64, limit int) ([]domain.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx, `SELECT seq, type, payload, created_at FROM user_events
+		WHERE user_id=$1 AND seq > $2 ORDER BY seq LIMIT $3`, userID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []domain.Event
+	for rows.Next() {
+		e := domain.Event{UserID: userID}
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.Type, &payload, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		var p eventPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return nil, err
+		}
+		e.Order, e.Balance = p.Order, p.Balance
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+func (r *eventRepo) LastID(ctx context.Context, userID int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	var id int64
+	err := r.pool.QueryRow(ctx, `SELECT seq FROM user_events WHERE user_id=$1 ORDER BY seq DESC LIMIT 1`, userID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
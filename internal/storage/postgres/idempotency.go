@@ -0,0 +1,93 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// idempotencyTTL is how long a stored response may be replayed.
+const idempotencyTTL = 24 * time.Hour
+
+// NewIdempotencyRepo creates idempotency key repository backed by pgx pool.
+func NewIdempotencyRepo(pool *pgxpool.Pool) repository.IdempotencyRepo {
+	return &idempotencyRepo{pool}
+}
+
+type idempotencyRepo struct{ pool *pgxpool.Pool }
+
+// Reserve inserts the key or takes over an expired one in a single statement,
+// so concurrent requests with the same key can't both reserve it.
+func (r *idempotencyRepo) Reserve(ctx context.Context, userID int64, key, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	rec := domain.IdempotencyRecord{UserID: userID, Key: key, RequestHash: requestHash}
+	err := r.pool.QueryRow(ctx, `INSERT INTO idempotency_keys (user_id, key, request_hash) VALUES ($1,$2,$3)
+		ON CONFLICT (user_id, key) DO UPDATE
+			SET request_hash=EXCLUDED.request_hash, status_code=NULL, content_type=NULL, body=NULL, created_at=now()
+			WHERE idempotency_keys.created_at < now() - $4 * interval '1 second'
+				OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < now() - $5 * interval '1 second')
+		RETURNING created_at`, userID, key, requestHash, idempotencyTTL.Seconds(), lease.Seconds()).Scan(&rec.CreatedAt)
+	if err == nil {
+		return rec, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return domain.IdempotencyRecord{}, false, err
+	}
+
+	var (
+		status      *int
+		contentType *string
+	)
+	err = r.pool.QueryRow(ctx, `SELECT request_hash, status_code, content_type, body, created_at FROM idempotency_keys WHERE user_id=$1 AND key=$2`, userID, key).
+		Scan(&rec.RequestHash, &status, &contentType, &rec.Body, &rec.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// deleted concurrently, the caller may try again
+		return domain.IdempotencyRecord{}, false, domain.ErrNotFound
+	}
+	if err != nil {
+		return domain.IdempotencyRecord{}, false, err
+	}
+	if status != nil {
+		rec.StatusCode = *status
+	}
+	if contentType != nil {
+		rec.ContentType = *contentType
+	}
+	return rec, false, nil
+}
+
+func (r *idempotencyRepo) Complete(ctx context.Context, userID int64, key string, statusCode int, contentType string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `UPDATE idempotency_keys SET status_code=$3, content_type=$4, body=$5 WHERE user_id=$1 AND key=$2`,
+		userID, key, statusCode, contentType, body)
+	return err
+}
+
+func (r *idempotencyRepo) Delete(ctx context.Context, userID int64, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE user_id=$1 AND key=$2`, userID, key)
+	return err
+}
+
+func (r *idempotencyRepo) Prune(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE created_at < now() - $1 * interval '1 second'`, idempotencyTTL.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyRepo(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	userRepo, _, _ := New(pool)
+	repo := NewIdempotencyRepo(pool)
+	ctx := context.Background()
+
+	uid, err := userRepo.Create(ctx, "idem", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, reserved, err := repo.Reserve(ctx, uid, "k", "h1", time.Minute); err != nil || !reserved {
+		t.Fatalf("reserve: %v %v", reserved, err)
+	}
+	rec, reserved, err := repo.Reserve(ctx, uid, "k", "h2", time.Minute)
+	if err != nil || reserved || rec.RequestHash != "h1" || rec.StatusCode != 0 {
+		t.Fatalf("expected in-progress record: %+v %v %v", rec, reserved, err)
+	}
+
+	if err := repo.Complete(ctx, uid, "k", 200, "application/json", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	rec, reserved, err = repo.Reserve(ctx, uid, "k", "h1", time.Minute)
+	if err != nil || reserved || rec.StatusCode != 200 || string(rec.Body) != `{}` || rec.ContentType != "application/json" {
+		t.Fatalf("expected completed record: %+v %v %v", rec, reserved, err)
+	}
+
+	if err := repo.Delete(ctx, uid, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, reserved, err := repo.Reserve(ctx, uid, "k", "h2", time.Minute); err != nil || !reserved {
+		t.Fatalf("reserve after delete: %v %v", reserved, err)
+	}
+
+	// keys past the replay period are pruned
+	if _, err := pool.Exec(ctx, `UPDATE idempotency_keys SET created_at=now()-interval '25 hours' WHERE key='k'`); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.Prune(ctx); err != nil || n != 1 {
+		t.Fatalf("expected one pruned key: %d %v", n, err)
+	}
+}
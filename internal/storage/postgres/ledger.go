@@ -0,0 +1,161 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewLedgerRepo creates ledger repository backed by pgx pool.
+func NewLedgerRepo(pool *pgxpool.Pool) repository.LedgerRepo {
+	return &ledgerRepo{pool}
+}
+
+type ledgerRepo struct{ pool *pgxpool.Pool }
+
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// postEntries records a balanced transaction within tx: the user's account
+// changes by amount and the counter account by -amount.
+func postEntries(ctx context.Context, tx pgx.Tx, userID int64, counter string, kind domain.LedgerEntryKind, amount decimal.Decimal, orderNumber string) (int64, error) {
+	var txID int64
+	if err := tx.QueryRow(ctx, `SELECT nextval('ledger_txn_seq')`).Scan(&txID); err != nil {
+		return 0, err
+	}
+	_, err := tx.Exec(ctx, `INSERT INTO ledger_entries (txn_id, account, user_id, kind, amount, order_number) VALUES
+		($1,$2,$3,$4,$5,NULLIF($6,'')),
+		($1,$7,NULL,$4,$8,NULLIF($6,''))`,
+		txID, domain.UserAccount(userID), userID, string(kind), amount, orderNumber, counter, amount.Neg())
+	if err != nil {
+		return 0, err
+	}
+	return txID, nil
+}
+
+// ledgerBalance computes user's balance from ledger entries.
+func ledgerBalance(ctx context.Context, q querier, userID int64) (domain.Balance, error) {
+	var bal domain.Balance
+	err := q.QueryRow(ctx, `SELECT
+		COALESCE(SUM(e.amount),0),
+		COALESCE(-SUM(e.amount) FILTER (WHERE e.kind='withdrawal' OR (e.kind='reversal' AND o.kind='withdrawal')),0)
+		FROM ledger_entries e LEFT JOIN ledger_entries o ON o.id=e.reversal_of
+		WHERE e.account=$1`, domain.UserAccount(userID)).Scan(&bal.Current, &bal.Withdrawn)
+	if err != nil {
+		return domain.Balance{}, err
+	}
+	return bal, nil
+}
+
+func (r *ledgerRepo) Adjust(ctx context.Context, userID int64, amount decimal.Decimal) (int64, error) {
+	var txID int64
+	err := inTx(ctx, r.pool, txSerializable, func(ctx context.Context, tx pgx.Tx) error {
+		var err error
+		txID, err = postEntries(ctx, tx, userID, domain.AccountAdjustments, domain.LedgerAdjustment, amount, "")
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return txID, nil
+}
+
+func (r *ledgerRepo) Reverse(ctx context.Context, txID int64) (int64, error) {
+	var revID int64
+	err := inTx(ctx, r.pool, txSerializable, func(ctx context.Context, tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT id, account, user_id, amount, order_number FROM ledger_entries WHERE txn_id=$1 ORDER BY id FOR UPDATE`, txID)
+		if err != nil {
+			return err
+		}
+		type leg struct {
+			id          int64
+			account     string
+			userID      *int64
+			amount      decimal.Decimal
+			orderNumber *string
+		}
+		var legs []leg
+		for rows.Next() {
+			var l leg
+			if err = rows.Scan(&l.id, &l.account, &l.userID, &l.amount, &l.orderNumber); err != nil {
+				rows.Close()
+				return err
+			}
+			legs = append(legs, l)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+		if len(legs) == 0 {
+			return domain.ErrNotFound
+		}
+
+		if err = tx.QueryRow(ctx, `SELECT nextval('ledger_txn_seq')`).Scan(&revID); err != nil {
+			return err
+		}
+		for _, l := range legs {
+			_, err = tx.Exec(ctx, `INSERT INTO ledger_entries (txn_id, account, user_id, kind, amount, order_number, reversal_of) VALUES ($1,$2,$3,$4,$5,$6,$7)`,
+				revID, l.account, l.userID, string(domain.LedgerReversal), l.amount.Neg(), l.orderNumber, l.id)
+			if err != nil {
+				if isUniqueViolation(err) {
+					return domain.ErrAlreadyReversed
+				}
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revID, nil
+}
+
+func (r *ledgerRepo) Balance(ctx context.Context, userID int64) (domain.Balance, error) {
+	var bal domain.Balance
+	err := inTx(ctx, r.pool, txSnapshot, func(ctx context.Context, tx pgx.Tx) error {
+		var err error
+		bal, err = ledgerBalance(ctx, tx, userID)
+		return err
+	})
+	if err != nil {
+		return domain.Balance{}, err
+	}
+	return bal, nil
+}
+
+func (r *ledgerRepo) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.LedgerEntry, error) {
+	var res []domain.LedgerEntry
+	err := inTx(ctx, r.pool, txSnapshot, func(ctx context.Context, tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT id, txn_id, account, kind, amount, COALESCE(order_number,''), reversal_of, created_at
+			FROM ledger_entries WHERE account=$1 ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`,
+			domain.UserAccount(userID), limit, offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		res = nil
+		for rows.Next() {
+			e := domain.LedgerEntry{UserID: userID}
+			var kind string
+			if err = rows.Scan(&e.ID, &e.TxID, &e.Account, &kind, &e.Amount, &e.OrderNumber, &e.ReversalOf, &e.CreatedAt); err != nil {
+				return err
+			}
+			e.Kind = domain.LedgerEntryKind(kind)
+			res = append(res, e)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
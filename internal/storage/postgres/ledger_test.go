@@ -0,0 +1,81 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+func TestLedgerRepo(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	userRepo, orderRepo, withdrawalRepo := New(pool)
+	ledger := NewLedgerRepo(pool)
+	ctx := context.Background()
+
+	uid, err := userRepo.Create(ctx, "ledger", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := orderRepo.Add(ctx, "1", uid, "NEW"); err != nil {
+		t.Fatal(err)
+	}
+	accrual := decimal.NewFromInt(100)
+	if err := orderRepo.UpdateStatus(ctx, "1", "PROCESSED", &accrual); err != nil {
+		t.Fatal(err)
+	}
+	// terminal status is final, so the accrual can't be credited twice
+	if err := orderRepo.UpdateStatus(ctx, "1", "PROCESSED", &accrual); !errors.Is(err, domain.ErrInvalidTransition) {
+		t.Fatalf("expected invalid transition, got %v", err)
+	}
+	if err := withdrawalRepo.Withdraw(ctx, "w1", uid, decimal.NewFromInt(30)); err != nil {
+		t.Fatal(err)
+	}
+	adjID, err := ledger.Adjust(ctx, uid, decimal.NewFromInt(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bal, err := ledger.Balance(ctx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bal.Current.Equal(decimal.NewFromInt(75)) || !bal.Withdrawn.Equal(decimal.NewFromInt(30)) {
+		t.Fatalf("unexpected balance %+v", bal)
+	}
+
+	if _, err := ledger.Reverse(ctx, adjID); err != nil {
+		t.Fatalf("reverse: %v", err)
+	}
+	if _, err := ledger.Reverse(ctx, adjID); !errors.Is(err, domain.ErrAlreadyReversed) {
+		t.Fatalf("expected already reversed, got %v", err)
+	}
+	if _, err := ledger.Reverse(ctx, 1<<40); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	entries, err := ledger.ListByUser(ctx, uid, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	if entries[0].Kind != domain.LedgerReversal || entries[0].ReversalOf == nil {
+		t.Fatalf("unexpected latest entry %+v", entries[0])
+	}
+
+	var total decimal.Decimal
+	if err := pool.QueryRow(ctx, `SELECT COALESCE(SUM(amount),0) FROM ledger_entries`).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if !total.IsZero() {
+		t.Fatalf("ledger is unbalanced: %s", total)
+	}
+}
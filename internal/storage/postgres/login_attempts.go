@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewLoginAttemptRepo creates failed login counters repository backed by pgx pool.
+func NewLoginAttemptRepo(pool *pgxpool.Pool) repository.LoginAttemptRepo {
+	return &loginAttemptRepo{pool}
+}
+
+type loginAttemptRepo struct{ pool *pgxpool.Pool }
+
+func (r *loginAttemptRepo) Get(ctx context.Context, key string) (domain.LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	var a domain.LoginAttempts
+	err := r.pool.QueryRow(ctx, `SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key=$1`, key).
+		Scan(&a.Failures, &a.LastFailureAt, &a.LockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.LoginAttempts{}, nil
+	}
+	return a, err
+}
+
+// Record locks the counters of key before counting the attempt, so
+// concurrent attempts from several replicas are serialized and each one sees
+// the attempts recorded before it. A missing row is inserted first, so there
+// is always a row to lock.
+func (r *loginAttemptRepo) Record(ctx context.Context, key string, window time.Duration, lockAfter int, lockFor time.Duration) (domain.LoginAttempts, error) {
+	var prev domain.LoginAttempts
+	err := inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 0, now())
+			ON CONFLICT (key) DO NOTHING`, key)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow(ctx, `SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key=$1 FOR UPDATE`, key).
+			Scan(&prev.Failures, &prev.LastFailureAt, &prev.LockedUntil)
+		if err != nil {
+			return err
+		}
+		if prev.Failures == 0 {
+			// the row was just inserted, there were no attempts
+			prev = domain.LoginAttempts{}
+		}
+		_, err = tx.Exec(ctx, `UPDATE login_attempts SET
+				failures = CASE WHEN last_failure_at < now() - $2 * interval '1 second' THEN 1 ELSE failures + 1 END,
+				last_failure_at = now(),
+				locked_until = CASE
+					WHEN $3 > 0 AND (CASE WHEN last_failure_at < now() - $2 * interval '1 second' THEN 1 ELSE failures + 1 END) >= $3
+					THEN now() + $4 * interval '1 second'
+					ELSE locked_until END
+			WHERE key=$1`, key, window.Seconds(), lockAfter, lockFor.Seconds())
+		return err
+	})
+	if err != nil {
+		return domain.LoginAttempts{}, err
+	}
+	return prev, nil
+}
+
+func (r *loginAttemptRepo) Release(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `UPDATE login_attempts SET failures=GREATEST(failures-1, 0) WHERE key=$1`, key)
+	return err
+}
+
+func (r *loginAttemptRepo) Reset(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `DELETE FROM login_attempts WHERE key=$1`, key)
+	return err
+}
+
+func (r *loginAttemptRepo) Prune(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `DELETE FROM login_attempts
+		WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < now())`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptRepo(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	repo := NewLoginAttemptRepo(pool)
+	ctx := context.Background()
+
+	if a, err := repo.Get(ctx, "login:x"); err != nil || a.Failures != 0 {
+		t.Fatalf("expected no failures: %+v %v", a, err)
+	}
+	for i := 0; i < 3; i++ {
+		prev, err := repo.Record(ctx, "login:x", time.Hour, 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev.Failures != i {
+			t.Fatalf("expected %d previous failures, got %d", i, prev.Failures)
+		}
+	}
+	if a, _ := repo.Get(ctx, "login:x"); a.Failures != 3 || a.LockedUntil == nil {
+		t.Fatalf("expected locked key, got %+v", a)
+	}
+
+	// an expired window restarts counting
+	if _, err := pool.Exec(ctx, `UPDATE login_attempts SET last_failure_at=now()-interval '2 hours' WHERE key='login:x'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Record(ctx, "login:x", time.Hour, 3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := repo.Get(ctx, "login:x"); a.Failures != 1 {
+		t.Fatalf("expected counter restart: %+v", a)
+	}
+
+	if err := repo.Reset(ctx, "login:x"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := repo.Get(ctx, "login:x"); a.Failures != 0 {
+		t.Fatalf("expected reset, got %+v", a)
+	}
+}
@@ -2,22 +2,336 @@ package postgres
 
 import (
 	"context"
-	"os"
-	"path/filepath"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/migrations"
 )
 
-// applyMigrations executes initial SQL schema.
-// ApplyMigrations executes the initial SQL schema.
-// It is safe to call multiple times because the queries
-// in the migration script use "IF NOT EXISTS" clauses.
+// migrationLockID is the advisory lock key serializing migration runs of all replicas.
+const migrationLockID int64 = 0x676d6d6967 // "gmmig"
+
+// ErrChecksumMismatch is returned when an applied migration has been edited since.
+var ErrChecksumMismatch = errors.New("migration checksum mismatch")
+
+// Migration is a versioned pair of up and down scripts.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string // sha256 of Up
+}
+
+// MigrationStatus describes a migration known to the binary or the database.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is nil for pending migrations.
+	AppliedAt *time.Time
+	// Modified reports that the applied script differs from the embedded one.
+	Modified bool
+	// Unknown reports an applied migration missing from the binary, e.g.
+	// after rolling back to an older release.
+	Unknown bool
+}
+
+// LoadMigrations reads migrations named NNNN_name.up.sql and NNNN_name.down.sql
+// from the root of fsys, sorted by version.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		base := strings.TrimSuffix(f, ".sql")
+		base, dir := strings.TrimSuffix(base, path.Ext(base)), path.Ext(base)
+		num, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || (dir != ".up" && dir != ".down") {
+			return nil, fmt.Errorf("unexpected migration file name %s", f)
+		}
+		b, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+		}
+		if dir == ".up" {
+			m.Up = string(b)
+			sum := sha256.Sum256(b)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(b)
+		}
+	}
+	list := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d %s has no up script", m.Version, m.Name)
+		}
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// Migrator applies and reverts migrations. Applied versions are recorded in
+// the schema_migrations table. Every migration runs in its own transaction,
+// and a run holds an advisory lock so that replicas starting together don't
+// race.
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// NewMigrator creates migrator for migrations in fsys.
+func NewMigrator(pool *pgxpool.Pool, fsys fs.FS) (*Migrator, error) {
+	list, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: list}, nil
+}
+
+// ApplyMigrations applies pending embedded migrations.
 func ApplyMigrations(ctx context.Context, pool *pgxpool.Pool) error {
-	path := filepath.Join("migrations", "0001_init.up.sql")
-	b, err := os.ReadFile(path)
+	m, err := NewMigrator(pool, migrations.FS)
 	if err != nil {
 		return err
 	}
-	_, err = pool.Exec(ctx, string(b))
+	_, err = m.Up(ctx)
 	return err
 }
+
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Up applies pending migrations in ascending order and returns them.
+// Returns ErrChecksumMismatch if an applied migration has been modified.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.migrations {
+			if a, ok := applied[mg.Version]; ok {
+				if a.checksum != mg.Checksum {
+					return fmt.Errorf("migration %d %s: %w", mg.Version, mg.Name, ErrChecksumMismatch)
+				}
+				continue
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mg.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1,$2,$3)`,
+					mg.Version, mg.Name, mg.Checksum)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s up: %w", mg.Version, mg.Name, err)
+			}
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts up to steps latest applied migrations in descending order
+// and returns them. Negative steps revert every migration.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	byVersion := map[int]Migration{}
+	for _, mg := range m.migrations {
+		byVersion[mg.Version] = mg
+	}
+	var done []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		versions := make([]int, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		for _, v := range versions {
+			if len(done) == steps {
+				break
+			}
+			mg, ok := byVersion[v]
+			if !ok {
+				return fmt.Errorf("migration %d %s is not known to this binary", v, applied[v].name)
+			}
+			if mg.Down == "" {
+				return fmt.Errorf("migration %d %s has no down script", mg.Version, mg.Name)
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mg.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version=$1`, mg.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s down: %w", mg.Version, mg.Name, err)
+			}
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists embedded migrations and applied migrations missing from the
+// binary, sorted by version.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var list []MigrationStatus
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.migrations {
+			st := MigrationStatus{Version: mg.Version, Name: mg.Name}
+			if a, ok := applied[mg.Version]; ok {
+				st.AppliedAt = &a.appliedAt
+				st.Modified = a.checksum != mg.Checksum
+				delete(applied, mg.Version)
+			}
+			list = append(list, st)
+		}
+		for v, a := range applied {
+			list = append(list, MigrationStatus{Version: v, Name: a.name, AppliedAt: &a.appliedAt, Unknown: true})
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, err
+}
+
+// locked runs fn on a dedicated connection holding the migration lock.
+// The schema_migrations table is created or converted first if needed.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	// unlock even if ctx has been cancelled, the connection returns to the pool
+	defer conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	if err := m.adoptGolangMigrate(ctx, conn); err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name TEXT NOT NULL,
+	checksum TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// adoptGolangMigrate converts the schema_migrations table left by
+// golang-migrate, which used to apply the same scripts, into the layout of
+// the Migrator. Embedded migrations up to its version are recorded as
+// applied. A dirty version means a script failed halfway and has to be
+// fixed by hand first.
+func (m *Migrator) adoptGolangMigrate(ctx context.Context, conn *pgxpool.Conn) error {
+	var legacy bool
+	err := conn.QueryRow(ctx, `SELECT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'schema_migrations' AND column_name = 'dirty'
+	)`).Scan(&legacy)
+	if err != nil || !legacy {
+		return err
+	}
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var (
+			version int64
+			dirty   bool
+		)
+		err := tx.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("golang-migrate left migration %d dirty, fix the schema and clear the flag first", version)
+		}
+		if n := len(m.migrations); version > 0 && (n == 0 || version > int64(m.migrations[n-1].Version)) {
+			return fmt.Errorf("golang-migrate version %d is not known to this binary", version)
+		}
+		if _, err := tx.Exec(ctx, `DROP TABLE schema_migrations`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, createMigrationsTable); err != nil {
+			return err
+		}
+		for _, mg := range m.migrations {
+			if int64(mg.Version) > version {
+				break
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1,$2,$3)`,
+				mg.Version, mg.Name, mg.Checksum)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *pgxpool.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.Query(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var (
+			v int
+			a appliedMigration
+		)
+		if err := rows.Scan(&v, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[v] = a
+	}
+	return applied, rows.Err()
+}
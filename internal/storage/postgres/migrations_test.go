@@ -0,0 +1,145 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Hobrus/gophermarket/migrations"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_second.up.sql":   {Data: []byte("CREATE TABLE b ();")},
+		"0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"0001_first.up.sql":    {Data: []byte("CREATE TABLE a ();")},
+		"0001_first.down.sql":  {Data: []byte("DROP TABLE a;")},
+		"README.md":            {Data: []byte("ignored")},
+	}
+	list, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Version != 1 || list[0].Name != "first" || list[1].Down != "DROP TABLE b;" {
+		t.Fatalf("unexpected migrations %+v", list)
+	}
+	if list[0].Checksum == "" || list[0].Checksum == list[1].Checksum {
+		t.Fatalf("unexpected checksums %s %s", list[0].Checksum, list[1].Checksum)
+	}
+
+	for name, bad := range map[string]fstest.MapFS{
+		"bad name":  {"first.up.sql": {}},
+		"no up":     {"0001_first.down.sql": {}},
+		"two names": {"0001_a.up.sql": {}, "0001_b.down.sql": {}},
+	} {
+		if _, err := LoadMigrations(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	list, err := LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range list {
+		if m.Version != i+1 {
+			t.Fatalf("migration versions must be contiguous, got %d at %d", m.Version, i)
+		}
+		if m.Down == "" {
+			t.Fatalf("migration %d %s has no down script", m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+	ctx := context.Background()
+
+	m, err := NewMigrator(pool, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// setupPostgres has applied everything already
+	if done, err := m.Up(ctx); err != nil || len(done) != 0 {
+		t.Fatalf("expected nothing to apply: %v %v", done, err)
+	}
+
+	done, err := m.Down(ctx, 2)
+	if err != nil || len(done) != 2 || done[0].Version < done[1].Version {
+		t.Fatalf("down: %+v %v", done, err)
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := 0
+	for _, st := range status {
+		if st.AppliedAt == nil {
+			pending++
+		}
+	}
+	if pending != 2 {
+		t.Fatalf("expected 2 pending migrations, got %d", pending)
+	}
+	if done, err := m.Up(ctx); err != nil || len(done) != 2 {
+		t.Fatalf("up: %+v %v", done, err)
+	}
+
+	if _, err := pool.Exec(ctx, `UPDATE schema_migrations SET checksum='x' WHERE version=1`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestMigrator_GolangMigrate(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+	ctx := context.Background()
+
+	m, err := NewMigrator(pool, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// revert the latest migration and record the rest the way golang-migrate does
+	if _, err := m.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	last := m.migrations[len(m.migrations)-1].Version
+	golangMigrate := func(version int, dirty bool) {
+		t.Helper()
+		_, err := pool.Exec(ctx, `DROP TABLE schema_migrations;
+			CREATE TABLE schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pool.Exec(ctx, `INSERT INTO schema_migrations VALUES ($1, $2)`, version, dirty); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	golangMigrate(last-1, true)
+	if _, err := m.Up(ctx); err == nil {
+		t.Fatal("expected dirty database to be refused")
+	}
+
+	golangMigrate(last-1, false)
+	done, err := m.Up(ctx)
+	if err != nil || len(done) != 1 || done[0].Version != last {
+		t.Fatalf("expected only migration %d to be applied: %+v %v", last, done, err)
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range status {
+		if st.AppliedAt == nil || st.Modified || st.Unknown {
+			t.Fatalf("unexpected status %+v", st)
+		}
+	}
+}
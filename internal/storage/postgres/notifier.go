@@ -0,0 +1,136 @@
+package postgres
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/pkg/pubsub"
+)
+
+// listenRetry defines how fast a lost listener connection is restored.
+var listenRetry = txRetry{baseDelay: 100 * time.Millisecond, maxDelay: 10 * time.Second}
+
+// Notifier implements repository.Notifier with NOTIFY. Notifications of
+// all channels are received by one dedicated LISTEN connection, which is
+// opened outside the pool by Run and restored when it drops.
+type Notifier struct {
+	pool *pgxpool.Pool
+	hub  pubsub.Hub
+	// subscribed wakes the listener to LISTEN a new channel
+	subscribed chan struct{}
+	onError    func(error)
+}
+
+// NewNotifier creates a notifier. Subscribers receive notifications only
+// while Run is running.
+func NewNotifier(pool *pgxpool.Pool) *Notifier {
+	return &Notifier{
+		pool:       pool,
+		subscribed: make(chan struct{}, 1),
+		onError:    func(error) {},
+	}
+}
+
+// SetErrorHandler sets the function called when the listener connection
+// fails, before it is restored. It must be called before Run.
+func (n *Notifier) SetErrorHandler(f func(error)) {
+	n.onError = f
+}
+
+func (n *Notifier) Notify(ctx context.Context, channel, payload string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+	_, err := n.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+func (n *Notifier) Subscribe(ctx context.Context, channel string) <-chan string {
+	ch := n.hub.Subscribe(ctx, channel)
+	select {
+	case n.subscribed <- struct{}{}:
+	default:
+	}
+	return ch
+}
+
+// Run receives notifications until ctx is done. When the connection drops
+// it is opened again with backoff, and subscribers get an empty payload
+// once it is back, as notifications sent meanwhile are lost.
+func (n *Notifier) Run(ctx context.Context) error {
+	failures := 0
+	for {
+		connected, err := n.listen(ctx, failures > 0)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			failures = 0
+		}
+		failures++
+		n.onError(err)
+		t := time.NewTimer(listenRetry.delay(failures))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// listen opens the listener connection and dispatches notifications until
+// it fails. connected reports whether the connection was established.
+func (n *Notifier) listen(ctx context.Context, restored bool) (connected bool, err error) {
+	connectCtx, cancel := context.WithTimeout(ctx, timeout())
+	conn, err := pgx.ConnectConfig(connectCtx, n.pool.Config().ConnConfig.Copy())
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	listening := make(map[string]bool)
+	for {
+		for _, c := range n.hub.Channels() {
+			if listening[c] {
+				continue
+			}
+			if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{c}.Sanitize()); err != nil {
+				return true, err
+			}
+			listening[c] = true
+		}
+		if restored {
+			n.hub.Broadcast("")
+			restored = false
+		}
+
+		waitCtx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-n.subscribed:
+				cancel()
+			case <-waitCtx.Done():
+			}
+		}()
+		msg, err := conn.WaitForNotification(waitCtx)
+		interrupted := waitCtx.Err() != nil
+		cancel()
+		wg.Wait()
+		switch {
+		case err == nil:
+			n.hub.Publish(msg.Channel, msg.Payload)
+		case ctx.Err() != nil:
+			return true, ctx.Err()
+		case !interrupted:
+			return true, err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// receive notifies channel until the payload arrives, as the listener may
+// not LISTEN yet.
+func receive(t *testing.T, n *Notifier, ch <-chan string, channel, payload string) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		if err := n.Notify(context.Background(), channel, payload); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-ch:
+			if got == payload {
+				return
+			}
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("payload %q not received", payload)
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := NewNotifier(pool)
+	failed := make(chan error, 10)
+	n.SetErrorHandler(func(err error) { failed <- err })
+	ch := n.Subscribe(ctx, "orders")
+	done := make(chan error)
+	go func() { done <- n.Run(ctx) }()
+
+	receive(t, n, ch, "orders", "1")
+
+	// a dropped connection is restored and subscribers learn about it
+	if _, err := pool.Exec(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE query LIKE 'LISTEN%'`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener failure not reported")
+	}
+	select {
+	case got := <-ch:
+		if got != "" {
+			t.Fatalf("expected empty payload after reconnect, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener not restored")
+	}
+	receive(t, n, ch, "orders", "2")
+
+	// channels subscribed later are listened on the same connection
+	late := n.Subscribe(ctx, "events")
+	receive(t, n, late, "events", "3")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewPasswordResetRepo creates password reset token repository backed by pgx pool.
+func NewPasswordResetRepo(pool *pgxpool.Pool) repository.PasswordResetRepo {
+	return &passwordResetRepo{pool}
+}
+
+type passwordResetRepo struct{ pool *pgxpool.Pool }
+
+func (r *passwordResetRepo) Create(ctx context.Context, userID int64, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES ($1,$2,$3)`, tokenHash, userID, expiresAt)
+	return err
+}
+
+func (r *passwordResetRepo) Consume(ctx context.Context, tokenHash, passwordHash string) (int64, error) {
+	var userID int64
+	err := inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		// the row lock makes concurrent attempts with the same token wait and then see used_at
+		err := tx.QueryRow(ctx, `UPDATE password_resets SET used_at=now()
+			WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now() RETURNING user_id`, tokenHash).Scan(&userID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.ErrResetTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE password_resets SET used_at=now() WHERE user_id=$1 AND used_at IS NULL`, userID); err != nil {
+			return err
+		}
+		_, err = changePassword(ctx, tx, userID, passwordHash)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
@@ -0,0 +1,59 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+func TestPasswordResetRepo(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	users, _, _ := New(pool)
+	repo := NewPasswordResetRepo(pool)
+	ctx := context.Background()
+
+	uid, err := users.Create(ctx, "reset", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour)
+	for _, h := range []string{"a", "b"} {
+		if err := repo.Create(ctx, uid, h, exp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.Create(ctx, uid, "expired", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.Consume(ctx, "expired", "newhash"); !errors.Is(err, domain.ErrResetTokenInvalid) {
+		t.Fatalf("expected invalid expired token, got %v", err)
+	}
+	if id, err := repo.Consume(ctx, "a", "newhash"); err != nil || id != uid {
+		t.Fatalf("consume: %d %v", id, err)
+	}
+	if u, _ := users.GetByLogin(ctx, "reset"); u.PasswordHash != "newhash" || u.TokenVersion != 1 {
+		t.Fatalf("expected password changed with the token: %+v", u)
+	}
+	for _, h := range []string{"a", "b", "unknown"} {
+		if _, err := repo.Consume(ctx, h, "otherhash"); !errors.Is(err, domain.ErrResetTokenInvalid) {
+			t.Fatalf("token %s: expected invalid, got %v", h, err)
+		}
+	}
+
+	v, err := users.ChangePassword(ctx, uid, "newhash")
+	if err != nil || v != 2 {
+		t.Fatalf("change password: %d %v", v, err)
+	}
+	if cur, _ := users.TokenVersion(ctx, uid); cur != 2 {
+		t.Fatalf("expected version 2, got %d", cur)
+	}
+	if _, err := users.ChangePassword(ctx, uid+100, "x"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
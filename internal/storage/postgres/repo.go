@@ -3,6 +3,7 @@ package postgres
 import (
 	"context"
 	"errors"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -14,7 +15,27 @@ import (
 	"github.com/Hobrus/gophermarket/internal/repository"
 )
 
-const timeout = 5 * time.Second
+// defaultTimeout limits a single repository call unless changed with
+// SetTimeout.
+const defaultTimeout = 5 * time.Second
+
+// timeoutNanos holds the timeout set with SetTimeout, zero for the default.
+var timeoutNanos atomic.Int64
+
+// timeout returns how long a single repository call may take.
+func timeout() time.Duration {
+	if d := time.Duration(timeoutNanos.Load()); d > 0 {
+		return d
+	}
+	return defaultTimeout
+}
+
+// SetTimeout changes how long a single repository call may take. It is safe
+// to call while the repositories are in use; calls already running keep
+// their timeout.
+func SetTimeout(d time.Duration) {
+	timeoutNanos.Store(int64(d))
+}
 
 // New creates repositories backed by pgx pool.
 func New(pool *pgxpool.Pool) (repository.UserRepo, repository.OrderRepo, repository.WithdrawalRepo) {
@@ -27,16 +48,6 @@ type orderRepo struct{ pool *pgxpool.Pool }
 
 type withdrawalRepo struct{ pool *pgxpool.Pool }
 
-func beginTx(ctx context.Context, pool *pgxpool.Pool) (pgx.Tx, context.Context, context.CancelFunc, error) {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	tx, err := pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
-	if err != nil {
-		cancel()
-		return nil, nil, nil, err
-	}
-	return tx, ctx, cancel, nil
-}
-
 func isUniqueViolation(err error) bool {
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) {
@@ -48,57 +59,115 @@ func isUniqueViolation(err error) bool {
 // -- UserRepo implementation --
 
 func (r *userRepo) Create(ctx context.Context, login, hash string) (int64, error) {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
-	if err != nil {
-		return 0, err
-	}
-	defer cancel()
-	defer tx.Rollback(ctx)
-
 	var id int64
-	err = tx.QueryRow(ctx, `INSERT INTO users (login, password_hash) VALUES ($1,$2) RETURNING id`, login, hash).Scan(&id)
+	err := inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		return tx.QueryRow(ctx, `INSERT INTO users (login, password_hash) VALUES ($1,$2) RETURNING id`, login, hash).Scan(&id)
+	})
 	if err != nil {
 		if isUniqueViolation(err) {
 			return 0, domain.ErrConflictSelf
 		}
 		return 0, err
 	}
-	if err = tx.Commit(ctx); err != nil {
-		return 0, err
-	}
 	return id, nil
 }
 
 func (r *userRepo) GetByLogin(ctx context.Context, login string) (domain.User, error) {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
+	var u domain.User
+	err := inTx(ctx, r.pool, txSnapshot, func(ctx context.Context, tx pgx.Tx) error {
+		return tx.QueryRow(ctx, `SELECT id, login, password_hash, token_version FROM users WHERE lower(login)=lower($1)`, login).
+			Scan(&u.ID, &u.Login, &u.PasswordHash, &u.TokenVersion)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.User{}, domain.ErrNotFound
+	}
 	if err != nil {
 		return domain.User{}, err
 	}
+	return u, nil
+}
+
+func (r *userRepo) GetByID(ctx context.Context, id int64) (domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
 	defer cancel()
-	defer tx.Rollback(ctx)
 
 	var u domain.User
-	err = tx.QueryRow(ctx, `SELECT id, login, password_hash FROM users WHERE login=$1`, login).
-		Scan(&u.ID, &u.Login, &u.PasswordHash)
+	err := r.pool.QueryRow(ctx, `SELECT id, login, password_hash, token_version FROM users WHERE id=$1`, id).
+		Scan(&u.ID, &u.Login, &u.PasswordHash, &u.TokenVersion)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return domain.User{}, domain.ErrNotFound
 	}
 	if err != nil {
 		return domain.User{}, err
 	}
-	if err = tx.Commit(ctx); err != nil {
-		return domain.User{}, err
-	}
 	return u, nil
 }
 
+func (r *userRepo) UpdatePasswordHash(ctx context.Context, userID int64, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `UPDATE users SET password_hash=$2 WHERE id=$1`, userID, hash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *userRepo) ChangePassword(ctx context.Context, userID int64, hash string) (int, error) {
+	var version int
+	err := inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		var err error
+		version, err = changePassword(ctx, tx, userID, hash)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// changePassword replaces the password hash of the user within tx and
+// returns the new token version. Access tokens are rejected by the new
+// version, refresh tokens by revocation.
+func changePassword(ctx context.Context, tx pgx.Tx, userID int64, hash string) (int, error) {
+	var version int
+	err := tx.QueryRow(ctx, `UPDATE users SET password_hash=$2, token_version=token_version+1 WHERE id=$1 RETURNING token_version`, userID, hash).
+		Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, domain.ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL`, userID); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+func (r *userRepo) TokenVersion(ctx context.Context, userID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	var version int
+	err := r.pool.QueryRow(ctx, `SELECT token_version FROM users WHERE id=$1`, userID).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, domain.ErrNotFound
+	}
+	return version, err
+}
+
 // -- OrderRepo implementation --
 
-func (r *orderRepo) Add(ctx context.Context, num string, userID int64, status string) (error, error, error) {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
+func (r *orderRepo) Add(ctx context.Context, num string, userID int64, status domain.OrderStatus) (error, error, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
 	defer cancel()
 
-	_, err := r.pool.Exec(ctx, `INSERT INTO orders (number, user_id, status) VALUES ($1,$2,$3)`, num, userID, status)
+	_, err := r.pool.Exec(ctx, `INSERT INTO orders (number, user_id, status) VALUES ($1,$2,$3)`, num, userID, string(status))
 	if err != nil {
 		if isUniqueViolation(err) {
 			var existing int64
@@ -117,57 +186,71 @@ func (r *orderRepo) Add(ctx context.Context, num string, userID int64, status st
 }
 
 func (r *orderRepo) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Order, error) {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
-	if err != nil {
-		return nil, err
-	}
-	defer cancel()
-	defer tx.Rollback(ctx)
-
-	rows, err := tx.Query(ctx, `SELECT number, user_id, status, accrual, uploaded_at FROM orders WHERE user_id=$1 ORDER BY uploaded_at DESC LIMIT $2 OFFSET $3`, userID, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
 	var orders []domain.Order
-	for rows.Next() {
-		var o domain.Order
-		err = rows.Scan(&o.Number, &o.UserID, &o.Status, &o.Accrual, &o.UploadedAt)
+	err := inTx(ctx, r.pool, txSnapshot, func(ctx context.Context, tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT number, user_id, status, accrual, uploaded_at, attempts FROM orders WHERE user_id=$1 ORDER BY uploaded_at DESC LIMIT $2 OFFSET $3`, userID, limit, offset)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		orders = append(orders, o)
-	}
-	if rows.Err() != nil {
-		return nil, rows.Err()
-	}
-
-	if err = tx.Commit(ctx); err != nil {
+		orders, err = scanOrders(rows)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 	return orders, nil
 }
 
 func (r *orderRepo) GetUnprocessed(ctx context.Context, limit int) ([]domain.Order, error) {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
+	var orders []domain.Order
+	err := inTx(ctx, r.pool, txSnapshot, func(ctx context.Context, tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT number, user_id, status, accrual, uploaded_at, attempts FROM orders WHERE status IN ('NEW','PROCESSING') AND next_check_at <= now() ORDER BY uploaded_at LIMIT $1`, limit)
+		if err != nil {
+			return err
+		}
+		orders, err = scanOrders(rows)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer cancel()
-	defer tx.Rollback(ctx)
+	return orders, nil
+}
 
-	rows, err := tx.Query(ctx, `SELECT number, user_id, status, accrual, uploaded_at FROM orders WHERE status IN ('NEW','PROCESSING') ORDER BY uploaded_at LIMIT $1`, limit)
+// Claim uses FOR UPDATE SKIP LOCKED so that replicas claiming at the same
+// time never receive the same order.
+func (r *orderRepo) Claim(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.Order, error) {
+	var orders []domain.Order
+	err := inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `UPDATE orders SET locked_by=$1, locked_until=now() + $3 * interval '1 millisecond'
+			WHERE number IN (
+				SELECT number FROM orders
+				WHERE status IN ('NEW','PROCESSING') AND next_check_at <= now()
+					AND (locked_until IS NULL OR locked_until < now())
+				ORDER BY uploaded_at LIMIT $2
+				FOR UPDATE SKIP LOCKED)
+			RETURNING number, user_id, status, accrual, uploaded_at, attempts`, owner, limit, ttl.Milliseconds())
+		if err != nil {
+			return err
+		}
+		orders, err = scanOrders(rows)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	return orders, nil
+}
+
+// scanOrders reads and closes rows selected as number, user_id, status,
+// accrual, uploaded_at, attempts.
+func scanOrders(rows pgx.Rows) ([]domain.Order, error) {
 	defer rows.Close()
 
 	var orders []domain.Order
 	for rows.Next() {
 		var o domain.Order
-		err = rows.Scan(&o.Number, &o.UserID, &o.Status, &o.Accrual, &o.UploadedAt)
-		if err != nil {
+		if err := rows.Scan(&o.Number, &o.UserID, &o.Status, &o.Accrual, &o.UploadedAt, &o.Attempts); err != nil {
 			return nil, err
 		}
 		orders = append(orders, o)
@@ -175,110 +258,144 @@ func (r *orderRepo) GetUnprocessed(ctx context.Context, limit int) ([]domain.Ord
 	if rows.Err() != nil {
 		return nil, rows.Err()
 	}
-
-	if err = tx.Commit(ctx); err != nil {
-		return nil, err
-	}
 	return orders, nil
 }
 
-func (r *orderRepo) UpdateStatus(ctx context.Context, num, status string, accrual *decimal.Decimal) error {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
-	if err != nil {
-		return err
-	}
+func (r *orderRepo) Release(ctx context.Context, num, owner string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
 	defer cancel()
-	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, `UPDATE orders SET status=$2, accrual=$3 WHERE number=$1`, num, status, accrual)
-	if err != nil {
-		return err
-	}
-	return tx.Commit(ctx)
+	_, err := r.pool.Exec(ctx, `UPDATE orders SET locked_by=NULL, locked_until=NULL WHERE number=$1 AND locked_by=$2`, num, owner)
+	return err
 }
 
-func (r *orderRepo) SumProcessedAccrualByUser(ctx context.Context, userID int64) (decimal.Decimal, error) {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
-	if err != nil {
-		return decimal.Zero, err
-	}
-	defer cancel()
-	defer tx.Rollback(ctx)
+func (r *orderRepo) UpdateStatus(ctx context.Context, num string, status domain.OrderStatus, accrual *decimal.Decimal) error {
+	return inTx(ctx, r.pool, txSerializable, func(ctx context.Context, tx pgx.Tx) error {
+		var (
+			userID int64
+			prev   domain.OrderStatus
+		)
+		err := tx.QueryRow(ctx, `SELECT user_id, status FROM orders WHERE number=$1 FOR UPDATE`, num).Scan(&userID, &prev)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !prev.CanTransition(status) {
+			return domain.ErrInvalidTransition
+		}
+		if status == prev {
+			return nil
+		}
 
-	var sum decimal.Decimal
-	err = tx.QueryRow(ctx, `SELECT COALESCE(SUM(accrual),0) FROM orders WHERE status='PROCESSED' AND user_id=$1`, userID).Scan(&sum)
-	if err != nil {
-		return decimal.Zero, err
-	}
-	if err = tx.Commit(ctx); err != nil {
-		return decimal.Zero, err
-	}
-	return sum, nil
+		_, err = tx.Exec(ctx, `UPDATE orders SET status=$2, accrual=$3, attempts=0, next_check_at=now() WHERE number=$1`, num, string(status), accrual)
+		if err != nil {
+			return err
+		}
+		if status == domain.OrderProcessed && accrual != nil && accrual.IsPositive() {
+			if _, err = postEntries(ctx, tx, userID, domain.AccountAccrual, domain.LedgerAccrual, *accrual, num); err != nil {
+				return err
+			}
+		}
+		// terminal statuses are final, so these are sent once per order
+		switch status {
+		case domain.OrderProcessed:
+			return enqueueWebhooks(ctx, tx, domain.WebhookOrderProcessed, userID, num, accrual)
+		case domain.OrderInvalid:
+			return enqueueWebhooks(ctx, tx, domain.WebhookOrderInvalid, userID, num, nil)
+		}
+		return nil
+	})
 }
 
-// -- WithdrawalRepo implementation --
+func (r *orderRepo) RecordFailure(ctx context.Context, num, lastErr string, next time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
 
-func (r *withdrawalRepo) Create(ctx context.Context, num string, userID int64, amount decimal.Decimal) error {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
+	tag, err := r.pool.Exec(ctx, `UPDATE orders SET attempts=attempts+1, last_error=$2, next_check_at=$3 WHERE number=$1`, num, lastErr, next)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *orderRepo) Postpone(ctx context.Context, num string, next time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
 	defer cancel()
-	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, `INSERT INTO withdrawals (order_number, user_id, amount) VALUES ($1,$2,$3)`, num, userID, amount)
+	tag, err := r.pool.Exec(ctx, `UPDATE orders SET next_check_at=$2 WHERE number=$1`, num, next)
 	if err != nil {
 		return err
 	}
-	return tx.Commit(ctx)
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
 }
 
-func (r *withdrawalRepo) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Withdrawal, error) {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
-	if err != nil {
-		return nil, err
-	}
-	defer cancel()
-	defer tx.Rollback(ctx)
+// -- WithdrawalRepo implementation --
 
-	rows, err := tx.Query(ctx, `SELECT order_number, user_id, amount, processed_at FROM withdrawals WHERE user_id=$1 ORDER BY processed_at DESC LIMIT $2 OFFSET $3`, userID, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+// Withdraw locks the user row so that concurrent withdrawals of the same user
+// are executed one by one. Read committed isolation is used on purpose: every
+// statement after the lock sees ledger entries committed by the previous holder.
+func (r *withdrawalRepo) Withdraw(ctx context.Context, num string, userID int64, amount decimal.Decimal) error {
+	return inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		var id int64
+		err := tx.QueryRow(ctx, `SELECT id FROM users WHERE id=$1 FOR UPDATE`, userID).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
 
-	var res []domain.Withdrawal
-	for rows.Next() {
-		var w domain.Withdrawal
-		if err = rows.Scan(&w.Number, &w.UserID, &w.Amount, &w.ProcessedAt); err != nil {
-			return nil, err
+		bal, err := ledgerBalance(ctx, tx, userID)
+		if err != nil {
+			return err
 		}
-		res = append(res, w)
-	}
-	if rows.Err() != nil {
-		return nil, rows.Err()
-	}
-	if err = tx.Commit(ctx); err != nil {
-		return nil, err
-	}
-	return res, nil
+		if bal.Current.Cmp(amount) < 0 {
+			return domain.ErrInsufficientFunds
+		}
+
+		_, err = tx.Exec(ctx, `INSERT INTO withdrawals (order_number, user_id, amount) VALUES ($1,$2,$3)`, num, userID, amount)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return domain.ErrDuplicateWithdrawal
+			}
+			return err
+		}
+		if _, err = postEntries(ctx, tx, userID, domain.AccountWithdrawals, domain.LedgerWithdrawal, amount.Neg(), num); err != nil {
+			return err
+		}
+		return enqueueWebhooks(ctx, tx, domain.WebhookWithdrawalCreated, userID, num, &amount)
+	})
 }
 
-func (r *withdrawalRepo) SumByUser(ctx context.Context, userID int64) (decimal.Decimal, error) {
-	tx, ctx, cancel, err := beginTx(ctx, r.pool)
-	if err != nil {
-		return decimal.Zero, err
-	}
-	defer cancel()
-	defer tx.Rollback(ctx)
+func (r *withdrawalRepo) ListByUser(ctx context.Context, userID int64, limit, offset int) ([]domain.Withdrawal, error) {
+	var res []domain.Withdrawal
+	err := inTx(ctx, r.pool, txSnapshot, func(ctx context.Context, tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT order_number, user_id, amount, processed_at FROM withdrawals WHERE user_id=$1 ORDER BY processed_at DESC LIMIT $2 OFFSET $3`, userID, limit, offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	var sum decimal.Decimal
-	err = tx.QueryRow(ctx, `SELECT COALESCE(SUM(amount),0) FROM withdrawals WHERE user_id=$1`, userID).Scan(&sum)
+		res = nil
+		for rows.Next() {
+			var w domain.Withdrawal
+			if err = rows.Scan(&w.Number, &w.UserID, &w.Amount, &w.ProcessedAt); err != nil {
+				return err
+			}
+			res = append(res, w)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		return decimal.Zero, err
-	}
-	if err = tx.Commit(ctx); err != nil {
-		return decimal.Zero, err
+		return nil, err
 	}
-	return sum, nil
+	return res, nil
 }
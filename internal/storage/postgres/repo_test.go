@@ -90,10 +90,22 @@ func TestRepositories(t *testing.T) {
 	if _, err = userRepo.Create(ctx, "login", "hash"); !errors.Is(err, domain.ErrConflictSelf) {
 		t.Fatalf("expected conflict")
 	}
+	if _, err = userRepo.Create(ctx, "LOGIN", "hash"); !errors.Is(err, domain.ErrConflictSelf) {
+		t.Fatalf("expected case-insensitive conflict")
+	}
 
-	u, err := userRepo.GetByLogin(ctx, "login")
-	if err != nil || u.ID != uid {
-		t.Fatalf("get user: %v", err)
+	u, err := userRepo.GetByLogin(ctx, "Login")
+	if err != nil || u.ID != uid || u.Login != "login" {
+		t.Fatalf("get user: %+v %v", u, err)
+	}
+	if err := userRepo.UpdatePasswordHash(ctx, uid, "newhash"); err != nil {
+		t.Fatalf("update hash: %v", err)
+	}
+	if u, _ := userRepo.GetByLogin(ctx, "login"); u.PasswordHash != "newhash" {
+		t.Fatalf("hash not updated: %s", u.PasswordHash)
+	}
+	if err := userRepo.UpdatePasswordHash(ctx, uid+100, "x"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
 	}
 
 	// orders
@@ -142,11 +154,11 @@ func TestRepositories(t *testing.T) {
 	}
 
 	// withdrawals
-	if err := withdrawalRepo.Create(ctx, "w1", uid, decimal.NewFromInt(5)); err != nil {
-		t.Fatalf("withdraw create: %v", err)
+	if err := withdrawalRepo.Withdraw(ctx, "w1", uid, decimal.NewFromInt(5)); err != nil {
+		t.Fatalf("withdraw: %v", err)
 	}
-	if err := withdrawalRepo.Create(ctx, "w2", uid, decimal.NewFromInt(3)); err != nil {
-		t.Fatalf("withdraw create: %v", err)
+	if err := withdrawalRepo.Withdraw(ctx, "w2", uid, decimal.NewFromInt(3)); err != nil {
+		t.Fatalf("withdraw: %v", err)
 	}
 
 	ws, err := withdrawalRepo.ListByUser(ctx, uid, 50, 0)
@@ -159,8 +171,63 @@ func TestRepositories(t *testing.T) {
 		t.Fatalf("paged withdrawals: %v %v", err, wpage)
 	}
 
-	sum, err := withdrawalRepo.SumByUser(ctx, uid)
-	if err != nil || !sum.Equal(decimal.NewFromInt(8)) {
-		t.Fatalf("sum withdrawals: %v %s", err, sum)
+	bal, err := NewLedgerRepo(pool).Balance(ctx, uid)
+	if err != nil || !bal.Withdrawn.Equal(decimal.NewFromInt(8)) {
+		t.Fatalf("unexpected balance: %v %+v", err, bal)
+	}
+
+	if err := withdrawalRepo.Withdraw(ctx, "w3", uid, decimal.NewFromInt(5)); !errors.Is(err, domain.ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if err := withdrawalRepo.Withdraw(ctx, "w3", uid, decimal.NewFromInt(2)); err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+}
+
+func TestOrderRepo_Claim(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	userRepo, orderRepo, _ := New(pool)
+	ctx := context.Background()
+
+	uid, err := userRepo.Create(ctx, "claim", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, num := range []string{"1", "2", "3"} {
+		if _, _, err := orderRepo.Add(ctx, num, uid, "NEW"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := orderRepo.Claim(ctx, "a", 2, time.Minute)
+	if err != nil || len(first) != 2 {
+		t.Fatalf("claim a: %v %v", err, first)
+	}
+	second, err := orderRepo.Claim(ctx, "b", 10, time.Minute)
+	if err != nil || len(second) != 1 {
+		t.Fatalf("claim b: %v %v", err, second)
+	}
+	for _, o := range first {
+		if o.Number == second[0].Number {
+			t.Fatalf("order %s claimed twice", o.Number)
+		}
+	}
+
+	// release by a foreign owner must not drop the lease
+	if err := orderRepo.Release(ctx, first[0].Number, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := orderRepo.Claim(ctx, "b", 10, time.Minute); err != nil || len(got) != 0 {
+		t.Fatalf("expected nothing to claim: %v %v", err, got)
+	}
+
+	if err := orderRepo.Release(ctx, first[0].Number, "a"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := orderRepo.Claim(ctx, "b", 10, time.Minute)
+	if err != nil || len(got) != 1 || got[0].Number != first[0].Number {
+		t.Fatalf("claim released: %v %v", err, got)
 	}
 }
@@ -0,0 +1,101 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewSessionRepo creates session repository backed by pgx pool.
+func NewSessionRepo(pool *pgxpool.Pool) repository.SessionRepo {
+	return &sessionRepo{pool}
+}
+
+type sessionRepo struct{ pool *pgxpool.Pool }
+
+func (r *sessionRepo) Create(ctx context.Context, s domain.Session, refreshHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `INSERT INTO sessions (id, family_id, user_id, refresh_hash, expires_at) VALUES ($1,$2,$3,$4,$5)`,
+		s.ID, s.FamilyID, s.UserID, refreshHash, s.ExpiresAt)
+	return err
+}
+
+func (r *sessionRepo) Rotate(ctx context.Context, refreshHash string, next domain.Session, nextHash string) (domain.Session, error) {
+	var reused bool
+	err := inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		var (
+			cur                  domain.Session
+			rotatedAt, revokedAt *time.Time
+		)
+		err := tx.QueryRow(ctx, `SELECT id, family_id, user_id, expires_at, rotated_at, revoked_at FROM sessions WHERE refresh_hash=$1 FOR UPDATE`, refreshHash).
+			Scan(&cur.ID, &cur.FamilyID, &cur.UserID, &cur.ExpiresAt, &rotatedAt, &revokedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.ErrSessionInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if revokedAt != nil || !cur.ExpiresAt.After(time.Now()) {
+			return domain.ErrSessionInvalid
+		}
+		reused = rotatedAt != nil
+		if reused {
+			// the token leaked: whoever holds the newer one can't be trusted either.
+			// The revocation must be committed, so the error is returned afterwards.
+			_, err = tx.Exec(ctx, `UPDATE sessions SET revoked_at=now() WHERE family_id=$1 AND revoked_at IS NULL`, cur.FamilyID)
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, `UPDATE sessions SET rotated_at=now() WHERE id=$1`, cur.ID); err != nil {
+			return err
+		}
+		next.FamilyID = cur.FamilyID
+		next.UserID = cur.UserID
+		return tx.QueryRow(ctx, `INSERT INTO sessions (id, family_id, user_id, refresh_hash, expires_at) VALUES ($1,$2,$3,$4,$5) RETURNING created_at`,
+			next.ID, next.FamilyID, next.UserID, nextHash, next.ExpiresAt).Scan(&next.CreatedAt)
+	})
+	if err != nil {
+		return domain.Session{}, err
+	}
+	if reused {
+		return domain.Session{}, domain.ErrRefreshTokenReused
+	}
+	return next, nil
+}
+
+func (r *sessionRepo) IsActive(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	var active bool
+	err := r.pool.QueryRow(ctx, `SELECT revoked_at IS NULL FROM sessions WHERE id=$1`, id).Scan(&active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return active, err
+}
+
+func (r *sessionRepo) RevokeFamily(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `UPDATE sessions SET revoked_at=now()
+		WHERE family_id=(SELECT family_id FROM sessions WHERE id=$1) AND revoked_at IS NULL`, id)
+	return err
+}
+
+func (r *sessionRepo) RevokeAll(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL`, userID)
+	return err
+}
@@ -0,0 +1,65 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+func TestSessionRepo(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+
+	userRepo, _, _ := New(pool)
+	repo := NewSessionRepo(pool)
+	ctx := context.Background()
+
+	uid, err := userRepo.Create(ctx, "sess", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := domain.Session{ID: uuid.NewString(), UserID: uid, ExpiresAt: time.Now().Add(time.Hour)}
+	first.FamilyID = first.ID
+	if err := repo.Create(ctx, first, "h1"); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := repo.Rotate(ctx, "h1", domain.Session{ID: uuid.NewString(), ExpiresAt: time.Now().Add(time.Hour)}, "h2")
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if second.FamilyID != first.ID || second.UserID != uid {
+		t.Fatalf("unexpected rotated session %+v", second)
+	}
+	if active, err := repo.IsActive(ctx, second.ID); err != nil || !active {
+		t.Fatalf("expected active session: %v %v", active, err)
+	}
+
+	if _, err := repo.Rotate(ctx, "h1", domain.Session{ID: uuid.NewString(), ExpiresAt: time.Now().Add(time.Hour)}, "h3"); !errors.Is(err, domain.ErrRefreshTokenReused) {
+		t.Fatalf("expected reuse error, got %v", err)
+	}
+	if active, _ := repo.IsActive(ctx, second.ID); active {
+		t.Fatal("reuse should revoke the family")
+	}
+	if _, err := repo.Rotate(ctx, "h2", domain.Session{ID: uuid.NewString(), ExpiresAt: time.Now().Add(time.Hour)}, "h4"); !errors.Is(err, domain.ErrSessionInvalid) {
+		t.Fatalf("expected invalid session, got %v", err)
+	}
+
+	other := domain.Session{ID: uuid.NewString(), UserID: uid, ExpiresAt: time.Now().Add(time.Hour)}
+	other.FamilyID = other.ID
+	if err := repo.Create(ctx, other, "h5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RevokeAll(ctx, uid); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := repo.IsActive(ctx, other.ID); active {
+		t.Fatal("expected all sessions revoked")
+	}
+}
@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Transaction modes chosen by repository methods.
+var (
+	// txSerializable suits read-write transactions whose decisions depend on
+	// rows they read. Conflicting transactions fail with 40001 and are retried.
+	txSerializable = pgx.TxOptions{IsoLevel: pgx.Serializable}
+	// txReadCommitted suits transactions that order themselves with row locks.
+	txReadCommitted = pgx.TxOptions{IsoLevel: pgx.ReadCommitted}
+	// txSnapshot suits plain reads: every statement sees the same snapshot,
+	// and read-only repeatable read transactions never fail to serialize.
+	txSnapshot = pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}
+)
+
+// txRetry defines how often a transaction is run again after a serialization
+// failure or a deadlock.
+type txRetry struct {
+	// attempts is the total number of runs, the first one included.
+	attempts int
+	// baseDelay is the delay after the first failure. It doubles with every
+	// subsequent failure.
+	baseDelay time.Duration
+	// maxDelay caps the delay between two runs.
+	maxDelay time.Duration
+}
+
+var defaultTxRetry = txRetry{attempts: 5, baseDelay: 5 * time.Millisecond, maxDelay: 200 * time.Millisecond}
+
+// inTx runs fn in a transaction with opts and commits it if fn returns nil.
+// The whole transaction is run again on serialization failures and deadlocks,
+// so fn must not have side effects outside tx and must reset its results.
+// Every run gets its own timeout.
+func inTx(ctx context.Context, pool *pgxpool.Pool, opts pgx.TxOptions, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	return defaultTxRetry.do(ctx, func() error {
+		ctx, cancel := context.WithTimeout(ctx, timeout())
+		defer cancel()
+		return pgx.BeginTxFunc(ctx, pool, opts, func(tx pgx.Tx) error {
+			return fn(ctx, tx)
+		})
+	})
+}
+
+// do calls fn until it succeeds, fails with an error that is not worth
+// retrying, the attempts are used up or ctx is done. The last error of fn is
+// returned.
+func (p txRetry) do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt >= p.attempts {
+			return err
+		}
+		t := time.NewTimer(p.delay(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// delay returns a random delay before the next run after attempt failures.
+// It lies between half and all of the exponential backoff, so transactions
+// that conflicted once don't collide again in lockstep.
+func (p txRetry) delay(attempt int) time.Duration {
+	d := p.baseDelay
+	for i := 1; i < attempt && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d-d/2)
+}
+
+// isRetryable reports whether err aborted a transaction that is likely to
+// succeed when run again: serialization failures and deadlocks.
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pgconn.PgError{Code: "40001"}, true},
+		{&pgconn.PgError{Code: "40P01"}, true},
+		{fmt.Errorf("commit: %w", &pgconn.PgError{Code: "40001"}), true},
+		{&pgconn.PgError{Code: "23505"}, false},
+		{errors.New("fail"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestTxRetry_Do(t *testing.T) {
+	p := txRetry{attempts: 3, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	conflict := &pgconn.PgError{Code: "40001"}
+
+	calls := 0
+	err := p.do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return conflict
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success on third call, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = p.do(context.Background(), func() error {
+		calls++
+		return conflict
+	})
+	if !errors.Is(err, conflict) || calls != 3 {
+		t.Fatalf("expected conflict after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	fail := errors.New("fail")
+	err = p.do(context.Background(), func() error {
+		calls++
+		return fail
+	})
+	if !errors.Is(err, fail) || calls != 1 {
+		t.Fatalf("expected no retry, got %v after %d calls", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	p.baseDelay, p.maxDelay = time.Hour, time.Hour
+	err = p.do(ctx, func() error {
+		calls++
+		return conflict
+	})
+	if !errors.Is(err, conflict) || calls != 1 {
+		t.Fatalf("expected to stop on canceled context, got %v after %d calls", err, calls)
+	}
+}
+
+func TestTxRetry_Delay(t *testing.T) {
+	p := txRetry{attempts: 10, baseDelay: 10 * time.Millisecond, maxDelay: 50 * time.Millisecond}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		{100, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			d := p.delay(tt.attempt)
+			if d < tt.max/2 || d > tt.max {
+				t.Fatalf("delay(%d) = %v, want between %v and %v", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestWithdrawalRepo_ConcurrentWithdraw(t *testing.T) {
+	pool, teardown := setupPostgres(t)
+	defer teardown()
+	users, _, withdrawals := New(pool)
+	ledger := NewLedgerRepo(pool)
+	ctx := context.Background()
+
+	uid, err := users.Create(ctx, "u", "p")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	const n = 4
+	if _, err := ledger.Adjust(ctx, uid, decimal.NewFromInt(n-1)); err != nil {
+		t.Fatalf("adjust: %v", err)
+	}
+
+	// withdrawals of the same user wait for each other on the user row, so
+	// exactly the funded ones commit and the last one sees an empty balance
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- withdrawals.Withdraw(ctx, fmt.Sprintf("order-%d", i), uid, decimal.NewFromInt(1))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	var insufficient int
+	for err := range errs {
+		switch {
+		case errors.Is(err, domain.ErrInsufficientFunds):
+			insufficient++
+		case err != nil:
+			t.Fatalf("withdraw: %v", err)
+		}
+	}
+	if insufficient != 1 {
+		t.Fatalf("expected one withdrawal to fail, got %d", insufficient)
+	}
+	bal, err := ledger.Balance(ctx, uid)
+	if err != nil || !bal.Current.IsZero() || !bal.Withdrawn.Equal(decimal.NewFromInt(n-1)) {
+		t.Fatalf("unexpected balance %+v: %v", bal, err)
+	}
+}
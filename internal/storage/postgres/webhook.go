@@ -0,0 +1,218 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// NewWebhookRepo creates webhook repository backed by pgx pool.
+func NewWebhookRepo(pool *pgxpool.Pool) repository.WebhookRepo {
+	return &webhookRepo{pool}
+}
+
+type webhookRepo struct{ pool *pgxpool.Pool }
+
+// enqueueWebhooks queues the event for every endpoint subscribed to it
+// within tx, so deliveries are stored if and only if the change is.
+func enqueueWebhooks(ctx context.Context, tx pgx.Tx, event domain.WebhookEvent, userID int64, num string, amount *decimal.Decimal) error {
+	_, err := tx.Exec(ctx, `INSERT INTO webhook_deliveries (webhook_id, event, user_id, order_number, amount)
+		SELECT id, $1, $2, $3, $4 FROM webhooks WHERE (user_id=$2 OR user_id IS NULL) AND $1 = ANY(events)`,
+		string(event), userID, num, amount)
+	return err
+}
+
+func (r *webhookRepo) Create(ctx context.Context, w domain.Webhook) (domain.Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	events := make([]string, len(w.Events))
+	for i, e := range w.Events {
+		events[i] = string(e)
+	}
+	err := r.pool.QueryRow(ctx, `INSERT INTO webhooks (user_id, url, secret, events) VALUES (NULLIF($1,0),$2,$3,$4) RETURNING id, created_at`,
+		w.UserID, w.URL, w.Secret, events).Scan(&w.ID, &w.CreatedAt)
+	if err != nil {
+		return domain.Webhook{}, err
+	}
+	return w, nil
+}
+
+func (r *webhookRepo) ListByUser(ctx context.Context, userID int64) ([]domain.Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx, `SELECT id, COALESCE(user_id,0), url, secret, events, created_at FROM webhooks
+		WHERE user_id IS NOT DISTINCT FROM NULLIF($1,0) ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []domain.Webhook
+	for rows.Next() {
+		var (
+			w      domain.Webhook
+			events []string
+		)
+		if err := rows.Scan(&w.ID, &w.UserID, &w.URL, &w.Secret, &events, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		w.Events = make([]domain.WebhookEvent, len(events))
+		for i, e := range events {
+			w.Events[i] = domain.WebhookEvent(e)
+		}
+		list = append(list, w)
+	}
+	return list, rows.Err()
+}
+
+func (r *webhookRepo) Delete(ctx context.Context, userID, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `DELETE FROM webhooks WHERE id=$1 AND user_id IS NOT DISTINCT FROM NULLIF($2,0)`, id, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// ClaimDeliveries uses FOR UPDATE SKIP LOCKED so that replicas claiming at
+// the same time never receive the same delivery.
+func (r *webhookRepo) ClaimDeliveries(ctx context.Context, owner string, limit int, ttl time.Duration) ([]domain.WebhookDelivery, error) {
+	var list []domain.WebhookDelivery
+	err := inTx(ctx, r.pool, txReadCommitted, func(ctx context.Context, tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `UPDATE webhook_deliveries d SET locked_by=$1, locked_until=now() + $3 * interval '1 millisecond'
+			FROM webhooks w
+			WHERE w.id = d.webhook_id AND d.id IN (
+				SELECT id FROM webhook_deliveries
+				WHERE status='pending' AND next_attempt_at <= now()
+					AND (locked_until IS NULL OR locked_until < now())
+				ORDER BY next_attempt_at LIMIT $2
+				FOR UPDATE SKIP LOCKED)
+			RETURNING `+deliveryColumns+`, w.url, w.secret`, owner, limit, ttl.Milliseconds())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var d domain.WebhookDelivery
+			dest := append(deliveryDest(&d), &d.URL, &d.Secret)
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+			list = append(list, d)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (r *webhookRepo) MarkDelivered(ctx context.Context, id int64, owner string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `UPDATE webhook_deliveries SET status='delivered', attempts=attempts+1, last_error='',
+		delivered_at=now(), locked_by=NULL, locked_until=NULL WHERE id=$1 AND locked_by=$2`, id, owner)
+	return err
+}
+
+func (r *webhookRepo) RecordFailure(ctx context.Context, id int64, owner, lastErr string, next time.Time, dead bool) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	status := domain.DeliveryPending
+	if dead {
+		status = domain.DeliveryDead
+	}
+	_, err := r.pool.Exec(ctx, `UPDATE webhook_deliveries SET status=$2, attempts=attempts+1, last_error=$3,
+		next_attempt_at=$4, locked_by=NULL, locked_until=NULL WHERE id=$1 AND locked_by=$5`, id, string(status), lastErr, next, owner)
+	return err
+}
+
+func (r *webhookRepo) ListDeliveries(ctx context.Context, userID, webhookID int64, limit int) ([]domain.WebhookDelivery, error) {
+	var list []domain.WebhookDelivery
+	err := inTx(ctx, r.pool, txSnapshot, func(ctx context.Context, tx pgx.Tx) error {
+		var found bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM webhooks WHERE id=$1 AND user_id IS NOT DISTINCT FROM NULLIF($2,0))`,
+			webhookID, userID).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return domain.ErrNotFound
+		}
+		rows, err := tx.Query(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries d
+			WHERE webhook_id=$1 ORDER BY id DESC LIMIT $2`, webhookID, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var d domain.WebhookDelivery
+			if err := rows.Scan(deliveryDest(&d)...); err != nil {
+				return err
+			}
+			list = append(list, d)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (r *webhookRepo) Redeliver(ctx context.Context, userID, webhookID, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `UPDATE webhook_deliveries d SET status='pending', attempts=0, last_error='', next_attempt_at=now(),
+			locked_by=NULL, locked_until=NULL
+		FROM webhooks w
+		WHERE d.id=$1 AND d.webhook_id=$2 AND w.id=d.webhook_id AND w.user_id IS NOT DISTINCT FROM NULLIF($3,0)`, id, webhookID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// PruneDeliveries uses next_attempt_at as the time of the last attempt of
+// dead deliveries; it is the last attempt plus the backoff, which is close
+// enough for a retention period.
+func (r *webhookRepo) PruneDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout())
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `DELETE FROM webhook_deliveries
+		WHERE (status='delivered' AND delivered_at < $1) OR (status='dead' AND next_attempt_at < $1)`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// deliveryColumns are scanned by deliveryDest.
+const deliveryColumns = `d.id, d.webhook_id, d.event, d.user_id, d.order_number, d.amount, d.occurred_at,
+	d.status, d.attempts, d.last_error, d.next_attempt_at, d.delivered_at`
+
+func deliveryDest(d *domain.WebhookDelivery) []any {
+	return []any{&d.ID, &d.WebhookID, &d.Event, &d.UserID, &d.OrderNumber, &d.Amount, &d.OccurredAt,
+		&d.Status, &d.Attempts, &d.LastError, &d.NextAttemptAt, &d.DeliveredAt}
+}
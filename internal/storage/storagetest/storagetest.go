@@ -0,0 +1,1043 @@
+// Package storagetest is a conformance suite for repository implementations.
+// Every storage backend runs it from its own tests, so they all keep the
+// semantics documented in package repository.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/Hobrus/gophermarket/internal/domain"
+	"github.com/Hobrus/gophermarket/internal/repository"
+)
+
+// Repos is a full set of repositories of one backend.
+type Repos struct {
+	Users          repository.UserRepo
+	Orders         repository.OrderRepo
+	Withdrawals    repository.WithdrawalRepo
+	Ledger         repository.LedgerRepo
+	Idempotency    repository.IdempotencyRepo
+	Sessions       repository.SessionRepo
+	APIKeys        repository.APIKeyRepo
+	LoginAttempts  repository.LoginAttemptRepo
+	PasswordResets repository.PasswordResetRepo
+	Events         repository.EventRepo
+	Webhooks       repository.WebhookRepo
+}
+
+// Run runs the suite. newRepos is called by every subtest and must return
+// repositories over empty storage.
+func Run(t *testing.T, newRepos func(t *testing.T) Repos) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, r Repos)
+	}{
+		{"Users", testUsers},
+		{"Orders", testOrders},
+		{"OrderProcessing", testOrderProcessing},
+		{"Claim", testClaim},
+		{"Withdrawals", testWithdrawals},
+		{"ConcurrentWithdraw", testConcurrentWithdraw},
+		{"Ledger", testLedger},
+		{"Idempotency", testIdempotency},
+		{"Sessions", testSessions},
+		{"APIKeys", testAPIKeys},
+		{"LoginAttempts", testLoginAttempts},
+		{"PasswordResets", testPasswordResets},
+		{"Events", testEvents},
+		{"Webhooks", testWebhooks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newRepos(t))
+		})
+	}
+}
+
+func createUser(t *testing.T, r Repos, login string) int64 {
+	t.Helper()
+	id, err := r.Users.Create(context.Background(), login, "hash")
+	if err != nil {
+		t.Fatalf("create user %s: %v", login, err)
+	}
+	return id
+}
+
+func processOrder(t *testing.T, r Repos, num string, userID int64, accrual int64) {
+	t.Helper()
+	ctx := context.Background()
+	if _, _, err := r.Orders.Add(ctx, num, userID, domain.OrderNew); err != nil {
+		t.Fatalf("add order %s: %v", num, err)
+	}
+	a := decimal.NewFromInt(accrual)
+	if err := r.Orders.UpdateStatus(ctx, num, domain.OrderProcessed, &a); err != nil {
+		t.Fatalf("process order %s: %v", num, err)
+	}
+}
+
+func testUsers(t *testing.T, r Repos) {
+	ctx := context.Background()
+
+	uid := createUser(t, r, "Alice")
+	if _, err := r.Users.Create(ctx, "alice", "hash"); !errors.Is(err, domain.ErrConflictSelf) {
+		t.Fatalf("expected case-insensitive conflict, got %v", err)
+	}
+	u, err := r.Users.GetByLogin(ctx, "ALICE")
+	if err != nil || u.ID != uid || u.Login != "Alice" || u.PasswordHash != "hash" || u.TokenVersion != 0 {
+		t.Fatalf("get by login: %+v %v", u, err)
+	}
+	if _, err := r.Users.GetByLogin(ctx, "bob"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if u, err := r.Users.GetByID(ctx, uid); err != nil || u.Login != "Alice" {
+		t.Fatalf("get by id: %+v %v", u, err)
+	}
+	if _, err := r.Users.GetByID(ctx, uid+100); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if err := r.Users.UpdatePasswordHash(ctx, uid, "rehashed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Users.UpdatePasswordHash(ctx, uid+100, "x"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	sess := domain.Session{ID: uuid.NewString(), FamilyID: uuid.NewString(), UserID: uid, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := r.Sessions.Create(ctx, sess, "users-r1"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := r.Users.ChangePassword(ctx, uid, "changed")
+	if err != nil || v != 1 {
+		t.Fatalf("change password: %d %v", v, err)
+	}
+	if active, err := r.Sessions.IsActive(ctx, sess.ID); err != nil || active {
+		t.Fatalf("sessions must be revoked: %v %v", active, err)
+	}
+	if v, err := r.Users.TokenVersion(ctx, uid); err != nil || v != 1 {
+		t.Fatalf("token version: %d %v", v, err)
+	}
+	if u, _ := r.Users.GetByID(ctx, uid); u.PasswordHash != "changed" || u.TokenVersion != 1 {
+		t.Fatalf("unexpected user after change %+v", u)
+	}
+	if _, err := r.Users.ChangePassword(ctx, uid+100, "x"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if _, err := r.Users.TokenVersion(ctx, uid+100); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func testOrders(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "orders")
+	other := createUser(t, r, "other")
+
+	for _, num := range []string{"1", "2", "3"} {
+		if errSelf, errOther, err := r.Orders.Add(ctx, num, uid, domain.OrderNew); errSelf != nil || errOther != nil || err != nil {
+			t.Fatalf("add order %s: %v %v %v", num, errSelf, errOther, err)
+		}
+	}
+	if errSelf, errOther, err := r.Orders.Add(ctx, "1", uid, domain.OrderNew); !errors.Is(errSelf, domain.ErrConflictSelf) || errOther != nil || err != nil {
+		t.Fatalf("expected self conflict: %v %v %v", errSelf, errOther, err)
+	}
+	if errSelf, errOther, err := r.Orders.Add(ctx, "1", other, domain.OrderNew); errSelf != nil || !errors.Is(errOther, domain.ErrConflictOther) || err != nil {
+		t.Fatalf("expected other conflict: %v %v %v", errSelf, errOther, err)
+	}
+
+	list, err := r.Orders.ListByUser(ctx, uid, 10, 0)
+	if err != nil || len(list) != 3 {
+		t.Fatalf("list orders: %v %v", list, err)
+	}
+	if list[0].Number != "3" || list[2].Number != "1" || list[0].Status != domain.OrderNew || list[0].UserID != uid {
+		t.Fatalf("expected newest first, got %+v", list)
+	}
+	page, err := r.Orders.ListByUser(ctx, uid, 1, 1)
+	if err != nil || len(page) != 1 || page[0].Number != "2" {
+		t.Fatalf("paged orders: %v %v", page, err)
+	}
+	if page, err := r.Orders.ListByUser(ctx, uid, 10, 3); err != nil || len(page) != 0 {
+		t.Fatalf("expected empty page: %v %v", page, err)
+	}
+	if list, err := r.Orders.ListByUser(ctx, other, 10, 0); err != nil || len(list) != 0 {
+		t.Fatalf("expected no orders of other user: %v %v", list, err)
+	}
+
+	processOrder(t, r, "4", uid, 10)
+	a := decimal.RequireFromString("2.5")
+	if err := r.Orders.UpdateStatus(ctx, "1", domain.OrderProcessed, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Orders.UpdateStatus(ctx, "2", domain.OrderInvalid, nil); err != nil {
+		t.Fatal(err)
+	}
+	bal, err := r.Ledger.Balance(ctx, uid)
+	if err != nil || !bal.Current.Equal(decimal.RequireFromString("12.5")) {
+		t.Fatalf("unexpected balance %+v %v", bal, err)
+	}
+	if bal, err := r.Ledger.Balance(ctx, other); err != nil || !bal.Current.IsZero() {
+		t.Fatalf("expected zero balance of other user: %+v %v", bal, err)
+	}
+	list, _ = r.Orders.ListByUser(ctx, uid, 10, 0)
+	if list[0].Number != "4" || list[0].Accrual == nil || !list[0].Accrual.Equal(decimal.NewFromInt(10)) {
+		t.Fatalf("unexpected processed order %+v", list[0])
+	}
+}
+
+func testOrderProcessing(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "processing")
+
+	for _, num := range []string{"1", "2"} {
+		if _, _, err := r.Orders.Add(ctx, num, uid, domain.OrderNew); err != nil {
+			t.Fatal(err)
+		}
+	}
+	due, err := r.Orders.GetUnprocessed(ctx, 10)
+	if err != nil || len(due) != 2 || due[0].Number != "1" {
+		t.Fatalf("expected oldest first: %v %v", due, err)
+	}
+	if due, _ := r.Orders.GetUnprocessed(ctx, 1); len(due) != 1 {
+		t.Fatalf("expected limit to apply: %v", due)
+	}
+
+	if err := r.Orders.RecordFailure(ctx, "1", "timeout", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Orders.RecordFailure(ctx, "404", "timeout", time.Now()); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	due, _ = r.Orders.GetUnprocessed(ctx, 10)
+	if len(due) != 1 || due[0].Number != "2" {
+		t.Fatalf("postponed order must not be due: %v", due)
+	}
+	list, _ := r.Orders.ListByUser(ctx, uid, 10, 0)
+	if list[1].Number != "1" || list[1].Attempts != 1 {
+		t.Fatalf("expected one failed attempt: %+v", list[1])
+	}
+
+	// a status update resets failures and makes the order due again
+	if err := r.Orders.UpdateStatus(ctx, "1", domain.OrderProcessing, nil); err != nil {
+		t.Fatal(err)
+	}
+	due, _ = r.Orders.GetUnprocessed(ctx, 10)
+	if len(due) != 2 || due[0].Number != "1" || due[0].Attempts != 0 || due[0].Status != domain.OrderProcessing {
+		t.Fatalf("expected reset order to be due: %+v", due)
+	}
+	// repeating the status keeps the backoff
+	if err := r.Orders.RecordFailure(ctx, "1", "still processing", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Orders.UpdateStatus(ctx, "1", domain.OrderProcessing, nil); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ = r.Orders.GetUnprocessed(ctx, 10); len(due) != 1 || due[0].Number != "2" {
+		t.Fatalf("repeated status must not make the order due: %+v", due)
+	}
+	if list, _ := r.Orders.ListByUser(ctx, uid, 10, 0); list[1].Attempts != 1 {
+		t.Fatalf("repeated status must not reset attempts: %+v", list[1])
+	}
+	// postponing moves the check without counting a failure
+	if err := r.Orders.Postpone(ctx, "2", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Orders.Postpone(ctx, "404", time.Now()); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if due, _ = r.Orders.GetUnprocessed(ctx, 10); len(due) != 0 {
+		t.Fatalf("postponed order must not be due: %+v", due)
+	}
+	if list, _ := r.Orders.ListByUser(ctx, uid, 10, 0); list[0].Attempts != 0 {
+		t.Fatalf("postponing must not count an attempt: %+v", list[0])
+	}
+
+	if err := r.Orders.UpdateStatus(ctx, "1", domain.OrderNew, nil); !errors.Is(err, domain.ErrInvalidTransition) {
+		t.Fatalf("expected invalid transition, got %v", err)
+	}
+	if err := r.Orders.UpdateStatus(ctx, "404", domain.OrderProcessing, nil); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := r.Orders.UpdateStatus(ctx, "1", domain.OrderInvalid, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Orders.UpdateStatus(ctx, "1", domain.OrderProcessed, nil); !errors.Is(err, domain.ErrInvalidTransition) {
+		t.Fatalf("terminal status must be final, got %v", err)
+	}
+	if err := r.Orders.Postpone(ctx, "2", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	due, _ = r.Orders.GetUnprocessed(ctx, 10)
+	if len(due) != 1 || due[0].Number != "2" {
+		t.Fatalf("invalid order must not be due: %v", due)
+	}
+}
+
+func testClaim(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "claim")
+	for _, num := range []string{"1", "2", "3"} {
+		if _, _, err := r.Orders.Add(ctx, num, uid, domain.OrderNew); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest orders are claimed first, in no particular order
+	first, err := r.Orders.Claim(ctx, "a", 2, time.Minute)
+	if err != nil || len(first) != 2 || first[0].Number == "3" || first[1].Number == "3" {
+		t.Fatalf("claim a: %v %v", first, err)
+	}
+	second, err := r.Orders.Claim(ctx, "b", 10, time.Minute)
+	if err != nil || len(second) != 1 || second[0].Number != "3" {
+		t.Fatalf("claim b: %v %v", second, err)
+	}
+
+	// release by a foreign owner must not drop the lease
+	if err := r.Orders.Release(ctx, "1", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Orders.Claim(ctx, "b", 10, time.Minute); err != nil || len(got) != 0 {
+		t.Fatalf("expected nothing to claim: %v %v", got, err)
+	}
+	if err := r.Orders.Release(ctx, "1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Orders.Claim(ctx, "b", 10, time.Minute)
+	if err != nil || len(got) != 1 || got[0].Number != "1" {
+		t.Fatalf("claim released: %v %v", got, err)
+	}
+
+	// expired leases may be taken over
+	if _, _, err := r.Orders.Add(ctx, "4", uid, domain.OrderNew); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Orders.Claim(ctx, "a", 10, time.Millisecond); err != nil || len(got) != 1 {
+		t.Fatalf("claim short lease: %v %v", got, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got, err := r.Orders.Claim(ctx, "b", 10, time.Minute); err != nil || len(got) != 1 || got[0].Number != "4" {
+		t.Fatalf("claim expired lease: %v %v", got, err)
+	}
+}
+
+func testWithdrawals(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "withdrawals")
+	other := createUser(t, r, "other")
+	processOrder(t, r, "1", uid, 100)
+
+	if err := r.Withdrawals.Withdraw(ctx, "w1", uid, decimal.NewFromInt(30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Withdrawals.Withdraw(ctx, "w2", uid, decimal.RequireFromString("20.5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Withdrawals.Withdraw(ctx, "w1", uid, decimal.NewFromInt(1)); !errors.Is(err, domain.ErrDuplicateWithdrawal) {
+		t.Fatalf("expected duplicate withdrawal, got %v", err)
+	}
+	if err := r.Withdrawals.Withdraw(ctx, "w3", uid, decimal.NewFromInt(50)); !errors.Is(err, domain.ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if err := r.Withdrawals.Withdraw(ctx, "w3", uid+100, decimal.NewFromInt(1)); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := r.Withdrawals.Withdraw(ctx, "w3", other, decimal.NewFromInt(5)); !errors.Is(err, domain.ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds of other, got %v", err)
+	}
+	processOrder(t, r, "2", other, 10)
+	if err := r.Withdrawals.Withdraw(ctx, "w3", other, decimal.NewFromInt(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Withdrawals.Withdraw(ctx, "w2", other, decimal.NewFromInt(5)); !errors.Is(err, domain.ErrDuplicateWithdrawal) {
+		t.Fatalf("expected duplicate withdrawal, got %v", err)
+	}
+
+	list, err := r.Withdrawals.ListByUser(ctx, uid, 10, 0)
+	if err != nil || len(list) != 2 || list[0].Number != "w2" || list[1].Number != "w1" {
+		t.Fatalf("expected newest first: %v %v", list, err)
+	}
+	if !list[0].Amount.Equal(decimal.RequireFromString("20.5")) || list[0].UserID != uid || list[0].ProcessedAt.IsZero() {
+		t.Fatalf("unexpected withdrawal %+v", list[0])
+	}
+	page, err := r.Withdrawals.ListByUser(ctx, uid, 1, 1)
+	if err != nil || len(page) != 1 || page[0].Number != "w1" {
+		t.Fatalf("paged withdrawals: %v %v", page, err)
+	}
+	bal, err := r.Ledger.Balance(ctx, uid)
+	if err != nil || !bal.Current.Equal(decimal.RequireFromString("49.5")) || !bal.Withdrawn.Equal(decimal.RequireFromString("50.5")) {
+		t.Fatalf("unexpected balance %+v %v", bal, err)
+	}
+	bal, err = r.Ledger.Balance(ctx, other)
+	if err != nil || !bal.Current.Equal(decimal.NewFromInt(5)) || !bal.Withdrawn.Equal(decimal.NewFromInt(5)) {
+		t.Fatalf("unexpected balance of other %+v %v", bal, err)
+	}
+}
+
+func testConcurrentWithdraw(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "concurrent")
+	processOrder(t, r, "1", uid, 5)
+
+	const n = 10
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ok  int
+		bad []error
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := r.Withdrawals.Withdraw(ctx, fmt.Sprintf("w%d", i), uid, decimal.NewFromInt(1))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				ok++
+			case !errors.Is(err, domain.ErrInsufficientFunds):
+				bad = append(bad, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(bad) > 0 {
+		t.Fatalf("unexpected errors %v", bad)
+	}
+	if ok != 5 {
+		t.Fatalf("expected 5 withdrawals to succeed, got %d", ok)
+	}
+	if bal, _ := r.Ledger.Balance(ctx, uid); !bal.Current.IsZero() || !bal.Withdrawn.Equal(decimal.NewFromInt(5)) {
+		t.Fatalf("expected zero balance, got %+v", bal)
+	}
+	if list, err := r.Withdrawals.ListByUser(ctx, uid, n, 0); err != nil || len(list) != 5 {
+		t.Fatalf("expected 5 withdrawals: %v %v", list, err)
+	}
+
+	// the same order number is accepted once however many requests race
+	other := createUser(t, r, "concurrent-other")
+	processOrder(t, r, "2", other, 5)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- r.Withdrawals.Withdraw(ctx, "dup", other, decimal.NewFromInt(1))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	ok = 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case !errors.Is(err, domain.ErrDuplicateWithdrawal):
+			t.Fatalf("expected duplicate withdrawal, got %v", err)
+		}
+	}
+	if ok != 1 {
+		t.Fatalf("expected a single withdrawal to succeed, got %d", ok)
+	}
+	if bal, _ := r.Ledger.Balance(ctx, other); !bal.Current.Equal(decimal.NewFromInt(4)) {
+		t.Fatalf("expected balance of 4, got %+v", bal)
+	}
+}
+
+func testLedger(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "ledger")
+	processOrder(t, r, "1", uid, 100)
+	if err := r.Withdrawals.Withdraw(ctx, "w1", uid, decimal.NewFromInt(30)); err != nil {
+		t.Fatal(err)
+	}
+	adjID, err := r.Ledger.Adjust(ctx, uid, decimal.NewFromInt(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bal, err := r.Ledger.Balance(ctx, uid)
+	if err != nil || !bal.Current.Equal(decimal.NewFromInt(75)) || !bal.Withdrawn.Equal(decimal.NewFromInt(30)) {
+		t.Fatalf("unexpected balance %+v %v", bal, err)
+	}
+
+	revID, err := r.Ledger.Reverse(ctx, adjID)
+	if err != nil || revID == adjID {
+		t.Fatalf("reverse: %d %v", revID, err)
+	}
+	if _, err := r.Ledger.Reverse(ctx, adjID); !errors.Is(err, domain.ErrAlreadyReversed) {
+		t.Fatalf("expected already reversed, got %v", err)
+	}
+	if _, err := r.Ledger.Reverse(ctx, 1<<40); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	entries, err := r.Ledger.ListByUser(ctx, uid, 10, 0)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("list entries: %v %v", entries, err)
+	}
+	latest := entries[0]
+	if latest.Kind != domain.LedgerReversal || latest.ReversalOf == nil || latest.TxID != revID || !latest.Amount.Equal(decimal.NewFromInt(-5)) {
+		t.Fatalf("unexpected latest entry %+v", latest)
+	}
+	if entries[3].Kind != domain.LedgerAccrual || entries[3].OrderNumber != "1" || entries[3].UserID != uid || entries[3].Account != domain.UserAccount(uid) {
+		t.Fatalf("unexpected first entry %+v", entries[3])
+	}
+	if page, err := r.Ledger.ListByUser(ctx, uid, 2, 1); err != nil || len(page) != 2 || page[0].ID != entries[1].ID {
+		t.Fatalf("paged entries: %v %v", page, err)
+	}
+
+	// reversing a withdrawal gives the points back and lowers the withdrawn sum
+	w := entries[2]
+	if w.Kind != domain.LedgerWithdrawal {
+		t.Fatalf("expected withdrawal entry, got %+v", w)
+	}
+	if _, err := r.Ledger.Reverse(ctx, w.TxID); err != nil {
+		t.Fatal(err)
+	}
+	bal, _ = r.Ledger.Balance(ctx, uid)
+	if !bal.Current.Equal(decimal.NewFromInt(100)) || !bal.Withdrawn.IsZero() {
+		t.Fatalf("unexpected balance after reversal %+v", bal)
+	}
+}
+
+func testIdempotency(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "idempotency")
+	other := createUser(t, r, "other")
+
+	rec, ok, err := r.Idempotency.Reserve(ctx, uid, "k", "h1", time.Minute)
+	if err != nil || !ok || rec.RequestHash != "h1" || rec.CreatedAt.IsZero() {
+		t.Fatalf("reserve: %+v %v %v", rec, ok, err)
+	}
+	rec, ok, err = r.Idempotency.Reserve(ctx, uid, "k", "h2", time.Minute)
+	if err != nil || ok || rec.RequestHash != "h1" || rec.StatusCode != 0 {
+		t.Fatalf("expected in-progress record: %+v %v %v", rec, ok, err)
+	}
+	if _, ok, err := r.Idempotency.Reserve(ctx, other, "k", "h1", time.Minute); err != nil || !ok {
+		t.Fatalf("keys must be per user: %v %v", ok, err)
+	}
+
+	if err := r.Idempotency.Complete(ctx, uid, "k", 201, "application/json", []byte(`{"ok":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	rec, ok, err = r.Idempotency.Reserve(ctx, uid, "k", "h1", time.Minute)
+	if err != nil || ok || rec.StatusCode != 201 || rec.ContentType != "application/json" || string(rec.Body) != `{"ok":true}` {
+		t.Fatalf("expected stored response: %+v %v %v", rec, ok, err)
+	}
+
+	if err := r.Idempotency.Delete(ctx, uid, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := r.Idempotency.Reserve(ctx, uid, "k", "h1", time.Minute); err != nil || !ok {
+		t.Fatalf("expected key to be free after delete: %v %v", ok, err)
+	}
+
+	// a key left in progress is free again after the lease, a completed one isn't
+	if _, ok, err := r.Idempotency.Reserve(ctx, uid, "done", "h1", time.Minute); err != nil || !ok {
+		t.Fatalf("reserve: %v %v", ok, err)
+	}
+	if err := r.Idempotency.Complete(ctx, uid, "done", 200, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, ok, err := r.Idempotency.Reserve(ctx, uid, "k", "h2", time.Second); err != nil || !ok {
+		t.Fatalf("expected key to be free after the lease: %v %v", ok, err)
+	}
+	if rec, ok, err := r.Idempotency.Reserve(ctx, uid, "done", "h1", time.Second); err != nil || ok || rec.StatusCode != 200 {
+		t.Fatalf("completed key must outlive the lease: %+v %v %v", rec, ok, err)
+	}
+	if n, err := r.Idempotency.Prune(ctx); err != nil || n != 0 {
+		t.Fatalf("expected unexpired keys to be kept: %d %v", n, err)
+	}
+}
+
+func testSessions(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "sessions")
+	exp := time.Now().Add(time.Hour)
+
+	first := domain.Session{ID: uuid.NewString(), FamilyID: uuid.NewString(), UserID: uid, ExpiresAt: exp}
+	if err := r.Sessions.Create(ctx, first, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := r.Sessions.IsActive(ctx, first.ID); err != nil || !active {
+		t.Fatalf("expected active session: %v %v", active, err)
+	}
+	if active, err := r.Sessions.IsActive(ctx, uuid.NewString()); err != nil || active {
+		t.Fatalf("unknown session must not be active: %v %v", active, err)
+	}
+
+	second, err := r.Sessions.Rotate(ctx, "r1", domain.Session{ID: uuid.NewString(), ExpiresAt: exp}, "r2")
+	if err != nil || second.FamilyID != first.FamilyID || second.UserID != uid || second.CreatedAt.IsZero() {
+		t.Fatalf("rotate: %+v %v", second, err)
+	}
+	if _, err := r.Sessions.Rotate(ctx, "unknown", domain.Session{ID: uuid.NewString(), ExpiresAt: exp}, "r3"); !errors.Is(err, domain.ErrSessionInvalid) {
+		t.Fatalf("expected invalid session, got %v", err)
+	}
+
+	// reusing a rotated token revokes the whole family
+	if _, err := r.Sessions.Rotate(ctx, "r1", domain.Session{ID: uuid.NewString(), ExpiresAt: exp}, "r3"); !errors.Is(err, domain.ErrRefreshTokenReused) {
+		t.Fatalf("expected reuse, got %v", err)
+	}
+	if active, _ := r.Sessions.IsActive(ctx, second.ID); active {
+		t.Fatal("family must be revoked after reuse")
+	}
+	if _, err := r.Sessions.Rotate(ctx, "r2", domain.Session{ID: uuid.NewString(), ExpiresAt: exp}, "r3"); !errors.Is(err, domain.ErrSessionInvalid) {
+		t.Fatalf("expected revoked session to be invalid, got %v", err)
+	}
+
+	expired := domain.Session{ID: uuid.NewString(), FamilyID: uuid.NewString(), UserID: uid, ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := r.Sessions.Create(ctx, expired, "old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Sessions.Rotate(ctx, "old", domain.Session{ID: uuid.NewString(), ExpiresAt: exp}, "r4"); !errors.Is(err, domain.ErrSessionInvalid) {
+		t.Fatalf("expected expired session to be invalid, got %v", err)
+	}
+
+	a := domain.Session{ID: uuid.NewString(), FamilyID: uuid.NewString(), UserID: uid, ExpiresAt: exp}
+	b := domain.Session{ID: uuid.NewString(), FamilyID: uuid.NewString(), UserID: uid, ExpiresAt: exp}
+	for i, s := range []domain.Session{a, b} {
+		if err := r.Sessions.Create(ctx, s, fmt.Sprintf("s%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Sessions.RevokeFamily(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := r.Sessions.IsActive(ctx, a.ID); active {
+		t.Fatal("revoked family must not be active")
+	}
+	if active, _ := r.Sessions.IsActive(ctx, b.ID); !active {
+		t.Fatal("other family must stay active")
+	}
+	if err := r.Sessions.RevokeAll(ctx, uid); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := r.Sessions.IsActive(ctx, b.ID); active {
+		t.Fatal("all sessions must be revoked")
+	}
+}
+
+func testAPIKeys(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "keys")
+	other := createUser(t, r, "other")
+
+	k1, err := r.APIKeys.Create(ctx, domain.APIKey{UserID: uid, Name: "ci", Prefix: "gmk_a", Scopes: []domain.Scope{domain.ScopeOrdersRead}}, "h1")
+	if err != nil || k1.ID == 0 || k1.CreatedAt.IsZero() || k1.LastUsedAt != nil {
+		t.Fatalf("create key: %+v %v", k1, err)
+	}
+	k2, err := r.APIKeys.Create(ctx, domain.APIKey{UserID: uid, Name: "bot", Prefix: "gmk_b", Scopes: []domain.Scope{domain.ScopeWithdraw, domain.ScopeBalanceRead}}, "h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.APIKeys.GetByHash(ctx, "h2")
+	if err != nil || got.ID != k2.ID || got.UserID != uid || got.LastUsedAt == nil || len(got.Scopes) != 2 || got.Scopes[0] != domain.ScopeWithdraw {
+		t.Fatalf("get by hash: %+v %v", got, err)
+	}
+	// a recent use isn't written again
+	if again, err := r.APIKeys.GetByHash(ctx, "h2"); err != nil || again.LastUsedAt == nil || !again.LastUsedAt.Equal(*got.LastUsedAt) {
+		t.Fatalf("expected the recorded use to be kept: %+v %v", again, err)
+	}
+	if _, err := r.APIKeys.GetByHash(ctx, "unknown"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	list, err := r.APIKeys.ListByUser(ctx, uid)
+	if err != nil || len(list) != 2 || list[0].ID != k1.ID || list[1].Name != "bot" {
+		t.Fatalf("list keys: %+v %v", list, err)
+	}
+
+	if err := r.APIKeys.Revoke(ctx, other, k1.ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("foreign key revoke must fail, got %v", err)
+	}
+	if err := r.APIKeys.Revoke(ctx, uid, k1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.APIKeys.Revoke(ctx, uid, k1.ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found on second revoke, got %v", err)
+	}
+	if _, err := r.APIKeys.GetByHash(ctx, "h1"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("revoked key must not authenticate, got %v", err)
+	}
+	if list, _ := r.APIKeys.ListByUser(ctx, uid); len(list) != 1 || list[0].ID != k2.ID {
+		t.Fatalf("expected only active keys: %+v", list)
+	}
+}
+
+func testLoginAttempts(t *testing.T, r Repos) {
+	ctx := context.Background()
+
+	if a, err := r.LoginAttempts.Get(ctx, "login:a"); err != nil || a.Failures != 0 || a.LockedUntil != nil {
+		t.Fatalf("expected zero counters: %+v %v", a, err)
+	}
+	for i := 0; i < 3; i++ {
+		prev, err := r.LoginAttempts.Record(ctx, "login:a", time.Hour, 3, time.Minute)
+		if err != nil || prev.Failures != i || (i > 0) == prev.LastFailureAt.IsZero() || prev.LockedUntil != nil {
+			t.Fatalf("attempt %d: %+v %v", i, prev, err)
+		}
+	}
+	a, err := r.LoginAttempts.Get(ctx, "login:a")
+	if err != nil || a.Failures != 3 || a.LockedUntil == nil || !a.LockedUntil.After(time.Now()) {
+		t.Fatalf("expected locked key: %+v %v", a, err)
+	}
+
+	// concurrent attempts are counted one after another
+	var wg sync.WaitGroup
+	seen := make([]int, 10)
+	for i := range seen {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prev, err := r.LoginAttempts.Record(ctx, "login:c", time.Hour, 0, 0)
+			if err != nil {
+				t.Error(err)
+			}
+			seen[i] = prev.Failures
+		}()
+	}
+	wg.Wait()
+	slices.Sort(seen)
+	for i, n := range seen {
+		if n != i {
+			t.Fatalf("expected every attempt to see the previous ones, got %v", seen)
+		}
+	}
+
+	// a released attempt is uncounted, the lock stays
+	if err := r.LoginAttempts.Release(ctx, "login:a"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := r.LoginAttempts.Get(ctx, "login:a"); a.Failures != 2 || a.LockedUntil == nil {
+		t.Fatalf("expected released attempt: %+v", a)
+	}
+
+	// failures older than the window start counting anew
+	if _, err := r.LoginAttempts.Record(ctx, "login:b", time.Hour, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := r.LoginAttempts.Record(ctx, "login:b", 10*time.Millisecond, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := r.LoginAttempts.Get(ctx, "login:b"); err != nil || a.Failures != 1 || a.LockedUntil != nil {
+		t.Fatalf("expected counting to restart: %+v %v", a, err)
+	}
+
+	if err := r.LoginAttempts.Reset(ctx, "login:a"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := r.LoginAttempts.Get(ctx, "login:a"); a.Failures != 0 || a.LockedUntil != nil {
+		t.Fatalf("expected reset counters: %+v", a)
+	}
+
+	// old counters are pruned unless they are still locked
+	if _, err := r.LoginAttempts.Record(ctx, "login:d", time.Hour, 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.LoginAttempts.Prune(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("expected recent counters to be kept: %d %v", n, err)
+	}
+	if n, err := r.LoginAttempts.Prune(ctx, time.Now().Add(time.Second)); err != nil || n != 2 {
+		t.Fatalf("expected two pruned counters: %d %v", n, err)
+	}
+	if a, _ := r.LoginAttempts.Get(ctx, "login:b"); a.Failures != 0 {
+		t.Fatalf("expected pruned counters: %+v", a)
+	}
+	if a, _ := r.LoginAttempts.Get(ctx, "login:d"); a.Failures != 1 || a.LockedUntil == nil {
+		t.Fatalf("expected locked counters to be kept: %+v", a)
+	}
+}
+
+func testPasswordResets(t *testing.T, r Repos) {
+	ctx := context.Background()
+	uid := createUser(t, r, "resets")
+	exp := time.Now().Add(time.Hour)
+
+	for _, h := range []string{"t1", "t2"} {
+		if err := r.PasswordResets.Create(ctx, uid, h, exp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.PasswordResets.Create(ctx, uid, "expired", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	sess := domain.Session{ID: uuid.NewString(), FamilyID: uuid.NewString(), UserID: uid, ExpiresAt: exp}
+	if err := r.Sessions.Create(ctx, sess, "reset-r1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.PasswordResets.Consume(ctx, "expired", "new-hash"); !errors.Is(err, domain.ErrResetTokenInvalid) {
+		t.Fatalf("expected expired token to be invalid, got %v", err)
+	}
+	if _, err := r.PasswordResets.Consume(ctx, "unknown", "new-hash"); !errors.Is(err, domain.ErrResetTokenInvalid) {
+		t.Fatalf("expected unknown token to be invalid, got %v", err)
+	}
+	if u, _ := r.Users.GetByLogin(ctx, "resets"); u.PasswordHash != "hash" || u.TokenVersion != 0 {
+		t.Fatalf("invalid tokens must not change the password: %+v", u)
+	}
+	id, err := r.PasswordResets.Consume(ctx, "t1", "new-hash")
+	if err != nil || id != uid {
+		t.Fatalf("consume: %d %v", id, err)
+	}
+	if u, _ := r.Users.GetByLogin(ctx, "resets"); u.PasswordHash != "new-hash" || u.TokenVersion != 1 {
+		t.Fatalf("expected password changed and token version incremented: %+v", u)
+	}
+	if active, err := r.Sessions.IsActive(ctx, sess.ID); err != nil || active {
+		t.Fatalf("sessions must be revoked: %v %v", active, err)
+	}
+	if _, err := r.PasswordResets.Consume(ctx, "t1", "other-hash"); !errors.Is(err, domain.ErrResetTokenInvalid) {
+		t.Fatalf("expected used token to be invalid, got %v", err)
+	}
+	if _, err := r.PasswordResets.Consume(ctx, "t2", "other-hash"); !errors.Is(err, domain.ErrResetTokenInvalid) {
+		t.Fatalf("other tokens of the user must be used up, got %v", err)
+	}
+}
+
+func testEvents(t *testing.T, r Repos) {
+	ctx := context.Background()
+	alice := createUser(t, r, "alice")
+	bob := createUser(t, r, "bob")
+
+	if id, err := r.Events.LastID(ctx, alice); err != nil || id != 0 {
+		t.Fatalf("expected no events, got %d %v", id, err)
+	}
+
+	accrual := decimal.RequireFromString("10.50")
+	var ids []int64
+	for i := 0; i < 4; i++ {
+		e := domain.Event{UserID: alice, Type: domain.EventOrder, Order: &domain.Order{
+			Number: fmt.Sprint(i), UserID: alice, Status: domain.OrderProcessed, Accrual: &accrual,
+		}}
+		id, err := r.Events.Append(ctx, e, 3)
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		if len(ids) > 0 && id <= ids[len(ids)-1] {
+			t.Fatalf("ids must increase: %d after %v", id, ids)
+		}
+		ids = append(ids, id)
+	}
+	bal := domain.Balance{Current: decimal.NewFromInt(5), Withdrawn: decimal.NewFromInt(1)}
+	if _, err := r.Events.Append(ctx, domain.Event{UserID: bob, Type: domain.EventBalance, Balance: &bal}, 3); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	// only the 3 latest events of alice are kept
+	list, err := r.Events.ListAfter(ctx, alice, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].ID != ids[1] || list[2].ID != ids[3] {
+		t.Fatalf("unexpected events %+v, ids %v", list, ids)
+	}
+	e := list[2]
+	if e.UserID != alice || e.Type != domain.EventOrder || e.Order == nil || e.Order.Number != "3" ||
+		e.Order.Status != domain.OrderProcessed || e.Order.Accrual == nil || !e.Order.Accrual.Equal(accrual) || e.CreatedAt.IsZero() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	list, err = r.Events.ListAfter(ctx, alice, ids[2], 10)
+	if err != nil || len(list) != 1 || list[0].ID != ids[3] {
+		t.Fatalf("expected events after %d, got %+v %v", ids[2], list, err)
+	}
+	if list, err = r.Events.ListAfter(ctx, alice, 0, 1); err != nil || len(list) != 1 || list[0].ID != ids[1] {
+		t.Fatalf("expected limit to apply, got %+v %v", list, err)
+	}
+	if id, err := r.Events.LastID(ctx, alice); err != nil || id != ids[3] {
+		t.Fatalf("expected last id %d, got %d %v", ids[3], id, err)
+	}
+
+	list, err = r.Events.ListAfter(ctx, bob, 0, 10)
+	if err != nil || len(list) != 1 || list[0].Balance == nil || !list[0].Balance.Current.Equal(bal.Current) ||
+		!list[0].Balance.Withdrawn.Equal(bal.Withdrawn) {
+		t.Fatalf("unexpected events of bob %+v %v", list, err)
+	}
+	// ids are numbered per user, events of alice don't move those of bob
+	if list[0].ID != 1 {
+		t.Fatalf("expected first event of bob to have id 1, got %d", list[0].ID)
+	}
+
+	// concurrent appends get consecutive ids
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Events.Append(ctx, domain.Event{UserID: bob, Type: domain.EventBalance, Balance: &bal}, n+1); err != nil {
+				t.Errorf("append: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	list, err = r.Events.ListAfter(ctx, bob, 0, 2*n)
+	if err != nil || len(list) != n+1 {
+		t.Fatalf("expected %d events of bob, got %d %v", n+1, len(list), err)
+	}
+	for i, e := range list {
+		if e.ID != int64(i+1) {
+			t.Fatalf("expected id %d at %d, got %d", i+1, i, e.ID)
+		}
+	}
+}
+
+func testWebhooks(t *testing.T, r Repos) {
+	ctx := context.Background()
+	alice := createUser(t, r, "alice")
+	bob := createUser(t, r, "bob")
+
+	hook, err := r.Webhooks.Create(ctx, domain.Webhook{UserID: alice, URL: "https://a.example/hook", Secret: "s1",
+		Events: []domain.WebhookEvent{domain.WebhookOrderProcessed, domain.WebhookWithdrawalCreated}})
+	if err != nil || hook.ID == 0 || hook.CreatedAt.IsZero() {
+		t.Fatalf("create: %+v %v", hook, err)
+	}
+	global, err := r.Webhooks.Create(ctx, domain.Webhook{URL: "https://admin.example/hook", Secret: "s2",
+		Events: []domain.WebhookEvent{domain.WebhookOrderInvalid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, err := r.Webhooks.ListByUser(ctx, alice); err != nil || len(list) != 1 || list[0].ID != hook.ID ||
+		list[0].URL != hook.URL || list[0].Secret != "s1" || len(list[0].Events) != 2 {
+		t.Fatalf("unexpected webhooks of alice %+v %v", list, err)
+	}
+	if list, err := r.Webhooks.ListByUser(ctx, 0); err != nil || len(list) != 1 || list[0].ID != global.ID || list[0].UserID != 0 {
+		t.Fatalf("unexpected global webhooks %+v %v", list, err)
+	}
+
+	// changes are queued for subscribed endpoints only
+	processOrder(t, r, "1", alice, 100)
+	processOrder(t, r, "2", bob, 50)
+	if _, _, err := r.Orders.Add(ctx, "3", bob, domain.OrderNew); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Orders.UpdateStatus(ctx, "3", domain.OrderInvalid, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Withdrawals.Withdraw(ctx, "4", alice, decimal.NewFromInt(30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Withdrawals.Withdraw(ctx, "5", alice, decimal.NewFromInt(1000)); !errors.Is(err, domain.ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+
+	list, err := r.Webhooks.ListDeliveries(ctx, alice, hook.ID, 10)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("unexpected deliveries %+v %v", list, err)
+	}
+	w, p := list[0], list[1]
+	if w.Event != domain.WebhookWithdrawalCreated || w.UserID != alice || w.OrderNumber != "4" || w.Amount == nil ||
+		!w.Amount.Equal(decimal.NewFromInt(30)) || w.Status != domain.DeliveryPending || w.OccurredAt.IsZero() {
+		t.Fatalf("unexpected withdrawal delivery %+v", w)
+	}
+	if p.Event != domain.WebhookOrderProcessed || p.OrderNumber != "1" || p.Amount == nil || !p.Amount.Equal(decimal.NewFromInt(100)) {
+		t.Fatalf("unexpected order delivery %+v", p)
+	}
+	g, err := r.Webhooks.ListDeliveries(ctx, 0, global.ID, 10)
+	if err != nil || len(g) != 1 || g[0].Event != domain.WebhookOrderInvalid || g[0].UserID != bob || g[0].Amount != nil {
+		t.Fatalf("unexpected global deliveries %+v %v", g, err)
+	}
+	if _, err := r.Webhooks.ListDeliveries(ctx, bob, hook.ID, 10); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found for other user, got %v", err)
+	}
+
+	claimed, err := r.Webhooks.ClaimDeliveries(ctx, "w1", 10, time.Minute)
+	if err != nil || len(claimed) != 3 {
+		t.Fatalf("claim: %+v %v", claimed, err)
+	}
+	for _, d := range claimed {
+		if d.WebhookID == global.ID && (d.URL != global.URL || d.Secret != "s2") {
+			t.Fatalf("claimed delivery without endpoint %+v", d)
+		}
+	}
+	if again, err := r.Webhooks.ClaimDeliveries(ctx, "w2", 10, time.Minute); err != nil || len(again) != 0 {
+		t.Fatalf("leased deliveries claimed again: %+v %v", again, err)
+	}
+
+	if err := r.Webhooks.MarkDelivered(ctx, p.ID, "w1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Webhooks.RecordFailure(ctx, w.ID, "w1", "status 500", time.Now().Add(-time.Second), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Webhooks.RecordFailure(ctx, g[0].ID, "w1", "status 404", time.Now(), true); err != nil {
+		t.Fatal(err)
+	}
+	// only the failed delivery is due again, dead ones wait for a redelivery
+	again, err := r.Webhooks.ClaimDeliveries(ctx, "w2", 10, time.Minute)
+	if err != nil || len(again) != 1 || again[0].ID != w.ID || again[0].Attempts != 1 || again[0].LastError != "status 500" {
+		t.Fatalf("unexpected claim after failure %+v %v", again, err)
+	}
+	// a result of the previous owner must not overwrite the new lease
+	if err := r.Webhooks.MarkDelivered(ctx, w.ID, "w1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Webhooks.RecordFailure(ctx, w.ID, "w1", "late", time.Now(), true); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = r.Webhooks.ListDeliveries(ctx, alice, hook.ID, 10)
+	if list[0].Status != domain.DeliveryPending || list[0].Attempts != 1 || list[0].LastError != "status 500" {
+		t.Fatalf("stale result applied %+v", list[0])
+	}
+	if list[1].Status != domain.DeliveryDelivered || list[1].DeliveredAt == nil || list[1].Attempts != 1 {
+		t.Fatalf("unexpected delivered delivery %+v", list[1])
+	}
+	if list, _ := r.Webhooks.ListDeliveries(ctx, alice, hook.ID, 1); len(list) != 1 || list[0].ID != w.ID {
+		t.Fatalf("expected limit to apply, got %+v", list)
+	}
+
+	if err := r.Webhooks.Redeliver(ctx, alice, global.ID, g[0].ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found for other owner, got %v", err)
+	}
+	if err := r.Webhooks.Redeliver(ctx, 0, global.ID, g[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	again, err = r.Webhooks.ClaimDeliveries(ctx, "w2", 10, time.Minute)
+	if err != nil || len(again) != 1 || again[0].ID != g[0].ID || again[0].Status != domain.DeliveryPending || again[0].Attempts != 0 {
+		t.Fatalf("unexpected claim after redelivery %+v %v", again, err)
+	}
+	// redelivery drops the lease, so the delivery is due at once
+	if err := r.Webhooks.Redeliver(ctx, 0, global.ID, g[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	again, err = r.Webhooks.ClaimDeliveries(ctx, "w3", 10, time.Minute)
+	if err != nil || len(again) != 1 || again[0].ID != g[0].ID {
+		t.Fatalf("redelivered delivery still leased %+v %v", again, err)
+	}
+
+	// delivered and dead deliveries are pruned, pending ones are kept
+	if err := r.Webhooks.RecordFailure(ctx, g[0].ID, "w3", "status 404", time.Now(), true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Webhooks.PruneDeliveries(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("pruned recent deliveries: %d %v", n, err)
+	}
+	if n, err := r.Webhooks.PruneDeliveries(ctx, time.Now().Add(time.Hour)); err != nil || n != 2 {
+		t.Fatalf("prune: %d %v", n, err)
+	}
+	if list, _ := r.Webhooks.ListDeliveries(ctx, alice, hook.ID, 10); len(list) != 1 || list[0].ID != w.ID {
+		t.Fatalf("unexpected deliveries after prune %+v", list)
+	}
+
+	if err := r.Webhooks.Delete(ctx, bob, hook.ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found for other user, got %v", err)
+	}
+	if err := r.Webhooks.Delete(ctx, alice, hook.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Webhooks.ListDeliveries(ctx, alice, hook.ID, 10); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected deleted webhook, got %v", err)
+	}
+	if list, err := r.Webhooks.ListByUser(ctx, alice); err != nil || len(list) != 0 {
+		t.Fatalf("expected no webhooks, got %+v %v", list, err)
+	}
+}
@@ -0,0 +1,3 @@
+-- +migrate Down
+DROP TABLE IF EXISTS ledger_entries;
+DROP SEQUENCE IF EXISTS ledger_txn_seq;
@@ -0,0 +1,42 @@
+-- +migrate Up
+CREATE SEQUENCE IF NOT EXISTS ledger_txn_seq;
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    txn_id BIGINT NOT NULL,
+    account TEXT NOT NULL,
+    user_id BIGINT REFERENCES users(id),
+    kind TEXT NOT NULL CHECK (kind IN ('accrual','withdrawal','adjustment','reversal')),
+    amount NUMERIC(12,2) NOT NULL,
+    order_number TEXT,
+    reversal_of BIGINT UNIQUE REFERENCES ledger_entries(id),
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_idx ON ledger_entries (account);
+CREATE INDEX IF NOT EXISTS ledger_entries_txn_idx ON ledger_entries (txn_id);
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_entries_order_kind_idx
+    ON ledger_entries (account, kind, order_number)
+    WHERE kind IN ('accrual','withdrawal');
+
+-- Backfill the ledger from balances computed before it was introduced.
+WITH src AS (
+    SELECT nextval('ledger_txn_seq') AS txn_id, user_id, number, accrual
+    FROM orders
+    WHERE status='PROCESSED' AND accrual > 0
+      AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.kind='accrual' AND e.order_number=orders.number)
+)
+INSERT INTO ledger_entries (txn_id, account, user_id, kind, amount, order_number)
+SELECT txn_id, 'user:' || user_id, user_id, 'accrual', accrual, number FROM src
+UNION ALL
+SELECT txn_id, 'system:accrual', NULL, 'accrual', -accrual, number FROM src;
+
+WITH src AS (
+    SELECT nextval('ledger_txn_seq') AS txn_id, user_id, order_number, amount
+    FROM withdrawals
+    WHERE NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.kind='withdrawal' AND e.order_number=withdrawals.order_number)
+)
+INSERT INTO ledger_entries (txn_id, account, user_id, kind, amount, order_number)
+SELECT txn_id, 'user:' || user_id, user_id, 'withdrawal', -amount, order_number FROM src
+UNION ALL
+SELECT txn_id, 'system:withdrawals', NULL, 'withdrawal', amount, order_number FROM src;
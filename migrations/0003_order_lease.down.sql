@@ -0,0 +1,4 @@
+-- +migrate Down
+DROP INDEX IF EXISTS orders_unprocessed_idx;
+ALTER TABLE orders DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE orders DROP COLUMN IF EXISTS locked_by;
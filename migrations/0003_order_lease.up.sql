@@ -0,0 +1,6 @@
+-- +migrate Up
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS locked_by TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS orders_unprocessed_idx ON orders (uploaded_at)
+    WHERE status IN ('NEW','PROCESSING');
@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID PRIMARY KEY,
+    family_id UUID NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    refresh_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    rotated_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS sessions_family_idx ON sessions (family_id);
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
@@ -0,0 +1,2 @@
+-- +migrate Down
+DROP INDEX IF EXISTS users_login_lower_idx;
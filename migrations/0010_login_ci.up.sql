@@ -0,0 +1,3 @@
+-- +migrate Up
+-- fails if logins differing only in case already exist; rename them first
+CREATE UNIQUE INDEX IF NOT EXISTS users_login_lower_idx ON users (lower(login));
@@ -0,0 +1,3 @@
+-- +migrate Down
+DROP TABLE IF EXISTS user_events;
+ALTER TABLE users DROP COLUMN IF EXISTS event_seq;
@@ -0,0 +1,13 @@
+-- +migrate Up
+-- Event ids are numbered per user. The counter lives on the user row, so
+-- appends of a user are serialized and commit in the order of their ids.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS event_seq BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS user_events (
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    seq BIGINT NOT NULL,
+    type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, seq)
+);
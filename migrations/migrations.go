@@ -0,0 +1,12 @@
+// Package migrations embeds the SQL migrations into the binary.
+//
+// Every migration is a pair of files NNNN_name.up.sql and NNNN_name.down.sql,
+// where NNNN is the version. Versions are applied in ascending order.
+package migrations
+
+import "embed"
+
+// FS holds the migration scripts.
+//
+//go:embed *.sql
+var FS embed.FS
@@ -1,20 +1,253 @@
 package crypto
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
 
-const passwordCost = 12
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
 
-// HashPassword hashes raw password using bcrypt with cost 12.
-func HashPassword(raw string) (string, error) {
-	b, err := bcrypt.GenerateFromPassword([]byte(raw), passwordCost)
+var (
+	// ErrMismatch is returned when password does not match the hash.
+	ErrMismatch = errors.New("password does not match")
+	// ErrUnsupportedHash is returned for hashes made by another algorithm.
+	ErrUnsupportedHash = errors.New("unsupported password hash")
+	// ErrMalformedHash is returned for hashes of a supported algorithm that
+	// can't be parsed or have invalid parameters.
+	ErrMalformedHash = errors.New("malformed password hash")
+	// ErrPasswordTooLong is returned by bcrypt for passwords over 72 bytes
+	// instead of silently ignoring the rest.
+	ErrPasswordTooLong = errors.New("password is longer than 72 bytes")
+)
+
+// Hasher hashes and verifies passwords.
+type Hasher interface {
+	// Hash returns a self-describing hash of password.
+	Hash(password string) (string, error)
+	// Verify returns ErrMismatch if password does not match hash and
+	// ErrUnsupportedHash if the hash was made by another algorithm.
+	Verify(hash, password string) error
+	// NeedsRehash reports whether hash was made by another algorithm or
+	// with other parameters than Hash would use now.
+	NeedsRehash(hash string) bool
+}
+
+// Argon2Params are argon2id parameters.
+type Argon2Params struct {
+	// Memory in KiB.
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2Params follow the second recommended option of RFC 9106.
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Time: 3, Threads: 4, SaltLen: 16, KeyLen: 32}
+
+// Argon2id hashes passwords with argon2id into PHC strings:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>.
+type Argon2id struct {
+	params Argon2Params
+	pepper []byte
+}
+
+// NewArgon2id creates argon2id hasher. A non-empty pepper is mixed into every
+// password with HMAC-SHA256. The pepper is kept out of the database, so it
+// can't change without invalidating all hashes made with it.
+func NewArgon2id(p Argon2Params, pepper []byte) *Argon2id {
+	return &Argon2id{params: p, pepper: pepper}
+}
+
+func (a *Argon2id) input(password string) []byte {
+	if len(a.pepper) == 0 {
+		return []byte(password)
+	}
+	m := hmac.New(sha256.New, a.pepper)
+	m.Write([]byte(password))
+	return m.Sum(nil)
+}
+
+// Hash returns the PHC string of password with a random salt.
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := a.params
+	key := argon2.IDKey(a.input(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify returns ErrMismatch if password does not match hash,
+// ErrUnsupportedHash for hashes that aren't argon2id and ErrMalformedHash
+// for broken ones.
+func (a *Argon2id) Verify(hash, password string) error {
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	got := argon2.IDKey(a.input(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// NeedsRehash reports whether hash isn't argon2id or was made with other
+// parameters than a's.
+func (a *Argon2id) NeedsRehash(hash string) bool {
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	p.SaltLen, p.KeyLen = uint32(len(salt)), uint32(len(key))
+	return p != a.params
+}
+
+func parseArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return Argon2Params{}, nil, nil, ErrUnsupportedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrUnsupportedHash
+	}
+	var p Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("%w: argon2id parameters: %v", ErrMalformedHash, err)
+	}
+	// argon2.IDKey panics on zero time or threads
+	if p.Memory == 0 || p.Time == 0 || p.Threads == 0 {
+		return Argon2Params{}, nil, nil, fmt.Errorf("%w: zero argon2id parameter", ErrMalformedHash)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("%w: argon2id salt: %v", ErrMalformedHash, err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, fmt.Errorf("%w: argon2id key", ErrMalformedHash)
+	}
+	return p, salt, key, nil
+}
+
+// legacyBcryptCost is the cost passwords were hashed with before argon2id.
+const legacyBcryptCost = 12
+
+// Bcrypt hashes passwords with bcrypt. It is kept to verify hashes made
+// before switching to argon2id.
+type Bcrypt struct {
+	cost int
+}
+
+// NewBcrypt creates bcrypt hasher with given cost.
+func NewBcrypt(cost int) *Bcrypt {
+	return &Bcrypt{cost: cost}
+}
+
+// Hash returns the bcrypt hash of password. Returns ErrPasswordTooLong for
+// passwords longer than 72 bytes, which bcrypt would truncate.
+func (b *Bcrypt) Hash(password string) (string, error) {
+	if len(password) > 72 {
+		return "", ErrPasswordTooLong
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
 	if err != nil {
 		return "", err
 	}
-	return string(b), nil
+	return string(h), nil
+}
+
+// Verify returns ErrMismatch if password does not match hash and
+// ErrUnsupportedHash for hashes that aren't bcrypt.
+func (b *Bcrypt) Verify(hash, password string) error {
+	if !isBcrypt(hash) {
+		return ErrUnsupportedHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatch
+	}
+	return err
+}
+
+// NeedsRehash reports whether hash isn't bcrypt or was made with another cost.
+func (b *Bcrypt) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.cost
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Multi hashes with the primary hasher and verifies hashes made by any of the hashers.
+type Multi struct {
+	primary Hasher
+	legacy  []Hasher
+}
+
+// NewMulti creates hasher migrating from legacy hashers to primary.
+func NewMulti(primary Hasher, legacy ...Hasher) *Multi {
+	return &Multi{primary: primary, legacy: legacy}
+}
+
+// Hash hashes password with the primary hasher.
+func (m *Multi) Hash(password string) (string, error) {
+	return m.primary.Hash(password)
+}
+
+// Verify tries the primary hasher and then the legacy ones in order until
+// one of them supports hash.
+func (m *Multi) Verify(hash, password string) error {
+	err := m.primary.Verify(hash, password)
+	for _, h := range m.legacy {
+		if !errors.Is(err, ErrUnsupportedHash) {
+			break
+		}
+		err = h.Verify(hash, password)
+	}
+	return err
+}
+
+// NeedsRehash reports whether hash wasn't made by the primary hasher with
+// its current parameters.
+func (m *Multi) NeedsRehash(hash string) bool {
+	return m.primary.NeedsRehash(hash)
+}
+
+// NewDefault returns argon2id hasher with default parameters that still
+// accepts bcrypt hashes.
+func NewDefault(pepper []byte) Hasher {
+	return NewDefaultParams(DefaultArgon2Params, pepper)
+}
+
+// NewDefaultParams is like NewDefault but hashes with argon2id parameters p.
+func NewDefaultParams(p Argon2Params, pepper []byte) Hasher {
+	return NewMulti(NewArgon2id(p, pepper), NewBcrypt(legacyBcryptCost))
+}
+
+// Default is the hasher used by HashPassword and ComparePassword.
+var Default = NewDefault(nil)
+
+// HashPassword hashes raw password with the Default hasher.
+func HashPassword(raw string) (string, error) {
+	return Default.Hash(raw)
 }
 
 // ComparePassword compares hashed password with raw password.
 // It returns an error if they do not match.
 func ComparePassword(hash, raw string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(raw))
+	return Default.Verify(hash, raw)
 }
@@ -1,6 +1,10 @@
 package crypto
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+)
 
 func TestComparePasswordSuccess(t *testing.T) {
 	hash, err := HashPassword("secret")
@@ -21,3 +25,88 @@ func TestComparePasswordFail(t *testing.T) {
 		t.Error("expected compare error")
 	}
 }
+
+var testParams = Argon2Params{Memory: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func TestArgon2id_PHCFormat(t *testing.T) {
+	h := NewArgon2id(testParams, nil)
+	hash, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("unexpected hash %s", hash)
+	}
+	if err := h.Verify(hash, "secret"); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := h.Verify(hash, "other"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+	if h.NeedsRehash(hash) {
+		t.Fatal("hash with current parameters needs no rehash")
+	}
+	stronger := testParams
+	stronger.Time = 2
+	if !NewArgon2id(stronger, nil).NeedsRehash(hash) {
+		t.Fatal("hash with outdated parameters needs rehash")
+	}
+}
+
+func TestArgon2id_Pepper(t *testing.T) {
+	peppered := NewArgon2id(testParams, []byte("pepper"))
+	hash, err := peppered.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peppered.Verify(hash, "secret"); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := NewArgon2id(testParams, nil).Verify(hash, "secret"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected mismatch without pepper, got %v", err)
+	}
+}
+
+func TestMulti_MigratesBcrypt(t *testing.T) {
+	legacy := NewBcrypt(4)
+	old, err := legacy.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewMulti(NewArgon2id(testParams, nil), legacy)
+
+	if err := h.Verify(old, "secret"); err != nil {
+		t.Fatalf("verify bcrypt: %v", err)
+	}
+	if err := h.Verify(old, "other"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+	if !h.NeedsRehash(old) {
+		t.Fatal("bcrypt hash needs rehash")
+	}
+	if err := h.Verify("plain", "secret"); !errors.Is(err, ErrUnsupportedHash) {
+		t.Fatalf("expected unsupported hash, got %v", err)
+	}
+}
+
+func TestBcrypt_TooLong(t *testing.T) {
+	if _, err := NewBcrypt(4).Hash(strings.Repeat("a", 73)); !errors.Is(err, ErrPasswordTooLong) {
+		t.Fatalf("expected ErrPasswordTooLong, got %v", err)
+	}
+}
+
+func TestArgon2id_ZeroParams(t *testing.T) {
+	h := NewArgon2id(testParams, nil)
+	for _, hash := range []string{
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5",
+	} {
+		if err := h.Verify(hash, "secret"); !errors.Is(err, ErrMalformedHash) {
+			t.Fatalf("%s: expected malformed hash, got %v", hash, err)
+		}
+		if !h.NeedsRehash(hash) {
+			t.Fatalf("%s: malformed hash needs rehash", hash)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Package jwtkeys manages keys used to sign and verify JWT tokens.
+//
+// A Keyring holds one active key used for signing and any number of older
+// keys still accepted for verification. Tokens carry the id of their key in
+// the kid header.
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported algorithms.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	// ErrUnknownKey is returned for tokens signed with a key not in the keyring.
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrCannotSign is returned when a key without a private part is used for signing.
+	ErrCannotSign = errors.New("key cannot sign")
+)
+
+// Key is a signing or verification key.
+type Key struct {
+	ID  string
+	Alg string
+
+	private any // []byte, *rsa.PrivateKey or ed25519.PrivateKey
+	public  any // []byte, *rsa.PublicKey or ed25519.PublicKey
+}
+
+// CanSign reports whether the key has a private part.
+func (k Key) CanSign() bool { return k.private != nil }
+
+func (k Key) method() jwt.SigningMethod {
+	switch k.Alg {
+	case RS256:
+		return jwt.SigningMethodRS256
+	case EdDSA:
+		return jwt.SigningMethodEdDSA
+	default:
+		return jwt.SigningMethodHS256
+	}
+}
+
+// NewHMAC creates HS256 key from a shared secret.
+func NewHMAC(secret []byte) Key {
+	return Key{ID: keyID(secret), Alg: HS256, private: secret, public: secret}
+}
+
+// NewRSA creates RS256 key. priv may be nil for a verification only key.
+func NewRSA(priv *rsa.PrivateKey, pub *rsa.PublicKey) Key {
+	if priv != nil {
+		pub = &priv.PublicKey
+	}
+	k := Key{Alg: RS256, public: pub}
+	if priv != nil {
+		k.private = priv
+	}
+	k.ID = publicKeyID(pub)
+	return k
+}
+
+// NewEd25519 creates EdDSA key. priv may be nil for a verification only key.
+func NewEd25519(priv ed25519.PrivateKey, pub ed25519.PublicKey) Key {
+	if priv != nil {
+		pub = priv.Public().(ed25519.PublicKey)
+	}
+	k := Key{Alg: EdDSA, public: pub}
+	if priv != nil {
+		k.private = priv
+	}
+	k.ID = publicKeyID(pub)
+	return k
+}
+
+// ParsePEM parses RSA or Ed25519 key in PEM format. Private keys may be
+// PKCS#1 or PKCS#8, public keys PKIX. Public keys can only verify tokens.
+func ParsePEM(data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("no PEM block found")
+	}
+	var (
+		parsed any
+		err    error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return Key{}, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return NewRSA(k, nil), nil
+	case *rsa.PublicKey:
+		return NewRSA(nil, k), nil
+	case ed25519.PrivateKey:
+		return NewEd25519(k, nil), nil
+	case ed25519.PublicKey:
+		return NewEd25519(nil, k), nil
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %T", parsed)
+	}
+}
+
+// LoadFile reads key from PEM file.
+func LoadFile(path string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	k, err := ParsePEM(data)
+	if err != nil {
+		return Key{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// Load builds keyring from PEM files and an optional HS256 secret.
+// The first file holds the active key, the rest are kept for verification.
+// Without files the secret becomes the active key, otherwise it is only
+// used to verify tokens issued before switching to asymmetric keys.
+func Load(files []string, secret []byte) (*Keyring, error) {
+	var keys []Key
+	for _, f := range files {
+		k, err := LoadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(secret) > 0 {
+		keys = append(keys, NewHMAC(secret))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+	return NewKeyring(keys[0], keys[1:]...)
+}
+
+// Keyring signs tokens with its active key and verifies tokens signed by any of its keys.
+type Keyring struct {
+	mu     sync.RWMutex
+	active Key
+	keys   map[string]Key
+	order  []string
+}
+
+// NewKeyring creates keyring with active key and keys accepted for verification only.
+func NewKeyring(active Key, verifyOnly ...Key) (*Keyring, error) {
+	if !active.CanSign() {
+		return nil, ErrCannotSign
+	}
+	r := &Keyring{active: active, keys: map[string]Key{}}
+	r.add(active)
+	for _, k := range verifyOnly {
+		r.add(k)
+	}
+	return r, nil
+}
+
+func (r *Keyring) add(k Key) {
+	if _, ok := r.keys[k.ID]; !ok {
+		r.order = append(r.order, k.ID)
+	}
+	r.keys[k.ID] = k
+}
+
+// Rotate makes k the active key. The previous keys stay valid for verification
+// until removed with Retire.
+func (r *Keyring) Rotate(k Key) error {
+	if !k.CanSign() {
+		return ErrCannotSign
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(k)
+	r.active = k
+	return nil
+}
+
+// Retire removes a key that is no longer accepted. The active key can't be retired.
+func (r *Keyring) Retire(kid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if kid == r.active.ID {
+		return errors.New("cannot retire active key")
+	}
+	if _, ok := r.keys[kid]; !ok {
+		return ErrUnknownKey
+	}
+	delete(r.keys, kid)
+	for i, id := range r.order {
+		if id == kid {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// ActiveID returns id of the key used for signing.
+func (r *Keyring) ActiveID() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.active.ID
+}
+
+// Sign signs claims with the active key and sets the kid header.
+func (r *Keyring) Sign(claims jwt.Claims) (string, error) {
+	r.mu.RLock()
+	k := r.active
+	r.mu.RUnlock()
+
+	token := jwt.NewWithClaims(k.method(), claims)
+	token.Header["kid"] = k.ID
+	return token.SignedString(k.private)
+}
+
+// Keyfunc resolves verification key for jwt.Parse by the kid header.
+// The token algorithm must match the algorithm of the key.
+func (r *Keyring) Keyfunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	r.mu.RLock()
+	k, ok := r.keys[kid]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if t.Method.Alg() != k.Alg {
+		return nil, fmt.Errorf("unexpected signing method %s for key %s", t.Method.Alg(), kid)
+	}
+	return k.public, nil
+}
+
+func keyID(b []byte) string {
+	sum := sha256.Sum256(b)
+	// hash twice so the id reveals nothing useful about a shared secret
+	sum = sha256.Sum256(sum[:])
+	return hex.EncodeToString(sum[:8])
+}
+
+func publicKeyID(pub any) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,117 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": 1, "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func TestKeyring_SignVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []Key{NewHMAC([]byte("s3cret")), NewRSA(rsaKey, nil), NewEd25519(edKey, nil)} {
+		ring, err := NewKeyring(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenStr, err := ring.Sign(claims())
+		if err != nil {
+			t.Fatalf("%s: sign: %v", k.Alg, err)
+		}
+		token, err := jwt.Parse(tokenStr, ring.Keyfunc)
+		if err != nil || !token.Valid {
+			t.Fatalf("%s: verify: %v", k.Alg, err)
+		}
+		if token.Header["kid"] != k.ID || token.Method.Alg() != k.Alg {
+			t.Fatalf("%s: unexpected header %v", k.Alg, token.Header)
+		}
+	}
+}
+
+func TestKeyring_Rotate(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	old := NewHMAC([]byte("old"))
+	ring, err := NewKeyring(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := ring.Sign(claims())
+
+	next := NewEd25519(edKey, nil)
+	if err := ring.Rotate(next); err != nil {
+		t.Fatal(err)
+	}
+	newToken, _ := ring.Sign(claims())
+
+	for _, s := range []string{oldToken, newToken} {
+		if _, err := jwt.Parse(s, ring.Keyfunc); err != nil {
+			t.Fatalf("token should verify after rotation: %v", err)
+		}
+	}
+	if err := ring.Retire(next.ID); err == nil {
+		t.Fatal("active key must not be retired")
+	}
+	if err := ring.Retire(old.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(oldToken, ring.Keyfunc); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected unknown key, got %v", err)
+	}
+}
+
+func TestKeyring_RejectsAlgorithmMismatch(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	k := NewRSA(rsaKey, nil)
+	ring, _ := NewKeyring(k)
+
+	// HS256 token signed with the public key bytes must not pass as RS256.
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	forged.Header["kid"] = k.ID
+	s, _ := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if _, err := jwt.Parse(s, ring.Keyfunc); err == nil {
+		t.Fatal("expected algorithm mismatch error")
+	}
+}
+
+func TestParsePEM(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+
+	signer, err := ParsePEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+	if err != nil || !signer.CanSign() || signer.Alg != EdDSA {
+		t.Fatalf("private key: %+v %v", signer, err)
+	}
+	verifier, err := ParsePEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	if err != nil || verifier.CanSign() || verifier.ID != signer.ID {
+		t.Fatalf("public key: %+v %v", verifier, err)
+	}
+	if _, err := NewKeyring(verifier); !errors.Is(err, ErrCannotSign) {
+		t.Fatalf("expected ErrCannotSign, got %v", err)
+	}
+
+	ring, _ := NewKeyring(signer, NewHMAC([]byte("secret")))
+	set := ring.JWKS()
+	if len(set.Keys) != 1 || set.Keys[0].Kty != "OKP" || set.Keys[0].Kid != signer.ID {
+		t.Fatalf("unexpected jwks %+v", set)
+	}
+}
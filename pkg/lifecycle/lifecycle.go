@@ -0,0 +1,169 @@
+// Package lifecycle starts the parts of an application in order and stops
+// them in reverse order once the application is asked to quit or one of the
+// parts fails.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Component is a part of the application managed by a Manager.
+// Every function is optional.
+type Component struct {
+	Name string
+	// Start prepares the component, e.g. binds a listener. An error aborts
+	// the start of the application.
+	Start func(ctx context.Context) error
+	// Run does the work of the component until ctx is canceled. It runs in
+	// its own goroutine; an error stops the application.
+	Run func(ctx context.Context) error
+	// Stop gracefully stops the component. It is called before the context
+	// passed to Run is canceled; Run must return once both happened.
+	Stop func(ctx context.Context) error
+}
+
+// Manager owns the components of an application.
+type Manager struct {
+	log     *zerolog.Logger
+	timeout time.Duration
+	comps   []Component
+}
+
+// New creates a manager that gives components timeout to stop.
+// The logger may be nil.
+func New(log *zerolog.Logger, timeout time.Duration) *Manager {
+	if log == nil {
+		nop := zerolog.Nop()
+		log = &nop
+	}
+	return &Manager{log: log, timeout: timeout}
+}
+
+// Add registers a component. Components are started in the order they are
+// added and stopped in reverse order.
+func (m *Manager) Add(c Component) {
+	m.comps = append(m.comps, c)
+}
+
+type running struct {
+	Component
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Run starts the components and blocks until ctx is canceled or a component
+// fails. Then it stops the started components, each within the timeout, and
+// returns the first error.
+func (m *Manager) Run(ctx context.Context) error {
+	failed := make(chan error, len(m.comps))
+	var (
+		started []*running
+		err     error
+	)
+	for _, c := range m.comps {
+		if c.Start != nil {
+			if err = c.Start(ctx); err != nil {
+				err = fmt.Errorf("start %s: %w", c.Name, err)
+				break
+			}
+		}
+		r := &running{Component: c, cancel: func() {}, done: make(chan struct{})}
+		if c.Run != nil {
+			var runCtx context.Context
+			runCtx, r.cancel = context.WithCancel(context.WithoutCancel(ctx))
+			go func() {
+				defer close(r.done)
+				if err := c.Run(runCtx); err != nil {
+					failed <- fmt.Errorf("%s: %w", c.Name, err)
+				}
+			}()
+		} else {
+			close(r.done)
+		}
+		started = append(started, r)
+		m.log.Info().Str("component", c.Name).Msg("started")
+	}
+
+	if err == nil {
+		select {
+		case <-ctx.Done():
+			m.log.Info().Msg("shutting down")
+		case err = <-failed:
+			m.log.Error().Err(err).Msg("component failed, shutting down")
+		}
+	}
+
+	for i := len(started) - 1; i >= 0; i-- {
+		if stopErr := m.stop(started[i]); stopErr != nil {
+			m.log.Error().Err(stopErr).Str("component", started[i].Name).Msg("stop failed")
+			if err == nil {
+				err = stopErr
+			}
+		}
+	}
+	// errors of components that failed while others were stopping
+	for len(failed) > 0 {
+		if e := <-failed; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// stop stops the component and waits for its Run to return.
+func (m *Manager) stop(r *running) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	var err error
+	if r.Stop != nil {
+		if err = r.Stop(ctx); err != nil {
+			err = fmt.Errorf("stop %s: %w", r.Name, err)
+		}
+	}
+	r.cancel()
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return errors.Join(err, fmt.Errorf("stop %s: %w", r.Name, ctx.Err()))
+	}
+	if err == nil {
+		m.log.Info().Str("component", r.Name).Msg("stopped")
+	}
+	return err
+}
+
+// HTTPServer returns a component serving srv on srv.Addr. The address is
+// bound on start, so a busy port fails the start. On stop the server
+// finishes in-flight requests; if that takes too long, their connections
+// are closed.
+func HTTPServer(name string, srv *http.Server) Component {
+	var ln net.Listener
+	return Component{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var err error
+			ln, err = net.Listen("tcp", srv.Addr)
+			return err
+		},
+		Run: func(ctx context.Context) error {
+			if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			if err := srv.Shutdown(ctx); err != nil {
+				return errors.Join(err, srv.Close())
+			}
+			return nil
+		},
+	}
+}
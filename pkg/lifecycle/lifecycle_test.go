@@ -0,0 +1,190 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(e string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *recorder) component(name string) Component {
+	return Component{
+		Name:  name,
+		Start: func(ctx context.Context) error { r.add("start " + name); return nil },
+		Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			r.add("done " + name)
+			return nil
+		},
+		Stop: func(ctx context.Context) error { r.add("stop " + name); return nil },
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestManager_Order(t *testing.T) {
+	var rec recorder
+	m := New(nil, time.Second)
+	m.Add(rec.component("a"))
+	m.Add(rec.component("b"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- m.Run(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	want := []string{"start a", "start b", "stop b", "done b", "stop a", "done a"}
+	if got := rec.get(); !equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestManager_ComponentFailure(t *testing.T) {
+	var rec recorder
+	fail := errors.New("fail")
+	m := New(nil, time.Second)
+	m.Add(rec.component("a"))
+	m.Add(Component{Name: "b", Run: func(ctx context.Context) error { return fail }})
+
+	err := m.Run(context.Background())
+	if !errors.Is(err, fail) {
+		t.Fatalf("expected failure, got %v", err)
+	}
+	if got := rec.get(); !equal(got, []string{"start a", "stop a", "done a"}) {
+		t.Fatalf("expected a to be stopped, got %v", got)
+	}
+}
+
+func TestManager_StartFailure(t *testing.T) {
+	var rec recorder
+	fail := errors.New("fail")
+	m := New(nil, time.Second)
+	m.Add(rec.component("a"))
+	m.Add(Component{Name: "b", Start: func(ctx context.Context) error { return fail }})
+	m.Add(rec.component("c"))
+
+	err := m.Run(context.Background())
+	if !errors.Is(err, fail) {
+		t.Fatalf("expected failure, got %v", err)
+	}
+	if got := rec.get(); !equal(got, []string{"start a", "stop a", "done a"}) {
+		t.Fatalf("expected only a to run, got %v", got)
+	}
+}
+
+func TestManager_StopTimeout(t *testing.T) {
+	m := New(nil, 10*time.Millisecond)
+	block := make(chan struct{})
+	defer close(block)
+	m.Add(Component{Name: "stuck", Run: func(ctx context.Context) error { <-block; return nil }})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestHTTPServer_BindFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	m := New(nil, time.Second)
+	m.Add(HTTPServer("http", &http.Server{Addr: ln.Addr().String()}))
+	if err := m.Run(context.Background()); err == nil {
+		t.Fatal("expected busy port to fail the start")
+	}
+}
+
+func TestHTTPServer_Drain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		io.WriteString(w, "done")
+	})}
+	m := New(nil, time.Second)
+	m.Add(HTTPServer("http", srv))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- m.Run(ctx) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result)
+	go func() {
+		for {
+			res, err := http.Get("http://" + addr)
+			if err != nil {
+				// the server may not listen yet
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			b, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			resc <- result{string(b), err}
+			return
+		}
+	}()
+
+	<-entered
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if r := <-resc; r.err != nil || r.body != "done" {
+		t.Fatalf("in-flight request cut off: %q %v", r.body, r.err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
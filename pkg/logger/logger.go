@@ -40,6 +40,12 @@ func FromContext(ctx context.Context) *zerolog.Logger {
 	return nil
 }
 
+// WithLogger stores l in context, e.g. for background workers that don't
+// serve requests.
+func WithLogger(ctx context.Context, l *zerolog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
 // Middleware injects a logger into request context. Logger will
 // contain request_id field if it's stored in context by previous middleware.
 func Middleware(base *zerolog.Logger) func(http.Handler) http.Handler {
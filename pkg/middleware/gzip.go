@@ -7,6 +7,16 @@ import (
 	"strings"
 )
 
+// ErrorWriter writes the response to a request a middleware rejects with
+// status; detail tells the client why. It lets the application answer in
+// the format of its handlers.
+type ErrorWriter func(w http.ResponseWriter, r *http.Request, status int, detail string)
+
+// plainError is used when no ErrorWriter is given.
+func plainError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	http.Error(w, detail, status)
+}
+
 type gzipReadCloser struct {
 	io.Reader
 	gz *gzip.Reader
@@ -23,14 +33,24 @@ func (g *gzipReadCloser) Close() error {
 
 // Gzip returns middleware that transparently decompresses request bodies
 // with Content-Encoding: gzip and compresses responses if the client
-// sends Accept-Encoding containing "gzip".
-func Gzip(level int) func(http.Handler) http.Handler {
+// sends Accept-Encoding containing "gzip". Requests it can't handle are
+// answered with onError, or with a plain text error if it is nil.
+func Gzip(level int, onError ErrorWriter) func(http.Handler) http.Handler {
+	return GzipFunc(func() int { return level }, onError)
+}
+
+// GzipFunc is like Gzip but asks level for the compression level of every
+// response, so the level may change while serving.
+func GzipFunc(level func() int, onError ErrorWriter) func(http.Handler) http.Handler {
+	if onError == nil {
+		onError = plainError
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.Header.Get("Content-Encoding") == "gzip" {
 				gz, err := gzip.NewReader(r.Body)
 				if err != nil {
-					w.WriteHeader(http.StatusBadRequest)
+					onError(w, r, http.StatusBadRequest, "request body is not valid gzip")
 					return
 				}
 				r.Body = &gzipReadCloser{Reader: gz, gz: gz, rc: r.Body}
@@ -38,9 +58,9 @@ func Gzip(level int) func(http.Handler) http.Handler {
 			}
 
 			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-				gz, err := gzip.NewWriterLevel(w, level)
+				gz, err := gzip.NewWriterLevel(w, level())
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+					onError(w, r, http.StatusInternalServerError, "internal server error")
 					return
 				}
 				defer gz.Close()
@@ -48,7 +68,7 @@ func Gzip(level int) func(http.Handler) http.Handler {
 				w.Header().Set("Content-Encoding", "gzip")
 				w.Header().Del("Content-Length")
 
-				gw := &gzipResponseWriter{ResponseWriter: w, Writer: gz}
+				gw := &gzipResponseWriter{ResponseWriter: w, gz: gz}
 				next.ServeHTTP(gw, r)
 			} else {
 				next.ServeHTTP(w, r)
@@ -59,9 +79,21 @@ func Gzip(level int) func(http.Handler) http.Handler {
 
 type gzipResponseWriter struct {
 	http.ResponseWriter
-	io.Writer
+	gz *gzip.Writer
 }
 
 func (w *gzipResponseWriter) Write(p []byte) (int, error) {
-	return w.Writer.Write(p)
+	return w.gz.Write(p)
+}
+
+// Flush sends what was compressed so far to the client, so streamed
+// responses are not held back in the compressor.
+func (w *gzipResponseWriter) Flush() {
+	_ = w.gz.Flush()
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
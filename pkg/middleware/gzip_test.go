@@ -11,7 +11,7 @@ import (
 
 func TestGzip_Decompress(t *testing.T) {
 	called := false
-	h := Gzip(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	h := Gzip(5, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		b, _ := io.ReadAll(r.Body)
 		if string(b) != "hello" {
 			t.Fatalf("unexpected body %q", b)
@@ -39,7 +39,12 @@ func TestGzip_Decompress(t *testing.T) {
 }
 
 func TestGzip_DecompressBad(t *testing.T) {
-	h := Gzip(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var gotStatus int
+	onError := func(w http.ResponseWriter, r *http.Request, status int, detail string) {
+		gotStatus = status
+		w.WriteHeader(status)
+	}
+	h := Gzip(5, onError)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Fatal("handler called")
 	}))
 
@@ -48,13 +53,25 @@ func TestGzip_DecompressBad(t *testing.T) {
 	w := httptest.NewRecorder()
 	h.ServeHTTP(w, req)
 
-	if w.Code != http.StatusBadRequest {
-		t.Fatalf("expected 400, got %d", w.Code)
+	if w.Code != http.StatusBadRequest || gotStatus != http.StatusBadRequest {
+		t.Fatalf("expected 400 from the error writer, got %d", w.Code)
+	}
+
+	// without an error writer the error is plain text
+	h = Gzip(5, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler called")
+	}))
+	req = httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("bad"))
+	req.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || w.Body.String() != "request body is not valid gzip\n" {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
 	}
 }
 
 func TestGzip_Compress(t *testing.T) {
-	h := Gzip(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	h := Gzip(5, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("world"))
 	}))
 
@@ -77,7 +94,7 @@ func TestGzip_Compress(t *testing.T) {
 }
 
 func TestGzip_NoCompress(t *testing.T) {
-	h := Gzip(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	h := Gzip(5, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("plain"))
 	}))
 
@@ -92,3 +109,28 @@ func TestGzip_NoCompress(t *testing.T) {
 		t.Fatalf("unexpected body %q", w.Body.String())
 	}
 }
+
+func TestGzip_Flush(t *testing.T) {
+	h := Gzip(5, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if !w.Flushed {
+		t.Fatal("expected the underlying writer to be flushed")
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(gz); string(b) != "first" {
+		t.Fatalf("unexpected body %q", b)
+	}
+}
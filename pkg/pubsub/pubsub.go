@@ -0,0 +1,82 @@
+// Package pubsub fans out string payloads to in-process subscribers of
+// named channels.
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// bufferSize is the number of payloads queued for a subscriber. Payloads
+// beyond it are dropped, so a slow subscriber never blocks publishers.
+const bufferSize = 16
+
+// Hub delivers published payloads to subscribers of a channel.
+// The zero value is ready to use.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan string]struct{}
+}
+
+// Subscribe returns payloads published to channel until ctx is done, when
+// the returned channel is closed.
+func (h *Hub) Subscribe(ctx context.Context, channel string) <-chan string {
+	ch := make(chan string, bufferSize)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[string]map[chan string]struct{})
+	}
+	if h.subs[channel] == nil {
+		h.subs[channel] = make(map[chan string]struct{})
+	}
+	h.subs[channel][ch] = struct{}{}
+	h.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[channel], ch)
+		if len(h.subs[channel]) == 0 {
+			delete(h.subs, channel)
+		}
+		close(ch)
+	})
+	return ch
+}
+
+// Publish delivers payload to the current subscribers of channel.
+func (h *Hub) Publish(channel, payload string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[channel] {
+		select {
+		case ch <- payload:
+		default:
+		}
+	}
+}
+
+// Broadcast delivers payload to the subscribers of every channel.
+func (h *Hub) Broadcast(payload string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subs := range h.subs {
+		for ch := range subs {
+			select {
+			case ch <- payload:
+			default:
+			}
+		}
+	}
+}
+
+// Channels returns the channels that have subscribers.
+func (h *Hub) Channels() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]string, 0, len(h.subs))
+	for c := range h.subs {
+		list = append(list, c)
+	}
+	return list
+}
@@ -0,0 +1,52 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHub(t *testing.T) {
+	var h Hub
+	ctx, cancel := context.WithCancel(context.Background())
+	a := h.Subscribe(ctx, "a")
+	b := h.Subscribe(context.Background(), "b")
+
+	h.Publish("a", "1")
+	h.Publish("b", "2")
+	if got := <-a; got != "1" {
+		t.Fatalf("got %q from a", got)
+	}
+	if got := <-b; got != "2" {
+		t.Fatalf("got %q from b", got)
+	}
+
+	h.Broadcast("")
+	if <-a != "" || <-b != "" {
+		t.Fatal("expected broadcast to reach every channel")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-a:
+		if ok {
+			t.Fatal("expected closed channel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not closed")
+	}
+	if got := h.Channels(); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("expected only b to be subscribed, got %v", got)
+	}
+}
+
+func TestHub_SlowSubscriber(t *testing.T) {
+	var h Hub
+	ch := h.Subscribe(context.Background(), "a")
+	for i := 0; i < bufferSize*2; i++ {
+		h.Publish("a", "x")
+	}
+	if len(ch) != bufferSize {
+		t.Fatalf("expected %d queued payloads, got %d", bufferSize, len(ch))
+	}
+}